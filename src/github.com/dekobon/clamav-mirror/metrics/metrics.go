@@ -0,0 +1,437 @@
+/*
+Package metrics collects counters, gauges and histograms and writes them in
+the Prometheus text exposition format, either in response to a scrape or to
+a file read by the node_exporter textfile collector.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Labels is a set of label names and values that identify a series.
+type Labels map[string]string
+
+// Default is the registry that the application's metrics are registered in.
+var Default = NewRegistry()
+
+// DurationBuckets are bucket bounds in seconds suited to requests and downloads.
+var DurationBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Registry holds the metrics that are written together.
+type Registry struct {
+	lock     sync.Mutex
+	families map[string]*family
+}
+
+// family is every series of a metric, which share a name, type and help text.
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+	lock       sync.Mutex
+	series     map[string]*series
+	funcs      []funcSeries
+}
+
+// series holds the value of a metric for a single set of label values.
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// funcSeries is a series whose value is read from a function when written.
+type funcSeries struct {
+	labels Labels
+	value  func() float64
+}
+
+// Counter is a metric whose value only increases.
+type Counter struct {
+	family *family
+}
+
+// Gauge is a metric whose value can go up and down.
+type Gauge struct {
+	family *family
+}
+
+// Histogram counts observations, such as durations, in buckets.
+type Histogram struct {
+	family *family
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Function that returns the family of a metric, creating it if it doesn't
+// exist. Registering the same name as a different type is a programming
+// error, so it panics.
+func (r *Registry) family(name string, help string, kind string, labelNames []string) *family {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if existing, ok := r.families[name]; ok {
+		if existing.kind != kind || len(existing.labelNames) != len(labelNames) {
+			panic(fmt.Sprintf("metric [%v] is already registered with a different type", name))
+		}
+
+		return existing
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+
+	r.families[name] = f
+
+	return f
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{family: r.family(name, help, "counter", labelNames)}
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{family: r.family(name, help, "gauge", labelNames)}
+}
+
+// NewHistogram registers a histogram with the given upper bounds of its
+// buckets and label names.
+func (r *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	f := r.family(name, help, "histogram", labelNames)
+	f.buckets = append([]float64{}, buckets...)
+	sort.Float64s(f.buckets)
+
+	return &Histogram{family: f}
+}
+
+// NewCounterFunc registers a counter series whose value is read from a
+// function, for counts that are already kept elsewhere. Several series with
+// different labels may be registered under the same name.
+func (r *Registry) NewCounterFunc(name string, help string, labels Labels, value func() float64) {
+	r.addFunc(name, help, "counter", labels, value)
+}
+
+// NewGaugeFunc registers a gauge series whose value is read from a function.
+func (r *Registry) NewGaugeFunc(name string, help string, labels Labels, value func() float64) {
+	r.addFunc(name, help, "gauge", labels, value)
+}
+
+func (r *Registry) addFunc(name string, help string, kind string, labels Labels, value func() float64) {
+	f := r.family(name, help, kind, nil)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.funcs = append(f.funcs, funcSeries{labels: labels, value: value})
+}
+
+// Function that returns the series for the given label values, creating it
+// if it doesn't exist. The caller must hold the family's lock.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric [%v] expects %d label values, got %d", f.name,
+			len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+
+		if f.kind == "histogram" {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds a value, which must not be negative, to the counter.
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic(fmt.Sprintf("counter [%v] can't decrease", c.family.name))
+	}
+
+	c.family.lock.Lock()
+	defer c.family.lock.Unlock()
+
+	c.family.get(labelValues).value += value
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.family.value(labelValues)
+}
+
+// Set sets the gauge to a value.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+
+	g.family.get(labelValues).value = value
+}
+
+// Add adds a value, which may be negative, to the gauge.
+func (g *Gauge) Add(value float64, labelValues ...string) {
+	g.family.lock.Lock()
+	defer g.family.lock.Unlock()
+
+	g.family.get(labelValues).value += value
+}
+
+// Value returns the current value of the gauge.
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.family.value(labelValues)
+}
+
+// Observe records a value in the histogram.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.lock.Lock()
+	defer h.family.lock.Unlock()
+
+	s := h.family.get(labelValues)
+
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += value
+	s.count++
+}
+
+// Count returns the number of values observed by the histogram.
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.family.lock.Lock()
+	defer h.family.lock.Unlock()
+
+	if s, ok := h.family.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.count
+	}
+
+	return 0
+}
+
+// Function that returns the value of a series without creating it, so that
+// reading a value doesn't add a series to the output.
+func (f *family) value(labelValues []string) float64 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if s, ok := f.series[strings.Join(labelValues, "\xff")]; ok {
+		return s.value
+	}
+
+	return 0
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name
+// and labels so that the output is stable.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	families := make([]*family, 0, len(r.families))
+
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+
+	r.lock.Unlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	counter := &countingWriter{writer: bufio.NewWriter(w)}
+
+	for _, f := range families {
+		f.write(counter)
+	}
+
+	if counter.err == nil {
+		counter.err = counter.writer.Flush()
+	}
+
+	return counter.written, counter.err
+}
+
+// Function that writes every series of a family.
+func (f *family) write(w *countingWriter) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(f.series) == 0 && len(f.funcs) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	var lines []string
+
+	for _, s := range f.series {
+		labels := make(Labels, len(f.labelNames))
+
+		for i, name := range f.labelNames {
+			labels[name] = s.labelValues[i]
+		}
+
+		if f.kind != "histogram" {
+			lines = append(lines, sample(f.name, labels, s.value))
+			continue
+		}
+
+		/* Buckets are written in order rather than sorted, so each histogram
+		 * is kept together as a single entry. */
+		var histogram []string
+
+		for i, bound := range f.buckets {
+			histogram = append(histogram, sample(f.name+"_bucket",
+				withLabel(labels, "le", formatValue(bound)), float64(s.counts[i])))
+		}
+
+		histogram = append(histogram,
+			sample(f.name+"_bucket", withLabel(labels, "le", "+Inf"), float64(s.count)),
+			sample(f.name+"_sum", labels, s.sum),
+			sample(f.name+"_count", labels, float64(s.count)))
+
+		lines = append(lines, strings.Join(histogram, ""))
+	}
+
+	for _, fs := range f.funcs {
+		lines = append(lines, sample(f.name, fs.labels, fs.value()))
+	}
+
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
+
+// Function that formats a single sample line.
+func sample(name string, labels Labels, value float64) string {
+	return name + formatLabels(labels) + " " + formatValue(value) + "\n"
+}
+
+// Function that returns a copy of labels with another label added.
+func withLabel(labels Labels, name string, value string) Labels {
+	copied := make(Labels, len(labels)+1)
+
+	for k, v := range labels {
+		copied[k] = v
+	}
+
+	copied[name] = value
+
+	return copied
+}
+
+// Function that formats labels as {name="value",...} sorted by name.
+func formatLabels(labels Labels) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(labels))
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabelValue(labels[name]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Function that formats a sample value.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+// countingWriter counts the bytes written and remembers the first error.
+type countingWriter struct {
+	writer  *bufio.Writer
+	written int64
+	err     error
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	n, err := w.writer.Write(p)
+	w.written += int64(n)
+	w.err = err
+
+	return n, err
+}
+
+// Handler returns an HTTP handler that serves the registry's metrics.
+func (r *Registry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if !(req.Method == "GET" || req.Method == "HEAD") {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	}
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExpositionFormatWriteTo(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("test_requests_total", "Requests served.", "type", "status")
+	requests.Inc("cvd", "200")
+	requests.Add(2, "cdiff", "304")
+	requests.Inc("cvd", "200")
+
+	version := registry.NewGauge("test_version", "Local version.", "database")
+	version.Set(25000, "daily")
+
+	duration := registry.NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.1})
+	duration.Observe(0.05)
+	duration.Observe(0.5)
+	duration.Observe(5)
+
+	registry.NewGaugeFunc("test_seconds_since", "Path \"escaped\"\nhelp.",
+		Labels{"name": `a"b\c`}, func() float64 { return math.NaN() })
+
+	var buf bytes.Buffer
+
+	if _, err := registry.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+# HELP test_requests_total Requests served.
+# TYPE test_requests_total counter
+test_requests_total{status="200",type="cvd"} 2
+test_requests_total{status="304",type="cdiff"} 2
+# HELP test_seconds_since Path "escaped"\nhelp.
+# TYPE test_seconds_since gauge
+test_seconds_since{name="a\"b\\c"} NaN
+# HELP test_version Local version.
+# TYPE test_version gauge
+test_version{database="daily"} 25000
+`
+
+	if buf.String() != expected {
+		t.Errorf("Unexpected output.\nExpected:\n%v\nActual:\n%v", expected, buf.String())
+	}
+}
+
+func TestUnobservedValue(t *testing.T) {
+	registry := NewRegistry()
+	counter := registry.NewCounter("test_total", "Test.", "cause")
+
+	if counter.Value("dns") != 0 {
+		t.Error("Expected an unobserved series to be zero")
+	}
+
+	var buf bytes.Buffer
+	registry.WriteTo(&buf)
+
+	if buf.Len() != 0 {
+		t.Errorf("Reading a value shouldn't add a series. Actual: %v", buf.String())
+	}
+}
+
+func TestAtomicWriteTextfile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics-")
+	defer os.RemoveAll(dir)
+
+	registry := NewRegistry()
+	registry.NewCounter("test_total", "Test.").Inc()
+
+	path := filepath.Join(dir, "clamav_mirror.prom")
+
+	if err := registry.WriteTextfile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(contents) != "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 1\n" {
+		t.Errorf("Unexpected textfile contents: %v", string(contents))
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected the temporary file to be renamed. Files: %v", len(files))
+	}
+}
@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// WriteTextfile writes the registry's metrics to a file for the node_exporter
+// textfile collector. The metrics are written to a temporary file that is
+// then renamed, so that the collector never reads a partially written file.
+func (r *Registry) WriteTextfile(path string) error {
+	output, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+"-")
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temporary file for metrics [%v]", path)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer os.Remove(output.Name())
+
+	if _, err := r.WriteTo(output); err != nil {
+		output.Close()
+		msg := fmt.Sprintf("Unable to write metrics to [%v]", output.Name())
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := output.Close(); err != nil {
+		msg := fmt.Sprintf("Unable to write metrics to [%v]", output.Name())
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	// The collector runs as another user, so the file must be world readable
+	if err := os.Chmod(output.Name(), 0644); err != nil {
+		msg := fmt.Sprintf("Unable to set permissions of [%v]", output.Name())
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := os.Rename(output.Name(), path); err != nil {
+		msg := fmt.Sprintf("Unable to move metrics into place at [%v]", path)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	return nil
+}
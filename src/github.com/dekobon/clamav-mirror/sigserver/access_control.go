@@ -0,0 +1,187 @@
+package sigserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// accessList is a list of networks that are allowed or denied access to a
+// group of routes. Denied networks take precedence over allowed networks. If
+// no networks are allowed, every network that isn't denied is allowed.
+type accessList struct {
+	name  string
+	lock  sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	// Number of requests that have been denied
+	denied uint64
+}
+
+// Access lists for signature files and for the API
+var signatureAccess = &accessList{name: "signatures"}
+var apiAccess = &accessList{name: "api"}
+
+// Networks of proxies that are trusted to report the client's address in the
+// X-Forwarded-For header
+var trustedProxies []*net.IPNet
+var trustedProxiesLock sync.RWMutex
+
+// Function that sets the networks that are allowed and denied access to the
+// routes of an access list.
+func (list *accessList) configure(allow []*net.IPNet, deny []*net.IPNet) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	list.allow = allow
+	list.deny = deny
+}
+
+// Function that sets the networks of proxies that are trusted to report the
+// client's address.
+func configureTrustedProxies(networks []*net.IPNet) {
+	trustedProxiesLock.Lock()
+	defer trustedProxiesLock.Unlock()
+
+	trustedProxies = networks
+}
+
+// Function that checks to see if an address is allowed access.
+func (list *accessList) allows(ip net.IP) bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	if ip == nil {
+		return len(list.allow) == 0 && len(list.deny) == 0
+	}
+
+	if networksContain(list.deny, ip) {
+		return false
+	}
+
+	return len(list.allow) == 0 || networksContain(list.allow, ip)
+}
+
+// Function that returns the number of requests that have been denied.
+func (list *accessList) deniedCount() uint64 {
+	return atomic.LoadUint64(&list.denied)
+}
+
+// Function that wraps a handler so that only clients allowed by the access
+// list can use it. Other clients are answered with 403.
+func withAccessList(list *accessList, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !list.allows(clientIP(r)) {
+			atomic.AddUint64(&list.denied, 1)
+			logger.Printf("[%v] {%v} %v FORBIDDEN (%v access list)", r.Method,
+				clientName(r), r.URL, list.name)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Function that returns the address of the client making a request. When the
+// request comes from a trusted proxy, the X-Forwarded-For header is read from
+// right to left and the first address that isn't a trusted proxy is used.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	trustedProxiesLock.RLock()
+	proxies := trustedProxies
+	trustedProxiesLock.RUnlock()
+
+	if ip == nil || !networksContain(proxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+
+		if forwardedIP == nil {
+			break
+		}
+
+		ip = forwardedIP
+
+		if !networksContain(proxies, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// Function that checks to see if an address is in any of the networks.
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Function that parses a comma separated list of networks in CIDR notation.
+// Single addresses are treated as a network containing only that address.
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, entry := range parseCommaList(value) {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+
+			if ip == nil {
+				return nil, errors.Errorf("Invalid IP address [%v]", entry)
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+
+		if err != nil {
+			return nil, errors.Errorf("Invalid network [%v]", entry)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// Function that returns networks as a comma separated list.
+func joinNetworks(networks []*net.IPNet) string {
+	values := make([]string, len(networks))
+
+	for i, network := range networks {
+		values[i] = network.String()
+	}
+
+	return strings.Join(values, ",")
+}
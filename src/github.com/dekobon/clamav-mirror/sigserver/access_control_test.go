@@ -0,0 +1,131 @@
+package sigserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustParseNetworks(t *testing.T, value string) []*net.IPNet {
+	networks, err := parseNetworks(value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return networks
+}
+
+func TestValidParseNetworks(t *testing.T) {
+	networks := mustParseNetworks(t, "10.0.0.0/8, 192.168.1.7,2001:db8::/32,::1")
+
+	expected := "10.0.0.0/8,192.168.1.7/32,2001:db8::/32,::1/128"
+
+	if actual := joinNetworks(networks); actual != expected {
+		t.Errorf("Unexpected networks.\nExpected: %v\nActual:   %v", expected, actual)
+	}
+}
+
+func TestInvalidParseNetworks(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0"} {
+		if _, err := parseNetworks(value); err == nil {
+			t.Errorf("Expected an error parsing [%v]", value)
+		}
+	}
+}
+
+func TestDenyTakesPrecedenceAllows(t *testing.T) {
+	list := &accessList{name: "test"}
+	list.configure(mustParseNetworks(t, "10.0.0.0/8"), mustParseNetworks(t, "10.1.0.0/16"))
+
+	cases := map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"192.168.1.1": false,
+	}
+
+	for ip, expected := range cases {
+		if actual := list.allows(net.ParseIP(ip)); actual != expected {
+			t.Errorf("Unexpected access for [%v]. Expected: %v Actual: %v", ip, expected, actual)
+		}
+	}
+}
+
+func TestEmptyAllowListAllows(t *testing.T) {
+	list := &accessList{name: "test"}
+	list.configure(nil, mustParseNetworks(t, "192.168.0.0/16"))
+
+	if !list.allows(net.ParseIP("10.0.0.1")) {
+		t.Error("Expected an address that isn't denied to be allowed")
+	}
+
+	if list.allows(net.ParseIP("192.168.4.4")) {
+		t.Error("Expected a denied address not to be allowed")
+	}
+}
+
+func TestUntrustedProxyClientIP(t *testing.T) {
+	trustedProxies = nil
+
+	r := httptest.NewRequest("GET", "/daily.cvd", nil)
+	r.RemoteAddr = "203.0.113.10:4000"
+	r.Header.Set("X-Forwarded-For", "10.0.0.1")
+
+	if ip := clientIP(r); ip.String() != "203.0.113.10" {
+		t.Errorf("X-Forwarded-For should be ignored from untrusted clients. Actual: %v", ip)
+	}
+}
+
+func TestTrustedProxyClientIP(t *testing.T) {
+	trustedProxies = mustParseNetworks(t, "127.0.0.1,172.16.0.0/12")
+	defer func() { trustedProxies = nil }()
+
+	r := httptest.NewRequest("GET", "/daily.cvd", nil)
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Add("X-Forwarded-For", "198.51.100.1, 203.0.113.10")
+	r.Header.Add("X-Forwarded-For", "172.16.0.5")
+
+	if ip := clientIP(r); ip.String() != "203.0.113.10" {
+		t.Errorf("Expected the first untrusted forwarded address. Actual: %v", ip)
+	}
+
+	if name := clientName(r); name != "203.0.113.10 via 127.0.0.1:4000" {
+		t.Errorf("Unexpected client name: %v", name)
+	}
+}
+
+func TestDeniedWithAccessList(t *testing.T) {
+	list := &accessList{name: "test"}
+	list.configure(mustParseNetworks(t, "10.0.0.0/8"), nil)
+
+	called := false
+	wrapped := withAccessList(list, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	r := httptest.NewRequest("GET", "/daily.cvd", nil)
+	r.RemoteAddr = "192.168.1.1:4000"
+	recorder := httptest.NewRecorder()
+	wrapped(recorder, r)
+
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a denied client. Actual: %v", recorder.Code)
+	}
+
+	if called {
+		t.Error("The wrapped handler shouldn't be called for a denied client")
+	}
+
+	if list.deniedCount() != 1 {
+		t.Errorf("Expected one denied request to be counted. Actual: %v", list.deniedCount())
+	}
+
+	r = httptest.NewRequest("GET", "/daily.cvd", nil)
+	r.RemoteAddr = "10.2.3.4:4000"
+	wrapped(httptest.NewRecorder(), r)
+
+	if !called {
+		t.Error("The wrapped handler should be called for an allowed client")
+	}
+}
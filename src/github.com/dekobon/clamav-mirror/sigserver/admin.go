@@ -0,0 +1,64 @@
+package sigserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Token that must be presented as a bearer token to use the admin API
+var adminToken string
+var adminTokenLock sync.RWMutex
+
+// Function that sets the token required to use the admin API.
+func configureAdminToken(token string) {
+	adminTokenLock.Lock()
+	defer adminTokenLock.Unlock()
+
+	adminToken = token
+}
+
+// Function that checks that a request carries the configured admin token. If
+// the request is not authorized, an error response is written and false is
+// returned.
+func authorizeAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	adminTokenLock.RLock()
+	expected := adminToken
+	adminTokenLock.RUnlock()
+
+	if expected == "" {
+		writeJSONError(w, http.StatusForbidden,
+			"The admin API is disabled because no admin token is configured")
+		return false
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	if token == authorization ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		logger.Printf("[%v] {%v} %v UNAUTHORIZED", r.Method, clientName(r), r.URL)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sigserver"`)
+		writeJSONError(w, http.StatusUnauthorized, "Invalid or missing admin token")
+		return false
+	}
+
+	return true
+}
+
+// Function that writes a value as a JSON response body.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logError.Printf("Error writing JSON response. %v", err)
+	}
+}
+
+// Function that writes an error message as a JSON response body.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -6,6 +6,7 @@ import (
 
 import (
 	"github.com/go-errors/errors"
+	"github.com/pborman/getopt"
 )
 
 import (
@@ -28,7 +29,14 @@ func main() {
 
 	cliFlags := sigserver.ParseConfig(appVersionInfo)
 
-	err := sigserver.RunUpdaterAndServer(cliFlags)
+	var err error
+
+	// Any parameters after the options are treated as a management command
+	if args := getopt.Args(); len(args) > 0 {
+		err = sigserver.RunCommand(cliFlags, args)
+	} else {
+		err = sigserver.RunUpdaterAndServer(cliFlags)
+	}
 
 	if err != nil {
 		log.Fatal(err.(*errors.Error).ErrorStack())
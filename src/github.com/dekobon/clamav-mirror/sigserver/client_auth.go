@@ -0,0 +1,197 @@
+package sigserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Type of the keys used to store values in a request's context
+type contextKey string
+
+// Context key of the authenticated identity of the client making a request
+const clientIdentityKey = contextKey("clientIdentity")
+
+// Function that loads the CA certificates that client certificates must be
+// signed by.
+func loadClientCAs(caPaths []string) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+
+	for _, caPath := range caPaths {
+		pem, err := ioutil.ReadFile(caPath)
+
+		if err != nil {
+			msg := fmt.Sprintf("Unable to read client CA [%v]", caPath)
+			return nil, errors.WrapPrefix(err, msg, 1)
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("No certificates found in client CA [%v]", caPath)
+		}
+	}
+
+	return pool, nil
+}
+
+// Function that configures TLS to require a client certificate signed by one
+// of the client CAs. If allow patterns are given, the certificate's common
+// name or one of its subject alternative names must also match a pattern.
+func requireClientCertificates(tlsConfig *tls.Config, caPaths []string, allowPatterns []string) error {
+	pool, err := loadClientCAs(caPaths)
+
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = pool
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("No client certificate was presented")
+		}
+
+		leaf := state.PeerCertificates[0]
+
+		if !clientCertificateAllowed(leaf, allowPatterns) {
+			logger.Printf("Rejected client certificate [%v] that isn't in the allow list",
+				certificateIdentity(leaf))
+			return errors.Errorf("Client certificate [%v] isn't allowed",
+				certificateIdentity(leaf))
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// Function that checks to see if the common name or any subject alternative
+// name of a certificate matches one of the allow patterns. Patterns may use
+// the wildcards "*" and "?". Every certificate is allowed when there are no
+// patterns.
+func clientCertificateAllowed(certificate *x509.Certificate, allowPatterns []string) bool {
+	if len(allowPatterns) == 0 {
+		return true
+	}
+
+	names := append([]string{certificate.Subject.CommonName}, certificate.DNSNames...)
+	names = append(names, certificate.EmailAddresses...)
+
+	for _, uri := range certificate.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, pattern := range allowPatterns {
+		for _, name := range names {
+			if name == "" {
+				continue
+			}
+
+			if matchCertificatePattern(strings.ToLower(pattern), strings.ToLower(name)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+/* Function that matches a certificate name against a pattern in which "*"
+ * matches any run of characters and "?" matches a single character. Unlike
+ * path.Match, "*" also matches "/" so that patterns such as
+ * "spiffe://example.org/*" match every URI below a path. */
+func matchCertificatePattern(pattern string, name string) bool {
+	p, n := []rune(pattern), []rune(name)
+	// Position in the pattern after the last "*" and in the name that it
+	// has matched up to, used to backtrack when a later character differs
+	star, starMatch := -1, 0
+	i, j := 0, 0
+
+	for j < len(n) {
+		switch {
+		case i < len(p) && p[i] == '*':
+			star, starMatch = i+1, j
+			i++
+		case i < len(p) && (p[i] == '?' || p[i] == n[j]):
+			i++
+			j++
+		case star >= 0:
+			starMatch++
+			i, j = star, starMatch
+		default:
+			return false
+		}
+	}
+
+	for i < len(p) && p[i] == '*' {
+		i++
+	}
+
+	return i == len(p)
+}
+
+// Function that returns the name used to identify the holder of a
+// certificate: its common name, or its first subject alternative name if it
+// doesn't have one.
+func certificateIdentity(certificate *x509.Certificate) string {
+	switch {
+	case certificate.Subject.CommonName != "":
+		return certificate.Subject.CommonName
+	case len(certificate.DNSNames) > 0:
+		return certificate.DNSNames[0]
+	case len(certificate.EmailAddresses) > 0:
+		return certificate.EmailAddresses[0]
+	case len(certificate.URIs) > 0:
+		return certificate.URIs[0].String()
+	default:
+		return "serial:" + certificate.SerialNumber.String()
+	}
+}
+
+// Function that wraps a handler so that the identity of a client that
+// authenticated with a certificate is stored in the request's context.
+func withClientIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			identity := certificateIdentity(r.TLS.PeerCertificates[0])
+			r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey, identity))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Function that returns the authenticated identity of the client making a
+// request, if it has one.
+func clientIdentity(r *http.Request) (string, bool) {
+	identity, ok := r.Context().Value(clientIdentityKey).(string)
+
+	return identity, ok && identity != ""
+}
+
+// Function that describes the client making a request for access logs. The
+// address reported by a trusted proxy is included when there is one.
+func clientName(r *http.Request) string {
+	name := r.RemoteAddr
+
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if ip := clientIP(r); ip != nil && ip.String() != host {
+			name = ip.String() + " via " + r.RemoteAddr
+		}
+	}
+
+	if identity, ok := clientIdentity(r); ok {
+		return name + " " + identity
+	}
+
+	return name
+}
@@ -0,0 +1,197 @@
+package sigserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Function that creates a certificate signed by the given parent. A nil
+// parent creates a self-signed CA.
+func newTestSignedCertificate(t *testing.T, commonName string, dnsNames []string,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certificate, _ := x509.ParseCertificate(der)
+
+	return certificate, key
+}
+
+// Function that starts an HTTPS server that requires client certificates
+// signed by a test CA and returns a function that makes requests to it with a
+// client certificate for the given name.
+func setupClientAuth(t *testing.T, allowPatterns []string) (*httptest.Server, func(string) (string, error), func()) {
+	dir, _ := ioutil.TempDir("", "client-auth-")
+	ca, caKey := newTestSignedCertificate(t, "Test CA", nil, nil, nil)
+	caPath := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+
+	tlsConfig := &tls.Config{}
+
+	if err := requireClientCertificates(tlsConfig, []string{caPath}, allowPatterns); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(withClientIdentity(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			identity, _ := clientIdentity(r)
+			w.Write([]byte(identity))
+		})))
+	server.TLS = tlsConfig
+	server.StartTLS()
+
+	get := func(name string) (string, error) {
+		certificate, key := newTestSignedCertificate(t, name, []string{name}, ca, caKey)
+		// A new transport is used so that each request makes a new handshake
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		client := &http.Client{Transport: transport}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{{
+			Certificate: [][]byte{certificate.Raw},
+			PrivateKey:  key,
+		}}
+
+		response, err := client.Get(server.URL)
+
+		if err != nil {
+			return "", err
+		}
+
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+
+		return string(body), nil
+	}
+
+	return server, get, func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAllowedRequireClientCertificates(t *testing.T) {
+	_, get, teardown := setupClientAuth(t, []string{"*.endpoints.example.com"})
+	defer teardown()
+
+	identity, err := get("host1.endpoints.example.com")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if identity != "host1.endpoints.example.com" {
+		t.Errorf("Expected the client identity in the request context. Actual: %v", identity)
+	}
+
+	if _, err := get("laptop.example.com"); err == nil {
+		t.Error("Expected a certificate that isn't in the allow list to be rejected")
+	}
+}
+
+func TestURIClientCertificateAllowed(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.org/ns/scanners/sa/clamd")
+	certificate := &x509.Certificate{URIs: []*url.URL{uri}}
+
+	cases := map[string]bool{
+		"spiffe://example.org/*":             true,
+		"spiffe://example.org/ns/*/sa/clamd": true,
+		"SPIFFE://EXAMPLE.ORG/ns/scanners/*": true,
+		"spiffe://example.org/ns/?":          false,
+		"spiffe://other.example.org/*":       false,
+		"spiffe://example.org/ns/scanners":   false,
+	}
+
+	for pattern, expected := range cases {
+		if actual := clientCertificateAllowed(certificate, []string{pattern}); actual != expected {
+			t.Errorf("Expected pattern [%v] to match the URI SAN: %v", pattern, expected)
+		}
+	}
+}
+
+func TestWildcardsMatchCertificatePattern(t *testing.T) {
+	cases := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"*.endpoints.example.com", "host1.endpoints.example.com", true},
+		{"*.endpoints.example.com", "endpoints.example.com", false},
+		{"scanner-??.example.com", "scanner-01.example.com", true},
+		{"scanner-??.example.com", "scanner-1.example.com", false},
+		{"*@example.com", "ops@example.com", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"*", "", true},
+		{"", "a", false},
+	}
+
+	for _, c := range cases {
+		if actual := matchCertificatePattern(c.pattern, c.name); actual != c.expected {
+			t.Errorf("Expected [%v] matching [%v] to be %v", c.pattern, c.name, c.expected)
+		}
+	}
+}
+
+func TestMissingCertificateRequireClientCertificates(t *testing.T) {
+	server, _, teardown := setupClientAuth(t, nil)
+	defer teardown()
+
+	if _, err := server.Client().Get(server.URL); err == nil {
+		t.Error("Expected a client without a certificate to be rejected")
+	}
+}
+
+func TestClientName(t *testing.T) {
+	request := httptest.NewRequest("GET", "/daily.cvd", nil)
+
+	if name := clientName(request); name != request.RemoteAddr {
+		t.Errorf("Expected only the remote address. Actual: %v", name)
+	}
+
+	certificate, _ := newTestSignedCertificate(t, "", []string{"host1.example.com"}, nil, nil)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{certificate}}
+
+	withClientIdentity(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := clientName(r); name != r.RemoteAddr+" host1.example.com" {
+			t.Errorf("Expected the SAN to identify the client. Actual: %v", name)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), request)
+}
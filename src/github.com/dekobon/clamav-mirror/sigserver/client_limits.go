@@ -0,0 +1,238 @@
+package sigserver
+
+import (
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// How long a client's limits are remembered after its last request
+const clientLimitIdleTimeout = 10 * time.Minute
+
+// Largest write made to a client before waiting on its bandwidth limit
+const throttleChunkSize = 32 * 1024
+
+// How long clients are asked to wait when too many .cvd files are being sent
+const cvdTransferRetryAfter = 60 * time.Second
+
+// clientLimit holds the rate limits of a single client.
+type clientLimit struct {
+	requests  *utils.TokenBucket
+	bandwidth *utils.TokenBucket
+	lastSeen  time.Time
+}
+
+/* clientLimiter limits the request rate and bandwidth of each client, where a
+ * client is identified by its authenticated name or else by its address.
+ * Limits of clients that haven't made a request recently are forgotten so
+ * that the number of clients tracked doesn't grow without bound. */
+type clientLimiter struct {
+	requestsPerMinute uint16
+	bytesPerSecond    uint64
+	lock              sync.Mutex
+	clients           map[string]*clientLimit
+	lastSweep         time.Time
+}
+
+// Per-client limits or nil when clients aren't limited
+var clientLimits *clientLimiter
+
+// Slots for full .cvd transfers or nil when they aren't limited
+var cvdTransferSlots chan struct{}
+
+// Number of requests that have been refused or slowed down by each limit
+var rateLimitedRequests uint64
+var throttledResponses uint64
+var cvdTransfersRefused uint64
+
+// Function that configures the per-client limits and the maximum number of
+// full .cvd files sent at the same time. A limit of zero disables it.
+func configureClientLimits(requestsPerMinute uint16, bytesPerSecond uint64, maxCVDTransfers uint16) {
+	clientLimits = nil
+	cvdTransferSlots = nil
+
+	if requestsPerMinute > 0 || bytesPerSecond > 0 {
+		clientLimits = &clientLimiter{
+			requestsPerMinute: requestsPerMinute,
+			bytesPerSecond:    bytesPerSecond,
+			clients:           make(map[string]*clientLimit),
+			lastSweep:         time.Now(),
+		}
+	}
+
+	if maxCVDTransfers > 0 {
+		cvdTransferSlots = make(chan struct{}, maxCVDTransfers)
+	}
+}
+
+// Function that returns the limits of a client, creating them on its first
+// request.
+func (limiter *clientLimiter) get(client string) *clientLimit {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(limiter.lastSweep) > clientLimitIdleTimeout {
+		for key, limit := range limiter.clients {
+			if now.Sub(limit.lastSeen) > clientLimitIdleTimeout {
+				delete(limiter.clients, key)
+			}
+		}
+
+		limiter.lastSweep = now
+	}
+
+	limit, ok := limiter.clients[client]
+
+	if !ok {
+		limit = &clientLimit{}
+
+		if limiter.requestsPerMinute > 0 {
+			limit.requests = utils.NewIntervalTokenBucket(uint64(limiter.requestsPerMinute),
+				time.Minute)
+		}
+
+		if limiter.bytesPerSecond > 0 {
+			limit.bandwidth = utils.NewTokenBucket(limiter.bytesPerSecond)
+		}
+
+		limiter.clients[client] = limit
+	}
+
+	limit.lastSeen = now
+
+	return limit
+}
+
+// Function that returns the key that a client's limits are tracked by.
+func clientLimitKey(r *http.Request) string {
+	if identity, ok := clientIdentity(r); ok {
+		return "identity:" + identity
+	}
+
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+
+	return r.RemoteAddr
+}
+
+// Function that checks to see if a request transfers a whole .cvd file, as
+// opposed to freshclam reading just its header with a range request.
+func fullCVDTransfer(r *http.Request) bool {
+	return r.Method == "GET" && r.Header.Get("Range") == "" &&
+		strings.HasSuffix(filepath.Base(filepath.Clean(r.URL.Path)), ".cvd")
+}
+
+// Function that wraps a handler so that each client is subject to its
+// request rate and bandwidth limits, and so that no more than the maximum
+// number of full .cvd files are sent at once. Requests over a limit are
+// answered with 429 and a Retry-After header.
+func withClientLimits(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := clientLimits
+		slots := cvdTransferSlots
+
+		if limiter != nil {
+			limit := limiter.get(clientLimitKey(r))
+
+			if limit.requests != nil && !limit.requests.TryTake(1) {
+				atomic.AddUint64(&rateLimitedRequests, 1)
+				logger.Printf("[%v] {%v} %v TOO MANY REQUESTS (request rate limit)",
+					r.Method, clientName(r), r.URL)
+				tooManyRequests(w, limit.requests.Delay(1))
+				return
+			}
+
+			if limit.bandwidth != nil {
+				w = &throttledResponseWriter{ResponseWriter: w, request: r,
+					bucket: limit.bandwidth}
+			}
+		}
+
+		if slots != nil && fullCVDTransfer(r) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			default:
+				atomic.AddUint64(&cvdTransfersRefused, 1)
+				logger.Printf("[%v] {%v} %v TOO MANY REQUESTS (%d .cvd transfers in progress)",
+					r.Method, clientName(r), r.URL, cap(slots))
+				tooManyRequests(w, cvdTransferRetryAfter)
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// Function that answers a request with 429, asking the client to retry after
+// the given delay.
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// throttledResponseWriter limits the rate at which a response is written to
+// a client's bandwidth limit.
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	request   *http.Request
+	bucket    *utils.TokenBucket
+	throttled bool
+}
+
+func (w *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		chunk := p
+
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+
+		if w.bucket.Wait(len(chunk)) > 0 && !w.throttled {
+			w.throttled = true
+			atomic.AddUint64(&throttledResponses, 1)
+			logger.Printf("[%v] {%v} %v THROTTLED (bandwidth limit)", w.request.Method,
+				clientName(w.request), w.request.URL)
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Function that flushes buffered data to the client, so that pull-through
+// downloads are streamed as they arrive.
+func (w *throttledResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
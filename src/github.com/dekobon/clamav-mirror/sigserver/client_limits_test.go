@@ -0,0 +1,130 @@
+package sigserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRequestRateWithClientLimits(t *testing.T) {
+	configureClientLimits(2, 0, 0)
+	defer configureClientLimits(0, 0, 0)
+
+	refused := atomic.LoadUint64(&rateLimitedRequests)
+	wrapped := withClientLimits(func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/daily.cvd", nil)
+		r.RemoteAddr = remoteAddr
+		recorder := httptest.NewRecorder()
+		wrapped(recorder, r)
+
+		return recorder
+	}
+
+	for i := 0; i < 2; i++ {
+		if recorder := request("192.0.2.1:1000"); recorder.Code != http.StatusOK {
+			t.Fatalf("Expected requests within the limit to succeed. Actual: %v", recorder.Code)
+		}
+	}
+
+	recorder := request("192.0.2.1:1001")
+
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429 once the limit is reached. Actual: %v", recorder.Code)
+	}
+
+	if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "30" {
+		t.Errorf("Expected to retry once a request is allowed. Actual: %v", retryAfter)
+	}
+
+	if atomic.LoadUint64(&rateLimitedRequests) != refused+1 {
+		t.Error("Expected the refused request to be counted")
+	}
+
+	// Each client has its own limit
+	if recorder := request("192.0.2.2:1000"); recorder.Code != http.StatusOK {
+		t.Errorf("Expected another client's request to succeed. Actual: %v", recorder.Code)
+	}
+}
+
+func TestMaxCVDTransfersWithClientLimits(t *testing.T) {
+	configureClientLimits(0, 0, 1)
+	defer configureClientLimits(0, 0, 0)
+
+	var inner *httptest.ResponseRecorder
+	var innerCode int
+
+	wrapped := withClientLimits(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/main.cvd" || inner != nil {
+			return
+		}
+
+		// Request other files while the first .cvd transfer is in progress
+		request := func(path string, header string) int {
+			r := httptest.NewRequest("GET", path, nil)
+
+			if header != "" {
+				r.Header.Set("Range", header)
+			}
+
+			inner = httptest.NewRecorder()
+			withClientLimits(func(w http.ResponseWriter, r *http.Request) {})(inner, r)
+
+			return inner.Code
+		}
+
+		if code := request("/daily-2.cdiff", ""); code != http.StatusOK {
+			t.Errorf("Expected .cdiff files not to be limited. Actual: %v", code)
+		}
+
+		if code := request("/daily.cvd", "bytes=0-511"); code != http.StatusOK {
+			t.Errorf("Expected .cvd header requests not to be limited. Actual: %v", code)
+		}
+
+		innerCode = request("/daily.cvd", "")
+	})
+
+	wrapped(httptest.NewRecorder(), httptest.NewRequest("GET", "/main.cvd", nil))
+
+	if innerCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 while the maximum .cvd transfers are in progress. Actual: %v",
+			innerCode)
+	}
+
+	if inner.Header().Get("Retry-After") != "60" {
+		t.Errorf("Unexpected Retry-After: %v", inner.Header().Get("Retry-After"))
+	}
+
+	recorder := httptest.NewRecorder()
+	wrapped(recorder, httptest.NewRequest("GET", "/daily.cvd", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected the slot to be released after the transfer. Actual: %v",
+			recorder.Code)
+	}
+}
+
+func TestBandwidthWithClientLimits(t *testing.T) {
+	configureClientLimits(0, 1024, 0)
+	defer configureClientLimits(0, 0, 0)
+
+	throttled := atomic.LoadUint64(&throttledResponses)
+	body := make([]byte, 1536)
+
+	wrapped := withClientLimits(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+
+	recorder := httptest.NewRecorder()
+	wrapped(recorder, httptest.NewRequest("GET", "/daily.cvd", nil))
+
+	if recorder.Body.Len() != len(body) {
+		t.Errorf("Expected the whole body to be written. Actual: %v", recorder.Body.Len())
+	}
+
+	if atomic.LoadUint64(&throttledResponses) != throttled+1 {
+		t.Error("Expected the throttled response to be counted")
+	}
+}
@@ -0,0 +1,260 @@
+package sigserver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/pborman/getopt"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+)
+
+// RunCommand runs a sigserver management command instead of starting the
+// server. The first argument is the name of the command.
+func RunCommand(config Config, args []string) error {
+	dataDirectory = config.UpdateConfig.DataFilePath
+	verboseMode = config.UpdateConfig.Verbose
+	allowedFileExtensions = config.AllowedFileExtensions
+	customDatabaseDirectory = config.CustomDatabasePath
+
+	switch args[0] {
+	case "ignore":
+		return runIgnoreCommand(args[1:])
+	case "publish":
+		return runPublishCommand(args[1:])
+	case "mirrors":
+		return sigupdate.RunCommand(config.UpdateConfig, args)
+	case "credentials":
+		return runCredentialsCommand(args[1:])
+	case "config":
+		return runConfigCommand(config, args[1:])
+	default:
+		return errors.Errorf("Unknown command [%v]. Valid commands: config, credentials, "+
+			"ignore, mirrors, publish", args[0])
+	}
+}
+
+/* Function that checks the configuration or displays it in the format of the
+ * configuration file. Settings have already been validated by the time that a
+ * command runs, so validate also loads the files that sigserver would only
+ * read once it starts.
+ *
+ *	config validate
+ *	config dump */
+func runConfigCommand(config Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: config validate|dump")
+	}
+
+	switch args[0] {
+	case "validate":
+		if config.TLSCertPath != "" {
+			if _, err := tls.LoadX509KeyPair(config.TLSCertPath, config.TLSKeyPath); err != nil {
+				return errors.WrapPrefix(err, "Unable to load TLS certificate", 1)
+			}
+		}
+
+		if config.CredentialsPath != "" {
+			if _, err := readCredentialsFile(config.CredentialsPath); err != nil {
+				return err
+			}
+		}
+
+		fmt.Println("Configuration is valid")
+
+		return nil
+	case "dump":
+		writeConfig(os.Stdout, config)
+		return nil
+	default:
+		return errors.Errorf("Unknown config command [%v]. Valid commands: validate, dump",
+			args[0])
+	}
+}
+
+// Function that validates and publishes a custom database from the command
+// line.
+//
+//	publish <database file> [--name=value]
+func runPublishCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: publish <database file> [--name=value]")
+	}
+
+	flags := getopt.New()
+	namePart := flags.StringLong("name", 'n', filepath.Base(args[0]),
+		"Name to publish the database as")
+	flags.SetParameters("<database file>")
+	flags.Parse(append([]string{"publish"}, args[1:]...))
+
+	contents, err := ioutil.ReadFile(args[0])
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read database [%v]", args[0])
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	database, err := publishCustomDatabase(customDatabaseDirectory, *namePart, contents)
+
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Published [%v] version [%v] (MD5 %v)\n", database.Name,
+		database.Version, database.MD5)
+
+	return nil
+}
+
+// Function that creates lines to add to a credentials file from the command
+// line. The password to hash is read from standard input.
+//
+//	credentials password <name> [databases]
+//	credentials token <name> [databases]
+func runCredentialsCommand(args []string) error {
+	usage := "Usage: credentials password <name> [databases] | " +
+		"credentials token <name> [databases]"
+
+	if len(args) < 2 || strings.Contains(args[1], ":") {
+		return errors.New(usage)
+	}
+
+	var hash string
+	var err error
+
+	switch args[0] {
+	case "password":
+		fmt.Fprint(os.Stderr, "Password: ")
+		password, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		password = strings.TrimRight(password, "\r\n")
+
+		if password == "" {
+			return errors.New("No password was given")
+		}
+
+		hash, err = newPasswordHash(password)
+	case "token":
+		token, tokenErr := newToken()
+
+		if tokenErr != nil {
+			return tokenErr
+		}
+
+		fmt.Fprintf(os.Stderr, "Token: %v\n", token)
+		hash = newTokenHash(token)
+	default:
+		return errors.New(usage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	line := args[1] + ":" + hash
+
+	if len(args) > 2 {
+		line = line + ":" + strings.Join(args[2:], ",")
+	}
+
+	if _, err := parseCredential(line); err != nil {
+		return err
+	}
+
+	fmt.Println(line)
+
+	return nil
+}
+
+// Function that manages the ignore list from the command line.
+//
+//	ignore list
+//	ignore add <signature name> [--reason=value] [--expires=value]
+//	ignore remove <signature name>
+func runIgnoreCommand(args []string) error {
+	usage := "Usage: ignore list | ignore add <signature name> " +
+		"[--reason=value] [--expires=value] | ignore remove <signature name>"
+
+	if len(args) < 1 {
+		return errors.New(usage)
+	}
+
+	var list IgnoreList
+	var err error
+
+	switch args[0] {
+	case "list":
+		list, err = refreshIgnoreList(dataDirectory)
+	case "add":
+		if len(args) < 2 {
+			return errors.New(usage)
+		}
+
+		flags := getopt.New()
+		reasonPart := flags.StringLong("reason", 'r', "",
+			"Reason the signature is being ignored")
+		expiresPart := flags.StringLong("expires", 'e', "",
+			"Timestamp, date (YYYY-MM-DD) or duration (e.g. 30d) after which "+
+				"the signature is no longer ignored")
+		flags.SetParameters("<signature name>")
+		flags.Parse(append([]string{"ignore add"}, args[2:]...))
+
+		expires, parseErr := parseIgnoreExpiry(*expiresPart, time.Now())
+
+		if parseErr != nil {
+			return parseErr
+		}
+
+		entry := IgnoreEntry{Name: args[1], Reason: *reasonPart, Expires: expires}
+		list, err = addIgnoreEntry(dataDirectory, entry)
+	case "remove":
+		if len(args) < 2 {
+			return errors.New(usage)
+		}
+
+		list, err = removeIgnoreEntry(dataDirectory, args[1])
+	default:
+		return errors.New(usage)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	printIgnoreList(list)
+
+	return nil
+}
+
+// Function that prints the ignore list as a table.
+func printIgnoreList(list IgnoreList) {
+	fmt.Printf("Ignore list version %v (modified %v)\n\n", list.Version,
+		list.Modified.Format(time.RFC3339))
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tEXPIRES\tADDED\tREASON")
+
+	for _, entry := range list.Entries {
+		expires := "never"
+
+		if entry.Expires != nil {
+			expires = entry.Expires.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\n", entry.Name, expires,
+			entry.Added.Format(time.RFC3339), strings.Replace(entry.Reason, "\n", " ", -1))
+	}
+
+	table.Flush()
+}
@@ -1,9 +1,17 @@
 package sigserver
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 )
 
 import (
@@ -12,20 +20,60 @@ import (
 
 import (
 	"github.com/dekobon/clamav-mirror/sigupdate"
+	"github.com/go-errors/errors"
 	"github.com/pborman/getopt"
 )
 
 // Config is a data structure that encapsulates the configuration parameters
 // used to run the sigserver application.
 type Config struct {
-	UpdateConfig         sigupdate.Config
-	Port                 uint16
-	UpdateHourlyInterval uint16
+	UpdateConfig          sigupdate.Config
+	Port                  uint16
+	UpdateHourlyInterval  uint16
+	UpdateSchedule        string
+	UpdateJitter          time.Duration
+	UpdateRetryBackoff    time.Duration
+	SignatureSearch       bool
+	AdminToken            string
+	CustomDatabasePath    string
+	AllowedFileExtensions []string
+	PullThrough           bool
+	RedirectMissingURL    *url.URL
+	RedirectRateLimit     uint16
+	TLSPort               uint16
+	TLSCertPath           string
+	TLSKeyPath            string
+	HTTPSRedirect         bool
+	TLSMinVersion         uint16
+	TLSCipherSuites       []uint16
+	TLSClientCAPaths      []string
+	TLSClientAllow        []string
+	SignatureAllow        []*net.IPNet
+	SignatureDeny         []*net.IPNet
+	APIAllow              []*net.IPNet
+	APIDeny               []*net.IPNet
+	TrustedProxies        []*net.IPNet
+	CredentialsPath       string
+	ClientRequestLimit    uint16
+	ClientBandwidthLimit  uint64
+	MaxCVDTransfers       uint16
+	ReadyMaxAge           time.Duration
+	ReusePort             bool
+	ShutdownTimeout       time.Duration
+	ConfigFilePath        string
 }
 
 var defaultConfig = Config{
 	Port:                 80,
 	UpdateHourlyInterval: 4,
+	UpdateRetryBackoff:   5 * time.Minute,
+	ShutdownTimeout:      30 * time.Second,
+	SignatureSearch:      false,
+	RedirectRateLimit:    60,
+	TLSPort:              443,
+	TLSMinVersion:        tls.VersionTLS12,
+	AllowedFileExtensions: []string{".cvd", ".cdiff", ".ign2", ".hdb", ".hsb",
+		".mdb", ".msb", ".ndb", ".ldb", ".cdb", ".fp", ".sfp", ".yar", ".yara"},
 }
 
 // ParseConfig parses environment variables and command line options for
@@ -63,21 +111,830 @@ func ParseEnvVars(defaults Config) Config {
 		config.UpdateHourlyInterval = defaults.UpdateHourlyInterval
 	}
 
+	if schedule, present := os.LookupEnv("UPDATE_SCHEDULE"); present {
+		config.UpdateSchedule = schedule
+	} else {
+		config.UpdateSchedule = defaults.UpdateSchedule
+	}
+
+	if jitter, present := os.LookupEnv("UPDATE_JITTER"); present {
+		duration, err := time.ParseDuration(jitter)
+
+		if err != nil {
+			log.Fatal("Error parsing UPDATE_JITTER environment variable", err)
+		}
+
+		config.UpdateJitter = duration
+	} else {
+		config.UpdateJitter = defaults.UpdateJitter
+	}
+
+	if backoff, present := os.LookupEnv("UPDATE_RETRY_BACKOFF"); present {
+		duration, err := time.ParseDuration(backoff)
+
+		if err != nil {
+			log.Fatal("Error parsing UPDATE_RETRY_BACKOFF environment variable", err)
+		}
+
+		config.UpdateRetryBackoff = duration
+	} else {
+		config.UpdateRetryBackoff = defaults.UpdateRetryBackoff
+	}
+
+	if signatureSearch, present := os.LookupEnv("SIGNATURE_SEARCH"); present {
+		b, err := strconv.ParseBool(signatureSearch)
+
+		if err != nil {
+			log.Fatal("Error parsing SIGNATURE_SEARCH environment variable")
+		}
+
+		config.SignatureSearch = b
+	} else {
+		config.SignatureSearch = defaults.SignatureSearch
+	}
+
+	if adminToken, present := os.LookupEnv("SIGSERVER_ADMIN_TOKEN"); present {
+		config.AdminToken = adminToken
+	} else {
+		config.AdminToken = defaults.AdminToken
+	}
+
+	if customDatabasePath, present := os.LookupEnv("CUSTOM_DATABASE_PATH"); present {
+		config.CustomDatabasePath = customDatabasePath
+	} else {
+		config.CustomDatabasePath = defaults.CustomDatabasePath
+	}
+
+	if extensions, present := os.LookupEnv("ALLOWED_FILE_EXTENSIONS"); present {
+		config.AllowedFileExtensions = parseFileExtensions(extensions)
+	} else {
+		config.AllowedFileExtensions = defaults.AllowedFileExtensions
+	}
+
+	if pullThrough, present := os.LookupEnv("PULL_THROUGH"); present {
+		b, err := strconv.ParseBool(pullThrough)
+
+		if err != nil {
+			log.Fatal("Error parsing PULL_THROUGH environment variable")
+		}
+
+		config.PullThrough = b
+	} else {
+		config.PullThrough = defaults.PullThrough
+	}
+
+	if redirectURL, present := os.LookupEnv("REDIRECT_MISSING_URL"); present {
+		u, err := parseRedirectURL(redirectURL)
+
+		if err != nil {
+			log.Fatal("Error parsing REDIRECT_MISSING_URL environment variable", err)
+		}
+
+		config.RedirectMissingURL = u
+	} else {
+		config.RedirectMissingURL = defaults.RedirectMissingURL
+	}
+
+	if rateLimit, present := os.LookupEnv("REDIRECT_RATE_LIMIT"); present {
+		i, err := strconv.ParseUint(rateLimit, 10, 16)
+
+		if err != nil {
+			log.Fatal("Error parsing REDIRECT_RATE_LIMIT environment variable")
+		}
+
+		config.RedirectRateLimit = uint16(i)
+	} else {
+		config.RedirectRateLimit = defaults.RedirectRateLimit
+	}
+
+	if tlsPort, present := os.LookupEnv("SIGSERVER_TLS_PORT"); present {
+		i, err := strconv.ParseUint(tlsPort, 10, 16)
+
+		if err != nil {
+			log.Fatal("Error parsing SIGSERVER_TLS_PORT environment variable")
+		}
+
+		config.TLSPort = uint16(i)
+	} else {
+		config.TLSPort = defaults.TLSPort
+	}
+
+	if tlsCert, present := os.LookupEnv("TLS_CERT"); present {
+		config.TLSCertPath = tlsCert
+	} else {
+		config.TLSCertPath = defaults.TLSCertPath
+	}
+
+	if tlsKey, present := os.LookupEnv("TLS_KEY"); present {
+		config.TLSKeyPath = tlsKey
+	} else {
+		config.TLSKeyPath = defaults.TLSKeyPath
+	}
+
+	if httpsRedirect, present := os.LookupEnv("HTTPS_REDIRECT"); present {
+		b, err := strconv.ParseBool(httpsRedirect)
+
+		if err != nil {
+			log.Fatal("Error parsing HTTPS_REDIRECT environment variable")
+		}
+
+		config.HTTPSRedirect = b
+	} else {
+		config.HTTPSRedirect = defaults.HTTPSRedirect
+	}
+
+	if minVersion, present := os.LookupEnv("TLS_MIN_VERSION"); present {
+		version, err := parseTLSVersion(minVersion)
+
+		if err != nil {
+			log.Fatal("Error parsing TLS_MIN_VERSION environment variable", err)
+		}
+
+		config.TLSMinVersion = version
+	} else {
+		config.TLSMinVersion = defaults.TLSMinVersion
+	}
+
+	if cipherSuites, present := os.LookupEnv("TLS_CIPHER_SUITES"); present {
+		suites, err := parseCipherSuites(cipherSuites)
+
+		if err != nil {
+			log.Fatal("Error parsing TLS_CIPHER_SUITES environment variable", err)
+		}
+
+		config.TLSCipherSuites = suites
+	} else {
+		config.TLSCipherSuites = defaults.TLSCipherSuites
+	}
+
+	if clientCA, present := os.LookupEnv("TLS_CLIENT_CA"); present {
+		config.TLSClientCAPaths = parseCommaList(clientCA)
+	} else {
+		config.TLSClientCAPaths = defaults.TLSClientCAPaths
+	}
+
+	if clientAllow, present := os.LookupEnv("TLS_CLIENT_ALLOW"); present {
+		config.TLSClientAllow = parseCommaList(clientAllow)
+	} else {
+		config.TLSClientAllow = defaults.TLSClientAllow
+	}
+
+	if signatureAllow, present := os.LookupEnv("SIGNATURE_ALLOW"); present {
+		networks, err := parseNetworks(signatureAllow)
+
+		if err != nil {
+			log.Fatal("Error parsing SIGNATURE_ALLOW environment variable", err)
+		}
+
+		config.SignatureAllow = networks
+	} else {
+		config.SignatureAllow = defaults.SignatureAllow
+	}
+
+	if signatureDeny, present := os.LookupEnv("SIGNATURE_DENY"); present {
+		networks, err := parseNetworks(signatureDeny)
+
+		if err != nil {
+			log.Fatal("Error parsing SIGNATURE_DENY environment variable", err)
+		}
+
+		config.SignatureDeny = networks
+	} else {
+		config.SignatureDeny = defaults.SignatureDeny
+	}
+
+	if apiAllow, present := os.LookupEnv("API_ALLOW"); present {
+		networks, err := parseNetworks(apiAllow)
+
+		if err != nil {
+			log.Fatal("Error parsing API_ALLOW environment variable", err)
+		}
+
+		config.APIAllow = networks
+	} else {
+		config.APIAllow = defaults.APIAllow
+	}
+
+	if apiDeny, present := os.LookupEnv("API_DENY"); present {
+		networks, err := parseNetworks(apiDeny)
+
+		if err != nil {
+			log.Fatal("Error parsing API_DENY environment variable", err)
+		}
+
+		config.APIDeny = networks
+	} else {
+		config.APIDeny = defaults.APIDeny
+	}
+
+	if trustedProxies, present := os.LookupEnv("TRUSTED_PROXIES"); present {
+		networks, err := parseNetworks(trustedProxies)
+
+		if err != nil {
+			log.Fatal("Error parsing TRUSTED_PROXIES environment variable", err)
+		}
+
+		config.TrustedProxies = networks
+	} else {
+		config.TrustedProxies = defaults.TrustedProxies
+	}
+
+	if credentialsPath, present := os.LookupEnv("CREDENTIALS_FILE"); present {
+		config.CredentialsPath = credentialsPath
+	} else {
+		config.CredentialsPath = defaults.CredentialsPath
+	}
+
+	if requestLimit, present := os.LookupEnv("CLIENT_REQUEST_LIMIT"); present {
+		i, err := strconv.ParseUint(requestLimit, 10, 16)
+
+		if err != nil {
+			log.Fatal("Error parsing CLIENT_REQUEST_LIMIT environment variable")
+		}
+
+		config.ClientRequestLimit = uint16(i)
+	} else {
+		config.ClientRequestLimit = defaults.ClientRequestLimit
+	}
+
+	if bandwidthLimit, present := os.LookupEnv("CLIENT_BANDWIDTH_LIMIT"); present {
+		limit, err := utils.ParseByteRate(bandwidthLimit)
+
+		if err != nil {
+			log.Fatal("Error parsing CLIENT_BANDWIDTH_LIMIT environment variable", err)
+		}
+
+		config.ClientBandwidthLimit = limit
+	} else {
+		config.ClientBandwidthLimit = defaults.ClientBandwidthLimit
+	}
+
+	if maxTransfers, present := os.LookupEnv("MAX_CVD_TRANSFERS"); present {
+		i, err := strconv.ParseUint(maxTransfers, 10, 16)
+
+		if err != nil {
+			log.Fatal("Error parsing MAX_CVD_TRANSFERS environment variable")
+		}
+
+		config.MaxCVDTransfers = uint16(i)
+	} else {
+		config.MaxCVDTransfers = defaults.MaxCVDTransfers
+	}
+
+	if maxAge, present := os.LookupEnv("READY_MAX_AGE"); present {
+		duration, err := time.ParseDuration(maxAge)
+
+		if err != nil {
+			log.Fatal("Error parsing READY_MAX_AGE environment variable", err)
+		}
+
+		config.ReadyMaxAge = duration
+	} else {
+		config.ReadyMaxAge = defaults.ReadyMaxAge
+	}
+
+	if reusePort, present := os.LookupEnv("SIGSERVER_REUSE_PORT"); present {
+		b, err := strconv.ParseBool(reusePort)
+
+		if err != nil {
+			log.Fatal("Error parsing SIGSERVER_REUSE_PORT environment variable")
+		}
+
+		config.ReusePort = b
+	} else {
+		config.ReusePort = defaults.ReusePort
+	}
+
+	if timeout, present := os.LookupEnv("SHUTDOWN_TIMEOUT"); present {
+		duration, err := time.ParseDuration(timeout)
+
+		if err != nil {
+			log.Fatal("Error parsing SHUTDOWN_TIMEOUT environment variable", err)
+		}
+
+		config.ShutdownTimeout = duration
+	} else {
+		config.ShutdownTimeout = defaults.ShutdownTimeout
+	}
+
 	return config
 }
 
+/* Setting of the admin API bearer token in the configuration file. It isn't
+ * a command line option because the command line of a process can be read by
+ * other users of the host, so it is only taken from the environment or the
+ * configuration file. */
+const adminTokenSetting = "admin-token"
+
+// Settings that can be set in the sigserver section of the configuration file
+var configSettings = []utils.ConfigSetting{
+	{Option: "port", EnvVar: "SIGSERVER_PORT"},
+	{Option: "hourly-update-interval", EnvVar: "UPDATE_HOURLY_INTERVAL"},
+	{Option: "update-schedule", EnvVar: "UPDATE_SCHEDULE"},
+	{Option: "update-jitter", EnvVar: "UPDATE_JITTER"},
+	{Option: "update-retry-backoff", EnvVar: "UPDATE_RETRY_BACKOFF"},
+	{Option: "signature-search", EnvVar: "SIGNATURE_SEARCH"},
+	{Option: "custom-database-path", EnvVar: "CUSTOM_DATABASE_PATH"},
+	{Option: "allowed-file-extensions", EnvVar: "ALLOWED_FILE_EXTENSIONS"},
+	{Option: "pull-through", EnvVar: "PULL_THROUGH"},
+	{Option: "redirect-missing-url", EnvVar: "REDIRECT_MISSING_URL"},
+	{Option: "redirect-rate-limit", EnvVar: "REDIRECT_RATE_LIMIT"},
+	{Option: "tls-port", EnvVar: "SIGSERVER_TLS_PORT"},
+	{Option: "tls-cert", EnvVar: "TLS_CERT"},
+	{Option: "tls-key", EnvVar: "TLS_KEY"},
+	{Option: "https-redirect", EnvVar: "HTTPS_REDIRECT"},
+	{Option: "tls-min-version", EnvVar: "TLS_MIN_VERSION"},
+	{Option: "tls-cipher-suites", EnvVar: "TLS_CIPHER_SUITES"},
+	{Option: "tls-client-ca", EnvVar: "TLS_CLIENT_CA"},
+	{Option: "tls-client-allow", EnvVar: "TLS_CLIENT_ALLOW"},
+	{Option: "signature-allow", EnvVar: "SIGNATURE_ALLOW"},
+	{Option: "signature-deny", EnvVar: "SIGNATURE_DENY"},
+	{Option: "api-allow", EnvVar: "API_ALLOW"},
+	{Option: "api-deny", EnvVar: "API_DENY"},
+	{Option: "trusted-proxies", EnvVar: "TRUSTED_PROXIES"},
+	{Option: "credentials-file", EnvVar: "CREDENTIALS_FILE"},
+	{Option: "client-request-limit", EnvVar: "CLIENT_REQUEST_LIMIT"},
+	{Option: "client-bandwidth-limit", EnvVar: "CLIENT_BANDWIDTH_LIMIT"},
+	{Option: "max-cvd-transfers", EnvVar: "MAX_CVD_TRANSFERS"},
+	{Option: "ready-max-age", EnvVar: "READY_MAX_AGE"},
+	{Option: "reuse-port", EnvVar: "SIGSERVER_REUSE_PORT"},
+	{Option: "shutdown-timeout", EnvVar: "SHUTDOWN_TIMEOUT"},
+}
+
+// flags holds the values of the sigserver command line options registered
+// with a getopt set, along with the sigupdate options.
+type flags struct {
+	set                   *getopt.Set
+	updateFlags           *sigupdate.Flags
+	port                  *uint16
+	updateHourlyInterval  *uint16
+	legacyHourlyInterval  *uint16
+	updateSchedule        *string
+	updateJitter          *string
+	updateRetryBackoff    *string
+	signatureSearch       *bool
+	adminToken            string
+	customDatabasePath    *string
+	allowedFileExtensions *string
+	pullThrough           *bool
+	redirectURL           *string
+	redirectRateLimit     *uint16
+	tlsPort               *uint16
+	tlsCert               *string
+	tlsKey                *string
+	httpsRedirect         *bool
+	tlsMinVersion         *string
+	tlsCipherSuites       *string
+	tlsClientCA           *string
+	tlsClientAllow        *string
+	signatureAllow        *string
+	signatureDeny         *string
+	apiAllow              *string
+	apiDeny               *string
+	trustedProxies        *string
+	credentialsPath       *string
+	clientRequestLimit    *uint16
+	clientBandwidthLimit  *string
+	maxCVDTransfers       *uint16
+	readyMaxAge           *string
+	reusePort             *bool
+	shutdownTimeout       *string
+}
+
 // ParseCliFlags parses the CLI options passed to the application.
 func ParseCliFlags(appVersionInfo utils.AppVersionInfo, defaults Config) Config {
-	listenPortPart := getopt.Uint16Long("port", 'p',
+	config, err := parseConfig(getopt.CommandLine, os.Args, appVersionInfo, defaults)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+/* Function that parses command line arguments using a getopt set, fills in
+ * the options that weren't given from the configuration file and validates
+ * the result. Settings are taken from the command line first, then the
+ * environment variables and then the configuration file. The same arguments
+ * are parsed again with a new set to reload the configuration. */
+func parseConfig(set *getopt.Set, args []string, appVersionInfo utils.AppVersionInfo,
+	defaults Config) (Config, error) {
+	defaults.UpdateConfig = sigupdate.ParseEnvVars(sigupdate.DefaultConfig())
+	flags := registerFlags(set, defaults)
+
+	set.Parse(args)
+
+	if flags.updateFlags.VersionRequested() {
+		sigupdate.PrintVersion(appVersionInfo)
+		os.Exit(0)
+	}
+
+	configFile, err := flags.updateFlags.ReadConfigFile()
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	if err := flags.updateFlags.ApplyConfigFile(configFile); err != nil {
+		return Config{}, err
+	}
+
+	section := configFile["sigserver"]
+
+	if token, present := section[adminTokenSetting]; present {
+		if _, envPresent := os.LookupEnv("SIGSERVER_ADMIN_TOKEN"); !envPresent {
+			flags.adminToken = token
+		}
+
+		section = withoutSetting(section, adminTokenSetting)
+	}
+
+	if err := utils.ApplyConfigSection(set, section, configSettings); err != nil {
+		return Config{}, errors.WrapPrefix(err, "Error in sigserver section of config file", 1)
+	}
+
+	updateConfig, err := flags.updateFlags.Config(appVersionInfo)
+
+	if err != nil {
+		return Config{}, err
+	}
+
+	return flags.config(updateConfig)
+}
+
+// Function that registers the sigserver and sigupdate command line options
+// with a getopt set, using the values of a configuration as their defaults.
+func registerFlags(set *getopt.Set, defaults Config) *flags {
+	f := &flags{set: set}
+
+	f.port = set.Uint16Long("port", 'p',
 		defaults.Port, "Port to serve signatures on")
-	updateHourlyIntervalPart := getopt.Uint16Long("houry-update-interval", 'h',
+	f.updateHourlyInterval = set.Uint16Long("hourly-update-interval", 'h',
 		defaults.UpdateHourlyInterval, "Number of hours to wait between signature updates")
+	// The original misspelling of the flag is still accepted
+	f.legacyHourlyInterval = set.Uint16Long("houry-update-interval", 0,
+		defaults.UpdateHourlyInterval, "Deprecated spelling of --hourly-update-interval")
+	f.updateSchedule = set.StringLong("update-schedule", 0, defaults.UpdateSchedule,
+		"Cron expression or interval (e.g. 30m) of signature updates")
+	f.updateJitter = set.StringLong("update-jitter", 0, defaults.UpdateJitter.String(),
+		"Maximum random delay added to each scheduled update (e.g. 10m)")
+	f.updateRetryBackoff = set.StringLong("update-retry-backoff", 0,
+		defaults.UpdateRetryBackoff.String(),
+		"Delay before retrying a failed update, doubled after each failure")
+	f.signatureSearch = boolFlag(set, defaults.SignatureSearch, "signature-search",
+		"Index signature names and enable the signature search API")
+	f.adminToken = defaults.AdminToken
+	f.customDatabasePath = set.StringLong("custom-database-path", 0,
+		defaults.CustomDatabasePath, "Path to the organization's custom databases")
+	f.allowedFileExtensions = set.StringLong("allowed-file-extensions", 0,
+		strings.Join(defaults.AllowedFileExtensions, ","),
+		"Comma separated list of database file extensions to serve")
+	f.pullThrough = boolFlag(set, defaults.PullThrough, "pull-through",
+		"Fetch missing signature files from upstream when they are requested")
+	f.redirectURL = set.StringLong("redirect-missing-url", 0,
+		redirectURLOrEmpty(defaults.RedirectMissingURL),
+		"Upstream URL to redirect clients to for missing signature files")
+	f.redirectRateLimit = set.Uint16Long("redirect-rate-limit", 0,
+		defaults.RedirectRateLimit, "Maximum number of redirects to upstream per minute")
+	f.tlsPort = set.Uint16Long("tls-port", 0, defaults.TLSPort,
+		"Port to serve signatures on using HTTPS")
+	f.tlsCert = set.StringLong("tls-cert", 0, defaults.TLSCertPath,
+		"Certificate file used to serve HTTPS")
+	f.tlsKey = set.StringLong("tls-key", 0, defaults.TLSKeyPath,
+		"Private key file of the HTTPS certificate")
+	f.httpsRedirect = boolFlag(set, defaults.HTTPSRedirect, "https-redirect",
+		"Redirect HTTP requests to HTTPS")
+	f.tlsMinVersion = set.StringLong("tls-min-version", 0,
+		tlsVersionName(defaults.TLSMinVersion), "Minimum TLS version accepted")
+	f.tlsCipherSuites = set.StringLong("tls-cipher-suites", 0,
+		cipherSuiteNames(defaults.TLSCipherSuites),
+		"Comma separated list of TLS cipher suites to accept")
+	f.tlsClientCA = set.StringLong("tls-client-ca", 0,
+		strings.Join(defaults.TLSClientCAPaths, ","),
+		"Comma separated list of CA files that client certificates must be signed by")
+	f.tlsClientAllow = set.StringLong("tls-client-allow", 0,
+		strings.Join(defaults.TLSClientAllow, ","),
+		"Comma separated list of client certificate names that are allowed")
+	f.signatureAllow = set.StringLong("signature-allow", 0,
+		joinNetworks(defaults.SignatureAllow),
+		"Comma separated list of networks allowed to download signatures")
+	f.signatureDeny = set.StringLong("signature-deny", 0,
+		joinNetworks(defaults.SignatureDeny),
+		"Comma separated list of networks denied from downloading signatures")
+	f.apiAllow = set.StringLong("api-allow", 0, joinNetworks(defaults.APIAllow),
+		"Comma separated list of networks allowed to use the API")
+	f.apiDeny = set.StringLong("api-deny", 0, joinNetworks(defaults.APIDeny),
+		"Comma separated list of networks denied from using the API")
+	f.trustedProxies = set.StringLong("trusted-proxies", 0,
+		joinNetworks(defaults.TrustedProxies),
+		"Comma separated list of proxy networks trusted to set X-Forwarded-For")
+	f.credentialsPath = set.StringLong("credentials-file", 0, defaults.CredentialsPath,
+		"File of credentials that clients must present to download signatures")
+	f.clientRequestLimit = set.Uint16Long("client-request-limit", 0,
+		defaults.ClientRequestLimit, "Maximum number of requests per minute from each client")
+	f.clientBandwidthLimit = set.StringLong("client-bandwidth-limit", 0,
+		strconv.FormatUint(defaults.ClientBandwidthLimit, 10),
+		"Maximum bytes per second sent to each client (e.g. 512K)")
+	f.maxCVDTransfers = set.Uint16Long("max-cvd-transfers", 0,
+		defaults.MaxCVDTransfers, "Maximum number of full .cvd files sent at the same time")
+	f.readyMaxAge = set.StringLong("ready-max-age", 0, defaults.ReadyMaxAge.String(),
+		"Maximum time since the last update for sigserver to be ready (e.g. 26h)")
+	f.reusePort = boolFlag(set, defaults.ReusePort, "reuse-port",
+		"Listen with SO_REUSEPORT so that a new process can take over the ports")
+	f.shutdownTimeout = set.StringLong("shutdown-timeout", 0,
+		defaults.ShutdownTimeout.String(),
+		"Time to wait for requests to finish when shutting down")
+
+	f.updateFlags = sigupdate.RegisterFlags(set, defaults.UpdateConfig)
+
+	return f
+}
+
+// Function that registers a boolean option that starts with a default value,
+// so that it can be turned off in the configuration file.
+func boolFlag(set *getopt.Set, value bool, name string, help string) *bool {
+	set.BoolVarLong(&value, name, 0, help)
+	return &value
+}
+
+// Function that validates the options and returns the configuration that
+// they describe.
+func (f *flags) config(updateConfig sigupdate.Config) (Config, error) {
+	customDatabasePath := *f.customDatabasePath
+
+	if customDatabasePath != "" {
+		absPath, err := filepath.Abs(customDatabasePath)
+
+		if err != nil || !utils.Exists(absPath) {
+			return Config{}, errors.Errorf("Custom database path doesn't exist or isn't "+
+				"accessible: %v", customDatabasePath)
+		}
+
+		customDatabasePath = absPath
+	}
+
+	redirectURL, err := parseRedirectURL(*f.redirectURL)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing redirect URL: %v", err)
+	}
+
+	if (*f.tlsCert == "") != (*f.tlsKey == "") {
+		return Config{}, errors.Errorf("Both a TLS certificate and a TLS key must be specified")
+	}
+
+	for _, path := range []string{*f.tlsCert, *f.tlsKey} {
+		if path != "" && !utils.Exists(path) {
+			return Config{}, errors.Errorf("TLS file doesn't exist or isn't accessible: %v", path)
+		}
+	}
+
+	if *f.credentialsPath != "" && !utils.Exists(*f.credentialsPath) {
+		return Config{}, errors.Errorf("Credentials file doesn't exist or isn't accessible: %v",
+			*f.credentialsPath)
+	}
+
+	clientBandwidthLimit, err := utils.ParseByteRate(*f.clientBandwidthLimit)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing client bandwidth limit: %v", err)
+	}
+
+	updateHourlyInterval := *f.updateHourlyInterval
+
+	if f.set.IsSet("houry-update-interval") && !f.set.IsSet("hourly-update-interval") {
+		updateHourlyInterval = *f.legacyHourlyInterval
+	}
+
+	if updateHourlyInterval == 0 {
+		return Config{}, errors.Errorf("The hourly update interval must be at least one hour")
+	}
+
+	// Without a schedule, signatures are updated every hourly interval
+	updateSchedule := *f.updateSchedule
+
+	if updateSchedule == "" {
+		updateSchedule = hourlyUpdateSchedule(updateHourlyInterval)
+	}
+
+	if _, err := parseUpdateSchedule(updateSchedule); err != nil {
+		return Config{}, errors.Errorf("Error parsing update schedule: %v", err)
+	}
+
+	updateJitter, err := time.ParseDuration(*f.updateJitter)
+
+	if err != nil || updateJitter < 0 {
+		return Config{}, errors.Errorf("Invalid update jitter [%v]. Use a duration such as 10m.",
+			*f.updateJitter)
+	}
+
+	updateRetryBackoff, err := time.ParseDuration(*f.updateRetryBackoff)
+
+	if err != nil || updateRetryBackoff < 0 {
+		return Config{}, errors.Errorf("Invalid update retry backoff [%v]. Use a duration "+
+			"such as 5m.", *f.updateRetryBackoff)
+	}
+
+	readyMaxAge, err := time.ParseDuration(*f.readyMaxAge)
+
+	if err != nil || readyMaxAge < 0 {
+		return Config{}, errors.Errorf("Invalid ready max age [%v]. Use a duration such as 26h.",
+			*f.readyMaxAge)
+	}
+
+	shutdownTimeout, err := time.ParseDuration(*f.shutdownTimeout)
+
+	if err != nil || shutdownTimeout < 0 {
+		return Config{}, errors.Errorf("Invalid shutdown timeout [%v]. Use a duration such "+
+			"as 30s.", *f.shutdownTimeout)
+	}
+
+	tlsMinVersion, err := parseTLSVersion(*f.tlsMinVersion)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing minimum TLS version: %v", err)
+	}
+
+	tlsCipherSuites, err := parseCipherSuites(*f.tlsCipherSuites)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing TLS cipher suites: %v", err)
+	}
+
+	tlsClientCAPaths := parseCommaList(*f.tlsClientCA)
+	tlsClientAllow := parseCommaList(*f.tlsClientAllow)
+
+	if len(tlsClientCAPaths) > 0 && *f.tlsCert == "" {
+		return Config{}, errors.Errorf("A TLS certificate must be specified to require " +
+			"client certificates")
+	}
+
+	if len(tlsClientAllow) > 0 && len(tlsClientCAPaths) == 0 {
+		return Config{}, errors.Errorf("A client CA must be specified to allow client " +
+			"certificates")
+	}
+
+	for _, caPath := range tlsClientCAPaths {
+		if !utils.Exists(caPath) {
+			return Config{}, errors.Errorf("Client CA file doesn't exist or isn't "+
+				"accessible: %v", caPath)
+		}
+	}
+
+	networkLists := make(map[string][]*net.IPNet)
 
-	updateConfig := sigupdate.ParseConfig(appVersionInfo)
+	for name, value := range map[string]string{
+		"signature-allow": *f.signatureAllow,
+		"signature-deny":  *f.signatureDeny,
+		"api-allow":       *f.apiAllow,
+		"api-deny":        *f.apiDeny,
+		"trusted-proxies": *f.trustedProxies,
+	} {
+		networks, err := parseNetworks(value)
+
+		if err != nil {
+			return Config{}, errors.Errorf("Error parsing %v: %v", name, err)
+		}
+
+		networkLists[name] = networks
+	}
 
 	return Config{
-		UpdateConfig:         updateConfig,
-		Port:                 *listenPortPart,
-		UpdateHourlyInterval: *updateHourlyIntervalPart,
+		UpdateConfig:          updateConfig,
+		Port:                  *f.port,
+		UpdateHourlyInterval:  updateHourlyInterval,
+		UpdateSchedule:        updateSchedule,
+		UpdateJitter:          updateJitter,
+		UpdateRetryBackoff:    updateRetryBackoff,
+		SignatureSearch:       *f.signatureSearch,
+		AdminToken:            f.adminToken,
+		CustomDatabasePath:    customDatabasePath,
+		AllowedFileExtensions: parseFileExtensions(*f.allowedFileExtensions),
+		PullThrough:           *f.pullThrough,
+		RedirectMissingURL:    redirectURL,
+		RedirectRateLimit:     *f.redirectRateLimit,
+		TLSPort:               *f.tlsPort,
+		TLSCertPath:           *f.tlsCert,
+		TLSKeyPath:            *f.tlsKey,
+		HTTPSRedirect:         *f.httpsRedirect,
+		TLSMinVersion:         tlsMinVersion,
+		TLSCipherSuites:       tlsCipherSuites,
+		TLSClientCAPaths:      tlsClientCAPaths,
+		TLSClientAllow:        tlsClientAllow,
+		SignatureAllow:        networkLists["signature-allow"],
+		SignatureDeny:         networkLists["signature-deny"],
+		APIAllow:              networkLists["api-allow"],
+		APIDeny:               networkLists["api-deny"],
+		TrustedProxies:        networkLists["trusted-proxies"],
+		CredentialsPath:       *f.credentialsPath,
+		ClientRequestLimit:    *f.clientRequestLimit,
+		ClientBandwidthLimit:  clientBandwidthLimit,
+		MaxCVDTransfers:       *f.maxCVDTransfers,
+		ReadyMaxAge:           readyMaxAge,
+		ReusePort:             *f.reusePort,
+		ShutdownTimeout:       shutdownTimeout,
+		ConfigFilePath:        f.updateFlags.ConfigFilePath(),
+	}, nil
+}
+
+// Function that writes a configuration in the format of the configuration
+// file, with a section for sigupdate and one for sigserver.
+func writeConfig(writer io.Writer, config Config) {
+	flags := registerFlags(getopt.New(), config)
+
+	flags.updateFlags.WriteConfig(writer)
+	utils.WriteConfigSection(writer, "sigserver", flags.set, configSettings)
+
+	adminToken := ""
+
+	if config.AdminToken != "" {
+		adminToken = utils.RedactedValue
 	}
+
+	fmt.Fprintf(writer, "  %v: %v\n", adminTokenSetting, strconv.Quote(adminToken))
+}
+
+// Function that returns a copy of a configuration file section without the
+// given setting.
+func withoutSetting(section map[string]string, name string) map[string]string {
+	remaining := make(map[string]string, len(section))
+
+	for key, value := range section {
+		if key != name {
+			remaining[key] = value
+		}
+	}
+
+	return remaining
+}
+
+// Function that parses a comma separated list of values.
+func parseCommaList(value string) []string {
+	var values []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+
+	return values
+}
+
+// Function that parses the URL that clients are redirected to for missing
+// files. The scheme defaults to http. An empty value disables redirects.
+func parseRedirectURL(value string) (*url.URL, error) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return nil, nil
+	}
+
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	u, err := url.Parse(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid redirect URL [%v]", value)
+	}
+
+	return u, nil
+}
+
+// Function that returns the redirect URL as a string or an empty string if
+// redirects are disabled.
+func redirectURLOrEmpty(redirectURL *url.URL) string {
+	if redirectURL == nil {
+		return ""
+	}
+
+	return redirectURL.String()
+}
+
+// Function that parses a comma separated list of file extensions, adding
+// the leading period if it was omitted.
+func parseFileExtensions(extensions string) []string {
+	var parsed []string
+
+	for _, extension := range strings.Split(extensions, ",") {
+		extension = strings.TrimSpace(extension)
+
+		if extension == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(extension, ".") {
+			extension = "." + extension
+		}
+
+		parsed = append(parsed, extension)
+	}
+
+	return parsed
 }
@@ -0,0 +1,147 @@
+package sigserver
+
+import (
+	"os"
+	"reflect"
+	"sync"
+)
+
+import (
+	"github.com/pborman/getopt"
+)
+
+// The configuration that sigserver is running with and the scheduler of its
+// updates, both of which change when the configuration file is reloaded
+var runningConfig Config
+var runningScheduler *updateScheduler
+var runningConfigLock sync.Mutex
+
+// Function that reloads the configuration file each time that sigserver
+// receives SIGHUP.
+func watchConfigFile(config Config, scheduler *updateScheduler) {
+	runningConfigLock.Lock()
+	runningConfig = config
+	runningScheduler = scheduler
+	runningConfigLock.Unlock()
+
+	onReload(func() {
+		reloadConfig(os.Args)
+	})
+
+	watchReloadSignal()
+}
+
+/* Function that parses the command line arguments, environment variables and
+ * configuration file again and applies the settings that can change while
+ * sigserver is running. If the configuration is invalid, sigserver keeps
+ * running with the configuration that it has. Other settings that changed are
+ * logged, because they only take effect after a restart. */
+func reloadConfig(args []string) {
+	runningConfigLock.Lock()
+	defer runningConfigLock.Unlock()
+
+	loaded, err := parseConfig(getopt.New(), args, runningConfig.UpdateConfig.AppVersionInfo,
+		ParseEnvVars(defaultConfig))
+
+	if err != nil {
+		logError.Printf("Keeping the running configuration because the configuration "+
+			"file [%v] is invalid. %v", runningConfig.ConfigFilePath, err)
+		return
+	}
+
+	applied := reloadableConfig(runningConfig, loaded)
+
+	if applied.UpdateSchedule != runningConfig.UpdateSchedule ||
+		applied.UpdateJitter != runningConfig.UpdateJitter ||
+		applied.UpdateRetryBackoff != runningConfig.UpdateRetryBackoff {
+		err := runningScheduler.reschedule(applied.UpdateSchedule, applied.UpdateJitter,
+			applied.UpdateRetryBackoff)
+
+		if err != nil {
+			logError.Printf("Keeping the running configuration. %v", err)
+			return
+		}
+	}
+
+	signatureAccess.configure(applied.SignatureAllow, applied.SignatureDeny)
+	apiAccess.configure(applied.APIAllow, applied.APIDeny)
+	configureTrustedProxies(applied.TrustedProxies)
+	configureAdminToken(applied.AdminToken)
+	configureReadyMaxAge(applied.ReadyMaxAge, runningScheduler)
+	configureUpdates(applied)
+
+	runningConfig = applied
+
+	logger.Printf("Reloaded configuration file [%v]", applied.ConfigFilePath)
+
+	for _, name := range restartRequiredSettings(applied, loaded) {
+		logger.Printf("Restart sigserver to apply the changed [%v] setting", name)
+	}
+}
+
+/* Function that returns the running configuration with the settings that can
+ * be changed without restarting taken from a reloaded configuration. The
+ * sigupdate settings are used by the next update, except for the data file
+ * path and verbose mode, which the server uses as well. */
+func reloadableConfig(running Config, loaded Config) Config {
+	applied := running
+
+	applied.UpdateConfig = loaded.UpdateConfig
+	applied.UpdateConfig.Verbose = running.UpdateConfig.Verbose
+	applied.UpdateConfig.DataFilePath = running.UpdateConfig.DataFilePath
+	applied.UpdateHourlyInterval = loaded.UpdateHourlyInterval
+	applied.UpdateSchedule = loaded.UpdateSchedule
+	applied.UpdateJitter = loaded.UpdateJitter
+	applied.UpdateRetryBackoff = loaded.UpdateRetryBackoff
+	applied.AdminToken = loaded.AdminToken
+	applied.SignatureAllow = loaded.SignatureAllow
+	applied.SignatureDeny = loaded.SignatureDeny
+	applied.APIAllow = loaded.APIAllow
+	applied.APIDeny = loaded.APIDeny
+	applied.TrustedProxies = loaded.TrustedProxies
+	applied.ReadyMaxAge = loaded.ReadyMaxAge
+
+	return applied
+}
+
+// Function that returns the names of the settings that differ between the
+// running and reloaded configurations once the reloadable ones are applied.
+func restartRequiredSettings(running Config, loaded Config) []string {
+	var changed []string
+
+	for _, setting := range []struct {
+		name    string
+		running interface{}
+		loaded  interface{}
+	}{
+		{"verbose", running.UpdateConfig.Verbose, loaded.UpdateConfig.Verbose},
+		{"data-file-path", running.UpdateConfig.DataFilePath, loaded.UpdateConfig.DataFilePath},
+		{"port", running.Port, loaded.Port},
+		{"signature-search", running.SignatureSearch, loaded.SignatureSearch},
+		{"custom-database-path", running.CustomDatabasePath, loaded.CustomDatabasePath},
+		{"allowed-file-extensions", running.AllowedFileExtensions, loaded.AllowedFileExtensions},
+		{"pull-through", running.PullThrough, loaded.PullThrough},
+		{"redirect-missing-url", running.RedirectMissingURL, loaded.RedirectMissingURL},
+		{"redirect-rate-limit", running.RedirectRateLimit, loaded.RedirectRateLimit},
+		{"tls-port", running.TLSPort, loaded.TLSPort},
+		{"tls-cert", running.TLSCertPath, loaded.TLSCertPath},
+		{"tls-key", running.TLSKeyPath, loaded.TLSKeyPath},
+		{"https-redirect", running.HTTPSRedirect, loaded.HTTPSRedirect},
+		{"tls-min-version", running.TLSMinVersion, loaded.TLSMinVersion},
+		{"tls-cipher-suites", running.TLSCipherSuites, loaded.TLSCipherSuites},
+		{"tls-client-ca", running.TLSClientCAPaths, loaded.TLSClientCAPaths},
+		{"tls-client-allow", running.TLSClientAllow, loaded.TLSClientAllow},
+		{"credentials-file", running.CredentialsPath, loaded.CredentialsPath},
+		{"client-request-limit", running.ClientRequestLimit, loaded.ClientRequestLimit},
+		{"client-bandwidth-limit", running.ClientBandwidthLimit, loaded.ClientBandwidthLimit},
+		{"max-cvd-transfers", running.MaxCVDTransfers, loaded.MaxCVDTransfers},
+		{"reuse-port", running.ReusePort, loaded.ReusePort},
+		{"shutdown-timeout", running.ShutdownTimeout, loaded.ShutdownTimeout},
+	} {
+		if !reflect.DeepEqual(setting.running, setting.loaded) {
+			changed = append(changed, setting.name)
+		}
+	}
+
+	return changed
+}
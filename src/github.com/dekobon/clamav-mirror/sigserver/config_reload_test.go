@@ -0,0 +1,148 @@
+package sigserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+	"github.com/pborman/getopt"
+)
+
+// Function that parses a configuration the way that sigserver does when it
+// starts.
+func parseTestConfig(t *testing.T, args []string) Config {
+	config, err := parseConfig(getopt.New(), args, utils.AppVersionInfo{},
+		ParseEnvVars(defaultConfig))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer useBlockingUpdates()()
+
+	dir, _ := ioutil.TempDir("", "config-reload-")
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "sigserver.yaml")
+	args := []string{"sigserver", "--config", configPath}
+	write := func(sigserverSection string) {
+		contents := "sigupdate:\n  data-file-path: " + dir + "\nsigserver:\n" + sigserverSection
+		ioutil.WriteFile(configPath, []byte(contents), 0644)
+	}
+
+	write("  admin-token: first\n  api-allow: [10.0.0.0/8]\n")
+
+	config := parseTestConfig(t, args)
+	scheduler, _ := newUpdateScheduler(config.UpdateSchedule, config.UpdateJitter,
+		config.UpdateRetryBackoff)
+
+	runningConfig = config
+	runningScheduler = scheduler
+	defer func() {
+		runningConfig = Config{}
+		runningScheduler = nil
+		apiAccess.configure(nil, nil)
+		configureAdminToken("")
+		configureReadyMaxAge(0, scheduler)
+	}()
+
+	write("  admin-token: second\n  api-allow: [192.168.0.0/16]\n" +
+		"  update-retry-backoff: 1m\n  tls-port: 8443\n")
+	reloadConfig(args)
+
+	if adminToken != "second" {
+		t.Errorf("Expected the admin token to be reloaded. Actual: %v", adminToken)
+	}
+
+	if !apiAccess.allows(net.ParseIP("192.168.1.1")) || apiAccess.allows(net.ParseIP("10.1.1.1")) {
+		t.Error("Expected the API access list to be reloaded")
+	}
+
+	if scheduler.backoff != time.Minute {
+		t.Errorf("Expected the update retry backoff to be reloaded. Actual: %v",
+			scheduler.backoff)
+	}
+
+	if runningConfig.TLSPort != config.TLSPort {
+		t.Errorf("Expected the TLS port to require a restart. Actual: %v",
+			runningConfig.TLSPort)
+	}
+
+	write("  admin-token: third\n  update-retry-backoff: soon\n")
+	reloadConfig(args)
+
+	if adminToken != "second" || runningConfig.UpdateRetryBackoff != time.Minute {
+		t.Error("Expected an invalid configuration file not to be applied")
+	}
+}
+
+func TestDumpParseConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config-dump-")
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "sigserver.yaml")
+	contents := "sigupdate:\n  data-file-path: " + dir + "\n  verbose: true\n" +
+		"  download-mirror-url: \"http://one.example.com;header=X-Token: abc\"\n" +
+		"sigserver:\n  signature-deny: [10.0.0.0/8, 172.16.0.0/12]\n" +
+		"  tls-min-version: \"1.3\"\n  client-bandwidth-limit: 512K\n"
+	ioutil.WriteFile(configPath, []byte(contents), 0644)
+
+	config := parseTestConfig(t, []string{"sigserver", "--config", configPath})
+
+	var dump bytes.Buffer
+	writeConfig(&dump, config)
+
+	dumpPath := filepath.Join(dir, "dump.yaml")
+	ioutil.WriteFile(dumpPath, dump.Bytes(), 0644)
+
+	dumped := parseTestConfig(t, []string{"sigserver", "--config", dumpPath})
+	dumped.ConfigFilePath = configPath
+
+	// Header values are redacted because they often hold tokens
+	config.UpdateConfig.Upstreams[0].Headers["X-Token"] = utils.RedactedValue
+
+	if !reflect.DeepEqual(config, dumped) {
+		t.Errorf("Dumped configuration not parsed as the original.\n"+
+			"Expected: %+v\n"+
+			"Actual  : %+v", config, dumped)
+	}
+}
+
+func TestAdminTokenParseConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config-token-")
+	defer os.RemoveAll(dir)
+
+	registerFlags(getopt.New(), defaultConfig).set.VisitAll(func(option getopt.Option) {
+		if option.Name() == "--admin-token" {
+			t.Error("The admin token should not be accepted on the command line")
+		}
+	})
+
+	configPath := filepath.Join(dir, "sigserver.yaml")
+	contents := "sigupdate:\n  data-file-path: " + dir + "\nsigserver:\n  admin-token: from-file\n"
+	ioutil.WriteFile(configPath, []byte(contents), 0644)
+	args := []string{"sigserver", "--config", configPath}
+
+	if config := parseTestConfig(t, args); config.AdminToken != "from-file" {
+		t.Errorf("Expected the admin token from the config file. Actual: %v", config.AdminToken)
+	}
+
+	os.Setenv("SIGSERVER_ADMIN_TOKEN", "from-env")
+	defer os.Unsetenv("SIGSERVER_ADMIN_TOKEN")
+
+	if config := parseTestConfig(t, args); config.AdminToken != "from-env" {
+		t.Errorf("Expected the environment to take precedence. Actual: %v", config.AdminToken)
+	}
+}
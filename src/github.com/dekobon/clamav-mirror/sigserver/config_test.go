@@ -3,6 +3,7 @@ package sigserver
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestParseEnvVars(t *testing.T) {
@@ -13,6 +14,8 @@ func TestParseEnvVars(t *testing.T) {
 
 	os.Setenv("SIGSERVER_PORT", "8888")
 	os.Setenv("UPDATE_HOURLY_INTERVAL", "9")
+	os.Setenv("UPDATE_SCHEDULE", "*/30 * * * *")
+	os.Setenv("UPDATE_JITTER", "10m")
 
 	actual := ParseEnvVars(defaults)
 
@@ -25,4 +28,10 @@ func TestParseEnvVars(t *testing.T) {
 		t.Errorf("Expected value 9 to be parsed from env var UPDATE_HOURLY_INTERVAL. "+
 			"Actual: %v", actual.UpdateHourlyInterval)
 	}
+
+	if actual.UpdateSchedule != "*/30 * * * *" || actual.UpdateJitter != 10*time.Minute {
+		t.Errorf("Expected the update schedule and jitter to be parsed from env vars "+
+			"UPDATE_SCHEDULE and UPDATE_JITTER. Actual: [%v] [%v]", actual.UpdateSchedule,
+			actual.UpdateJitter)
+	}
 }
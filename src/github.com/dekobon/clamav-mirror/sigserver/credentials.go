@@ -0,0 +1,451 @@
+package sigserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Prefix of password hashes derived using PBKDF2 with HMAC-SHA256
+const pbkdf2HashPrefix = "$pbkdf2-sha256$"
+
+// Prefix of token hashes, which are a plain SHA-256 sum of the token
+const tokenHashPrefix = "{SHA256}"
+
+// Number of PBKDF2 iterations used when hashing new passwords
+const passwordHashIterations = 100000
+
+// Suffix that distinguishes .cdiff files of the same database
+var cdiffVersionSuffix = regexp.MustCompile(`-[0-9]+$`)
+
+// credential is a client that can authenticate to download signatures.
+type credential struct {
+	name string
+	hash string
+	// Patterns of the databases that the client may download; all databases
+	// may be downloaded when there are none
+	databases []string
+}
+
+/* credentialStore holds the credentials loaded from a credentials file. Each
+ * line of the file has the form:
+ *
+ *	name:hash[:databases]
+ *
+ * Verifying a PBKDF2 hash is deliberately slow, so the SHA-256 sum of the
+ * last password that was verified for each client is remembered in order
+ * that freshclam doesn't pay that cost for every file that it downloads. */
+type credentialStore struct {
+	path        string
+	lock        sync.RWMutex
+	credentials map[string]credential
+	verified    map[string][sha256.Size]byte
+}
+
+// Credentials that clients must present to download signatures or nil when
+// downloads don't require authentication
+var downloadCredentials *credentialStore
+
+// Function that loads a credentials file that can be reloaded.
+func newCredentialStore(credentialsPath string) (*credentialStore, error) {
+	store := &credentialStore{path: credentialsPath}
+
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Function that loads the credentials file. If it can't be loaded, the
+// previously loaded credentials continue to be used.
+func (store *credentialStore) reload() error {
+	credentials, err := readCredentialsFile(store.path)
+
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.credentials = credentials
+	store.verified = make(map[string][sha256.Size]byte)
+
+	return nil
+}
+
+// Function that requires clients to present credentials from a credentials
+// file in order to download signatures. The file is reloaded when sigserver
+// receives SIGHUP.
+func configureCredentials(credentialsPath string) error {
+	store, err := newCredentialStore(credentialsPath)
+
+	if err != nil {
+		return err
+	}
+
+	downloadCredentials = store
+
+	onReload(func() {
+		if err := store.reload(); err != nil {
+			logError.Printf("Keeping the current credentials. %v", err)
+		} else {
+			logger.Printf("Reloaded credentials [%v]", credentialsPath)
+		}
+	})
+
+	watchReloadSignal()
+
+	return nil
+}
+
+// Function that reads and parses a credentials file. Blank lines and lines
+// starting with "#" are ignored.
+func readCredentialsFile(credentialsPath string) (map[string]credential, error) {
+	file, err := os.Open(credentialsPath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open credentials file [%v]", credentialsPath)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	credentials := make(map[string]credential)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parsed, err := parseCredential(line)
+
+		if err != nil {
+			return nil, errors.Errorf("Invalid credential on line %d of [%v]: %v",
+				lineNumber, credentialsPath, err)
+		}
+
+		if _, exists := credentials[parsed.name]; exists {
+			return nil, errors.Errorf("Duplicate credential [%v] on line %d of [%v]",
+				parsed.name, lineNumber, credentialsPath)
+		}
+
+		credentials[parsed.name] = parsed
+	}
+
+	if err := scanner.Err(); err != nil {
+		msg := fmt.Sprintf("Unable to read credentials file [%v]", credentialsPath)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return credentials, nil
+}
+
+// Function that parses a single line of a credentials file.
+func parseCredential(line string) (credential, error) {
+	parts := strings.SplitN(line, ":", 3)
+
+	if len(parts) < 2 || parts[0] == "" {
+		return credential{}, errors.New("Expected name:hash[:databases]")
+	}
+
+	parsed := credential{name: parts[0], hash: parts[1]}
+
+	if !validSecretHash(parsed.hash) {
+		return credential{}, errors.Errorf("Unsupported hash for [%v]", parsed.name)
+	}
+
+	// Token hashes are compared as strings, so the hex sum must be lowercase
+	if strings.HasPrefix(parsed.hash, tokenHashPrefix) {
+		parsed.hash = tokenHashPrefix + strings.ToLower(parsed.hash[len(tokenHashPrefix):])
+	}
+
+	if len(parts) == 3 {
+		parsed.databases = parseCommaList(parts[2])
+	}
+
+	for _, pattern := range parsed.databases {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return credential{}, errors.Errorf("Invalid database pattern [%v]", pattern)
+		}
+	}
+
+	return parsed, nil
+}
+
+// Function that finds the credential presented by a request using HTTP Basic
+// authentication or a bearer token.
+func (store *credentialStore) authenticate(r *http.Request) (credential, bool) {
+	if name, password, ok := r.BasicAuth(); ok {
+		return store.verifyPassword(name, password)
+	}
+
+	authorization := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(authorization, "Bearer ")
+
+	if token == authorization || token == "" {
+		return credential{}, false
+	}
+
+	return store.verifyToken(token)
+}
+
+// Function that checks the password of the named client.
+func (store *credentialStore) verifyPassword(name string, password string) (credential, bool) {
+	sum := sha256.Sum256([]byte(password))
+
+	store.lock.RLock()
+	found, exists := store.credentials[name]
+	verified, cached := store.verified[name]
+	store.lock.RUnlock()
+
+	if !exists {
+		return credential{}, false
+	}
+
+	if cached && subtle.ConstantTimeCompare(sum[:], verified[:]) == 1 {
+		return found, true
+	}
+
+	if !verifySecretHash(found.hash, password) {
+		return credential{}, false
+	}
+
+	store.lock.Lock()
+	/* Don't remember a password that was verified against credentials that
+	 * have since been reloaded. */
+	if current, ok := store.credentials[name]; ok && current.hash == found.hash {
+		store.verified[name] = sum
+	}
+	store.lock.Unlock()
+
+	return found, true
+}
+
+// Function that finds the client that a bearer token belongs to. Tokens are
+// only matched against token hashes, because checking every password hash
+// would be far too slow.
+func (store *credentialStore) verifyToken(token string) (credential, bool) {
+	tokenHash := newTokenHash(token)
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, candidate := range store.credentials {
+		if subtle.ConstantTimeCompare([]byte(candidate.hash), []byte(tokenHash)) == 1 {
+			return candidate, true
+		}
+	}
+
+	return credential{}, false
+}
+
+// Function that checks to see if a client may download a file.
+func (c credential) permits(file string) bool {
+	if len(c.databases) == 0 {
+		return true
+	}
+
+	database := databaseName(file)
+
+	for _, pattern := range c.databases {
+		if matched, _ := path.Match(pattern, database); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Function that returns the name of the database that a file belongs to, for
+// example "daily" for both daily.cvd and daily-24012.cdiff.
+func databaseName(file string) string {
+	if i := strings.Index(file, "."); i >= 0 {
+		file = file[:i]
+	}
+
+	return cdiffVersionSuffix.ReplaceAllString(file, "")
+}
+
+// Function that wraps a handler so that clients must present valid
+// credentials that permit them to download the requested file. Clients that
+// authenticated with a certificate don't need credentials.
+func withCredentials(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		store := downloadCredentials
+
+		if _, authenticated := clientIdentity(r); store == nil || authenticated {
+			next(w, r)
+			return
+		}
+
+		found, ok := store.authenticate(r)
+
+		if !ok {
+			logger.Printf("[%v] {%v} %v UNAUTHORIZED", r.Method, clientName(r), r.URL)
+			w.Header().Set("WWW-Authenticate", `Basic realm="sigserver"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), clientIdentityKey, found.name))
+
+		if !found.permits(filepath.Base(filepath.Clean(r.URL.Path))) {
+			logger.Printf("[%v] {%v} %v FORBIDDEN (not permitted for client)", r.Method,
+				clientName(r), r.URL)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Function that checks to see if a hash is in one of the supported formats.
+func validSecretHash(hash string) bool {
+	if strings.HasPrefix(hash, tokenHashPrefix) {
+		sum, err := hex.DecodeString(strings.TrimPrefix(hash, tokenHashPrefix))
+		return err == nil && len(sum) == sha256.Size
+	}
+
+	_, _, _, err := parsePBKDF2Hash(hash)
+
+	return err == nil
+}
+
+// Function that checks a password or token against its hash.
+func verifySecretHash(hash string, secret string) bool {
+	if strings.HasPrefix(hash, tokenHashPrefix) {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(newTokenHash(secret))) == 1
+	}
+
+	iterations, salt, key, err := parsePBKDF2Hash(hash)
+
+	if err != nil {
+		return false
+	}
+
+	derived := pbkdf2SHA256([]byte(secret), salt, iterations, len(key))
+
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// Function that parses a hash of the form
+// $pbkdf2-sha256$<iterations>$<salt>$<key> where the salt and key are base64
+// encoded without padding.
+func parsePBKDF2Hash(hash string) (int, []byte, []byte, error) {
+	if !strings.HasPrefix(hash, pbkdf2HashPrefix) {
+		return 0, nil, nil, errors.New("Not a PBKDF2 hash")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(hash, pbkdf2HashPrefix), "$")
+
+	if len(parts) != 3 {
+		return 0, nil, nil, errors.New("Expected iterations, salt and key")
+	}
+
+	iterations, err := strconv.Atoi(parts[0])
+
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errors.Errorf("Invalid iterations [%v]", parts[0])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[1])
+
+	if err != nil {
+		return 0, nil, nil, errors.WrapPrefix(err, "Invalid salt", 1)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[2])
+
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("Invalid key")
+	}
+
+	return iterations, salt, key, nil
+}
+
+// Function that hashes a password with PBKDF2 using a random salt.
+func newPasswordHash(password string) (string, error) {
+	salt := make([]byte, 16)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", errors.WrapPrefix(err, "Unable to generate salt", 1)
+	}
+
+	key := pbkdf2SHA256([]byte(password), salt, passwordHashIterations, sha256.Size)
+
+	return fmt.Sprintf("%s%d$%s$%s", pbkdf2HashPrefix, passwordHashIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Function that returns the hash of a bearer token.
+func newTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return tokenHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// Function that generates a random bearer token.
+func newToken() (string, error) {
+	token := make([]byte, 32)
+
+	if _, err := rand.Read(token); err != nil {
+		return "", errors.WrapPrefix(err, "Unable to generate token", 1)
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// Function that derives a key from a password as described in RFC 8018
+// section 5.2, using HMAC-SHA256 as the pseudorandom function.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLength+sha256.Size)
+
+	for block := uint32(1); len(key) < keyLength; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+
+		key = append(key, t...)
+	}
+
+	return key[:keyLength]
+}
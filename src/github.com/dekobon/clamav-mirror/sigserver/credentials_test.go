@@ -0,0 +1,204 @@
+package sigserver
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Function that hashes a password with few iterations so that tests are fast.
+func testPasswordHash(password string) string {
+	salt := []byte("test-salt")
+	key := pbkdf2SHA256([]byte(password), salt, 10, sha256.Size)
+
+	return fmt.Sprintf("%s10$%s$%s", pbkdf2HashPrefix,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// Function that writes a credentials file and requires downloads to present
+// its credentials.
+func writeTestCredentials(t *testing.T, dir string, contents string) string {
+	credentialsPath := filepath.Join(dir, "credentials")
+
+	if err := ioutil.WriteFile(credentialsPath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return credentialsPath
+}
+
+func TestRFC7914VectorPBKDF2SHA256(t *testing.T) {
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	actual := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+
+	if actual != expected {
+		t.Errorf("Unexpected derived key.\nExpected: %v\nActual:   %v", expected, actual)
+	}
+}
+
+func TestNewPasswordHashVerifySecretHash(t *testing.T) {
+	hash, err := newPasswordHash("correct horse")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifySecretHash(hash, "correct horse") {
+		t.Error("Expected the password to match its hash")
+	}
+
+	if verifySecretHash(hash, "battery staple") {
+		t.Error("Expected a different password not to match the hash")
+	}
+}
+
+func TestInvalidParseCredential(t *testing.T) {
+	lines := []string{
+		"no-hash",
+		":" + newTokenHash("token"),
+		"client:plaintext",
+		"client:{SHA256}abcd",
+		"client:$pbkdf2-sha256$0$c2FsdA$a2V5",
+		"client:" + newTokenHash("token") + ":[daily",
+	}
+
+	for _, line := range lines {
+		if _, err := parseCredential(line); err == nil {
+			t.Errorf("Expected an error parsing [%v]", line)
+		}
+	}
+}
+
+func TestPermitsDatabases(t *testing.T) {
+	c, err := parseCredential("client:" + newTokenHash("token") + ":main,daily,acme*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"main.cvd":          true,
+		"daily-24012.cdiff": true,
+		"acme-feed.ndb":     true,
+		"bytecode.cvd":      false,
+		"safebrowsing.cvd":  false,
+	}
+
+	for file, expected := range cases {
+		if actual := c.permits(file); actual != expected {
+			t.Errorf("Unexpected permission for [%v]. Expected: %v Actual: %v",
+				file, expected, actual)
+		}
+	}
+}
+
+func TestDuplicateReadCredentialsFile(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "credentials-")
+	defer os.RemoveAll(dir)
+
+	credentialsPath := writeTestCredentials(t, dir, "client:"+newTokenHash("a")+"\n"+
+		"client:"+newTokenHash("b")+"\n")
+
+	if _, err := readCredentialsFile(credentialsPath); err == nil {
+		t.Error("Expected an error for a duplicate credential")
+	}
+}
+
+func TestBasicAndBearerWithCredentials(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "credentials-")
+	defer os.RemoveAll(dir)
+
+	credentialsPath := writeTestCredentials(t, dir, "# Branch offices\n"+
+		"branch:"+testPasswordHash("secret")+":main,daily\n"+
+		"scanner:"+newTokenHash("scanner-token")+"\n")
+
+	store, err := newCredentialStore(credentialsPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	downloadCredentials = store
+	defer func() { downloadCredentials = nil }()
+
+	var identity string
+	wrapped := withCredentials(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = clientIdentity(r)
+	})
+
+	request := func(file string, authorize func(r *http.Request)) int {
+		r := httptest.NewRequest("GET", "/"+file, nil)
+		authorize(r)
+		recorder := httptest.NewRecorder()
+		wrapped(recorder, r)
+
+		return recorder.Code
+	}
+
+	basic := func(user string, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	bearer := func(token string) func(r *http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+
+	if code := request("main.cvd", func(r *http.Request) {}); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials. Actual: %v", code)
+	}
+
+	if code := request("main.cvd", basic("branch", "wrong")); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password. Actual: %v", code)
+	}
+
+	// The second request is answered from the verified password cache
+	for i := 0; i < 2; i++ {
+		identity = ""
+
+		if code := request("daily-2.cdiff", basic("branch", "secret")); code != http.StatusOK {
+			t.Errorf("Expected 200 for a valid password. Actual: %v", code)
+		}
+
+		if identity != "branch" {
+			t.Errorf("Expected the client identity to be set. Actual: %v", identity)
+		}
+	}
+
+	if code := request("bytecode.cvd", basic("branch", "secret")); code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a database that isn't permitted. Actual: %v", code)
+	}
+
+	if code := request("bytecode.cvd", bearer("scanner-token")); code != http.StatusOK {
+		t.Errorf("Expected 200 for a valid token. Actual: %v", code)
+	}
+
+	if code := request("bytecode.cvd", bearer("other-token")); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for an unknown token. Actual: %v", code)
+	}
+
+	// Reloading replaces the credentials and forgets verified passwords
+	writeTestCredentials(t, dir, "branch:"+testPasswordHash("rotated")+"\n")
+
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := request("main.cvd", basic("branch", "secret")); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a password that was rotated. Actual: %v", code)
+	}
+
+	if code := request("main.cvd", bearer("scanner-token")); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a token that was removed. Actual: %v", code)
+	}
+
+	if code := request("bytecode.cvd", basic("branch", "rotated")); code != http.StatusOK {
+		t.Errorf("Expected 200 for the new password. Actual: %v", code)
+	}
+}
@@ -0,0 +1,220 @@
+package sigserver
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Filename of the file storing the versions of published custom databases
+const customDatabaseStateFilename = "databases.json"
+
+// Maximum size of a custom database that can be published via the API
+const maxCustomDatabaseSize = 64 * 1024 * 1024
+
+// Custom database filenames may only contain a limited set of characters
+var customDatabaseNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.\-]*$`)
+
+// CustomDatabase is the metadata recorded for a published custom database.
+type CustomDatabase struct {
+	Name      string    `json:"name"`
+	Version   uint64    `json:"version"`
+	Published time.Time `json:"published"`
+	MD5       string    `json:"md5"`
+	Size      int64     `json:"size"`
+}
+
+// CustomDatabases is the persisted state of all published custom databases.
+type CustomDatabases struct {
+	Databases map[string]CustomDatabase `json:"databases"`
+}
+
+// Directory containing the organization's custom databases
+var customDatabaseDirectory string
+
+// Guards reading and writing of the custom database state
+var customDatabaseLock sync.Mutex
+
+// Function that validates that a custom database name is safe to use as a
+// filename and has an extension that we are allowed to serve.
+func validateCustomDatabaseName(name string) error {
+	if len(name) >= 48 || !customDatabaseNamePattern.MatchString(name) ||
+		strings.Contains(name, "..") {
+		return errors.Errorf("Invalid database name [%v]", name)
+	}
+
+	if !allowedFileExtension(name) {
+		return errors.Errorf("Database [%v] doesn't have an allowed file extension. "+
+			"Allowed extensions: %v", name, strings.Join(allowedFileExtensions, ", "))
+	}
+
+	if strings.HasSuffix(name, ".cvd") || strings.HasSuffix(name, ".cdiff") ||
+		name == ignoreDatabaseFilename {
+		return errors.Errorf("Database [%v] would conflict with mirrored signatures", name)
+	}
+
+	return nil
+}
+
+// Function that reads the custom database state from the custom database
+// directory.
+func loadCustomDatabases(directory string) (CustomDatabases, error) {
+	state := CustomDatabases{Databases: make(map[string]CustomDatabase)}
+	statePath := filepath.Join(directory, customDatabaseStateFilename)
+
+	if !utils.Exists(statePath) {
+		return state, nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read custom database state [%v]", statePath)
+		return state, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		msg := fmt.Sprintf("Unable to parse custom database state [%v]", statePath)
+		return state, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if state.Databases == nil {
+		state.Databases = make(map[string]CustomDatabase)
+	}
+
+	return state, nil
+}
+
+// Function that validates a custom database and publishes it to the custom
+// database directory. Every publication increments the database's version
+// and moves its modification time forward so that freshclam clients using
+// DatabaseCustomURL download the new copy.
+func publishCustomDatabase(directory string, name string, contents []byte) (CustomDatabase, error) {
+	if directory == "" {
+		return CustomDatabase{}, errors.New("No custom database path is configured")
+	}
+
+	if err := validateCustomDatabaseName(name); err != nil {
+		return CustomDatabase{}, err
+	}
+
+	if err := validateDatabase(name, contents); err != nil {
+		return CustomDatabase{}, err
+	}
+
+	customDatabaseLock.Lock()
+	defer customDatabaseLock.Unlock()
+
+	state, err := loadCustomDatabases(directory)
+
+	if err != nil {
+		return CustomDatabase{}, err
+	}
+
+	previous := state.Databases[name]
+	checksum := md5.Sum(contents)
+	published := time.Now().UTC().Truncate(time.Second)
+
+	// Last-Modified only has a resolution of seconds
+	if !published.After(previous.Published) {
+		published = previous.Published.Add(time.Second)
+	}
+
+	database := CustomDatabase{
+		Name:      name,
+		Version:   previous.Version + 1,
+		Published: published,
+		MD5:       hex.EncodeToString(checksum[:]),
+		Size:      int64(len(contents)),
+	}
+
+	if err := utils.WriteFileAtomically(filepath.Join(directory, name), contents, published); err != nil {
+		return CustomDatabase{}, err
+	}
+
+	state.Databases[name] = database
+	data, err := json.MarshalIndent(state, "", "  ")
+
+	if err != nil {
+		return CustomDatabase{}, errors.WrapPrefix(err, "Unable to serialize custom database state", 1)
+	}
+
+	statePath := filepath.Join(directory, customDatabaseStateFilename)
+
+	if err := utils.WriteFileAtomically(statePath, data, published); err != nil {
+		return CustomDatabase{}, err
+	}
+
+	logger.Printf("Published custom database [%v] version [%v]", name, database.Version)
+
+	return database, nil
+}
+
+// Function that handles requests to the custom database API. Listing the
+// databases is allowed for everyone, but publishing requires the admin token.
+//
+//	GET /api/databases
+//	PUT /api/databases/<name>
+func customDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+
+	if customDatabaseDirectory == "" {
+		writeJSONError(w, http.StatusNotFound, "No custom database path is configured")
+		return
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/databases"), "/")
+
+	switch {
+	case (r.Method == "GET" || r.Method == "HEAD") && name == "":
+		state, err := loadCustomDatabases(customDatabaseDirectory)
+
+		if err != nil {
+			logError.Printf("Error reading custom databases. %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "Unable to read custom databases")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, state)
+	case r.Method == "PUT" && name != "":
+		if !authorizeAdminRequest(w, r) {
+			return
+		}
+
+		contents, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxCustomDatabaseSize))
+
+		if err != nil {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+
+		database, err := publishCustomDatabase(customDatabaseDirectory, name, contents)
+
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		logger.Printf("[%v] {%v} Published [%v] version [%v]", r.Method, clientName(r),
+			name, database.Version)
+		writeJSON(w, http.StatusOK, database)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
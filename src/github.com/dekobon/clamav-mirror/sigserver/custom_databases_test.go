@@ -0,0 +1,103 @@
+package sigserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVersionIncrementsPublishCustomDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "custom-")
+	defer os.RemoveAll(dir)
+
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+	contents := []byte("Org.Malware.Foo-1:0:*:deadbeef\n")
+
+	first, err := publishCustomDatabase(dir, "org.ndb", contents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := publishCustomDatabase(dir, "org.ndb", contents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Version != 1 || second.Version != 2 {
+		t.Errorf("Expected versions 1 and 2. Actual: %v and %v", first.Version, second.Version)
+	}
+
+	if !second.Published.After(first.Published) {
+		t.Error("Each publication must have a newer modification time")
+	}
+
+	stat, err := os.Stat(filepath.Join(dir, "org.ndb"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !stat.ModTime().Equal(second.Published) {
+		t.Errorf("Expected modification time %v. Actual: %v", second.Published, stat.ModTime())
+	}
+}
+
+func TestInvalidNamePublishCustomDatabase(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "custom-")
+	defer os.RemoveAll(dir)
+
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+	contents := []byte("Org.Malware.Foo-1:0:*:deadbeef\n")
+
+	for _, name := range []string{"../org.ndb", "main.cvd", "org.exe", ".hidden.ndb"} {
+		if _, err := publishCustomDatabase(dir, name, contents); err == nil {
+			t.Errorf("Expected publishing [%v] to fail", name)
+		}
+	}
+}
+
+func TestValidDatabasesValidateDatabase(t *testing.T) {
+	databases := map[string]string{
+		"org.hdb":  "44d88612fea8a8f36de82e1278abb02f:68:Eicar-Test-Signature\n",
+		"org.hsb":  "# comment\n275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f:*:Org.Test-1:73\n",
+		"org.mdb":  "1024:44d88612fea8a8f36de82e1278abb02f:Org.Section-1\n",
+		"org.ndb":  "Org.Body-1:1:EP+0:e8????????5b{2-4}(aa|bb)\n",
+		"org.ldb":  "Org.Logical-1;Engine:51-255,Target:1;0&1;41414141;42424242\n",
+		"org.ign2": "Win.Trojan.Agent-1\n",
+		"org.yar":  "rule OrgRule {\n  strings:\n    $a = \"}{\"\n  condition:\n    $a // }\n}\n",
+	}
+
+	for name, contents := range databases {
+		if err := validateDatabase(name, []byte(contents)); err != nil {
+			t.Errorf("Expected [%v] to be valid. %v", name, err)
+		}
+	}
+}
+
+func TestInvalidDatabasesValidateDatabase(t *testing.T) {
+	databases := map[string]string{
+		"org.hdb":   "not-a-hash:68:Eicar-Test-Signature\n",
+		"org.mdb":   "size:44d88612fea8a8f36de82e1278abb02f:Org.Section-1\n",
+		"org.ndb":   "Org.Body-1:99:*:deadbeef\n",
+		"org.ldb":   "Org.Logical-1;Engine:51-255;0\n",
+		"org.yar":   "rule OrgRule {\n  condition:\n    true\n",
+		"empty.ndb": "# only a comment\n",
+		"org.exe":   "MZ",
+	}
+
+	for name, contents := range databases {
+		if err := validateDatabase(name, []byte(contents)); err == nil {
+			t.Errorf("Expected [%v] to be invalid", name)
+		}
+	}
+
+	err := validateDatabase("org.ndb", []byte("Good-1:0:*:aa\nBad Name:0:*:aa\n"))
+
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected the error to report the line number. Actual: %v", err)
+	}
+}
@@ -0,0 +1,227 @@
+package sigserver
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Size of the plain-text header that prefixes every .cvd file
+const cvdHeaderSize = 512
+
+// CVDHeader is for storing the metadata stored in the header of a .cvd file.
+type CVDHeader struct {
+	BuildTime          string
+	Version            uint64
+	Signatures         uint64
+	FunctionalityLevel uint64
+	MD5                string
+	Builder            string
+}
+
+// Function that reads the 512 byte header of a .cvd file.
+func readCVDHeader(localFilePath string) (CVDHeader, error) {
+	file, err := os.Open(localFilePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open CVD file [%v]", localFilePath)
+		return CVDHeader{}, errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	return parseCVDHeader(file)
+}
+
+// Function that parses the header of a .cvd file from the supplied reader.
+// Header fields are colon delimited in the form of:
+// ClamAV-VDB:build time:version:signature count:functionality level:md5:dsig:builder:stime
+func parseCVDHeader(reader io.Reader) (CVDHeader, error) {
+	buf := make([]byte, cvdHeaderSize)
+
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return CVDHeader{}, errors.WrapPrefix(err, "Unable to read CVD header", 1)
+	}
+
+	header := strings.TrimRight(string(buf), " \x00")
+
+	if !strings.HasPrefix(header, "ClamAV-VDB:") {
+		return CVDHeader{}, errors.Errorf("Invalid CVD header - missing "+
+			"ClamAV-VDB prefix. Actual: [%.32v]", header)
+	}
+
+	fields := strings.Split(header, ":")
+
+	/* Older versions of sigtool wrote the build time with a colon between
+	 * the hours and minutes, so we rejoin the time into a single field. */
+	if len(fields) > 9 {
+		fields = append([]string{fields[0], fields[1] + ":" + fields[2]}, fields[3:]...)
+	}
+
+	if len(fields) < 8 {
+		return CVDHeader{}, errors.Errorf("Invalid CVD header - too few "+
+			"fields. Total fields: [%v]", len(fields))
+	}
+
+	version, err := strconv.ParseUint(fields[2], 10, 64)
+
+	if err != nil {
+		return CVDHeader{}, errors.WrapPrefix(err, "Error parsing CVD version", 1)
+	}
+
+	signatures, err := strconv.ParseUint(fields[3], 10, 64)
+
+	if err != nil {
+		return CVDHeader{}, errors.WrapPrefix(err, "Error parsing CVD signature count", 1)
+	}
+
+	flevel, err := strconv.ParseUint(fields[4], 10, 64)
+
+	if err != nil {
+		return CVDHeader{}, errors.WrapPrefix(err, "Error parsing CVD functionality level", 1)
+	}
+
+	return CVDHeader{
+		BuildTime:          fields[1],
+		Version:            version,
+		Signatures:         signatures,
+		FunctionalityLevel: flevel,
+		MD5:                fields[5],
+		Builder:            fields[7],
+	}, nil
+}
+
+// Function that iterates through each of the database files contained
+// within a .cvd file's archive.
+func forEachCVDEntry(localFilePath string, fn func(name string, reader io.Reader) error) error {
+	file, err := os.Open(localFilePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open CVD file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	if _, err := parseCVDHeader(file); err != nil {
+		return err
+	}
+
+	/* CVD archives are gzipped tarballs, but uncompressed archives (.cld)
+	 * are also allowed by ClamAV, so we sniff the gzip magic number. */
+	buffered := bufio.NewReader(file)
+	var archive io.Reader = buffered
+
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+
+		if err != nil {
+			msg := fmt.Sprintf("Unable to decompress CVD file [%v]", localFilePath)
+			return errors.WrapPrefix(err, msg, 1)
+		}
+
+		defer gz.Close()
+		archive = gz
+	}
+
+	tarReader := tar.NewReader(archive)
+
+	for {
+		entry, err := tarReader.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("Error reading archive in CVD file [%v]", localFilePath)
+			return errors.WrapPrefix(err, msg, 1)
+		}
+
+		if !entry.FileInfo().Mode().IsRegular() {
+			continue
+		}
+
+		if err := fn(entry.Name, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+// Function that reads the script embedded in a .cdiff file and passes each
+// line of the script to the supplied function. Cdiff files are in the form
+// of a header (ClamAV-Diff:version:compressed length:) followed by a gzipped
+// script and a trailing digital signature.
+func forEachCdiffLine(localFilePath string, fn func(line string) error) error {
+	file, err := os.Open(localFilePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open cdiff file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	buffered := bufio.NewReader(file)
+	var header string
+
+	for i := 0; i < 3; i++ {
+		field, err := buffered.ReadString(':')
+
+		if err != nil {
+			msg := fmt.Sprintf("Unable to read header of cdiff file [%v]", localFilePath)
+			return errors.WrapPrefix(err, msg, 1)
+		}
+
+		header += field
+	}
+
+	fields := strings.Split(header, ":")
+
+	if fields[0] != "ClamAV-Diff" {
+		return errors.Errorf("Invalid cdiff header in file [%v]: %v",
+			localFilePath, header)
+	}
+
+	length, err := strconv.ParseInt(fields[2], 10, 64)
+
+	if err != nil {
+		msg := fmt.Sprintf("Error parsing compressed length of cdiff file [%v]",
+			localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	gz, err := gzip.NewReader(io.LimitReader(buffered, length))
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to decompress cdiff file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		if err := fn(scanner.Text()); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		msg := fmt.Sprintf("Error reading script in cdiff file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	return nil
+}
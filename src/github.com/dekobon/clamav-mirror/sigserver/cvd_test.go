@@ -0,0 +1,117 @@
+package sigserver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Function that writes a .cvd file containing the given database files to
+// the specified directory.
+func writeTestCVD(t *testing.T, dir string, name string, version uint64,
+	databases map[string]string) string {
+	header := fmt.Sprintf("ClamAV-VDB:02 Jan 2006 15-04 -0700:%d:%d:90:"+
+		"d41d8cd98f00b204e9800998ecf8427e:dsig:tester:1136239440", version, len(databases))
+	buf := bytes.NewBufferString(header + strings.Repeat(" ", cvdHeaderSize-len(header)))
+
+	gz := gzip.NewWriter(buf)
+	archive := tar.NewWriter(gz)
+
+	for filename, contents := range databases {
+		archive.WriteHeader(&tar.Header{
+			Name:     filename,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+		})
+		archive.Write([]byte(contents))
+	}
+
+	archive.Close()
+	gz.Close()
+
+	path := filepath.Join(dir, name+".cvd")
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write test CVD [%v]. %v", path, err)
+	}
+
+	return path
+}
+
+// Function that writes a .cdiff file containing the given script to the
+// specified directory.
+func writeTestCdiff(t *testing.T, dir string, name string, version uint64,
+	script string) string {
+	compressed := new(bytes.Buffer)
+	gz := gzip.NewWriter(compressed)
+	gz.Write([]byte(script))
+	gz.Close()
+
+	buf := bytes.NewBufferString(fmt.Sprintf("ClamAV-Diff:%d:%d:", version, compressed.Len()))
+	buf.Write(compressed.Bytes())
+	buf.WriteString(":dsig")
+
+	path := filepath.Join(dir, fmt.Sprintf("%v-%d.cdiff", name, version))
+
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to write test cdiff [%v]. %v", path, err)
+	}
+
+	return path
+}
+
+func TestTypicalHeaderReadCVDHeader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cvd-")
+	defer os.RemoveAll(dir)
+
+	path := writeTestCVD(t, dir, "daily", 23602, map[string]string{})
+
+	header, err := readCVDHeader(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Version != 23602 {
+		t.Errorf("Expected version 23602. Actual: %v", header.Version)
+	}
+
+	if header.MD5 != "d41d8cd98f00b204e9800998ecf8427e" {
+		t.Errorf("Expected MD5 to be parsed. Actual: %v", header.MD5)
+	}
+
+	if header.FunctionalityLevel != 90 {
+		t.Errorf("Expected functionality level 90. Actual: %v", header.FunctionalityLevel)
+	}
+}
+
+func TestColonInBuildTimeParseCVDHeader(t *testing.T) {
+	header := "ClamAV-VDB:02 Jan 2006 15:04 -0700:58:4566249:60:" +
+		"7dd6b8d5bbad2c9b3ea2cbd8ad6d6f0f:dsig:sigmgr:1490000000"
+	padded := header + strings.Repeat(" ", cvdHeaderSize-len(header))
+
+	parsed, err := parseCVDHeader(strings.NewReader(padded))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Version != 58 || parsed.MD5 != "7dd6b8d5bbad2c9b3ea2cbd8ad6d6f0f" {
+		t.Errorf("Header fields were not parsed correctly: %v", parsed)
+	}
+}
+
+func TestInvalidPrefixParseCVDHeader(t *testing.T) {
+	_, err := parseCVDHeader(strings.NewReader(strings.Repeat("x", cvdHeaderSize)))
+
+	if err == nil || !strings.HasPrefix(err.Error(), "Invalid CVD header") {
+		t.Errorf("Expected invalid header error. Actual: %v", err)
+	}
+}
@@ -0,0 +1,295 @@
+package sigserver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Maximum number of syntax errors reported when validating a database
+const maxReportedSyntaxErrors = 10
+
+// Function that validates a single line of a database. An error message is
+// returned if the line is invalid.
+type lineValidator func(line string) string
+
+/* Validators for each of the database types that can be published. Types
+ * without a validator can't be published because we can't verify that they
+ * won't break clients. */
+var databaseValidators = map[string]lineValidator{
+	".hdb": validateHashLine,
+	".hsb": validateHashLine,
+	".fp":  validateHashLine,
+	".sfp": validateHashLine,
+	".mdb": validateSectionHashLine,
+	".msb": validateSectionHashLine,
+	".ndb": validateBodyLine,
+	".ldb": validateLogicalLine,
+	".cdb": validateContainerLine,
+	".ign2": func(line string) string {
+		if strings.ContainsAny(line, " \t") {
+			return "signature names must not contain whitespace"
+		}
+
+		return ""
+	},
+}
+
+var hexPattern = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+var bodySignaturePattern = regexp.MustCompile(`^[0-9a-fA-F?*{}\[\]()|!,;\-]+$`)
+var yaraRulePattern = regexp.MustCompile(`(?m)^\s*((private|global)\s+)*rule\s+[A-Za-z_][A-Za-z0-9_]*`)
+
+// Function that validates the syntax of a database file. The database type
+// is determined by the file extension.
+func validateDatabase(filename string, contents []byte) error {
+	extension := strings.ToLower(filepath.Ext(filename))
+
+	if extension == ".yar" || extension == ".yara" {
+		return validateYaraRules(filename, contents)
+	}
+
+	validator, ok := databaseValidators[extension]
+
+	if !ok {
+		return errors.Errorf("Publishing databases of type [%v] is not supported", extension)
+	}
+
+	var problems []string
+	signatures := 0
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		signatures++
+
+		if problem := validator(line); problem != "" && len(problems) < maxReportedSyntaxErrors {
+			problems = append(problems, fmt.Sprintf("line %d: %v", lineNumber, problem))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		msg := fmt.Sprintf("Error reading database [%v]", filename)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("Invalid syntax in database [%v]:\n  %v", filename,
+			strings.Join(problems, "\n  "))
+	}
+
+	if signatures == 0 {
+		return errors.Errorf("Database [%v] doesn't contain any signatures", filename)
+	}
+
+	return nil
+}
+
+// Function that validates a hash signature (HashString:FileSize:MalwareName).
+func validateHashLine(line string) string {
+	fields := strings.Split(line, ":")
+
+	if len(fields) < 3 {
+		return "expecting HashString:FileSize:MalwareName"
+	}
+
+	if !validHash(fields[0]) {
+		return fmt.Sprintf("invalid MD5, SHA1 or SHA256 hash [%v]", fields[0])
+	}
+
+	if !validSize(fields[1]) {
+		return fmt.Sprintf("invalid file size [%v]", fields[1])
+	}
+
+	return validName(fields[2])
+}
+
+// Function that validates a PE section hash signature
+// (PESectionSize:PESectionHash:MalwareName).
+func validateSectionHashLine(line string) string {
+	fields := strings.Split(line, ":")
+
+	if len(fields) < 3 {
+		return "expecting PESectionSize:PESectionHash:MalwareName"
+	}
+
+	if !validSize(fields[0]) {
+		return fmt.Sprintf("invalid section size [%v]", fields[0])
+	}
+
+	if !validHash(fields[1]) {
+		return fmt.Sprintf("invalid MD5, SHA1 or SHA256 hash [%v]", fields[1])
+	}
+
+	return validName(fields[2])
+}
+
+// Function that validates an extended body signature
+// (MalwareName:TargetType:Offset:HexSignature[:MinFL:[MaxFL]]).
+func validateBodyLine(line string) string {
+	fields := strings.Split(line, ":")
+
+	if len(fields) < 4 || len(fields) > 6 {
+		return "expecting MalwareName:TargetType:Offset:HexSignature[:MinFL[:MaxFL]]"
+	}
+
+	if problem := validName(fields[0]); problem != "" {
+		return problem
+	}
+
+	if target, err := strconv.ParseUint(fields[1], 10, 8); err != nil || target > 14 {
+		return fmt.Sprintf("invalid target type [%v]", fields[1])
+	}
+
+	if len(fields[2]) == 0 {
+		return "missing offset"
+	}
+
+	if !bodySignaturePattern.MatchString(fields[3]) {
+		return fmt.Sprintf("invalid hex signature [%.32v]", fields[3])
+	}
+
+	for _, flevel := range fields[4:] {
+		if _, err := strconv.ParseUint(flevel, 10, 16); err != nil && flevel != "" {
+			return fmt.Sprintf("invalid functionality level [%v]", flevel)
+		}
+	}
+
+	return ""
+}
+
+// Function that validates a logical signature
+// (SignatureName;TargetDescriptionBlock;LogicalExpression;Subsig0;...).
+func validateLogicalLine(line string) string {
+	fields := strings.Split(line, ";")
+
+	if len(fields) < 4 {
+		return "expecting SignatureName;TargetDescriptionBlock;LogicalExpression;Subsig0[;Subsig1...]"
+	}
+
+	if problem := validName(fields[0]); problem != "" {
+		return problem
+	}
+
+	if !strings.Contains(fields[1], "Target:") {
+		return fmt.Sprintf("target description block [%v] is missing Target", fields[1])
+	}
+
+	if len(fields[2]) == 0 {
+		return "missing logical expression"
+	}
+
+	for i, subsig := range fields[3:] {
+		if len(subsig) == 0 {
+			return fmt.Sprintf("subsignature %d is empty", i)
+		}
+	}
+
+	return ""
+}
+
+// Function that validates a container metadata signature, which has at
+// least ten colon delimited fields beginning with the signature name.
+func validateContainerLine(line string) string {
+	fields := strings.Split(line, ":")
+
+	if len(fields) < 10 {
+		return "expecting at least 10 fields starting with VirusName:ContainerType"
+	}
+
+	return validName(fields[0])
+}
+
+// Function that does a basic check of YARA rules: there must be at least one
+// rule and braces must be balanced outside of strings and comments.
+func validateYaraRules(filename string, contents []byte) error {
+	if !yaraRulePattern.Match(contents) {
+		return errors.Errorf("Invalid syntax in database [%v]: no rules found", filename)
+	}
+
+	depth := 0
+	line := 1
+
+	for i := 0; i < len(contents); i++ {
+		switch c := contents[i]; {
+		case c == '\n':
+			line++
+		case c == '"':
+			for i++; i < len(contents) && contents[i] != '"' && contents[i] != '\n'; i++ {
+				if contents[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(contents) && contents[i+1] == '/':
+			for i < len(contents) && contents[i] != '\n' {
+				i++
+			}
+			line++
+		case c == '/' && i+1 < len(contents) && contents[i+1] == '*':
+			end := bytes.Index(contents[i+2:], []byte("*/"))
+
+			if end < 0 {
+				return errors.Errorf("Invalid syntax in database [%v]: "+
+					"unterminated comment on line %d", filename, line)
+			}
+
+			line += bytes.Count(contents[i:i+2+end], []byte("\n"))
+			i += end + 3
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+
+			if depth < 0 {
+				return errors.Errorf("Invalid syntax in database [%v]: "+
+					"unexpected } on line %d", filename, line)
+			}
+		}
+	}
+
+	if depth != 0 {
+		return errors.Errorf("Invalid syntax in database [%v]: unbalanced braces", filename)
+	}
+
+	return nil
+}
+
+func validHash(hash string) bool {
+	length := len(hash)
+	return (length == 32 || length == 40 || length == 64) && hexPattern.MatchString(hash)
+}
+
+func validSize(size string) bool {
+	if size == "*" {
+		return true
+	}
+
+	_, err := strconv.ParseUint(size, 10, 64)
+
+	return err == nil
+}
+
+func validName(name string) string {
+	if len(name) == 0 {
+		return "missing signature name"
+	}
+
+	if strings.ContainsAny(name, " \t") {
+		return fmt.Sprintf("signature name [%v] must not contain whitespace", name)
+	}
+
+	return ""
+}
@@ -0,0 +1,213 @@
+package sigserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+/* These tests mimic the requests that freshclam makes to a mirror so that
+ * changes to how files are served don't break existing clients. */
+
+// User-Agent sent by freshclam
+const freshclamUserAgent = "ClamAV/0.103.8 (OS: linux-gnu, ARCH: x86_64, CPU: x86_64)"
+
+// Build time of the files served in these tests
+var freshclamTestModTime = time.Date(2017, 7, 27, 12, 0, 0, 0, time.UTC)
+
+// Function that starts a server that serves a daily.cvd and a daily-2.cdiff.
+func setupFreshclamCompat(t *testing.T) (*httptest.Server, string) {
+	dir, err := ioutil.TempDir("", "freshclam-compat-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataDirectory = dir
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+
+	cvdPath := writeTestCVD(t, dir, "daily", 2, map[string]string{"daily.hdb": "a:1:b\n"})
+	cdiffPath := writeTestCdiff(t, dir, "daily", 2, "OPEN daily.hdb\nCLOSE\n")
+
+	for _, path := range []string{cvdPath, cdiffPath} {
+		os.Chtimes(path, freshclamTestModTime, freshclamTestModTime)
+	}
+
+	return httptest.NewServer(http.HandlerFunc(handler)), dir
+}
+
+// Function that makes a request as freshclam would with the given headers.
+func freshclamRequest(t *testing.T, method string, url string, headers map[string]string) (*http.Response, []byte) {
+	request, _ := http.NewRequest(method, url, nil)
+	request.Header.Set("User-Agent", freshclamUserAgent)
+	request.Header.Set("Connection", "close")
+
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+
+	return response, body
+}
+
+func TestFullDownloadFreshclamCompat(t *testing.T) {
+	server, dir := setupFreshclamCompat(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "daily.cvd"))
+	response, body := freshclamRequest(t, "GET", server.URL+"/daily.cvd", nil)
+
+	if response.StatusCode != http.StatusOK || string(body) != string(contents) {
+		t.Fatalf("Expected the whole file. Status: %v Length: %v", response.StatusCode, len(body))
+	}
+
+	if response.Header.Get("Content-Length") != fmt.Sprint(len(contents)) {
+		t.Errorf("Expected Content-Length [%v]. Actual: %v", len(contents),
+			response.Header.Get("Content-Length"))
+	}
+
+	if etag := response.Header.Get("ETag"); etag != `"d41d8cd98f00b204e9800998ecf8427e"` {
+		t.Errorf("Expected the ETag to be the MD5 from the CVD header. Actual: %v", etag)
+	}
+
+	if response.Header.Get("Last-Modified") != freshclamTestModTime.Format(http.TimeFormat) {
+		t.Errorf("Unexpected Last-Modified: %v", response.Header.Get("Last-Modified"))
+	}
+
+	if response.Header.Get("Accept-Ranges") != "bytes" {
+		t.Error("Expected range requests to be advertised")
+	}
+}
+
+func TestHeaderRangeFreshclamCompat(t *testing.T) {
+	server, dir := setupFreshclamCompat(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "daily.cvd"))
+
+	// freshclam reads the version of a remote .cvd from its 512 byte header
+	response, body := freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"Range": "bytes=0-511"})
+
+	if response.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected 206 Partial Content. Actual: %v", response.StatusCode)
+	}
+
+	if string(body) != string(contents[:cvdHeaderSize]) {
+		t.Errorf("Expected the CVD header. Actual: %q", body)
+	}
+
+	if contentRange := response.Header.Get("Content-Range"); contentRange !=
+		fmt.Sprintf("bytes 0-511/%d", len(contents)) {
+		t.Errorf("Unexpected Content-Range: %v", contentRange)
+	}
+
+	response, _ = freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(contents)+10)})
+
+	if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("Expected 416 for a range past the end of the file. Actual: %v",
+			response.StatusCode)
+	}
+}
+
+func TestIfModifiedSinceFreshclamCompat(t *testing.T) {
+	server, dir := setupFreshclamCompat(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	cases := map[string]int{
+		freshclamTestModTime.Format(http.TimeFormat):                      http.StatusNotModified,
+		freshclamTestModTime.Add(time.Hour).Format(http.TimeFormat):       http.StatusNotModified,
+		freshclamTestModTime.Add(-time.Hour).Format(http.TimeFormat):      http.StatusOK,
+		freshclamTestModTime.Add(-time.Hour * 24).Format(http.TimeFormat): http.StatusOK,
+	}
+
+	for _, file := range []string{"/daily.cvd", "/daily-2.cdiff"} {
+		for modifiedSince, expected := range cases {
+			response, _ := freshclamRequest(t, "GET", server.URL+file,
+				map[string]string{"If-Modified-Since": modifiedSince})
+
+			if response.StatusCode != expected {
+				t.Errorf("Expected [%v] for [%v] modified since [%v]. Actual: %v",
+					expected, file, modifiedSince, response.StatusCode)
+			}
+		}
+	}
+}
+
+func TestETagFreshclamCompat(t *testing.T) {
+	server, dir := setupFreshclamCompat(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	etag := `"d41d8cd98f00b204e9800998ecf8427e"`
+
+	response, _ := freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"If-None-Match": etag})
+
+	if response.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching ETag. Actual: %v", response.StatusCode)
+	}
+
+	response, _ = freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"If-None-Match": `"00000000000000000000000000000000"`})
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for a different ETag. Actual: %v", response.StatusCode)
+	}
+
+	// A resumed download only gets the rest of the file if it hasn't changed
+	response, _ = freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"Range": "bytes=512-", "If-Range": etag})
+
+	if response.StatusCode != http.StatusPartialContent {
+		t.Errorf("Expected 206 for a matching If-Range. Actual: %v", response.StatusCode)
+	}
+
+	response, _ = freshclamRequest(t, "GET", server.URL+"/daily.cvd",
+		map[string]string{"Range": "bytes=512-", "If-Range": `"00000000000000000000000000000000"`})
+
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected the whole file for a changed If-Range. Actual: %v", response.StatusCode)
+	}
+}
+
+func TestHeadFreshclamCompat(t *testing.T) {
+	server, dir := setupFreshclamCompat(t)
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "daily-2.cdiff"))
+	response, body := freshclamRequest(t, "HEAD", server.URL+"/daily-2.cdiff", nil)
+
+	if response.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Errorf("Expected 200 without a body. Actual: %v [%v bytes]", response.StatusCode, len(body))
+	}
+
+	if response.Header.Get("Content-Length") != fmt.Sprint(len(contents)) {
+		t.Errorf("Expected Content-Length [%v]. Actual: %v", len(contents),
+			response.Header.Get("Content-Length"))
+	}
+
+	response, _ = freshclamRequest(t, "GET", server.URL+"/daily-3.cdiff", nil)
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing cdiff. Actual: %v", response.StatusCode)
+	}
+}
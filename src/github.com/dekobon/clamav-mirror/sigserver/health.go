@@ -0,0 +1,233 @@
+package sigserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/metrics"
+	"github.com/dekobon/clamav-mirror/sigupdate"
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Signature files that must be in the data directory for sigserver to be ready
+var requiredSignatureFiles = []string{"main.cvd", "daily.cvd", "bytecode.cvd"}
+
+// Signature file whose modification time is used when no update is known to
+// have succeeded. ClamAV builds it several times a day, unlike main.cvd.
+const freshestSignatureFile = "daily.cvd"
+
+// Filename of the file in the data directory recording the last update that
+// completed successfully, so that it is known after a restart
+const lastUpdateStateFilename = "last-update.json"
+
+// Time of the last update that completed successfully
+var lastSuccessfulUpdate time.Time
+var lastSuccessfulUpdateLock sync.RWMutex
+
+// lastUpdateState is the persisted time of the last successful update.
+type lastUpdateState struct {
+	LastSuccessfulUpdate time.Time `json:"last_successful_update"`
+}
+
+// How recently signatures must have been updated for sigserver to be ready
+var readyMaxAge time.Duration
+var readyMaxAgeLock sync.RWMutex
+
+// Version information reported by the version endpoint
+var appVersionInfo utils.AppVersionInfo
+
+// ReadinessResponse is the response body of the readiness endpoint.
+type ReadinessResponse struct {
+	Ready      bool       `json:"ready"`
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+	MaxAge     string     `json:"max_age"`
+	Missing    []string   `json:"missing,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// Function that records the outcome of a signature update. Updates that were
+// skipped because every upstream is in a cooldown period fail, so they don't
+// count.
+func recordUpdate(dataFilePath string, result sigupdate.UpdateResult, err error) {
+	if err != nil || len(result.Signatures) == 0 {
+		return
+	}
+
+	now := time.Now()
+
+	lastSuccessfulUpdateLock.Lock()
+	lastSuccessfulUpdate = now
+	lastSuccessfulUpdateLock.Unlock()
+
+	data, err := json.MarshalIndent(lastUpdateState{LastSuccessfulUpdate: now.UTC()}, "", "  ")
+
+	if err == nil {
+		err = utils.WriteFileAtomically(filepath.Join(dataFilePath, lastUpdateStateFilename),
+			data, now)
+	}
+
+	if err != nil {
+		logError.Printf("Unable to save the time of the last update. %v", err)
+	}
+}
+
+// Function that reads the time of the last successful update from before
+// sigserver was started.
+func loadLastSuccessfulUpdate(dataFilePath string) error {
+	statePath := filepath.Join(dataFilePath, lastUpdateStateFilename)
+
+	if !utils.Exists(statePath) {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read the time of the last update [%v]", statePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	var state lastUpdateState
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		msg := fmt.Sprintf("Unable to parse the time of the last update [%v]", statePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	lastSuccessfulUpdateLock.Lock()
+	defer lastSuccessfulUpdateLock.Unlock()
+
+	lastSuccessfulUpdate = state.LastSuccessfulUpdate
+
+	return nil
+}
+
+/* Function that returns the time that signatures were last known to be up to
+ * date. If no update is known to have succeeded, the modification time of
+ * daily.cvd is used instead, so that fresh data isn't unready after a restart
+ * while upstreams are unreachable. sigupdate sets the modification time of a
+ * .cvd file to its build time, so the other files are often months old. */
+func lastUpdateTime(dataDirectory string) (time.Time, bool) {
+	lastSuccessfulUpdateLock.RLock()
+	lastUpdate := lastSuccessfulUpdate
+	lastSuccessfulUpdateLock.RUnlock()
+
+	if !lastUpdate.IsZero() {
+		return lastUpdate, true
+	}
+
+	stat, err := os.Stat(filepath.Join(dataDirectory, freshestSignatureFile))
+
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return stat.ModTime(), true
+}
+
+// Function that checks to see if the data directory has every required
+// signature file and that they have been updated recently enough.
+func readiness(dataDirectory string, maxAge time.Duration, now time.Time) ReadinessResponse {
+	response := ReadinessResponse{MaxAge: maxAge.String()}
+
+	for _, file := range requiredSignatureFiles {
+		if !utils.Exists(filepath.Join(dataDirectory, file)) {
+			response.Missing = append(response.Missing, file)
+		}
+	}
+
+	lastUpdate, known := lastUpdateTime(dataDirectory)
+
+	if known {
+		lastUpdate = lastUpdate.UTC().Truncate(time.Second)
+		response.LastUpdate = &lastUpdate
+	}
+
+	switch {
+	case len(response.Missing) > 0:
+		response.Reason = "Signature files are missing from the data directory"
+	case !known:
+		response.Reason = "Signatures have never been updated"
+	case now.Sub(lastUpdate) > maxAge:
+		response.Reason = "Signatures haven't been updated within the maximum age"
+	default:
+		response.Ready = true
+	}
+
+	return response
+}
+
+// Function that handles liveness checks. It answers as long as the process
+// is able to serve requests.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// Function that sets how recently signatures must have been updated for
+// sigserver to be ready. Without a maximum age, signatures updated on
+// schedule are fresh for two update intervals.
+func configureReadyMaxAge(maxAge time.Duration, scheduler *updateScheduler) {
+	if maxAge == 0 {
+		maxAge = 2 * scheduler.interval(time.Now())
+	}
+
+	readyMaxAgeLock.Lock()
+	defer readyMaxAgeLock.Unlock()
+
+	readyMaxAge = maxAge
+}
+
+// Function that handles readiness checks. It answers 503 when signatures are
+// missing or stale, so that load balancers can route around this instance.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+
+	readyMaxAgeLock.RLock()
+	maxAge := readyMaxAge
+	readyMaxAgeLock.RUnlock()
+
+	response := readiness(dataDirectory, maxAge, time.Now())
+
+	if !response.Ready {
+		if verboseMode {
+			logger.Printf("[%v] {%v} %v NOT READY (%v)", r.Method, clientName(r), r.URL,
+				response.Reason)
+		}
+
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// Function that handles requests for the version of sigserver.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+	writeJSON(w, http.StatusOK, appVersionInfo)
+}
+
+// Function that registers the health, readiness, version and metrics
+// endpoints. These paths have no file extension, so they never clash with
+// signature files.
+func registerStatusHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", withAccessList(apiAccess, healthHandler))
+	mux.HandleFunc("/readyz", withAccessList(apiAccess, readinessHandler))
+	mux.HandleFunc("/version", withAccessList(apiAccess, versionHandler))
+	mux.HandleFunc("/metrics", withAccessList(apiAccess, metrics.Default.Handler()))
+}
@@ -0,0 +1,179 @@
+package sigserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Function that sets the time of the last successful update for a test.
+func setLastSuccessfulUpdate(updated time.Time) {
+	lastSuccessfulUpdateLock.Lock()
+	defer lastSuccessfulUpdateLock.Unlock()
+
+	lastSuccessfulUpdate = updated
+}
+
+func TestMissingFilesReadiness(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readiness-")
+	defer os.RemoveAll(dir)
+
+	setLastSuccessfulUpdate(time.Now())
+	defer setLastSuccessfulUpdate(time.Time{})
+
+	ioutil.WriteFile(filepath.Join(dir, "main.cvd"), []byte("main"), 0644)
+
+	response := readiness(dir, time.Hour, time.Now())
+
+	if response.Ready {
+		t.Fatal("Expected not to be ready with missing signature files")
+	}
+
+	if len(response.Missing) != 2 || response.Missing[0] != "daily.cvd" {
+		t.Errorf("Unexpected missing files: %v", response.Missing)
+	}
+}
+
+func TestStaleReadiness(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readiness-")
+	defer os.RemoveAll(dir)
+
+	for _, file := range requiredSignatureFiles {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644)
+	}
+
+	now := time.Now()
+	setLastSuccessfulUpdate(now.Add(-2 * time.Hour))
+	defer setLastSuccessfulUpdate(time.Time{})
+
+	if response := readiness(dir, 3*time.Hour, now); !response.Ready {
+		t.Errorf("Expected to be ready within the maximum age. Reason: %v", response.Reason)
+	}
+
+	if response := readiness(dir, time.Hour, now); response.Ready {
+		t.Error("Expected not to be ready once the maximum age has passed")
+	}
+
+	// Without a known update, the age of daily.cvd is used
+	setLastSuccessfulUpdate(time.Time{})
+	old := now.Add(-5 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "daily.cvd"), old, old)
+
+	response := readiness(dir, 4*time.Hour, now)
+
+	if response.Ready || response.LastUpdate == nil ||
+		!response.LastUpdate.Equal(old.UTC().Truncate(time.Second)) {
+		t.Errorf("Expected an old daily.cvd to make signatures stale. Actual: %+v", response)
+	}
+}
+
+func TestRestartedReadiness(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readiness-")
+	defer os.RemoveAll(dir)
+
+	for _, file := range requiredSignatureFiles {
+		ioutil.WriteFile(filepath.Join(dir, file), []byte(file), 0644)
+	}
+
+	// sigupdate dates each .cvd file by its build time, so main.cvd is old
+	now := time.Now()
+	built := now.Add(-90 * 24 * time.Hour)
+	os.Chtimes(filepath.Join(dir, "main.cvd"), built, built)
+	os.Chtimes(filepath.Join(dir, "bytecode.cvd"), built, built)
+
+	setLastSuccessfulUpdate(time.Time{})
+	defer setLastSuccessfulUpdate(time.Time{})
+
+	if response := readiness(dir, 8*time.Hour, now); !response.Ready {
+		t.Errorf("Expected a fresh daily.cvd to be ready. Reason: %v", response.Reason)
+	}
+
+	// The last successful update is known after a restart
+	recordUpdate(dir, sigupdate.UpdateResult{
+		Signatures: []sigupdate.SignatureResult{{Name: "daily"}},
+	}, nil)
+	updated := lastSuccessfulUpdate
+	setLastSuccessfulUpdate(time.Time{})
+
+	if err := loadLastSuccessfulUpdate(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if !lastSuccessfulUpdate.Equal(updated) {
+		t.Errorf("Expected the last update to be loaded. Expected: %v Actual: %v",
+			updated, lastSuccessfulUpdate)
+	}
+}
+
+func TestSkippedRecordUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readiness-")
+	defer os.RemoveAll(dir)
+
+	setLastSuccessfulUpdate(time.Time{})
+	defer setLastSuccessfulUpdate(time.Time{})
+
+	recordUpdate(dir, sigupdate.UpdateResult{}, nil)
+
+	if !lastSuccessfulUpdate.IsZero() {
+		t.Error("Expected a skipped update not to be recorded")
+	}
+
+	recordUpdate(dir, sigupdate.UpdateResult{
+		Signatures: []sigupdate.SignatureResult{{Name: "daily"}},
+	}, nil)
+
+	if lastSuccessfulUpdate.IsZero() {
+		t.Error("Expected a successful update to be recorded")
+	}
+}
+
+func TestRegisterStatusHandlers(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "readiness-")
+	defer os.RemoveAll(dir)
+
+	dataDirectory = dir
+	readyMaxAge = time.Hour
+	appVersionInfo = utils.AppVersionInfo{AppVersion: "1.2.3", GitCommitHash: "abc123"}
+	defer func() { appVersionInfo = utils.AppVersionInfo{} }()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handler)
+	registerStatusHandlers(mux)
+
+	request := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+
+		return recorder
+	}
+
+	if recorder := request("/healthz"); recorder.Code != http.StatusOK ||
+		recorder.Body.String() != "ok\n" {
+		t.Errorf("Unexpected health response: %v %v", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := request("/readyz"); recorder.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an empty data directory not to be ready. Actual: %v", recorder.Code)
+	}
+
+	recorder := request("/version")
+	var version map[string]string
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &version); err != nil {
+		t.Fatal(err)
+	}
+
+	if version["version"] != "1.2.3" || version["git_commit_hash"] != "abc123" {
+		t.Errorf("Unexpected version response: %v", recorder.Body.String())
+	}
+}
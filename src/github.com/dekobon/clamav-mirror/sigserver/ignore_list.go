@@ -0,0 +1,459 @@
+package sigserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Filename of the generated ignore database served to clients
+const ignoreDatabaseFilename = "local.ign2"
+
+// Filename of the file storing the ignore list entries and version
+const ignoreListFilename = "ignore-list.json"
+
+// IgnoreEntry is a single signature that is suppressed by the ignore list.
+type IgnoreEntry struct {
+	Name    string     `json:"name"`
+	Reason  string     `json:"reason"`
+	Added   time.Time  `json:"added"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// IgnoreList is the persisted state of the organization's ignore list. The
+// version is incremented every time that the list of entries changes.
+type IgnoreList struct {
+	Version  uint64        `json:"version"`
+	Modified time.Time     `json:"modified"`
+	Entries  []IgnoreEntry `json:"entries"`
+}
+
+// Error returned when removing a signature that isn't on the ignore list
+var errIgnoreEntryNotFound = errors.New("Signature is not on the ignore list")
+
+// Guards reading and writing of the ignore list state and database
+var ignoreListLock sync.Mutex
+
+/* The ignore list as last loaded or changed and the ignore database generated
+ * from it, which are served without reading the data directory. A timer
+ * removes entries from them when the next entry expires. */
+var publishedIgnoreList *IgnoreList
+var publishedIgnoreDatabase []byte
+var publishedIgnoreListLock sync.RWMutex
+var ignoreListExpiryTimer *time.Timer
+
+// Function that checks to see if an ignore entry has expired.
+func (entry IgnoreEntry) expired(now time.Time) bool {
+	return entry.Expires != nil && !now.Before(*entry.Expires)
+}
+
+// Function that validates that a signature name can be written to a .ign2
+// database, which has a single signature name per line.
+func validateIgnoreName(name string) error {
+	if len(name) == 0 || len(name) > 256 {
+		return errors.Errorf("Signature name must be between 1 and 256 characters")
+	}
+
+	if strings.HasPrefix(name, "#") {
+		return errors.Errorf("Signature name [%v] must not start with #", name)
+	}
+
+	for _, r := range name {
+		if unicode.IsSpace(r) || unicode.IsControl(r) || r == ':' {
+			return errors.Errorf("Signature name [%v] must not contain "+
+				"whitespace, control characters or colons", name)
+		}
+	}
+
+	return nil
+}
+
+// Function that reads the ignore list state from the data directory. If no
+// state has been saved, an empty list is returned.
+func loadIgnoreList(dataFilePath string) (IgnoreList, error) {
+	list := IgnoreList{Entries: []IgnoreEntry{}}
+	statePath := filepath.Join(dataFilePath, ignoreListFilename)
+
+	if !utils.Exists(statePath) {
+		return list, nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read ignore list [%v]", statePath)
+		return list, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := json.Unmarshal(data, &list); err != nil {
+		msg := fmt.Sprintf("Unable to parse ignore list [%v]", statePath)
+		return list, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return list, nil
+}
+
+// Function that saves the ignore list state and regenerates the ignore
+// database from it.
+func saveIgnoreList(dataFilePath string, list IgnoreList) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Unable to serialize ignore list", 1)
+	}
+
+	statePath := filepath.Join(dataFilePath, ignoreListFilename)
+
+	if err := utils.WriteFileAtomically(statePath, data, list.Modified); err != nil {
+		return err
+	}
+
+	return writeIgnoreDatabase(dataFilePath, list)
+}
+
+// Function that writes the .ign2 database for the ignore list. The file's
+// modification time is set to the time that the list last changed so that
+// clients using If-Modified-Since only download it when it has changed.
+func writeIgnoreDatabase(dataFilePath string, list IgnoreList) error {
+	databasePath := filepath.Join(dataFilePath, ignoreDatabaseFilename)
+
+	return utils.WriteFileAtomically(databasePath, renderIgnoreDatabase(list), list.Modified)
+}
+
+// Function that generates the contents of the .ign2 database for the ignore
+// list.
+func renderIgnoreDatabase(list IgnoreList) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by sigserver - version %d\n", list.Version)
+
+	for _, entry := range list.Entries {
+		buf.WriteString(entry.Name)
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes()
+}
+
+/* Function that makes the ignore list and its database available to clients
+ * and sets a timer to refresh them when the next entry expires. This must be
+ * called while holding ignoreListLock. */
+func publishIgnoreList(dataFilePath string, list IgnoreList, now time.Time) {
+	database := renderIgnoreDatabase(list)
+
+	publishedIgnoreListLock.Lock()
+	publishedIgnoreList = &list
+	publishedIgnoreDatabase = database
+	publishedIgnoreListLock.Unlock()
+
+	if ignoreListExpiryTimer != nil {
+		ignoreListExpiryTimer.Stop()
+		ignoreListExpiryTimer = nil
+	}
+
+	var next *time.Time
+
+	for _, entry := range list.Entries {
+		if entry.Expires != nil && (next == nil || entry.Expires.Before(*next)) {
+			next = entry.Expires
+		}
+	}
+
+	if next == nil {
+		return
+	}
+
+	ignoreListExpiryTimer = time.AfterFunc(next.Sub(now), func() {
+		if _, err := refreshIgnoreList(dataFilePath); err != nil {
+			logError.Printf("Error removing expired ignore list entries. %v", err)
+		}
+	})
+}
+
+// Function that returns the published ignore list and its database, or false
+// if the ignore list hasn't been loaded.
+func publishedIgnores() (IgnoreList, []byte, bool) {
+	publishedIgnoreListLock.RLock()
+	defer publishedIgnoreListLock.RUnlock()
+
+	if publishedIgnoreList == nil {
+		return IgnoreList{}, nil, false
+	}
+
+	return *publishedIgnoreList, publishedIgnoreDatabase, true
+}
+
+// Function that loads the ignore list, applies the supplied change to its
+// entries and saves the list if the entries were modified. Expired entries
+// are always removed.
+func updateIgnoreList(dataFilePath string, now time.Time,
+	change func(entries []IgnoreEntry) ([]IgnoreEntry, error)) (IgnoreList, error) {
+	ignoreListLock.Lock()
+	defer ignoreListLock.Unlock()
+
+	list, err := loadIgnoreList(dataFilePath)
+
+	if err != nil {
+		return list, err
+	}
+
+	entries := []IgnoreEntry{}
+	expired := false
+
+	for _, entry := range list.Entries {
+		if entry.expired(now) {
+			logger.Printf("Ignore list entry [%v] expired at %v", entry.Name, *entry.Expires)
+			expired = true
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	changed := expired
+
+	if change != nil {
+		updated, err := change(entries)
+
+		if err != nil {
+			return list, err
+		}
+
+		changed = true
+		entries = updated
+	}
+
+	databaseMissing := !utils.Exists(filepath.Join(dataFilePath, ignoreDatabaseFilename))
+
+	if !changed && !databaseMissing {
+		publishIgnoreList(dataFilePath, list, now)
+		return list, nil
+	}
+
+	if changed {
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name < entries[j].Name
+		})
+
+		/* Last-Modified only has a resolution of seconds, so we make sure that
+		 * every change moves the modification time forward. */
+		modified := now.UTC().Truncate(time.Second)
+
+		if !modified.After(list.Modified) {
+			modified = list.Modified.Add(time.Second)
+		}
+
+		list.Version++
+		list.Modified = modified
+		list.Entries = entries
+	} else if list.Modified.IsZero() {
+		list.Modified = now.UTC().Truncate(time.Second)
+	}
+
+	if err := saveIgnoreList(dataFilePath, list); err != nil {
+		return list, err
+	}
+
+	publishIgnoreList(dataFilePath, list, now)
+
+	return list, nil
+}
+
+// Function that removes expired entries from the ignore list and makes sure
+// that the ignore database reflects the current list.
+func refreshIgnoreList(dataFilePath string) (IgnoreList, error) {
+	return updateIgnoreList(dataFilePath, time.Now(), nil)
+}
+
+// Function that adds a signature to the ignore list or replaces the reason
+// and expiration of a signature already on the list.
+func addIgnoreEntry(dataFilePath string, entry IgnoreEntry) (IgnoreList, error) {
+	if err := validateIgnoreName(entry.Name); err != nil {
+		return IgnoreList{}, err
+	}
+
+	now := time.Now()
+
+	if entry.expired(now) {
+		return IgnoreList{}, errors.Errorf("Expiration time [%v] is in the past",
+			*entry.Expires)
+	}
+
+	entry.Added = now.UTC().Truncate(time.Second)
+
+	return updateIgnoreList(dataFilePath, now, func(entries []IgnoreEntry) ([]IgnoreEntry, error) {
+		for i, existing := range entries {
+			if existing.Name == entry.Name {
+				entries[i] = entry
+				return entries, nil
+			}
+		}
+
+		return append(entries, entry), nil
+	})
+}
+
+// Function that removes a signature from the ignore list.
+func removeIgnoreEntry(dataFilePath string, name string) (IgnoreList, error) {
+	return updateIgnoreList(dataFilePath, time.Now(), func(entries []IgnoreEntry) ([]IgnoreEntry, error) {
+		for i, existing := range entries {
+			if existing.Name == name {
+				return append(entries[:i], entries[i+1:]...), nil
+			}
+		}
+
+		return nil, errors.New(errIgnoreEntryNotFound)
+	})
+}
+
+// Function that parses an ignore entry expiration, which may either be an
+// RFC 3339 timestamp, a date (YYYY-MM-DD) or a duration relative to now
+// (e.g. 30d). An empty value means that the entry never expires.
+func parseIgnoreExpiry(value string, now time.Time) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	if expires, err := time.Parse(time.RFC3339, value); err == nil {
+		return &expires, nil
+	}
+
+	if expires, err := time.Parse("2006-01-02", value); err == nil {
+		return &expires, nil
+	}
+
+	duration, err := utils.ParseDuration(value)
+
+	if err != nil || duration <= 0 {
+		return nil, errors.Errorf("Invalid expiration [%v] - expecting a "+
+			"timestamp, a date or a positive duration (e.g. 30d)", value)
+	}
+
+	expires := now.Add(duration).UTC().Truncate(time.Second)
+
+	return &expires, nil
+}
+
+// Function that serves the ignore database from memory, so that requests for
+// it don't read the data directory.
+func ignoreDatabaseHandler(w http.ResponseWriter, r *http.Request) {
+	list, database, published := publishedIgnores()
+
+	if !published {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !(r.Method == "GET" || r.Method == "HEAD") {
+		logger.Printf("[%v] {%v} %v DENIED", r.Method, clientName(r), r.URL)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	logger.Printf("[%v] {%v} %v --> %v (version %v)", r.Method, clientName(r), r.URL,
+		ignoreDatabaseFilename, list.Version)
+
+	http.ServeContent(w, r, ignoreDatabaseFilename, list.Modified, bytes.NewReader(database))
+}
+
+// ignoreEntryRequest is the request body used to add an entry via the API.
+type ignoreEntryRequest struct {
+	Name    string `json:"name"`
+	Reason  string `json:"reason"`
+	Expires string `json:"expires"`
+}
+
+// Function that handles requests to the ignore list API. Listing the ignore
+// list is allowed for everyone, but changes require the admin token.
+func ignoreListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+
+	var list IgnoreList
+	var err error
+
+	switch r.Method {
+	case "GET", "HEAD":
+		var published bool
+
+		if list, _, published = publishedIgnores(); !published {
+			list, err = refreshIgnoreList(dataDirectory)
+		}
+	case "POST":
+		if !authorizeAdminRequest(w, r) {
+			return
+		}
+
+		var request ignoreEntryRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+
+		if err := decoder.Decode(&request); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON request body: "+err.Error())
+			return
+		}
+
+		expires, err := parseIgnoreExpiry(request.Expires, time.Now())
+
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		entry := IgnoreEntry{Name: request.Name, Reason: request.Reason, Expires: expires}
+
+		if err := validateIgnoreName(entry.Name); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		list, err = addIgnoreEntry(dataDirectory, entry)
+
+		if err == nil {
+			logger.Printf("[%v] {%v} Added [%v] to ignore list (version %v): %v",
+				r.Method, clientName(r), entry.Name, list.Version, entry.Reason)
+		}
+	case "DELETE":
+		if !authorizeAdminRequest(w, r) {
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		list, err = removeIgnoreEntry(dataDirectory, name)
+
+		if err == nil {
+			logger.Printf("[%v] {%v} Removed [%v] from ignore list (version %v)",
+				r.Method, clientName(r), name, list.Version)
+		} else if errors.Is(err, errIgnoreEntryNotFound) {
+			writeJSONError(w, http.StatusNotFound,
+				fmt.Sprintf("Signature [%v] is not on the ignore list", name))
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		logError.Printf("Error updating ignore list. %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "Unable to update the ignore list")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,195 @@
+package sigserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddAndRemoveIgnoreEntry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ignore-")
+	defer os.RemoveAll(dir)
+
+	list, err := addIgnoreEntry(dir, IgnoreEntry{Name: "Win.Trojan.Foo-1", Reason: "FP on our agent"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Version != 1 || len(list.Entries) != 1 {
+		t.Errorf("Expected version 1 with 1 entry. Actual: %+v", list)
+	}
+
+	list, err = addIgnoreEntry(dir, IgnoreEntry{Name: "Doc.Dropper.Bar-2"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	database, err := ioutil.ReadFile(filepath.Join(dir, ignoreDatabaseFilename))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# Generated by sigserver - version 2\nDoc.Dropper.Bar-2\nWin.Trojan.Foo-1\n"
+
+	if string(database) != expected {
+		t.Errorf("Unexpected ignore database contents.\nExpected: %q\nActual  : %q",
+			expected, string(database))
+	}
+
+	previousModified := list.Modified
+	list, err = removeIgnoreEntry(dir, "Win.Trojan.Foo-1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Version != 3 || len(list.Entries) != 1 {
+		t.Errorf("Expected version 3 with 1 entry. Actual: %+v", list)
+	}
+
+	if !list.Modified.After(previousModified) {
+		t.Errorf("Modification time must move forward on every change. "+
+			"Previous: %v Actual: %v", previousModified, list.Modified)
+	}
+
+	if _, err := removeIgnoreEntry(dir, "Win.Trojan.Foo-1"); err == nil {
+		t.Error("Expected error when removing a signature that isn't on the list")
+	}
+}
+
+func TestExpiredEntriesRefreshIgnoreList(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ignore-")
+	defer os.RemoveAll(dir)
+
+	expires := time.Now().Add(-time.Minute)
+	list := IgnoreList{
+		Version:  4,
+		Modified: time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+		Entries: []IgnoreEntry{
+			{Name: "Expired-1", Expires: &expires},
+			{Name: "Permanent-1"},
+		},
+	}
+
+	if err := saveIgnoreList(dir, list); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := refreshIgnoreList(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refreshed.Version != 5 || len(refreshed.Entries) != 1 ||
+		refreshed.Entries[0].Name != "Permanent-1" {
+		t.Errorf("Expected expired entry to be removed. Actual: %+v", refreshed)
+	}
+}
+
+func TestPublishedIgnoreDatabaseHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ignore-")
+	defer os.RemoveAll(dir)
+
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+	dataDirectory = dir
+	defer func() {
+		publishedIgnoreList = nil
+		publishedIgnoreDatabase = nil
+	}()
+
+	list, err := addIgnoreEntry(dir, IgnoreEntry{Name: "Win.Trojan.Foo-1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database is served from memory rather than the data directory
+	os.Remove(filepath.Join(dir, ignoreDatabaseFilename))
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/local.ign2", nil))
+
+	if recorder.Code != http.StatusOK ||
+		recorder.Body.String() != "# Generated by sigserver - version 1\nWin.Trojan.Foo-1\n" {
+		t.Errorf("Unexpected ignore database response [%v]: %q", recorder.Code,
+			recorder.Body.String())
+	}
+
+	r := httptest.NewRequest("GET", "/local.ign2", nil)
+	r.Header.Set("If-Modified-Since", list.Modified.Format(http.TimeFormat))
+	recorder = httptest.NewRecorder()
+	handler(recorder, r)
+
+	if recorder.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for an unchanged ignore database. Actual: %v", recorder.Code)
+	}
+}
+
+func TestExpiryTimerPublishIgnoreList(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ignore-")
+	defer os.RemoveAll(dir)
+
+	defer func() {
+		publishedIgnoreList = nil
+		publishedIgnoreDatabase = nil
+	}()
+
+	expires := time.Now().Add(50 * time.Millisecond)
+
+	if _, err := addIgnoreEntry(dir, IgnoreEntry{Name: "Expiring-1", Expires: &expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if list, _, _ := publishedIgnores(); len(list.Entries) == 0 {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Error("Expected the expired entry to be removed without a request")
+}
+
+func TestInvalidNamesAddIgnoreEntry(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "ignore-")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"", "# comment", "Two Words", "Name:md5"} {
+		if _, err := addIgnoreEntry(dir, IgnoreEntry{Name: name}); err == nil {
+			t.Errorf("Expected validation error for signature name [%v]", name)
+		}
+	}
+}
+
+func TestDurationParseIgnoreExpiry(t *testing.T) {
+	now := time.Date(2017, 7, 27, 12, 0, 0, 0, time.UTC)
+
+	expires, err := parseIgnoreExpiry("30d", now)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !expires.Equal(now.Add(30 * 24 * time.Hour)) {
+		t.Errorf("Expected expiration in 30 days. Actual: %v", expires)
+	}
+
+	if expires, _ := parseIgnoreExpiry("", now); expires != nil {
+		t.Errorf("Expected no expiration. Actual: %v", expires)
+	}
+
+	if _, err := parseIgnoreExpiry("-1h", now); err == nil {
+		t.Error("Expected error for negative duration")
+	}
+}
@@ -0,0 +1,129 @@
+package sigserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+import (
+	"github.com/go-errors/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// Names of the sockets that sigserver serves on
+const (
+	httpSocketName  = "http"
+	httpsSocketName = "https"
+)
+
+/* Function that returns the sockets passed to sigserver using the systemd
+ * socket activation protocol, keyed by the socket's name. Sockets without a
+ * name (FileDescriptorName in the .socket unit) are named "http" and "https"
+ * in the order that they were passed. The environment variables are cleared
+ * so that they aren't passed on to child processes such as sigtool. */
+func inheritedListeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+
+	if err != nil || count < 1 {
+		return listeners, errors.Errorf("Invalid LISTEN_FDS value [%v]", os.Getenv("LISTEN_FDS"))
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	defaultNames := []string{httpSocketName, httpsSocketName}
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		unix.CloseOnExec(fd)
+
+		name := ""
+
+		if i < len(names) && (names[i] == httpSocketName || names[i] == httpsSocketName) {
+			name = names[i]
+		} else if i < len(defaultNames) {
+			name = defaultNames[i]
+		}
+
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("listen-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+
+		if err != nil {
+			msg := fmt.Sprintf("Unable to use inherited socket [%d]", fd)
+			return listeners, errors.WrapPrefix(err, msg, 1)
+		}
+
+		if _, exists := listeners[name]; name == "" || exists {
+			logger.Printf("Ignoring inherited socket [%d] on [%v]", fd, listener.Addr())
+			listener.Close()
+			continue
+		}
+
+		listeners[name] = listener
+	}
+
+	return listeners, nil
+}
+
+/* Function that listens on a TCP port. With reusePort, SO_REUSEPORT is set
+ * so that a new sigserver process can listen on the same port while the old
+ * process finishes the requests that it has in progress. */
+func listen(address string, reusePort bool) (net.Listener, error) {
+	config := net.ListenConfig{}
+
+	if reusePort {
+		config.Control = func(network string, address string, conn syscall.RawConn) error {
+			var sockErr error
+
+			err := conn.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		}
+	}
+
+	listener, err := config.Listen(context.Background(), "tcp", address)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to listen on [%v]", address)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return listener, nil
+}
+
+// Function that returns the inherited socket with a name if there is one,
+// otherwise it listens on the given address.
+func serverListener(inherited map[string]net.Listener, name string, address string,
+	reusePort bool) (net.Listener, error) {
+	if listener, ok := inherited[name]; ok {
+		logger.Printf("Using inherited %v socket [%v]", name, listener.Addr())
+		return listener, nil
+	}
+
+	return listen(address, reusePort)
+}
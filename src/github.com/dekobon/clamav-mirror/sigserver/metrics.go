@@ -0,0 +1,135 @@
+package sigserver
+
+import (
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/metrics"
+)
+
+var servedRequests = metrics.Default.NewCounter("clamav_mirror_http_requests_total",
+	"Number of signature file requests by file type and status code.", "type", "status")
+var servedBytes = metrics.Default.NewCounter("clamav_mirror_http_response_bytes_total",
+	"Number of bytes of signature files sent by file type.", "type")
+var servedDuration = metrics.Default.NewHistogram("clamav_mirror_http_request_duration_seconds",
+	"Time taken to serve signature file requests by file type.", metrics.DurationBuckets, "type")
+var transfersInFlight = metrics.Default.NewGauge("clamav_mirror_http_transfers_in_flight",
+	"Number of signature file requests being served.")
+
+func init() {
+	accessLists := []*accessList{signatureAccess, apiAccess}
+
+	for _, list := range accessLists {
+		list := list
+		metrics.Default.NewCounterFunc("clamav_mirror_access_denied_total",
+			"Number of requests denied by each access list.", metrics.Labels{"list": list.name},
+			func() float64 { return float64(list.deniedCount()) })
+	}
+
+	limitCounters := map[string]*uint64{
+		"request_rate":  &rateLimitedRequests,
+		"bandwidth":     &throttledResponses,
+		"cvd_transfers": &cvdTransfersRefused,
+	}
+
+	for limit, counter := range limitCounters {
+		counter := counter
+		metrics.Default.NewCounterFunc("clamav_mirror_client_limit_hits_total",
+			"Number of requests refused or slowed down by each client limit.",
+			metrics.Labels{"limit": limit},
+			func() float64 { return float64(atomic.LoadUint64(counter)) })
+	}
+}
+
+// Function that returns the type of a requested file used to label metrics:
+// its extension when it is one that we serve, or "other".
+func requestFileType(r *http.Request) string {
+	extension := strings.TrimPrefix(filepath.Ext(r.URL.Path), ".")
+
+	if extension != "" && allowedFileExtension("."+extension) {
+		return extension
+	}
+
+	return "other"
+}
+
+// Function that wraps a handler so that the requests that it serves are
+// counted by status code and the bytes sent are recorded.
+func withMetrics(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileType := requestFileType(r)
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+
+		transfersInFlight.Add(1)
+
+		defer func() {
+			transfersInFlight.Add(-1)
+			servedRequests.Inc(fileType, strconv.Itoa(recorder.status))
+			servedBytes.Add(float64(recorder.written), fileType)
+			servedDuration.Observe(time.Since(started).Seconds(), fileType)
+		}()
+
+		next(recorder, r)
+	}
+}
+
+// statusRecorder remembers the status code and number of bytes of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	written     int64
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+
+	return n, err
+}
+
+/* Function that copies a response body from a reader. http.ServeContent uses
+ * this when the writer has it, and the underlying writer then sends files
+ * with sendfile rather than copying them through user space. */
+func (w *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.wroteHeader = true
+
+	var n int64
+	var err error
+
+	if readerFrom, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = readerFrom.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
+	}
+
+	w.written += n
+
+	return n, err
+}
+
+// Function that flushes buffered data to the client, so that pull-through
+// downloads are streamed as they arrive.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
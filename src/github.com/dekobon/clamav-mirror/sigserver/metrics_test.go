@@ -0,0 +1,126 @@
+package sigserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/metrics"
+)
+
+func TestStatusAndBytesWithMetrics(t *testing.T) {
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+
+	ok := servedRequests.Value("cdiff", "200")
+	notModified := servedRequests.Value("cvd", "304")
+	bytesSent := servedBytes.Value("cdiff")
+
+	wrapped := withMetrics(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Write([]byte("0123456789"))
+	})
+
+	wrapped(httptest.NewRecorder(), httptest.NewRequest("GET", "/daily-5.cdiff", nil))
+
+	r := httptest.NewRequest("GET", "/daily.cvd", nil)
+	r.Header.Set("If-None-Match", `"abc"`)
+	wrapped(httptest.NewRecorder(), r)
+
+	if servedRequests.Value("cdiff", "200") != ok+1 {
+		t.Error("Expected the .cdiff request to be counted with status 200")
+	}
+
+	if servedRequests.Value("cvd", "304") != notModified+1 {
+		t.Error("Expected the .cvd request to be counted with status 304")
+	}
+
+	if servedBytes.Value("cdiff") != bytesSent+10 {
+		t.Errorf("Expected 10 more bytes to be counted. Actual: %v",
+			servedBytes.Value("cdiff")-bytesSent)
+	}
+
+	if transfersInFlight.Value() != 0 {
+		t.Errorf("Expected no transfers in flight. Actual: %v", transfersInFlight.Value())
+	}
+}
+
+// readerFromRecorder is a response writer that records whether a response
+// was copied with ReadFrom.
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFrom bool
+}
+
+func (w *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestReadFromWithMetrics(t *testing.T) {
+	bytesSent := servedBytes.Value("cvd")
+
+	wrapped := withMetrics(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "daily.cvd", time.Now(), strings.NewReader("0123456789"))
+	})
+
+	writer := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	wrapped(writer, httptest.NewRequest("GET", "/daily.cvd", nil))
+
+	if !writer.readFrom {
+		t.Error("Expected the response to be copied with the writer's ReadFrom")
+	}
+
+	if writer.Body.String() != "0123456789" {
+		t.Errorf("Unexpected response body: %v", writer.Body.String())
+	}
+
+	if servedBytes.Value("cvd") != bytesSent+10 {
+		t.Errorf("Expected 10 more bytes to be counted. Actual: %v",
+			servedBytes.Value("cvd")-bytesSent)
+	}
+}
+
+func TestRequestFileType(t *testing.T) {
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+
+	cases := map[string]string{
+		"/main.cvd":      "cvd",
+		"/daily-2.cdiff": "cdiff",
+		"/../etc/passwd": "other",
+		"/index.html":    "other",
+		"/no-extension":  "other",
+	}
+
+	for path, expected := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = path
+
+		if actual := requestFileType(r); actual != expected {
+			t.Errorf("Unexpected type for [%v]. Expected: %v Actual: %v", path, expected, actual)
+		}
+	}
+}
+
+func TestAccessDeniedMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	metrics.Default.WriteTo(&buf)
+
+	for _, line := range []string{
+		`clamav_mirror_access_denied_total{list="signatures"} `,
+		`clamav_mirror_client_limit_hits_total{limit="cvd_transfers"} `,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected metrics to include [%v]", line)
+		}
+	}
+}
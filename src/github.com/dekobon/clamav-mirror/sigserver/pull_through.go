@@ -0,0 +1,507 @@
+package sigserver
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Configuration used to fetch files from upstream or nil when pull-through
+// is disabled
+var pullThroughConfig *sigupdate.Config
+
+/* Fetches that are in progress keyed by filename. Clients that request a file
+ * that is already being fetched are served from the same fetch rather than
+ * each client causing another download from upstream. */
+var pullThroughFetches = make(map[string]*pullThroughFetch)
+var pullThroughLock sync.Mutex
+
+/* Files that upstream answered 404 for, mapped to when they may be fetched
+ * again. This stops clients from asking upstream for the same missing file
+ * over and over. Guarded by pullThroughLock. */
+var pullThroughNotFound = make(map[string]time.Time)
+
+// How long a file that upstream doesn't have is reported as missing without
+// asking upstream again
+const pullThroughNotFoundTTL = 5 * time.Minute
+
+// Latest version of each signature advertised by ClamAV as of the last update
+var advertisedVersions = make(map[string]uint64)
+var advertisedVersionsLock sync.RWMutex
+
+/* Context of every fetch from upstream, which is cancelled when sigserver
+ * shuts down. Fetches aren't tied to the request of the client that started
+ * them because other clients may be streaming the same fetch. */
+var pullThroughContext, cancelPullThrough = context.WithCancel(context.Background())
+
+// Longest time that a fetch from upstream can take, including downloading
+// the file, before it is aborted
+const pullThroughTimeout = 30 * time.Minute
+
+// Size of the chunks copied from upstream before waiting clients are woken
+const pullThroughChunkSize = 32 * 1024
+
+// pullThroughFetch is a single download of a file from upstream that is
+// streamed to every client that requested it.
+type pullThroughFetch struct {
+	filename string
+	// Closed once the upstream has responded
+	ready chan struct{}
+	lock  sync.Mutex
+	cond  *sync.Cond
+	// Path of the file being written, which is the temporary file until the
+	// download has completed and then the file in the data directory.
+	path          string
+	written       int64
+	contentLength int64
+	lastModified  time.Time
+	statusCode    int
+	done          bool
+	err           error
+}
+
+/* Function that checks to see if a missing file should be fetched from
+ * upstream. Only cdiffs up to the advertised version of their signature can
+ * exist, so requests for later ones are answered without asking upstream. */
+func pullThroughAllowed(file string) bool {
+	if pullThroughConfig == nil {
+		return false
+	}
+
+	match := upstreamFilePattern.FindStringSubmatch(file)
+
+	if match == nil {
+		return false
+	}
+
+	if match[2] == "" {
+		return true
+	}
+
+	number, err := strconv.ParseUint(match[2], 10, 64)
+
+	return err == nil && number <= advertisedVersion(match[1])
+}
+
+// Function that records the versions advertised by ClamAV during an update.
+func recordAdvertisedVersions(result sigupdate.UpdateResult) {
+	advertisedVersionsLock.Lock()
+	defer advertisedVersionsLock.Unlock()
+
+	for _, signature := range result.Signatures {
+		if signature.AdvertisedVersion > 0 {
+			advertisedVersions[signature.Name] = signature.AdvertisedVersion
+		}
+	}
+}
+
+/* Function that returns the latest advertised version of a signature. Until
+ * an update has seen the advertised version, the version of the signature in
+ * the data directory is used, which is never ahead of it. */
+func advertisedVersion(name string) uint64 {
+	advertisedVersionsLock.RLock()
+	version, known := advertisedVersions[name]
+	advertisedVersionsLock.RUnlock()
+
+	if known {
+		return version
+	}
+
+	file, err := os.Open(filepath.Join(dataDirectory, name+".cvd"))
+
+	if err != nil {
+		return 0
+	}
+
+	defer file.Close()
+
+	header, err := parseCVDHeader(file)
+
+	if err != nil {
+		return 0
+	}
+
+	return header.Version
+}
+
+// Function that checks to see if upstream recently reported that it doesn't
+// have a file.
+func recentlyNotFound(file string, now time.Time) bool {
+	pullThroughLock.Lock()
+	defer pullThroughLock.Unlock()
+
+	until, found := pullThroughNotFound[file]
+
+	if found && !now.Before(until) {
+		delete(pullThroughNotFound, file)
+		return false
+	}
+
+	return found
+}
+
+// Function that remembers that upstream doesn't have a file. Entries that
+// have expired are dropped so that the cache doesn't grow without bound.
+func recordNotFound(file string, now time.Time) {
+	pullThroughLock.Lock()
+	defer pullThroughLock.Unlock()
+
+	for name, until := range pullThroughNotFound {
+		if !now.Before(until) {
+			delete(pullThroughNotFound, name)
+		}
+	}
+
+	pullThroughNotFound[file] = now.Add(pullThroughNotFoundTTL)
+}
+
+/* Function that returns the fetch of a file from upstream, starting it if
+ * the file isn't already being fetched. Nil is returned if the file was
+ * cached by a fetch that finished after the caller found it missing, so that
+ * the cached file isn't downloaded and overwritten again. */
+func startPullThroughFetch(file string) *pullThroughFetch {
+	pullThroughLock.Lock()
+	defer pullThroughLock.Unlock()
+
+	if fetch, ok := pullThroughFetches[file]; ok {
+		return fetch
+	}
+
+	if utils.Exists(filepath.Join(dataDirectory, file)) {
+		return nil
+	}
+
+	fetch := &pullThroughFetch{
+		filename:      file,
+		ready:         make(chan struct{}),
+		contentLength: -1,
+	}
+	fetch.cond = sync.NewCond(&fetch.lock)
+	pullThroughFetches[file] = fetch
+
+	go fetch.run(*pullThroughConfig)
+
+	return fetch
+}
+
+// Function that downloads the file from upstream into a temporary file in the
+// data directory and moves it into place once it is complete.
+func (fetch *pullThroughFetch) run(config sigupdate.Config) {
+	defer func() {
+		pullThroughLock.Lock()
+		delete(pullThroughFetches, fetch.filename)
+		pullThroughLock.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(pullThroughContext, pullThroughTimeout)
+	defer cancel()
+
+	upstreamFile, statusCode, err := sigupdate.OpenUpstreamFileContext(ctx, config, fetch.filename)
+
+	if err != nil {
+		fetch.finish(statusCode, err)
+		return
+	}
+
+	defer upstreamFile.Body.Close()
+
+	output, err := ioutil.TempFile(dataDirectory, "."+fetch.filename+"-")
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temporary file for [%v]", fetch.filename)
+		fetch.finish(http.StatusInternalServerError, errors.WrapPrefix(err, msg, 1))
+		return
+	}
+
+	defer output.Close()
+
+	fetch.lock.Lock()
+	fetch.path = output.Name()
+	fetch.contentLength = upstreamFile.ContentLength
+	fetch.lastModified = upstreamFile.LastModified
+	fetch.statusCode = statusCode
+	fetch.lock.Unlock()
+	close(fetch.ready)
+
+	if err := fetch.copy(output, upstreamFile); err != nil {
+		os.Remove(output.Name())
+		fetch.finish(statusCode, err)
+		return
+	}
+
+	logger.Printf("Pull-through complete: %v [%v] --> %v", fetch.filename,
+		upstreamFile.Source.Address, fetch.path)
+}
+
+// Function that copies the file from upstream, waking waiting clients after
+// each chunk. The file is verified and moved into the data directory once it
+// has been completely downloaded.
+func (fetch *pullThroughFetch) copy(output *os.File, upstreamFile sigupdate.UpstreamFile) error {
+	buf := make([]byte, pullThroughChunkSize)
+
+	for {
+		n, readErr := upstreamFile.Body.Read(buf)
+
+		if n > 0 {
+			if _, err := output.Write(buf[:n]); err != nil {
+				msg := fmt.Sprintf("Unable to write to temporary file [%v]", output.Name())
+				return errors.WrapPrefix(err, msg, 1)
+			}
+
+			fetch.lock.Lock()
+			fetch.written += int64(n)
+			fetch.cond.Broadcast()
+			fetch.lock.Unlock()
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+
+		if readErr != nil {
+			msg := fmt.Sprintf("Error fetching [%v] from upstream", fetch.filename)
+			return errors.WrapPrefix(readErr, msg, 1)
+		}
+	}
+
+	if upstreamFile.ContentLength >= 0 && fetch.written != upstreamFile.ContentLength {
+		return errors.Errorf("Fetched [%v] bytes of [%v] from upstream for [%v]",
+			fetch.written, upstreamFile.ContentLength, fetch.filename)
+	}
+
+	if strings.HasSuffix(fetch.filename, ".cvd") {
+		if err := verifyCVD(output.Name()); err != nil {
+			return err
+		}
+	}
+
+	os.Chtimes(output.Name(), upstreamFile.LastModified, upstreamFile.LastModified)
+
+	localFilePath := filepath.Join(dataDirectory, fetch.filename)
+
+	/* The path is switched while holding the lock so that a client that
+	 * opens the file after this point finds it in the data directory. */
+	fetch.lock.Lock()
+	defer fetch.lock.Unlock()
+
+	if err := os.Rename(output.Name(), localFilePath); err != nil {
+		msg := fmt.Sprintf("Unable to move [%v] into the data directory", fetch.filename)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	fetch.path = localFilePath
+	fetch.done = true
+	fetch.cond.Broadcast()
+
+	return nil
+}
+
+// Function that marks the fetch as failed and wakes any waiting clients.
+func (fetch *pullThroughFetch) finish(statusCode int, err error) {
+	logError.Printf("Unable to fetch [%v] from upstream. %v", fetch.filename, err)
+
+	if statusCode == http.StatusNotFound {
+		recordNotFound(fetch.filename, time.Now())
+	}
+
+	fetch.lock.Lock()
+	fetch.statusCode = statusCode
+	fetch.err = err
+	fetch.done = true
+	fetch.cond.Broadcast()
+	fetch.lock.Unlock()
+
+	select {
+	case <-fetch.ready:
+	default:
+		close(fetch.ready)
+	}
+}
+
+// Function that checks that the archive of a .cvd file matches the MD5 sum in
+// its header, so that a truncated or corrupted download isn't cached.
+func verifyCVD(localFilePath string) error {
+	file, err := os.Open(localFilePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open CVD file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	header, err := parseCVDHeader(file)
+
+	if err != nil {
+		return err
+	}
+
+	hash := md5.New()
+
+	if _, err := io.Copy(hash, file); err != nil {
+		msg := fmt.Sprintf("Unable to read CVD file [%v]", localFilePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, header.MD5) {
+		return errors.Errorf("MD5 of CVD file [%v] doesn't match its header. "+
+			"Expected: [%v] Actual: [%v]", localFilePath, header.MD5, sum)
+	}
+
+	return nil
+}
+
+// Function that serves a file that isn't in the data directory by fetching it
+// from upstream. The response is streamed to the client while the file is
+// downloading.
+func pullThroughHandler(w http.ResponseWriter, r *http.Request, file string) {
+	if !(r.Method == "GET" || r.Method == "HEAD") {
+		logger.Printf("[%v] {%v} %v DENIED", r.Method, clientName(r), r.URL)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if recentlyNotFound(file, time.Now()) {
+		logger.Printf("[%v] {%v} %v NOT FOUND (upstream)", r.Method, clientName(r), r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	fetch := startPullThroughFetch(file)
+
+	if fetch == nil {
+		serveDataFile(w, r, file, filepath.Join(dataDirectory, file))
+		return
+	}
+
+	<-fetch.ready
+
+	fetch.lock.Lock()
+	path := fetch.path
+	contentLength := fetch.contentLength
+	lastModified := fetch.lastModified
+	statusCode := fetch.statusCode
+	fetchErr := fetch.err
+	fetch.lock.Unlock()
+
+	if fetchErr != nil && path == "" {
+		/* Clients such as freshclam fall back to other files when a file
+		 * can't be found, so anything other than a server error is reported
+		 * as missing. */
+		if statusCode > 499 || statusCode < 0 {
+			w.WriteHeader(http.StatusBadGateway)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+
+		return
+	}
+
+	w.Header().Set("Last-Modified", lastModified.Truncate(time.Second).Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if modifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil &&
+		!modifiedSince.Before(lastModified.Truncate(time.Second)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if contentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
+	}
+
+	logger.Printf("[%v] {%v} %v --> %v (pull-through)", r.Method, clientName(r), r.URL, file)
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	fetch.stream(w)
+}
+
+// Function that writes the file to a client as it is downloaded. If the fetch
+// fails part way through, the connection is aborted so that the client
+// doesn't mistake a partial file for a complete one.
+func (fetch *pullThroughFetch) stream(w http.ResponseWriter) {
+	fetch.lock.Lock()
+	reader, err := os.Open(fetch.path)
+	fetch.lock.Unlock()
+
+	if err != nil {
+		logError.Printf("Unable to open fetched file [%v]. %v", fetch.filename, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	defer reader.Close()
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, pullThroughChunkSize)
+	var offset int64
+
+	for {
+		fetch.lock.Lock()
+
+		for fetch.written == offset && !fetch.done {
+			fetch.cond.Wait()
+		}
+
+		written := fetch.written
+		done := fetch.done
+		fetchErr := fetch.err
+		fetch.lock.Unlock()
+
+		if fetchErr != nil {
+			panic(http.ErrAbortHandler)
+		}
+
+		for offset < written {
+			size := written - offset
+
+			if size > int64(len(buf)) {
+				size = int64(len(buf))
+			}
+
+			n, err := reader.ReadAt(buf[:size], offset)
+
+			if n > 0 {
+				if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+					return
+				}
+
+				offset += int64(n)
+			}
+
+			if n == 0 || (err != nil && err != io.EOF) {
+				logError.Printf("Error reading fetched file [%v]. %v", fetch.filename, err)
+				panic(http.ErrAbortHandler)
+			}
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package sigserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+)
+
+// Function that configures pull-through to fetch from the given upstream
+// into a temporary data directory.
+func setupPullThrough(t *testing.T, upstreamURL string) string {
+	dir, err := ioutil.TempDir("", "pull-through-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(upstreamURL)
+	dataDirectory = dir
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+	pullThroughConfig = &sigupdate.Config{
+		DataFilePath: dir,
+		Upstreams:    []sigupdate.Upstream{{URL: u}},
+	}
+	recordAdvertisedVersions(sigupdate.UpdateResult{
+		Signatures: []sigupdate.SignatureResult{{Name: "daily", AdvertisedVersion: 20}},
+	})
+
+	return dir
+}
+
+func teardownPullThrough(dir string) {
+	pullThroughConfig = nil
+	advertisedVersions = make(map[string]uint64)
+	pullThroughNotFound = make(map[string]time.Time)
+	os.RemoveAll(dir)
+}
+
+func TestCoalescedPullThroughHandler(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	contents := strings.Repeat("cdiff", 20000)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Length", fmt.Sprint(len(contents)))
+		w.Write([]byte(contents[:1000]))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(contents[1000:]))
+	}))
+	defer upstream.Close()
+
+	dir := setupPullThrough(t, upstream.URL)
+	defer teardownPullThrough(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 3)
+
+	for i := range bodies {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			response, err := http.Get(server.URL + "/daily-10.cdiff")
+
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			defer response.Body.Close()
+			body, _ := ioutil.ReadAll(response.Body)
+			bodies[i] = string(body)
+		}(i)
+	}
+
+	// Wait for the fetch to start before letting the upstream finish
+	for atomic.LoadInt32(&requests) == 0 {
+		runtime.Gosched()
+	}
+
+	close(release)
+	wg.Wait()
+
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("Expected a single request to upstream. Actual: %v", count)
+	}
+
+	for i, body := range bodies {
+		if body != contents {
+			t.Errorf("Client [%d] received [%d] bytes. Expected [%d]", i, len(body), len(contents))
+		}
+	}
+
+	cached, err := ioutil.ReadFile(filepath.Join(dir, "daily-10.cdiff"))
+
+	if err != nil || string(cached) != contents {
+		t.Errorf("Expected the fetched file to be cached in the data directory. %v", err)
+	}
+}
+
+func TestCachedPullThroughHandler(t *testing.T) {
+	var requests int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("upstream"))
+	}))
+	defer upstream.Close()
+
+	dir := setupPullThrough(t, upstream.URL)
+	defer teardownPullThrough(dir)
+
+	// A fetch finished between the request finding the file missing and
+	// starting a fetch of its own
+	ioutil.WriteFile(filepath.Join(dir, "daily-10.cdiff"), []byte("cached"), 0644)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/daily-10.cdiff", nil)
+	pullThroughHandler(recorder, request, "daily-10.cdiff")
+
+	if count := atomic.LoadInt32(&requests); count != 0 {
+		t.Errorf("Expected the cached file not to be fetched again. Actual: %v requests", count)
+	}
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "cached" {
+		t.Errorf("Expected the cached file to be served. Actual: %v %v", recorder.Code,
+			recorder.Body.String())
+	}
+}
+
+func TestMissingPullThroughHandler(t *testing.T) {
+	var requests int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+
+	dir := setupPullThrough(t, upstream.URL)
+	defer teardownPullThrough(dir)
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", "/daily-11.cdiff", nil))
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for a file missing upstream. Actual: %v", recorder.Code)
+		}
+	}
+
+	// The second request is answered from the cache of missing files
+	if requests != 1 {
+		t.Errorf("Expected a single request to upstream. Actual: %v", requests)
+	}
+
+	pullThroughNotFound["daily-11.cdiff"] = time.Now()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/daily-11.cdiff", nil))
+
+	if recorder.Code != http.StatusNotFound || requests != 2 {
+		t.Errorf("Expected upstream to be asked again once the cache expired. "+
+			"Requests: %v", requests)
+	}
+
+	// Files that don't look like signatures are never fetched
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/local.hdb", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a non-signature file. Actual: %v", recorder.Code)
+	}
+}
+
+func TestAdvertisedVersionPullThroughHandler(t *testing.T) {
+	var requests int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("cdiff"))
+	}))
+	defer upstream.Close()
+
+	dir := setupPullThrough(t, upstream.URL)
+	defer teardownPullThrough(dir)
+
+	// Neither cdiffs after the advertised version nor those of a signature
+	// with no known version can exist upstream
+	for _, file := range []string{"daily-21.cdiff", "daily-999999999.cdiff", "main-59.cdiff"} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", "/"+file, nil))
+
+		if recorder.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for [%v]. Actual: %v", file, recorder.Code)
+		}
+	}
+
+	if requests != 0 {
+		t.Errorf("Expected no requests to upstream. Actual: %v", requests)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/daily-20.cdiff", nil))
+
+	if recorder.Code != http.StatusOK || requests != 1 {
+		t.Errorf("Expected the advertised cdiff to be fetched. Status: %v Requests: %v",
+			recorder.Code, requests)
+	}
+}
+
+func TestCancelledPullThroughHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never respond until the request is aborted
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+
+	dir := setupPullThrough(t, upstream.URL)
+	defer teardownPullThrough(dir)
+
+	pullThroughContext, cancelPullThrough = context.WithCancel(context.Background())
+	defer func() {
+		pullThroughContext, cancelPullThrough = context.WithCancel(context.Background())
+	}()
+
+	time.AfterFunc(100*time.Millisecond, cancelPullThrough)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/daily-10.cdiff", nil))
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("Expected 502 once the fetch was aborted. Actual: %v", recorder.Code)
+	}
+}
+
+func TestVerifyCVD(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "verify-cvd-")
+	defer os.RemoveAll(dir)
+
+	archive := []byte("archive contents")
+	sum := md5.Sum(archive)
+	header := fmt.Sprintf("ClamAV-VDB:02 Jan 2006 15-04 -0700:10:1:90:%v:dsig:tester:1136239440",
+		hex.EncodeToString(sum[:]))
+	contents := bytes.NewBufferString(header + strings.Repeat(" ", cvdHeaderSize-len(header)))
+	contents.Write(archive)
+
+	path := filepath.Join(dir, "daily.cvd")
+	ioutil.WriteFile(path, contents.Bytes(), 0644)
+
+	if err := verifyCVD(path); err != nil {
+		t.Errorf("Expected a valid CVD to be verified. %v", err)
+	}
+
+	ioutil.WriteFile(path, contents.Bytes()[:contents.Len()-1], 0644)
+
+	if err := verifyCVD(path); err == nil {
+		t.Error("Expected a truncated CVD to be rejected")
+	}
+}
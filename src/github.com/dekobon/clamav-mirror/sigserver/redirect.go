@@ -0,0 +1,63 @@
+package sigserver
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Upstream that clients are redirected to for missing files or nil when
+// redirects are disabled
+var redirectMissingURL *url.URL
+
+// Limits how often clients are redirected to the upstream
+var redirectLimiter *utils.TokenBucket
+
+// Function that enables redirecting clients to an upstream for signature
+// files that aren't in the data directory. No more than the given number of
+// redirects are sent per minute.
+func configureMissingFileRedirect(upstreamURL *url.URL, perMinute uint16) {
+	redirectMissingURL = upstreamURL
+
+	if upstreamURL != nil {
+		redirectLimiter = utils.NewIntervalTokenBucket(uint64(perMinute), time.Minute)
+	}
+}
+
+// Function that checks to see if clients should be redirected to an upstream
+// for a missing file.
+func missingFileRedirectAllowed(file string) bool {
+	return redirectMissingURL != nil && upstreamFilePattern.MatchString(file)
+}
+
+// Function that redirects a client to the upstream for a file that isn't in
+// the data directory. Once the rate limit has been reached, clients are told
+// that the file can't be found as they would be without redirects.
+func missingFileRedirectHandler(w http.ResponseWriter, r *http.Request, file string) {
+	if !(r.Method == "GET" || r.Method == "HEAD") {
+		logger.Printf("[%v] {%v} %v DENIED", r.Method, clientName(r), r.URL)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !redirectLimiter.TryTake(1) {
+		logger.Printf("[%v] {%v} %v (404 Not Found - redirect rate limit reached)",
+			r.Method, clientName(r), r.URL)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	location := *redirectMissingURL
+	location.Path = strings.TrimSuffix(location.Path, "/") + "/" + file
+	location.RawPath = ""
+
+	logger.Printf("[%v] {%v} %v --> %v (302 Found)", r.Method, clientName(r), r.URL,
+		location.String())
+
+	http.Redirect(w, r, location.String(), http.StatusFound)
+}
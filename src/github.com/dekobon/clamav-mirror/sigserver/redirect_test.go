@@ -0,0 +1,74 @@
+package sigserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestRateLimitedMissingFileRedirectHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "redirect-")
+	defer os.RemoveAll(dir)
+
+	dataDirectory = dir
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+
+	upstreamURL, err := parseRedirectURL("db.us.clamav.net/clamav/")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configureMissingFileRedirect(upstreamURL, 1)
+	defer configureMissingFileRedirect(nil, 0)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/daily-10.cdiff", nil))
+
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect for a missing file. Actual: %v", recorder.Code)
+	}
+
+	if location := recorder.Header().Get("Location"); location !=
+		"http://db.us.clamav.net/clamav/daily-10.cdiff" {
+		t.Errorf("Unexpected redirect location: %v", location)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/daily-11.cdiff", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 once the redirect rate limit is reached. Actual: %v", recorder.Code)
+	}
+}
+
+func TestNonSignatureMissingFileRedirectHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "redirect-")
+	defer os.RemoveAll(dir)
+
+	dataDirectory = dir
+	allowedFileExtensions = defaultConfig.AllowedFileExtensions
+
+	upstreamURL, _ := parseRedirectURL("http://db.us.clamav.net")
+	configureMissingFileRedirect(upstreamURL, 10)
+	defer configureMissingFileRedirect(nil, 0)
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/custom.hdb", nil))
+
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a file that upstreams don't publish. Actual: %v", recorder.Code)
+	}
+}
+
+func TestInvalidParseRedirectURL(t *testing.T) {
+	if _, err := parseRedirectURL("ftp://db.us.clamav.net"); err == nil {
+		t.Error("Expected a non-HTTP redirect URL to be rejected")
+	}
+
+	if u, err := parseRedirectURL(""); u != nil || err != nil {
+		t.Errorf("Expected an empty redirect URL to disable redirects. Actual: %v %v", u, err)
+	}
+}
@@ -0,0 +1,51 @@
+package sigserver
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+/* Functions that are run when sigserver is asked to reload with SIGHUP. Each
+ * component that can be reloaded without restarting registers a function
+ * here, so that a single signal reloads everything. */
+var reloadHooks []func()
+var reloadHooksLock sync.Mutex
+var reloadSignalOnce sync.Once
+
+// Function that registers a function to be run when sigserver is reloaded.
+func onReload(hook func()) {
+	reloadHooksLock.Lock()
+	defer reloadHooksLock.Unlock()
+
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// Function that runs every registered reload function in the order that they
+// were registered.
+func runReloadHooks() {
+	reloadHooksLock.Lock()
+	hooks := append([]func(){}, reloadHooks...)
+	reloadHooksLock.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Function that starts listening for SIGHUP, running the reload functions
+// each time that it is received.
+func watchReloadSignal() {
+	reloadSignalOnce.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGHUP)
+
+		go func() {
+			for range signals {
+				logger.Println("Received SIGHUP - reloading")
+				runReloadHooks()
+			}
+		}()
+	})
+}
@@ -0,0 +1,221 @@
+package sigserver
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/robfig/cron"
+)
+
+/* updateScheduler starts signature updates on a schedule. Each run is
+ * delayed by a random amount of up to the jitter, so that a fleet of mirrors
+ * sharing a schedule don't all contact upstream at the same moment. When an
+ * update fails, it is retried with an exponential backoff rather than
+ * waiting for the next scheduled run. */
+type updateScheduler struct {
+	lock     sync.Mutex
+	schedule cron.Schedule
+	jitter   time.Duration
+	backoff  time.Duration
+	random   func(n int64) int64
+	changed  chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// Function that creates a scheduler for an update schedule spec.
+func newUpdateScheduler(spec string, jitter time.Duration, backoff time.Duration) (*updateScheduler, error) {
+	schedule, err := parseUpdateSchedule(spec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &updateScheduler{
+		schedule: schedule,
+		jitter:   jitter,
+		backoff:  backoff,
+		random:   rand.Int63n,
+		changed:  make(chan struct{}, 1),
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// Function that changes the schedule, jitter and backoff of a scheduler that
+// may already be running. The next update is rescheduled straight away.
+func (s *updateScheduler) reschedule(spec string, jitter time.Duration, backoff time.Duration) error {
+	schedule, err := parseUpdateSchedule(spec)
+
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.schedule = schedule
+	s.jitter = jitter
+	s.backoff = backoff
+	s.lock.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Function that parses an update schedule. A schedule is either a duration
+// between updates such as "30m", a standard five field cron expression such
+// as "15 */4 * * *" or a descriptor such as "@hourly" or "@every 2h".
+func parseUpdateSchedule(spec string) (cron.Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if interval, err := time.ParseDuration(spec); err == nil {
+		if interval < time.Minute {
+			return nil, errors.Errorf("Update interval [%v] must be at least one minute", spec)
+		}
+
+		return cron.Every(interval), nil
+	}
+
+	schedule, err := cron.ParseStandard(spec)
+
+	if err != nil {
+		msg := fmt.Sprintf("Invalid update schedule [%v]", spec)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return schedule, nil
+}
+
+// Function that returns the schedule used when only an hourly interval is
+// configured.
+func hourlyUpdateSchedule(hours uint16) string {
+	return fmt.Sprintf("@every %dh", hours)
+}
+
+// Function that returns the time of the next scheduled update after a time,
+// including a random jitter.
+func (s *updateScheduler) next(now time.Time) time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	next := s.schedule.Next(now)
+
+	if s.jitter > 0 {
+		next = next.Add(time.Duration(s.random(int64(s.jitter))))
+	}
+
+	return next
+}
+
+/* Function that returns when to retry after a number of consecutive failed
+ * updates. The delay doubles with each failure, but a retry never happens
+ * later than the next scheduled update. */
+func (s *updateScheduler) retry(failures uint, now time.Time) time.Time {
+	scheduled := s.next(now)
+
+	s.lock.Lock()
+	delay := s.backoff
+	s.lock.Unlock()
+
+	if delay <= 0 || failures == 0 {
+		return scheduled
+	}
+
+	for i := uint(1); i < failures && delay < scheduled.Sub(now); i++ {
+		delay *= 2
+	}
+
+	if retry := now.Add(delay); retry.Before(scheduled) {
+		return retry
+	}
+
+	return scheduled
+}
+
+/* Function that returns the typical time between scheduled updates, which
+ * is used to decide how old signatures can be before sigserver isn't ready.
+ * Cron expressions can have uneven gaps, so the longest of the next few
+ * gaps is used. */
+func (s *updateScheduler) interval(now time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var longest time.Duration
+	previous := s.schedule.Next(now)
+
+	for i := 0; i < 24; i++ {
+		next := s.schedule.Next(previous)
+
+		if gap := next.Sub(previous); gap > longest {
+			longest = gap
+		}
+
+		previous = next
+	}
+
+	return longest + s.jitter
+}
+
+/* Function that starts updates at each scheduled time until the scheduler is
+ * stopped, given the number of updates that have already failed in a row. A
+ * scheduled update is skipped while another update is running. When the
+ * schedule changes, the next update is rescheduled. */
+func (s *updateScheduler) run(runner *updateRunner, failures uint) {
+	next := s.retry(failures, time.Now())
+
+	for {
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-s.stopped:
+			timer.Stop()
+			return
+		case <-s.changed:
+			timer.Stop()
+			next = s.retry(failures, time.Now())
+			continue
+		case <-timer.C:
+		}
+
+		status, done, started := runner.start(triggerSchedule)
+
+		if !started && status.ID == 0 {
+			return
+		} else if !started {
+			logger.Printf("Skipping scheduled update because update [%v] is still running",
+				status.ID)
+			next = s.next(time.Now())
+			continue
+		}
+
+		status = <-done
+
+		if status.State == updateFailed {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		next = s.retry(failures, time.Now())
+
+		if failures > 0 {
+			logger.Printf("Signature update failed %v times in a row. Retrying at %v",
+				failures, next.Format(time.RFC3339))
+		} else if verboseMode {
+			logger.Printf("Next signature update at %v", next.Format(time.RFC3339))
+		}
+	}
+}
+
+// Function that stops the scheduler from starting any more updates.
+func (s *updateScheduler) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
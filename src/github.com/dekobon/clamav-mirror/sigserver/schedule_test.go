@@ -0,0 +1,107 @@
+package sigserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseUpdateSchedule(t *testing.T) {
+	now := time.Date(2017, 7, 27, 10, 7, 0, 0, time.UTC)
+
+	cases := map[string]time.Time{
+		"30m":           now.Add(30 * time.Minute),
+		"@every 2h":     now.Add(2 * time.Hour),
+		"15 */4 * * *":  time.Date(2017, 7, 27, 12, 15, 0, 0, time.UTC),
+		"@daily":        time.Date(2017, 7, 28, 0, 0, 0, 0, time.UTC),
+		" 0 3 * * 1-5 ": time.Date(2017, 7, 28, 3, 0, 0, 0, time.UTC),
+	}
+
+	for spec, expected := range cases {
+		schedule, err := parseUpdateSchedule(spec)
+
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%v]: %v", spec, err)
+			continue
+		}
+
+		if next := schedule.Next(now); !next.Equal(expected) {
+			t.Errorf("Unexpected next update for [%v]. Expected: %v Actual: %v",
+				spec, expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "10s", "every 30 minutes", "* * *", "61 * * * *"} {
+		if _, err := parseUpdateSchedule(spec); err == nil {
+			t.Errorf("Expected update schedule [%v] to be rejected", spec)
+		}
+	}
+}
+
+func TestJitterNext(t *testing.T) {
+	scheduler, _ := newUpdateScheduler("1h", 10*time.Minute, 0)
+	scheduler.random = func(n int64) int64 { return n - 1 }
+	now := time.Date(2017, 7, 27, 10, 0, 0, 0, time.UTC)
+
+	next := scheduler.next(now)
+
+	if next.Sub(now) != 70*time.Minute-time.Nanosecond {
+		t.Errorf("Expected the jitter to delay the update. Actual: %v", next.Sub(now))
+	}
+
+	if interval := scheduler.interval(now); interval != 70*time.Minute {
+		t.Errorf("Expected the interval to include the jitter. Actual: %v", interval)
+	}
+}
+
+func TestBackoffRetry(t *testing.T) {
+	scheduler, _ := newUpdateScheduler("4h", 0, 5*time.Minute)
+	now := time.Date(2017, 7, 27, 10, 0, 0, 0, time.UTC)
+
+	expected := []time.Duration{4 * time.Hour, 5 * time.Minute, 10 * time.Minute,
+		20 * time.Minute, 40 * time.Minute, 80 * time.Minute, 160 * time.Minute,
+		4 * time.Hour, 4 * time.Hour}
+
+	for failures, delay := range expected {
+		if retry := scheduler.retry(uint(failures), now); retry.Sub(now) != delay {
+			t.Errorf("Unexpected retry after %v failures. Expected: %v Actual: %v",
+				failures, delay, retry.Sub(now))
+		}
+	}
+
+	scheduler.backoff = 0
+
+	if retry := scheduler.retry(3, now); retry.Sub(now) != 4*time.Hour {
+		t.Errorf("Expected failed updates to wait for the schedule without a backoff. "+
+			"Actual: %v", retry.Sub(now))
+	}
+}
+
+func TestCronInterval(t *testing.T) {
+	scheduler, _ := newUpdateScheduler("0 1,13,19 * * *", 0, 0)
+	now := time.Date(2017, 7, 27, 10, 0, 0, 0, time.UTC)
+
+	if interval := scheduler.interval(now); interval != 12*time.Hour {
+		t.Errorf("Expected the longest gap between updates. Actual: %v", interval)
+	}
+}
+
+func TestRescheduleNext(t *testing.T) {
+	scheduler, _ := newUpdateScheduler("1h", 0, 0)
+	now := time.Date(2017, 7, 27, 10, 0, 0, 0, time.UTC)
+
+	if err := scheduler.reschedule("15 */4 * * *", 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if next := scheduler.next(now); !next.Equal(time.Date(2017, 7, 27, 12, 15, 0, 0, time.UTC)) {
+		t.Errorf("Expected the new schedule to be used. Actual: %v", next)
+	}
+
+	if retry := scheduler.retry(1, now); retry.Sub(now) != time.Minute {
+		t.Errorf("Expected the new backoff to be used. Actual: %v", retry.Sub(now))
+	}
+
+	if err := scheduler.reschedule("every now and then", 0, 0); err == nil {
+		t.Error("Expected an invalid schedule to be rejected")
+	}
+}
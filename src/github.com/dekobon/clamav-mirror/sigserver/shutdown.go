@@ -0,0 +1,64 @@
+package sigserver
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Function that returns a channel that receives the signals asking sigserver
+// to shut down.
+func watchShutdownSignal() <-chan os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	return signals
+}
+
+/* Function that shuts sigserver down gracefully. No more updates are started
+ * and a running update is cancelled, while the servers stop accepting
+ * connections and wait for requests in progress, such as .cvd downloads, to
+ * finish. Connections that are still open once the timeout has passed are
+ * closed and fetches from upstream are aborted. */
+func shutdown(servers []*http.Server, scheduler *updateScheduler, timeout time.Duration) {
+	scheduler.stop()
+	updateStopped := updates.shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		<-ctx.Done()
+		cancelPullThrough()
+	}()
+
+	var wg sync.WaitGroup
+
+	for _, server := range servers {
+		wg.Add(1)
+
+		go func(server *http.Server) {
+			defer wg.Done()
+
+			if err := server.Shutdown(ctx); err != nil {
+				logError.Printf("Closing connections to [%v] that didn't finish before "+
+					"the shutdown timeout. %v", server.Addr, err)
+				server.Close()
+			}
+		}(server)
+	}
+
+	wg.Wait()
+
+	select {
+	case <-updateStopped:
+	case <-ctx.Done():
+		logError.Println("The signature update didn't stop before the shutdown timeout")
+	}
+
+	logger.Println("Shutdown complete")
+}
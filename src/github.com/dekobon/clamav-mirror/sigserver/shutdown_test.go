@@ -0,0 +1,136 @@
+package sigserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// Function that serves a handler that waits to be released on a new listener.
+func startBlockingServer(t *testing.T, release chan struct{}) (*http.Server, string) {
+	listener, err := listen("127.0.0.1:0", false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte(" complete"))
+	})}
+
+	go server.Serve(listener)
+
+	return server, "http://" + listener.Addr().String() + "/daily.cvd"
+}
+
+func TestDrainShutdown(t *testing.T) {
+	defer useBlockingUpdates()()
+
+	release := make(chan struct{})
+	server, url := startBlockingServer(t, release)
+
+	response, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	updates.start(triggerSchedule)
+	scheduler, _ := newUpdateScheduler("1h", 0, 0)
+	finished := make(chan struct{})
+
+	go func() {
+		shutdown([]*http.Server{server}, scheduler, 5*time.Second)
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		t.Fatal("Expected shutdown to wait for the download in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	<-finished
+
+	if body, _ := ioutil.ReadAll(response.Body); string(body) != "partial complete" {
+		t.Errorf("Expected the download to complete. Actual: %q", body)
+	}
+
+	if last := updates.status().Last; last == nil || last.State != updateCancelled {
+		t.Errorf("Expected the running update to be cancelled. Actual: %+v", last)
+	}
+
+	if _, _, started := updates.start(triggerAdmin); started {
+		t.Error("Expected no updates to start after shutting down")
+	}
+}
+
+func TestTimeoutShutdown(t *testing.T) {
+	defer useBlockingUpdates()()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	server, url := startBlockingServer(t, release)
+	response, err := http.Get(url)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer response.Body.Close()
+
+	scheduler, _ := newUpdateScheduler("1h", 0, 0)
+	started := time.Now()
+
+	shutdown([]*http.Server{server}, scheduler, 50*time.Millisecond)
+
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("Expected shutdown to stop waiting after the timeout. Actual: %v", elapsed)
+	}
+}
+
+func TestReusePortListen(t *testing.T) {
+	first, err := listen("127.0.0.1:0", true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer first.Close()
+
+	second, err := listen(first.Addr().String(), true)
+
+	if err != nil {
+		t.Fatalf("Expected a second listener on the same port. %v", err)
+	}
+
+	second.Close()
+
+	if third, err := listen(first.Addr().String(), false); err == nil {
+		third.Close()
+		t.Error("Expected the port to be in use without SO_REUSEPORT")
+	}
+}
+
+func TestNotForUsInheritedListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+
+	listeners, err := inheritedListeners()
+
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Expected sockets passed to another process to be ignored. Actual: %v %v",
+			listeners, err)
+	}
+}
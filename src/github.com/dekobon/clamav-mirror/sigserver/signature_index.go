@@ -0,0 +1,534 @@
+package sigserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Maximum number of results that a single search request may return
+const maxSignatureSearchResults = 1000
+
+// Default number of results returned when no limit is specified
+const defaultSignatureSearchResults = 100
+
+// signatureNameField describes where to find a signature's name within a
+// single line of a database file.
+type signatureNameField struct {
+	separator string
+	index     int
+}
+
+/* Mapping of database file extensions to the location of the signature name
+ * within each line. Database types without signature names (e.g. bytecode,
+ * phishing and whitelist databases) are not indexed. */
+var signatureNameFields = map[string]signatureNameField{
+	".db":  {"=", 0},
+	".hdb": {":", 2},
+	".hdu": {":", 2},
+	".hsb": {":", 2},
+	".hsu": {":", 2},
+	".mdb": {":", 2},
+	".mdu": {":", 2},
+	".msb": {":", 2},
+	".msu": {":", 2},
+	".ndb": {":", 0},
+	".ndu": {":", 0},
+	".cdb": {":", 0},
+	".idb": {":", 0},
+	".ldb": {";", 0},
+	".ldu": {";", 0},
+	".crb": {";", 0},
+}
+
+// SignatureSearchResult is a single signature returned from a search of the
+// signature index.
+type SignatureSearchResult struct {
+	Name     string `json:"name"`
+	Database string `json:"database"`
+	Source   string `json:"source"`
+	Version  uint64 `json:"version"`
+}
+
+// SignatureSearchResponse is the response body returned by the signature
+// search API.
+type SignatureSearchResponse struct {
+	Query     string                  `json:"query"`
+	Match     string                  `json:"match"`
+	Total     int                     `json:"total"`
+	Truncated bool                    `json:"truncated"`
+	IndexedAt time.Time               `json:"indexed_at"`
+	Results   []SignatureSearchResult `json:"results"`
+}
+
+// signatureIndexEntry is a compact representation of a single signature. The
+// database and source names are stored as offsets into the index's name
+// tables because there are millions of entries and only a handful of names.
+type signatureIndexEntry struct {
+	name     string
+	database uint16
+	source   uint16
+	version  uint64
+}
+
+// signatureIndex is a sorted, searchable list of signature names.
+type signatureIndex struct {
+	entries   []signatureIndexEntry
+	databases []string
+	sources   []string
+	builtAt   time.Time
+}
+
+var signatureIndexLock sync.RWMutex
+var currentSignatureIndex *signatureIndex
+
+// Function that rebuilds the signature index from the files in the data
+// directory and swaps it in place of the existing index.
+func rebuildSignatureIndex(dataFilePath string) {
+	start := time.Now()
+	index, err := buildSignatureIndex(dataFilePath)
+
+	if err != nil {
+		logError.Printf("Error building signature index: %v", err)
+		return
+	}
+
+	signatureIndexLock.Lock()
+	currentSignatureIndex = index
+	signatureIndexLock.Unlock()
+
+	logger.Printf("Indexed [%v] signature names in %v", len(index.entries),
+		time.Since(start))
+}
+
+// Function that reads all of the signature names from the .cvd files in the
+// given directory along with any .cdiff files newer than each .cvd file.
+// Signatures found in a .cvd are recorded with the .cvd's version because
+// the exact version that they were introduced in is no longer available.
+func buildSignatureIndex(dataFilePath string) (*signatureIndex, error) {
+	index := &signatureIndex{builtAt: time.Now().UTC()}
+	databaseIDs := make(map[string]uint16)
+	sourceIDs := make(map[string]uint16)
+
+	intern := func(name string, ids map[string]uint16, names *[]string) uint16 {
+		if id, ok := ids[name]; ok {
+			return id
+		}
+
+		id := uint16(len(*names))
+		ids[name] = id
+		*names = append(*names, name)
+		return id
+	}
+
+	/* Every signature read is added to this pool and each line of a
+	 * database refers to its signature by offset (or -1 for lines without
+	 * a signature name). Tracking lines rather than names lets us apply the
+	 * line numbered DEL and XCHG commands found in cdiffs. */
+	var pool []signatureIndexEntry
+
+	add := func(line string, database string, source string, version uint64) int32 {
+		name, ok := signatureNameFromLine(database, line)
+
+		if !ok {
+			return -1
+		}
+
+		pool = append(pool, signatureIndexEntry{
+			name:     name,
+			database: intern(database, databaseIDs, &index.databases),
+			source:   intern(source, sourceIDs, &index.sources),
+			version:  version,
+		})
+
+		return int32(len(pool) - 1)
+	}
+
+	files, err := ioutil.ReadDir(dataFilePath)
+
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "Unable to list data directory", 1)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".cvd") {
+			continue
+		}
+
+		cvdPath := filepath.Join(dataFilePath, file.Name())
+		header, err := readCVDHeader(cvdPath)
+
+		if err != nil {
+			logError.Printf("Skipping [%v] while indexing signatures: %v", cvdPath, err)
+			continue
+		}
+
+		lines := make(map[string][]int32)
+
+		err = forEachCVDEntry(cvdPath, func(database string, reader io.Reader) error {
+			if _, ok := signatureNameFields[filepath.Ext(database)]; !ok {
+				return nil
+			}
+
+			return forEachLine(reader, func(line string) {
+				lines[database] = append(lines[database], add(line, database, file.Name(), header.Version))
+			})
+		})
+
+		if err != nil {
+			logError.Printf("Error reading [%v] while indexing signatures: %v", cvdPath, err)
+			continue
+		}
+
+		prefix := strings.TrimSuffix(file.Name(), ".cvd")
+
+		for _, cdiff := range cdiffsNewerThan(files, prefix, header.Version) {
+			cdiffPath := filepath.Join(dataFilePath, cdiff.filename)
+			edit := newCdiffEdit("")
+
+			err := forEachCdiffLine(cdiffPath, func(line string) error {
+				switch {
+				case strings.HasPrefix(line, "OPEN "):
+					edit = newCdiffEdit(strings.TrimSpace(strings.TrimPrefix(line, "OPEN ")))
+				case strings.HasPrefix(line, "CLOSE"):
+					edit.apply(lines, func(line string) int32 {
+						return add(line, edit.database, cdiff.filename, cdiff.version)
+					})
+					edit = newCdiffEdit("")
+				default:
+					edit.record(line)
+				}
+
+				return nil
+			})
+
+			if err != nil {
+				logError.Printf("Error reading [%v] while indexing signatures: %v", cdiffPath, err)
+			}
+		}
+
+		for _, databaseLines := range lines {
+			for _, offset := range databaseLines {
+				if offset >= 0 {
+					index.entries = append(index.entries, pool[offset])
+				}
+			}
+		}
+	}
+
+	/* Sort by name and then by version so that when a signature is present
+	 * multiple times in the same database, we keep the oldest version. */
+	sort.Slice(index.entries, func(i, j int) bool {
+		a, b := index.entries[i], index.entries[j]
+
+		if a.name != b.name {
+			return a.name < b.name
+		}
+
+		if a.database != b.database {
+			return a.database < b.database
+		}
+
+		return a.version < b.version
+	})
+
+	deduped := index.entries[:0]
+
+	for i, entry := range index.entries {
+		if i > 0 {
+			previous := deduped[len(deduped)-1]
+
+			if previous.name == entry.name && previous.database == entry.database {
+				continue
+			}
+		}
+
+		deduped = append(deduped, entry)
+	}
+
+	index.entries = deduped
+
+	return index, nil
+}
+
+type versionedCdiff struct {
+	filename string
+	version  uint64
+}
+
+// Function that finds all of the cdiffs for a given database prefix that
+// are newer than the specified version and returns them in version order.
+func cdiffsNewerThan(files []os.FileInfo, prefix string, version uint64) []versionedCdiff {
+	var cdiffs []versionedCdiff
+
+	for _, file := range files {
+		name := file.Name()
+
+		if !strings.HasPrefix(name, prefix+"-") || !strings.HasSuffix(name, ".cdiff") {
+			continue
+		}
+
+		versionPart := strings.TrimSuffix(strings.TrimPrefix(name, prefix+"-"), ".cdiff")
+		cdiffVersion, err := strconv.ParseUint(versionPart, 10, 64)
+
+		if err != nil || cdiffVersion <= version {
+			continue
+		}
+
+		cdiffs = append(cdiffs, versionedCdiff{filename: name, version: cdiffVersion})
+	}
+
+	sort.Slice(cdiffs, func(i, j int) bool {
+		return cdiffs[i].version < cdiffs[j].version
+	})
+
+	return cdiffs
+}
+
+// cdiffEdit collects the changes that a cdiff makes to a single database
+// between its OPEN and CLOSE commands. ClamAV numbers DEL and XCHG lines
+// relative to the database as it was when opened and appends ADD lines when
+// the database is closed.
+type cdiffEdit struct {
+	database  string
+	deleted   map[int]bool
+	exchanged map[int]string
+	added     []string
+}
+
+func newCdiffEdit(database string) *cdiffEdit {
+	return &cdiffEdit{
+		database:  database,
+		deleted:   make(map[int]bool),
+		exchanged: make(map[int]string),
+	}
+}
+
+// Function that records a single ADD, DEL or XCHG command.
+func (edit *cdiffEdit) record(line string) {
+	if edit.database == "" {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(line, "ADD "):
+		edit.added = append(edit.added, strings.TrimPrefix(line, "ADD "))
+	case strings.HasPrefix(line, "DEL "):
+		// DEL <line number> <start of line>
+		fields := strings.SplitN(line, " ", 3)
+
+		if number, err := strconv.Atoi(fields[1]); err == nil {
+			edit.deleted[number] = true
+		}
+	case strings.HasPrefix(line, "XCHG "):
+		// XCHG <line number> <start of old line> <new line>
+		fields := strings.SplitN(line, " ", 4)
+
+		if len(fields) < 4 {
+			return
+		}
+
+		if number, err := strconv.Atoi(fields[1]); err == nil {
+			edit.exchanged[number] = fields[3]
+		}
+	}
+}
+
+// Function that applies the recorded changes to the lines of the database,
+// using the supplied function to index any added or exchanged lines.
+func (edit *cdiffEdit) apply(lines map[string][]int32, add func(line string) int32) {
+	if edit.database == "" {
+		return
+	}
+
+	if _, ok := signatureNameFields[filepath.Ext(edit.database)]; !ok {
+		return
+	}
+
+	original := lines[edit.database]
+	updated := make([]int32, 0, len(original)+len(edit.added))
+
+	for i, offset := range original {
+		number := i + 1
+
+		if edit.deleted[number] {
+			continue
+		}
+
+		if line, ok := edit.exchanged[number]; ok {
+			offset = add(line)
+		}
+
+		updated = append(updated, offset)
+	}
+
+	for _, line := range edit.added {
+		updated = append(updated, add(line))
+	}
+
+	lines[edit.database] = updated
+}
+
+// Function that extracts the signature name from a single database line.
+func signatureNameFromLine(database string, line string) (string, bool) {
+	field, ok := signatureNameFields[filepath.Ext(database)]
+
+	if !ok || len(line) == 0 || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	parts := strings.SplitN(line, field.separator, field.index+2)
+
+	if len(parts) <= field.index {
+		return "", false
+	}
+
+	name := strings.TrimSpace(parts[field.index])
+
+	return name, len(name) > 0
+}
+
+// Function that calls the supplied function for each line of the reader.
+func forEachLine(reader io.Reader, fn func(line string)) error {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return errors.WrapPrefix(err, "Error reading database lines", 1)
+	}
+
+	return nil
+}
+
+// Function that searches the index for signature names matching the query.
+// Prefix matches use a binary search of the sorted names while substring
+// matches scan the entire index. Total is the number of matches found, which
+// may be more than the number of results returned.
+func (index *signatureIndex) search(query string, prefix bool, limit int) ([]SignatureSearchResult, int) {
+	results := []SignatureSearchResult{}
+	total := 0
+
+	collect := func(entry signatureIndexEntry) {
+		total++
+
+		if len(results) < limit {
+			results = append(results, SignatureSearchResult{
+				Name:     entry.name,
+				Database: index.databases[entry.database],
+				Source:   index.sources[entry.source],
+				Version:  entry.version,
+			})
+		}
+	}
+
+	if prefix {
+		start := sort.Search(len(index.entries), func(i int) bool {
+			return index.entries[i].name >= query
+		})
+
+		for i := start; i < len(index.entries) && strings.HasPrefix(index.entries[i].name, query); i++ {
+			collect(index.entries[i])
+		}
+	} else {
+		for _, entry := range index.entries {
+			if strings.Contains(entry.name, query) {
+				collect(entry)
+			}
+		}
+	}
+
+	return results, total
+}
+
+// Function that handles requests to the signature search API.
+func signatureSearchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+
+	if !(r.Method == "GET" || r.Method == "HEAD") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+
+	if len(query) == 0 || len(query) > 256 {
+		http.Error(w, "The query parameter [q] must be between 1 and 256 characters",
+			http.StatusBadRequest)
+		return
+	}
+
+	match := r.URL.Query().Get("match")
+
+	if match == "" {
+		match = "prefix"
+	}
+
+	if match != "prefix" && match != "substring" {
+		http.Error(w, "The match parameter must be either [prefix] or [substring]",
+			http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSignatureSearchResults
+
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		i, err := strconv.Atoi(limitParam)
+
+		if err != nil || i < 1 || i > maxSignatureSearchResults {
+			http.Error(w, "The limit parameter must be between 1 and "+
+				strconv.Itoa(maxSignatureSearchResults), http.StatusBadRequest)
+			return
+		}
+
+		limit = i
+	}
+
+	signatureIndexLock.RLock()
+	index := currentSignatureIndex
+	signatureIndexLock.RUnlock()
+
+	if index == nil {
+		http.Error(w, "The signature index has not been built yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	results, total := index.search(query, match == "prefix", limit)
+
+	response := SignatureSearchResponse{
+		Query:     query,
+		Match:     match,
+		Total:     total,
+		Truncated: total > len(results),
+		IndexedAt: index.builtAt,
+		Results:   results,
+	}
+
+	if verboseMode {
+		logger.Printf("[%v] {%v} %v --> %v results", r.Method, clientName(r), r.URL, total)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "GET" {
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logError.Printf("Error writing signature search response. %v", err)
+		}
+	}
+}
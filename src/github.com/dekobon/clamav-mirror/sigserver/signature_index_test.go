@@ -0,0 +1,123 @@
+package sigserver
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCvdAndCdiffBuildSignatureIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sigindex-")
+	defer os.RemoveAll(dir)
+
+	writeTestCVD(t, dir, "daily", 100, map[string]string{
+		"daily.ndb":  "Win.Trojan.Foo-123:1:*:deadbeef\nWin.Trojan.Bar-1:0:*:cafe\n",
+		"daily.hdb":  "44d88612fea8a8f36de82e1278abb02f:68:Eicar-Test-Signature\n",
+		"daily.ldb":  "Doc.Dropper.Agent-1;Engine:51-255,Target:2;0;aabb\n",
+		"daily.info": "daily.ndb:123:abcd\n",
+	})
+	writeTestCdiff(t, dir, "daily", 100, "OPEN daily.ndb\nADD Win.Trojan.Stale-1:0:*:ab\nCLOSE\n")
+	writeTestCdiff(t, dir, "daily", 101, "OPEN daily.ndb\nADD Win.Trojan.Foo-124:0:*:ab\n"+
+		"ADD Win.Trojan.Foo-123:0:*:ab\nCLOSE\n")
+
+	index, err := buildSignatureIndex(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, total := index.search("Win.Trojan.Foo", true, 10)
+
+	if total != 2 {
+		t.Fatalf("Expected 2 prefix matches. Actual: %v %v", total, results)
+	}
+
+	if results[0].Name != "Win.Trojan.Foo-123" || results[0].Version != 100 ||
+		results[0].Database != "daily.ndb" || results[0].Source != "daily.cvd" {
+		t.Errorf("Unexpected result for signature in CVD: %+v", results[0])
+	}
+
+	if results[1].Name != "Win.Trojan.Foo-124" || results[1].Version != 101 ||
+		results[1].Source != "daily-101.cdiff" {
+		t.Errorf("Unexpected result for signature in cdiff: %+v", results[1])
+	}
+
+	if _, total := index.search("Win.Trojan.Stale", true, 10); total != 0 {
+		t.Error("Signatures from cdiffs older than the CVD should not be indexed")
+	}
+
+	results, total = index.search("Test-Signature", false, 10)
+
+	if total != 1 || results[0].Name != "Eicar-Test-Signature" || results[0].Database != "daily.hdb" {
+		t.Errorf("Expected substring match on hash database. Actual: %+v", results)
+	}
+
+	if _, total := index.search("Dropper", false, 10); total != 1 {
+		t.Errorf("Expected substring match on logical database. Actual: %v", total)
+	}
+}
+
+func TestDeletedAndExchangedBuildSignatureIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sigindex-")
+	defer os.RemoveAll(dir)
+
+	writeTestCVD(t, dir, "daily", 100, map[string]string{
+		"daily.ndb": "Win.Trojan.Foo-123:1:*:deadbeef\nWin.Trojan.Bar-1:0:*:cafe\n" +
+			"Win.Trojan.Baz-1:0:*:beef\n",
+	})
+	writeTestCdiff(t, dir, "daily", 101, "OPEN daily.ndb\nDEL 1 Win.Trojan.Foo-123:1:*:deadbeef\n"+
+		"XCHG 3 Win.Trojan.Baz-1:0:*:beef Win.Trojan.Baz-2:0:*:beef\nADD Win.Trojan.Qux-1:0:*:ab\nCLOSE\n")
+	// Line numbers refer to the database as left by the previous cdiff
+	writeTestCdiff(t, dir, "daily", 102, "OPEN daily.ndb\nDEL 3 Win.Trojan.Qux-1\nCLOSE\n")
+
+	index, err := buildSignatureIndex(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, removed := range []string{"Win.Trojan.Foo-123", "Win.Trojan.Baz-1", "Win.Trojan.Qux-1"} {
+		if _, total := index.search(removed, true, 10); total != 0 {
+			t.Errorf("Signature [%v] removed by a cdiff should not be indexed", removed)
+		}
+	}
+
+	results, total := index.search("Win.Trojan.", true, 10)
+
+	if total != 2 || results[0].Name != "Win.Trojan.Bar-1" || results[0].Version != 100 ||
+		results[1].Name != "Win.Trojan.Baz-2" || results[1].Source != "daily-101.cdiff" {
+		t.Errorf("Unexpected signatures after applying cdiffs: %+v", results)
+	}
+}
+
+func TestLimitSearch(t *testing.T) {
+	index := &signatureIndex{
+		databases: []string{"daily.ndb"},
+		sources:   []string{"daily.cvd"},
+		entries: []signatureIndexEntry{
+			{name: "A-1"}, {name: "A-2"}, {name: "A-3"}, {name: "B-1"},
+		},
+	}
+
+	results, total := index.search("A-", true, 2)
+
+	if total != 3 || len(results) != 2 {
+		t.Errorf("Expected 2 of 3 results. Actual: %v of %v", len(results), total)
+	}
+}
+
+func TestCommentsSignatureNameFromLine(t *testing.T) {
+	if _, ok := signatureNameFromLine("daily.ndb", "# comment"); ok {
+		t.Error("Comment lines should not produce signature names")
+	}
+
+	if _, ok := signatureNameFromLine("daily.cbc", "Name:1:2"); ok {
+		t.Error("Unsupported database types should not produce signature names")
+	}
+
+	name, ok := signatureNameFromLine("main.mdb", "1024:44d88612fea8a8f36de82e1278abb02f:Win.Test-1")
+
+	if !ok || name != "Win.Test-1" {
+		t.Errorf("Expected name from section hash database. Actual: %v", name)
+	}
+}
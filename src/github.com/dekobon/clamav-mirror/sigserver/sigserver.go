@@ -1,12 +1,12 @@
 package sigserver
 
 import (
-	"fmt"
-	"io"
+	"context"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -14,7 +14,6 @@ import (
 
 import (
 	"github.com/go-errors/errors"
-	"github.com/robfig/cron"
 )
 
 import (
@@ -26,6 +25,11 @@ var logger *log.Logger
 var logError *log.Logger
 var dataDirectory string
 var verboseMode bool
+var allowedFileExtensions []string
+
+// Signature files published by upstreams that can be fetched from them when
+// they aren't in the data directory. The number of a cdiff is captured.
+var upstreamFilePattern = regexp.MustCompile(`^(main|daily|bytecode|safebrowsing)(?:\.cvd|-([0-9]+)\.cdiff)$`)
 
 func init() {
 	logger = log.New(os.Stdout, "", log.LstdFlags)
@@ -38,17 +42,72 @@ func RunUpdaterAndServer(config Config) error {
 	updateConfig := config.UpdateConfig
 	dataDirectory = updateConfig.DataFilePath
 	verboseMode = updateConfig.Verbose
+	configureAdminToken(config.AdminToken)
+	allowedFileExtensions = config.AllowedFileExtensions
+	customDatabaseDirectory = config.CustomDatabasePath
+	appVersionInfo = updateConfig.AppVersionInfo
 
-	{
-		err := scheduleUpdates(config)
+	if err := loadLastSuccessfulUpdate(dataDirectory); err != nil {
+		logError.Printf("Discarding the unreadable time of the last update. %v", err)
+	}
+
+	if config.PullThrough {
+		pullThroughConfig = &config.UpdateConfig
+	}
+
+	/* The ignore list is loaded once and then changed through the API, so
+	 * changes made with the ignore command are only picked up on SIGHUP. */
+	if _, err := refreshIgnoreList(dataDirectory); err != nil {
+		logError.Printf("Error loading ignore list. %v", err)
+	}
+
+	onReload(func() {
+		if _, err := refreshIgnoreList(dataDirectory); err != nil {
+			logError.Printf("Error reloading ignore list. %v", err)
+		}
+	})
+
+	watchReloadSignal()
+
+	configureMissingFileRedirect(config.RedirectMissingURL, config.RedirectRateLimit)
+
+	signatureAccess.configure(config.SignatureAllow, config.SignatureDeny)
+	apiAccess.configure(config.APIAllow, config.APIDeny)
+	configureTrustedProxies(config.TrustedProxies)
+	configureClientLimits(config.ClientRequestLimit, config.ClientBandwidthLimit,
+		config.MaxCVDTransfers)
+
+	if config.CredentialsPath != "" {
+		err := configureCredentials(config.CredentialsPath)
 
 		if err != nil {
-			return errors.WrapPrefix(err, "Error scheduling periodic updates", 1).Err
+			return errors.WrapPrefix(err, "Error loading credentials", 1).Err
 		}
 	}
 
+	updateSchedule := config.UpdateSchedule
+
+	if updateSchedule == "" {
+		updateSchedule = hourlyUpdateSchedule(config.UpdateHourlyInterval)
+	}
+
+	scheduler, err := newUpdateScheduler(updateSchedule, config.UpdateJitter,
+		config.UpdateRetryBackoff)
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Error parsing update schedule", 1).Err
+	}
+
+	configureReadyMaxAge(config.ReadyMaxAge, scheduler)
+
+	if config.ConfigFilePath != "" {
+		watchConfigFile(config, scheduler)
+	}
+
+	configureUpdates(config)
+
 	{
-		err := runServer(config.Port)
+		err := runServer(config, scheduler)
 
 		if err != nil {
 			return errors.WrapPrefix(err, "Error starting HTTP server", 1).Err
@@ -58,44 +117,204 @@ func RunUpdaterAndServer(config Config) error {
 	return nil
 }
 
-func runServer(port uint16) error {
-	listenAddr := ":" + strconv.Itoa(int(port))
+func runServer(config Config, scheduler *updateScheduler) error {
+	http.HandleFunc("/", withMetrics(withAccessList(signatureAccess,
+		withCredentials(withClientLimits(handler)))))
+	http.HandleFunc("/api/ignores", withAccessList(apiAccess, ignoreListHandler))
+	http.HandleFunc("/api/databases", withAccessList(apiAccess, customDatabaseHandler))
+	http.HandleFunc("/api/databases/", withAccessList(apiAccess, customDatabaseHandler))
+	http.HandleFunc("/api/updates", withAccessList(apiAccess, updatesHandler))
+
+	if config.SignatureSearch {
+		http.HandleFunc("/api/signatures", withAccessList(apiAccess, signatureSearchHandler))
+	}
+
+	registerStatusHandlers(http.DefaultServeMux)
+
+	shutdownSignals := watchShutdownSignal()
+
+	inherited, err := inheritedListeners()
+
+	if err != nil {
+		return err
+	}
+
+	var servers []*http.Server
+	serverErrors := make(chan error, 2)
+	var httpHandler http.Handler
+
+	if config.TLSCertPath != "" {
+		tlsServer, err := newTLSServer(config)
+
+		if err != nil {
+			return err
+		}
+
+		listener, err := serverListener(inherited, httpsSocketName, tlsServer.Addr,
+			config.ReusePort)
+
+		if err != nil {
+			return err
+		}
+
+		logger.Printf("Starting ClamAV signature mirror HTTPS server on port [%v]",
+			listener.Addr())
+
+		servers = append(servers, tlsServer)
+
+		go func() {
+			serverErrors <- tlsServer.ServeTLS(listener, "", "")
+		}()
+
+		/* Plain HTTP can't authenticate clients, so when client certificates
+		 * are required HTTP requests are always redirected. */
+		if config.HTTPSRedirect || len(config.TLSClientCAPaths) > 0 {
+			/* Load balancers often check health over plain HTTP, so the
+			 * status endpoints aren't redirected. */
+			redirectMux := http.NewServeMux()
+			redirectMux.Handle("/", httpsRedirectHandler(config.TLSPort))
+			registerStatusHandlers(redirectMux)
+			httpHandler = redirectMux
+		}
+	} else if listener, ok := inherited[httpsSocketName]; ok {
+		logger.Printf("Ignoring inherited https socket [%v] because no TLS certificate "+
+			"is configured", listener.Addr())
+		listener.Close()
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":" + strconv.Itoa(int(config.Port)),
+		Handler: httpHandler,
+	}
+
+	listener, err := serverListener(inherited, httpSocketName, httpServer.Addr, config.ReusePort)
+
+	if err != nil {
+		return err
+	}
+
 	logger.Printf("Starting ClamAV signature mirror HTTP server on port [%v]",
-		listenAddr)
-	http.HandleFunc("/", handler)
-	http.ListenAndServe(listenAddr, nil)
+		listener.Addr())
+
+	servers = append(servers, httpServer)
+
+	go func() {
+		serverErrors <- httpServer.Serve(listener)
+	}()
+
+	scheduleUpdates(scheduler)
+
+	select {
+	case err := <-serverErrors:
+		return err
+	case signal := <-shutdownSignals:
+		logger.Printf("Received %v - shutting down", signal)
+	}
+
+	shutdown(servers, scheduler, config.ShutdownTimeout)
 
 	return nil
 }
 
-func scheduleUpdates(config Config) error {
+// Function that creates the HTTPS server. The certificate is reloaded when
+// sigserver receives SIGHUP and when the certificate files change. If client
+// CAs are configured, clients must authenticate with a certificate.
+func newTLSServer(config Config) (*http.Server, error) {
+	reloader, err := newCertificateReloader(config.TLSCertPath, config.TLSKeyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reloader.watch(certificatePollInterval)
+
+	onReload(func() {
+		if err := reloader.reload(); err != nil {
+			logError.Printf("Keeping the current TLS certificate. %v", err)
+		} else {
+			logger.Printf("Reloaded TLS certificate [%v]", config.TLSCertPath)
+		}
+	})
+
+	watchReloadSignal()
 
-	cronSchedule := fmt.Sprintf("@every %dh", config.UpdateHourlyInterval)
+	tlsConfig := newServerTLSConfig(reloader, config.TLSMinVersion, config.TLSCipherSuites)
 
-	run := func() {
-		err := sigupdate.RunSignatureUpdate(config.UpdateConfig)
+	if len(config.TLSClientCAPaths) > 0 {
+		err := requireClientCertificates(tlsConfig, config.TLSClientCAPaths, config.TLSClientAllow)
 
 		if err != nil {
-			logError.Println(err)
+			return nil, err
 		}
 	}
 
-	// Update once before scheduling
-	run()
+	return &http.Server{
+		Addr:      ":" + strconv.Itoa(int(config.TLSPort)),
+		Handler:   withClientIdentity(http.DefaultServeMux),
+		TLSConfig: tlsConfig,
+	}, nil
+}
 
-	c := cron.New()
-	c.AddFunc(cronSchedule, run)
-	c.Start()
+// Function that sets how signatures are updated, which changes when the
+// configuration is reloaded.
+func configureUpdates(config Config) {
+	updates.configure(func(ctx context.Context) (sigupdate.UpdateResult, error) {
+		result, err := sigupdate.RunSignatureUpdateContext(ctx, config.UpdateConfig)
+		recordUpdate(config.UpdateConfig.DataFilePath, result, err)
+		recordAdvertisedVersions(result)
 
-	return nil
+		if err != nil {
+			logError.Println(err)
+		}
+
+		if _, err := refreshIgnoreList(config.UpdateConfig.DataFilePath); err != nil {
+			logError.Println(err)
+		}
+
+		if config.SignatureSearch {
+			rebuildSignatureIndex(config.UpdateConfig.DataFilePath)
+		}
+
+		return result, err
+	})
+}
+
+/* Function that starts an update in the background and then updates
+ * signatures on schedule. This is called once sigserver is serving requests,
+ * so that files already in the data directory are served while the first
+ * update runs and a shutdown signal isn't missed. */
+func scheduleUpdates(scheduler *updateScheduler) {
+	go func() {
+		var failures uint
+
+		// Update once before scheduling
+		if _, done, started := updates.start(triggerStartup); started {
+			if status := <-done; status.State == updateFailed {
+				failures++
+			}
+		}
+
+		scheduler.run(updates, failures)
+	}()
+}
+
+// Function that checks to see if a file has one of the extensions that we
+// are configured to serve.
+func allowedFileExtension(file string) bool {
+	for _, extension := range allowedFileExtensions {
+		if strings.HasSuffix(file, extension) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func validFileRequested(path string, file string) bool {
 	dir := filepath.Dir(path)
-	validFileExtension := (strings.HasSuffix(file, ".cvd") || strings.HasSuffix(file, ".cdiff")) &&
-		!strings.Contains(file, "..")
+	validFileExtension := allowedFileExtension(file) && !strings.Contains(file, "..")
 	validDir := dir == "/"
-	// CVD or cdiff filenames should never be very big
+	// Signature database filenames should never be very big
 	validFilename := len(file) < 48 && len(file) > 4
 
 	return validDir && validFileExtension && validFilename
@@ -120,70 +339,91 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if file == ignoreDatabaseFilename {
+		ignoreDatabaseHandler(w, r)
+		return
+	}
+
 	dataFilePath := dataDirectory + string(filepath.Separator) + file
 	fileExists := utils.Exists(dataFilePath)
 
-	if !fileExists {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	// Fall back to the organization's own databases
+	if !fileExists && customDatabaseDirectory != "" {
+		dataFilePath = customDatabaseDirectory + string(filepath.Separator) + file
+		fileExists = utils.Exists(dataFilePath)
 	}
 
-	stat, err := os.Stat(dataFilePath)
+	if !fileExists && pullThroughAllowed(file) {
+		pullThroughHandler(w, r, file)
+		return
+	}
 
-	if err != nil {
-		logError.Printf("Error running stat on file [%v]. %v", dataFilePath, err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !fileExists && missingFileRedirectAllowed(file) {
+		missingFileRedirectHandler(w, r, file)
 		return
 	}
 
-	localModTime := stat.ModTime().UTC().Truncate(time.Second)
+	if !fileExists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-	w.Header().Set("Last-Modified", stat.ModTime().UTC().Truncate(time.Second).Format(http.TimeFormat))
-	w.Header().Set("Content-Type", "application/octet-stream")
+	serveDataFile(w, r, file, dataFilePath)
+}
 
+// Function that serves a signature file from disk.
+func serveDataFile(w http.ResponseWriter, r *http.Request, file string, dataFilePath string) {
 	if !(r.Method == "GET" || r.Method == "HEAD") {
-		logger.Printf("[%v] {%v} %v DENIED", r.Method, r.RemoteAddr, r.URL)
+		logger.Printf("[%v] {%v} %v DENIED", r.Method, clientName(r), r.URL)
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	modifiedSinceString := r.Header.Get("If-Modified-Since")
+	dataFileReader, err := os.Open(dataFilePath)
 
-	if len(modifiedSinceString) > 0 {
-		modifiedSince, err := http.ParseTime(modifiedSinceString)
+	if err != nil {
+		logError.Printf("Error reading [%v] from disk. %v", dataFilePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		if err != nil {
-			logError.Printf("Couldn't parse time value [%v]. %v", r.Header.Get("If-Modified-Since"), err)
-		}
+	defer dataFileReader.Close()
 
-		modifiedSince = modifiedSince.UTC()
+	stat, err := dataFileReader.Stat()
 
-		logger.Printf("Local modification time: %v. Remote modification time: %v (%v)",
-			localModTime, modifiedSince, modifiedSinceString)
+	if err != nil {
+		logError.Printf("Error running stat on file [%v]. %v", dataFilePath, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-		if modifiedSince.After(localModTime) || modifiedSince.Equal(localModTime.UTC()) {
-			if verboseMode {
-				logger.Printf("[%v] {%v} %v --> %v (304 Not-Modified)", r.Method, r.RemoteAddr, r.URL, dataFilePath)
-			}
+	w.Header().Set("Content-Type", "application/octet-stream")
 
-			w.WriteHeader(http.StatusNotModified)
-			return
-		}
+	if etag := fileETag(dataFilePath); etag != "" {
+		w.Header().Set("ETag", etag)
 	}
 
-	logger.Printf("[%v] {%v} %v --> %v", r.Method, r.RemoteAddr, r.URL, dataFilePath)
+	logger.Printf("[%v] {%v} %v --> %v", r.Method, clientName(r), r.URL, dataFilePath)
 
-	if r.Method == "GET" {
-		dataFileReader, err := os.Open(dataFilePath)
-		defer dataFileReader.Close()
+	/* ServeContent answers conditional requests (If-Modified-Since,
+	 * If-None-Match and If-Range) and byte range requests. freshclam uses
+	 * range requests to read just the header of a .cvd file. */
+	http.ServeContent(w, r, file, stat.ModTime().UTC().Truncate(time.Second), dataFileReader)
+}
 
-		if err != nil {
-			logError.Printf("Error reading [%v] from disk. %v",
-				dataFilePath, err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+// Function that returns the entity tag of a file. The ETag of a .cvd file is
+// the MD5 sum from its header, which changes whenever the signatures do.
+// Other files don't have an ETag and are validated by modification time.
+func fileETag(dataFilePath string) string {
+	if !strings.HasSuffix(dataFilePath, ".cvd") {
+		return ""
+	}
+
+	header, err := readCVDHeader(dataFilePath)
 
-		io.Copy(w, dataFileReader)
+	if err != nil || !hexPattern.MatchString(header.MD5) {
+		return ""
 	}
+
+	return `"` + strings.ToLower(header.MD5) + `"`
 }
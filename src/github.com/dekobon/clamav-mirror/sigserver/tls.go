@@ -0,0 +1,236 @@
+package sigserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// How often the certificate files are checked for changes
+const certificatePollInterval = 30 * time.Second
+
+// TLS versions that can be configured as the minimum version
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/* certificateReloader serves the certificate that was most recently loaded
+ * from the certificate and key files. Handshakes in progress keep the
+ * certificate that they started with, so reloading doesn't drop any
+ * connections. */
+type certificateReloader struct {
+	certPath    string
+	keyPath     string
+	lock        sync.RWMutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+// Function that loads a certificate and key pair that can be reloaded.
+func newCertificateReloader(certPath string, keyPath string) (*certificateReloader, error) {
+	reloader := &certificateReloader{certPath: certPath, keyPath: keyPath}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	return reloader, nil
+}
+
+// Function that loads the certificate and key files. If they can't be
+// loaded, the previously loaded certificate continues to be served.
+func (reloader *certificateReloader) reload() error {
+	certStat, certErr := os.Stat(reloader.certPath)
+	keyStat, keyErr := os.Stat(reloader.keyPath)
+
+	certificate, err := tls.LoadX509KeyPair(reloader.certPath, reloader.keyPath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to load TLS certificate [%v] and key [%v]",
+			reloader.certPath, reloader.keyPath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+
+	reloader.certificate = &certificate
+
+	if certErr == nil && keyErr == nil {
+		reloader.certModTime = certStat.ModTime()
+		reloader.keyModTime = keyStat.ModTime()
+	}
+
+	return nil
+}
+
+// Function that reloads the certificate if either file has been modified
+// since it was last loaded.
+func (reloader *certificateReloader) reloadIfModified() {
+	certStat, err := os.Stat(reloader.certPath)
+
+	if err != nil {
+		return
+	}
+
+	keyStat, err := os.Stat(reloader.keyPath)
+
+	if err != nil {
+		return
+	}
+
+	reloader.lock.RLock()
+	modified := !certStat.ModTime().Equal(reloader.certModTime) ||
+		!keyStat.ModTime().Equal(reloader.keyModTime)
+	reloader.lock.RUnlock()
+
+	if !modified {
+		return
+	}
+
+	/* Certificates are often rotated by writing the certificate and key
+	 * separately, so a mismatched pair is retried at the next poll. */
+	if err := reloader.reload(); err != nil {
+		logError.Printf("Keeping the current TLS certificate. %v", err)
+		return
+	}
+
+	logger.Printf("Reloaded TLS certificate [%v]", reloader.certPath)
+}
+
+// Function that checks the certificate files for changes until the program
+// exits.
+func (reloader *certificateReloader) watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			reloader.reloadIfModified()
+		}
+	}()
+}
+
+// Function that returns the current certificate for a TLS handshake.
+func (reloader *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.lock.RLock()
+	defer reloader.lock.RUnlock()
+
+	return reloader.certificate, nil
+}
+
+// Function that creates the TLS configuration used to serve HTTPS.
+func newServerTLSConfig(reloader *certificateReloader, minVersion uint16, cipherSuites []uint16) *tls.Config {
+	return &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+	}
+}
+
+// Function that parses a minimum TLS version such as "1.2".
+func parseTLSVersion(version string) (uint16, error) {
+	parsed, ok := tlsVersions[strings.TrimSpace(version)]
+
+	if !ok {
+		return 0, errors.Errorf("Unsupported TLS version [%v]. Valid versions: "+
+			"1.0, 1.1, 1.2, 1.3", version)
+	}
+
+	return parsed, nil
+}
+
+// Function that returns the name of a TLS version as accepted by
+// parseTLSVersion.
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// Function that returns the names of cipher suites as a comma separated list.
+func cipherSuiteNames(suites []uint16) string {
+	names := make([]string, len(suites))
+
+	for i, suite := range suites {
+		names[i] = tls.CipherSuiteName(suite)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Function that parses a comma separated list of cipher suite names, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. An empty list uses Go's defaults.
+func parseCipherSuites(names string) ([]uint16, error) {
+	available := make(map[string]uint16)
+
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		available[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			continue
+		}
+
+		id, ok := available[name]
+
+		if !ok {
+			return nil, errors.Errorf("Unknown TLS cipher suite [%v]", name)
+		}
+
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
+
+// Function that creates a handler that redirects every request to the same
+// URL using HTTPS on the given port.
+func httpsRedirectHandler(tlsPort uint16) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		if tlsPort != 443 {
+			host = host + ":" + strconv.Itoa(int(tlsPort))
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		if verboseMode {
+			logger.Printf("[%v] {%v} %v --> %v (301 Moved Permanently)", r.Method,
+				clientName(r), r.URL, target)
+		}
+
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
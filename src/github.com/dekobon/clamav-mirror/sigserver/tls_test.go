@@ -0,0 +1,167 @@
+package sigserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Function that writes a self-signed certificate and key for the given common
+// name to the specified paths.
+func writeTestCertificate(t *testing.T, certPath string, keyPath string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{commonName},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// Function that returns the common name of the certificate being served.
+func servedCommonName(t *testing.T, reloader *certificateReloader) string {
+	certificate, _ := reloader.getCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed.Subject.CommonName
+}
+
+func TestReloadIfModifiedCertificateReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls-")
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+	writeTestCertificate(t, certPath, keyPath, "first.example.com")
+
+	reloader, err := newCertificateReloader(certPath, keyPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestCertificate(t, certPath, keyPath, "second.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certPath, later, later)
+	reloader.reloadIfModified()
+
+	if name := servedCommonName(t, reloader); name != "second.example.com" {
+		t.Errorf("Expected the rotated certificate to be served. Actual: %v", name)
+	}
+
+	// A broken certificate doesn't replace the working one
+	ioutil.WriteFile(certPath, []byte("not a certificate"), 0644)
+
+	if err := reloader.reload(); err == nil {
+		t.Error("Expected an invalid certificate to fail to load")
+	}
+
+	if name := servedCommonName(t, reloader); name != "second.example.com" {
+		t.Errorf("Expected the previous certificate to still be served. Actual: %v", name)
+	}
+}
+
+func TestReloadHooks(t *testing.T) {
+	reloadHooksLock.Lock()
+	saved := reloadHooks
+	reloadHooks = nil
+	reloadHooksLock.Unlock()
+
+	defer func() {
+		reloadHooksLock.Lock()
+		reloadHooks = saved
+		reloadHooksLock.Unlock()
+	}()
+
+	var order []int
+	onReload(func() { order = append(order, 1) })
+	onReload(func() { order = append(order, 2) })
+	runReloadHooks()
+
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Errorf("Expected reload hooks to run in order. Actual: %v", order)
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if version, err := parseTLSVersion("1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Errorf("Expected TLS 1.3. Actual: %v %v", version, err)
+	}
+
+	if _, err := parseTLSVersion("3.0"); err == nil {
+		t.Error("Expected an unknown TLS version to be rejected")
+	}
+
+	if name := tlsVersionName(tls.VersionTLS12); name != "1.2" {
+		t.Errorf("Expected the name 1.2. Actual: %v", name)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	names := "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	suites, err := parseCipherSuites(names)
+
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites: %v %v", suites, err)
+	}
+
+	if joined := cipherSuiteNames(suites); joined !=
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384" {
+		t.Errorf("Unexpected cipher suite names: %v", joined)
+	}
+
+	if _, err := parseCipherSuites("TLS_MADE_UP"); err == nil {
+		t.Error("Expected an unknown cipher suite to be rejected")
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	cases := map[uint16]string{
+		443:  "https://mirror.example.com/daily.cvd?x=1",
+		8443: "https://mirror.example.com:8443/daily.cvd?x=1",
+	}
+
+	for port, expected := range cases {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "http://mirror.example.com:8080/daily.cvd?x=1", nil)
+		httpsRedirectHandler(port)(recorder, request)
+
+		if recorder.Code != http.StatusMovedPermanently || recorder.Header().Get("Location") != expected {
+			t.Errorf("Expected a redirect to [%v]. Actual: %v %v", expected, recorder.Code,
+				recorder.Header().Get("Location"))
+		}
+	}
+}
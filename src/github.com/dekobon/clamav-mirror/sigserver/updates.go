@@ -0,0 +1,252 @@
+package sigserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+)
+
+// What started a signature update
+const (
+	triggerStartup  = "startup"
+	triggerSchedule = "schedule"
+	triggerAdmin    = "admin"
+)
+
+// States that a signature update can be in
+const (
+	updateRunning    = "running"
+	updateCancelling = "cancelling"
+	updateSucceeded  = "succeeded"
+	updateFailed     = "failed"
+	updateSkipped    = "skipped"
+	updateCancelled  = "cancelled"
+)
+
+// UpdateStatus describes a signature update that is running or has finished.
+type UpdateStatus struct {
+	ID         uint64                      `json:"id"`
+	Trigger    string                      `json:"trigger"`
+	State      string                      `json:"state"`
+	Started    time.Time                   `json:"started"`
+	Finished   *time.Time                  `json:"finished,omitempty"`
+	Error      string                      `json:"error,omitempty"`
+	Signatures []sigupdate.SignatureResult `json:"signatures,omitempty"`
+}
+
+// UpdatesResponse is the response body of the updates API.
+type UpdatesResponse struct {
+	Current *UpdateStatus `json:"current"`
+	Last    *UpdateStatus `json:"last"`
+}
+
+/* updateRunner makes sure that only one signature update runs at a time,
+ * whether it was started by the schedule or the admin API, and keeps the
+ * status of the current and last updates. */
+type updateRunner struct {
+	lock    sync.Mutex
+	update  func(ctx context.Context) (sigupdate.UpdateResult, error)
+	nextID  uint64
+	current *UpdateStatus
+	last    *UpdateStatus
+	cancel  context.CancelFunc
+	idle    chan struct{}
+	closed  bool
+}
+
+// Signature updates run by sigserver
+var updates = &updateRunner{}
+
+// Function that sets the function that performs a signature update.
+func (u *updateRunner) configure(update func(ctx context.Context) (sigupdate.UpdateResult, error)) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.update = update
+}
+
+/* Function that starts a signature update in the background unless one is
+ * already running, in which case its status is returned. The returned
+ * channel receives the status of the update once it has finished. No update
+ * is started once sigserver is shutting down. */
+func (u *updateRunner) start(trigger string) (UpdateStatus, <-chan UpdateStatus, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.closed {
+		return UpdateStatus{}, nil, false
+	}
+
+	if u.current != nil {
+		return *u.current, nil, false
+	}
+
+	u.nextID++
+	status := &UpdateStatus{
+		ID:      u.nextID,
+		Trigger: trigger,
+		State:   updateRunning,
+		Started: time.Now().UTC().Truncate(time.Second),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan UpdateStatus, 1)
+	update := u.update
+
+	u.current = status
+	u.cancel = cancel
+	u.idle = make(chan struct{})
+
+	go func() {
+		result, err := update(ctx)
+		done <- u.finish(ctx, result, err)
+	}()
+
+	return *status, done, true
+}
+
+// Function that records and returns the outcome of the current update.
+func (u *updateRunner) finish(ctx context.Context, result sigupdate.UpdateResult,
+	err error) UpdateStatus {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	status := u.current
+	finished := time.Now().UTC().Truncate(time.Second)
+	status.Finished = &finished
+	status.Signatures = result.Signatures
+
+	switch {
+	case err != nil && ctx.Err() != nil:
+		status.State = updateCancelled
+	case sigupdate.IsCooldownError(err) && len(result.Signatures) == 0:
+		// Every upstream was in a cooldown period, so nothing was downloaded
+		status.State = updateSkipped
+	case err != nil:
+		status.State = updateFailed
+	default:
+		status.State = updateSucceeded
+	}
+
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	u.cancel()
+	u.cancel = nil
+	u.current = nil
+	u.last = status
+	close(u.idle)
+
+	return *status
+}
+
+// Function that asks the current update to stop. Files that were completely
+// downloaded before it stops are kept.
+func (u *updateRunner) cancelCurrent() (UpdateStatus, bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.current == nil {
+		return UpdateStatus{}, false
+	}
+
+	u.current.State = updateCancelling
+	u.cancel()
+
+	return *u.current, true
+}
+
+// Function that stops any more updates from starting and cancels the current
+// update. The returned channel is closed once no update is running.
+func (u *updateRunner) shutdown() <-chan struct{} {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	u.closed = true
+
+	if u.current == nil {
+		idle := make(chan struct{})
+		close(idle)
+
+		return idle
+	}
+
+	u.current.State = updateCancelling
+	u.cancel()
+
+	return u.idle
+}
+
+// Function that returns copies of the status of the current and last updates.
+func (u *updateRunner) status() UpdatesResponse {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	var response UpdatesResponse
+
+	if u.current != nil {
+		current := *u.current
+		response.Current = &current
+	}
+
+	if u.last != nil {
+		last := *u.last
+		response.Last = &last
+	}
+
+	return response
+}
+
+// Function that handles requests to the updates API, which shows the status
+// of updates and starts or cancels them. Every request requires the admin
+// token.
+func updatesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Server", "ClamAV Mirror")
+
+	if !(r.Method == "GET" || r.Method == "HEAD" || r.Method == "POST" || r.Method == "DELETE") {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !authorizeAdminRequest(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		writeJSON(w, http.StatusOK, updates.status())
+	case "POST":
+		status, _, started := updates.start(triggerAdmin)
+
+		if !started && status.ID == 0 {
+			writeJSONError(w, http.StatusServiceUnavailable, "sigserver is shutting down")
+			return
+		} else if !started {
+			writeJSONError(w, http.StatusConflict, "A signature update is already running")
+			return
+		}
+
+		logger.Printf("[%v] {%v} Started signature update [%v]", r.Method, clientName(r),
+			status.ID)
+
+		writeJSON(w, http.StatusAccepted, status)
+	case "DELETE":
+		status, cancelled := updates.cancelCurrent()
+
+		if !cancelled {
+			writeJSONError(w, http.StatusConflict, "No signature update is running")
+			return
+		}
+
+		logger.Printf("[%v] {%v} Cancelled signature update [%v]", r.Method, clientName(r),
+			status.ID)
+
+		writeJSON(w, http.StatusAccepted, status)
+	}
+}
@@ -0,0 +1,158 @@
+package sigserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/sigupdate"
+)
+
+// Function that replaces the update runner with one whose updates run until
+// they are cancelled.
+func useBlockingUpdates() (restore func()) {
+	previous := updates
+	updates = &updateRunner{}
+	updates.configure(func(ctx context.Context) (sigupdate.UpdateResult, error) {
+		<-ctx.Done()
+		return sigupdate.UpdateResult{}, ctx.Err()
+	})
+
+	return func() { updates = previous }
+}
+
+func TestSerializedStart(t *testing.T) {
+	defer useBlockingUpdates()()
+
+	first, done, started := updates.start(triggerSchedule)
+
+	if !started || first.State != updateRunning {
+		t.Fatalf("Expected the first update to start. Actual: %+v", first)
+	}
+
+	if status, _, started := updates.start(triggerAdmin); started || status.ID != first.ID {
+		t.Fatal("Expected an update not to start while another is running")
+	}
+
+	if status, cancelled := updates.cancelCurrent(); !cancelled || status.State != updateCancelling {
+		t.Fatalf("Expected the running update to be cancelled. Actual: %+v", status)
+	}
+
+	<-done
+
+	response := updates.status()
+
+	if response.Current != nil || response.Last == nil || response.Last.State != updateCancelled {
+		t.Fatalf("Expected the last update to be cancelled. Actual: %+v", response)
+	}
+
+	if _, cancelled := updates.cancelCurrent(); cancelled {
+		t.Error("Expected nothing to cancel once the update has finished")
+	}
+
+	if second, _, started := updates.start(triggerAdmin); !started || second.ID != first.ID+1 {
+		t.Errorf("Expected an update to start after the last one finished. Actual: %+v", second)
+	}
+
+	updates.cancelCurrent()
+}
+
+func TestFailedStart(t *testing.T) {
+	previous := updates
+	defer func() { updates = previous }()
+
+	updates = &updateRunner{}
+	updates.configure(func(ctx context.Context) (sigupdate.UpdateResult, error) {
+		return sigupdate.UpdateResult{}, context.DeadlineExceeded
+	})
+
+	_, done, _ := updates.start(triggerStartup)
+	<-done
+
+	if last := updates.status().Last; last.State != updateFailed || last.Error == "" {
+		t.Errorf("Expected the update to have failed. Actual: %+v", last)
+	}
+}
+
+func TestUpdatesHandler(t *testing.T) {
+	defer useBlockingUpdates()()
+
+	adminToken = "secret"
+	defer func() { adminToken = "" }()
+
+	request := func(method string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/api/updates", nil)
+
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		recorder := httptest.NewRecorder()
+		updatesHandler(recorder, r)
+
+		return recorder
+	}
+
+	if recorder := request("POST", "wrong"); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an invalid token to be rejected. Actual: %v", recorder.Code)
+	}
+
+	if recorder := request("GET", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a missing token to be rejected. Actual: %v", recorder.Code)
+	}
+
+	if recorder := request("POST", "secret"); recorder.Code != http.StatusAccepted {
+		t.Fatalf("Expected an update to be started. Actual: %v", recorder.Code)
+	}
+
+	if recorder := request("POST", "secret"); recorder.Code != http.StatusConflict {
+		t.Errorf("Expected a second update to be refused. Actual: %v", recorder.Code)
+	}
+
+	var response UpdatesResponse
+	json.Unmarshal(request("GET", "secret").Body.Bytes(), &response)
+
+	if response.Current == nil || response.Current.Trigger != triggerAdmin {
+		t.Errorf("Expected the running update in the status. Actual: %+v", response)
+	}
+
+	if recorder := request("DELETE", "secret"); recorder.Code != http.StatusAccepted {
+		t.Errorf("Expected the update to be cancelled. Actual: %v", recorder.Code)
+	}
+}
+
+func TestCooldownSkippedStart(t *testing.T) {
+	previous := updates
+	defer func() { updates = previous }()
+
+	updates = &updateRunner{}
+	updates.configure(func(ctx context.Context) (sigupdate.UpdateResult, error) {
+		return sigupdate.UpdateResult{}, errors.New(&sigupdate.CooldownError{
+			Host: "database.clamav.net", StatusCode: 429, Until: time.Now().Add(time.Hour)})
+	})
+
+	_, done, _ := updates.start(triggerAdmin)
+
+	if status := <-done; status.State != updateSkipped || status.Error == "" {
+		t.Errorf("Expected an update during a cooldown to be skipped. Actual: %+v", status)
+	}
+
+	updates.configure(func(ctx context.Context) (sigupdate.UpdateResult, error) {
+		return sigupdate.UpdateResult{}, errors.New("no such host")
+	})
+
+	_, done, _ = updates.start(triggerAdmin)
+
+	if status := <-done; status.State != updateFailed {
+		t.Errorf("Expected other errors to fail the update. Actual: %+v", status)
+	}
+}
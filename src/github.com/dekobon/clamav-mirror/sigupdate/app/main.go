@@ -11,6 +11,7 @@ import (
 
 import (
 	"github.com/go-errors/errors"
+	"github.com/pborman/getopt"
 )
 
 var githash = "unknown"
@@ -27,7 +28,15 @@ func main() {
 	}
 
 	config := sigupdate.ParseConfig(appVersionInfo)
-	err := sigupdate.RunSignatureUpdate(config)
+
+	var err error
+
+	// Any parameters after the options are treated as a management command
+	if args := getopt.Args(); len(args) > 0 {
+		err = sigupdate.RunCommand(config, args)
+	} else {
+		_, err = sigupdate.RunSignatureUpdate(config)
+	}
 
 	if err != nil {
 		log.Fatal(err.(*errors.Error).ErrorStack())
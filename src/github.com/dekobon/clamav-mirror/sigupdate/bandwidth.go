@@ -0,0 +1,42 @@
+package sigupdate
+
+import (
+	"io"
+	"sync"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Limits the rate of all downloads from upstreams in aggregate. When nil,
+// downloads are not limited.
+var bandwidthLimiter *utils.TokenBucket
+var bandwidthLimiterLock sync.Mutex
+
+// Function that sets the maximum number of bytes per second downloaded from
+// upstreams. A limit of zero removes the limit. The existing limiter is kept
+// if the limit hasn't changed so that downloads in progress stay limited.
+func configureBandwidthLimit(limit uint64) {
+	bandwidthLimiterLock.Lock()
+	defer bandwidthLimiterLock.Unlock()
+
+	if limit == 0 {
+		bandwidthLimiter = nil
+	} else if bandwidthLimiter == nil || bandwidthLimiter.Rate() != limit {
+		bandwidthLimiter = utils.NewTokenBucket(limit)
+	}
+}
+
+// Function that wraps a download so that it is subject to the bandwidth
+// limit.
+func limitBandwidth(reader io.Reader) io.Reader {
+	bandwidthLimiterLock.Lock()
+	defer bandwidthLimiterLock.Unlock()
+
+	if bandwidthLimiter == nil {
+		return reader
+	}
+
+	return bandwidthLimiter.Reader(reader)
+}
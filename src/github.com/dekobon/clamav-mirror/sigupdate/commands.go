@@ -0,0 +1,65 @@
+package sigupdate
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// RunCommand runs a sigupdate management command instead of updating the
+// signatures. The first argument is the name of the command.
+func RunCommand(config Config, args []string) error {
+	verboseMode = config.Verbose
+
+	switch args[0] {
+	case "mirrors":
+		return runMirrorsCommand(config)
+	case "config":
+		return runConfigCommand(config, args[1:])
+	default:
+		return errors.Errorf("Unknown command [%v]. Valid commands: mirrors, config", args[0])
+	}
+}
+
+// Function that displays the recorded health of each upstream mirror.
+//
+//	mirrors
+func runMirrorsCommand(config Config) error {
+	health, err := loadMirrorHealth(config.DataFilePath)
+
+	if err != nil {
+		return err
+	}
+
+	health.print(os.Stdout, time.Now())
+
+	return nil
+}
+
+/* Function that checks the configuration or displays it in the format of the
+ * configuration file. The configuration has already been validated by the
+ * time that a command runs, so validate only has to report success.
+ *
+ *	config validate
+ *	config dump */
+func runConfigCommand(config Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: config validate|dump")
+	}
+
+	switch args[0] {
+	case "validate":
+		fmt.Println("Configuration is valid")
+		return nil
+	case "dump":
+		WriteConfig(os.Stdout, config)
+		return nil
+	default:
+		return errors.Errorf("Unknown config command [%v]. Valid commands: validate, dump",
+			args[0])
+	}
+}
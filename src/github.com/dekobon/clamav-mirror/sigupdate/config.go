@@ -2,11 +2,13 @@ package sigupdate
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 import (
@@ -14,26 +16,39 @@ import (
 )
 
 import (
+	"github.com/go-errors/errors"
 	"github.com/pborman/getopt"
-	"strings"
 )
 
 // Config is a data structure that encapsulates the configuration parameters
 // used to run the sigupdate application.
 type Config struct {
-	Verbose           bool
-	DataFilePath      string
-	DiffThreshold     uint16
-	DownloadMirrorURL *url.URL
-	DNSDbInfoDomain   string
+	Verbose             bool
+	DataFilePath        string
+	DiffThreshold       uint16
+	Upstreams           []Upstream
+	UpstreamRetryBudget uint16
+	DNSDbInfoDomain     string
+	ProxyURL            *url.URL
+	NoProxy             string
+	CABundlePaths       []string
+	ClientCertPath      string
+	ClientKeyPath       string
+	BandwidthLimit      uint64
+	CVDDownloadWindows  []utils.TimeWindow
+	UserAgent           string
+	AppVersionInfo      utils.AppVersionInfo
+	MetricsTextfile     string
 }
 
 var defaultConfig = Config{
-	Verbose:           false,
-	DataFilePath:      "/var/clamav/data",
-	DiffThreshold:     100,
-	DownloadMirrorURL: defaultMirrorURL(),
-	DNSDbInfoDomain:   "current.cvd.clamav.net",
+	Verbose:             false,
+	DataFilePath:        "/var/clamav/data",
+	DiffThreshold:       100,
+	Upstreams:           []Upstream{{URL: defaultMirrorURL()}},
+	UpstreamRetryBudget: 0,
+	DNSDbInfoDomain:     "current.cvd.clamav.net",
+	UserAgent:           defaultUserAgent,
 }
 
 func defaultMirrorURL() *url.URL {
@@ -81,15 +96,27 @@ func ParseEnvVars(defaults Config) Config {
 	}
 
 	if downloadMirrorURL, present := os.LookupEnv("DOWNLOAD_MIRROR_URL"); present {
-		u, err := url.Parse(downloadMirrorURL)
+		upstreams, err := parseUpstreams(downloadMirrorURL)
 
 		if err != nil {
 			log.Fatal("Error parsing DOWNLOAD_MIRROR_URL", err)
 		}
 
-		config.DownloadMirrorURL = u
+		config.Upstreams = upstreams
 	} else {
-		config.DownloadMirrorURL = defaults.DownloadMirrorURL
+		config.Upstreams = defaults.Upstreams
+	}
+
+	if retryBudget, present := os.LookupEnv("UPSTREAM_RETRY_BUDGET"); present {
+		i, err := strconv.ParseUint(retryBudget, 10, 16)
+
+		if err != nil {
+			log.Fatal("Error parsing UPSTREAM_RETRY_BUDGET environment variable")
+		}
+
+		config.UpstreamRetryBudget = uint16(i)
+	} else {
+		config.UpstreamRetryBudget = defaults.UpstreamRetryBudget
 	}
 
 	if DNSDbDomain, present := os.LookupEnv("DNS_DB_DOMAIN"); present {
@@ -98,86 +125,495 @@ func ParseEnvVars(defaults Config) Config {
 		config.DNSDbInfoDomain = defaults.DNSDbInfoDomain
 	}
 
+	if proxy, present := os.LookupEnv("UPSTREAM_PROXY"); present {
+		u, err := parseProxyURL(proxy)
+
+		if err != nil {
+			log.Fatal("Error parsing UPSTREAM_PROXY environment variable", err)
+		}
+
+		config.ProxyURL = u
+	} else {
+		config.ProxyURL = defaults.ProxyURL
+	}
+
+	if noProxy, present := os.LookupEnv("UPSTREAM_NO_PROXY"); present {
+		config.NoProxy = noProxy
+	} else {
+		config.NoProxy = defaults.NoProxy
+	}
+
+	if caBundle, present := os.LookupEnv("UPSTREAM_CA_BUNDLE"); present {
+		config.CABundlePaths = parsePathList(caBundle)
+	} else {
+		config.CABundlePaths = defaults.CABundlePaths
+	}
+
+	if clientCert, present := os.LookupEnv("UPSTREAM_CLIENT_CERT"); present {
+		config.ClientCertPath = clientCert
+	} else {
+		config.ClientCertPath = defaults.ClientCertPath
+	}
+
+	if clientKey, present := os.LookupEnv("UPSTREAM_CLIENT_KEY"); present {
+		config.ClientKeyPath = clientKey
+	} else {
+		config.ClientKeyPath = defaults.ClientKeyPath
+	}
+
+	if bandwidthLimit, present := os.LookupEnv("BANDWIDTH_LIMIT"); present {
+		limit, err := utils.ParseByteRate(bandwidthLimit)
+
+		if err != nil {
+			log.Fatal("Error parsing BANDWIDTH_LIMIT environment variable", err)
+		}
+
+		config.BandwidthLimit = limit
+	} else {
+		config.BandwidthLimit = defaults.BandwidthLimit
+	}
+
+	if windows, present := os.LookupEnv("CVD_DOWNLOAD_WINDOWS"); present {
+		parsed, err := utils.ParseTimeWindows(windows)
+
+		if err != nil {
+			log.Fatal("Error parsing CVD_DOWNLOAD_WINDOWS environment variable", err)
+		}
+
+		config.CVDDownloadWindows = parsed
+	} else {
+		config.CVDDownloadWindows = defaults.CVDDownloadWindows
+	}
+
+	if userAgent, present := os.LookupEnv("USER_AGENT"); present {
+		if _, err := parseRequestTemplate("User-Agent", userAgent); err != nil {
+			log.Fatal("Error parsing USER_AGENT environment variable", err)
+		}
+
+		config.UserAgent = userAgent
+	} else {
+		config.UserAgent = defaults.UserAgent
+	}
+
+	if metricsTextfile, present := os.LookupEnv("METRICS_TEXTFILE"); present {
+		config.MetricsTextfile = metricsTextfile
+	} else {
+		config.MetricsTextfile = defaults.MetricsTextfile
+	}
+
 	return config
 }
 
+// Sections of the configuration file shared by sigupdate and sigserver
+var configFileSections = []string{"sigupdate", "sigserver"}
+
+// Settings that can be set in the sigupdate section of the configuration file
+var configSettings = []utils.ConfigSetting{
+	{Option: "verbose", EnvVar: "VERBOSE"},
+	{Option: "data-file-path", EnvVar: "DATA_FILE_PATH"},
+	{Option: "diff-count-threshold", EnvVar: "DIFF_THRESHOLD"},
+	{Option: "download-mirror-url", EnvVar: "DOWNLOAD_MIRROR_URL", Redact: redactUpstreams},
+	{Option: "upstream-retry-budget", EnvVar: "UPSTREAM_RETRY_BUDGET"},
+	{Option: "clamav-dns-db-info-domain", EnvVar: "DNS_DB_DOMAIN"},
+	{Option: "proxy", EnvVar: "UPSTREAM_PROXY", Redact: redactProxyURL},
+	{Option: "no-proxy", EnvVar: "UPSTREAM_NO_PROXY"},
+	{Option: "ca-bundle", EnvVar: "UPSTREAM_CA_BUNDLE"},
+	{Option: "client-cert", EnvVar: "UPSTREAM_CLIENT_CERT"},
+	{Option: "client-key", EnvVar: "UPSTREAM_CLIENT_KEY"},
+	{Option: "bandwidth-limit", EnvVar: "BANDWIDTH_LIMIT"},
+	{Option: "cvd-download-windows", EnvVar: "CVD_DOWNLOAD_WINDOWS"},
+	{Option: "user-agent", EnvVar: "USER_AGENT"},
+	{Option: "metrics-textfile", EnvVar: "METRICS_TEXTFILE"},
+}
+
+// Flags holds the values of the sigupdate command line options registered
+// with a getopt set. sigserver registers them alongside its own options.
+type Flags struct {
+	set                 *getopt.Set
+	verbose             *bool
+	version             *bool
+	configFile          *string
+	dataFilePath        *string
+	diffThreshold       *uint16
+	downloadMirrors     *string
+	upstreamRetryBudget *uint16
+	dnsDbInfoDomain     *string
+	proxy               *string
+	noProxy             *string
+	caBundle            *string
+	clientCert          *string
+	clientKey           *string
+	bandwidthLimit      *string
+	cvdDownloadWindows  *string
+	userAgent           *string
+	metricsTextfile     *string
+}
+
+// DefaultConfig returns the configuration used when nothing is configured.
+func DefaultConfig() Config {
+	return defaultConfig
+}
+
 // ParseCliFlags parses the CLI options passed to the application.
 func ParseCliFlags(appVersionInfo utils.AppVersionInfo, defaults Config) Config {
-	verbosePart := getopt.BoolLong("verbose", 'v',
+	flags := RegisterFlags(getopt.CommandLine, defaults)
+
+	getopt.Parse()
+
+	if flags.VersionRequested() {
+		PrintVersion(appVersionInfo)
+		os.Exit(0)
+	}
+
+	configFile, err := flags.ReadConfigFile()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := flags.ApplyConfigFile(configFile); err != nil {
+		log.Fatal(err)
+	}
+
+	config, err := flags.Config(appVersionInfo)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return config
+}
+
+/* RegisterFlags registers the sigupdate command line options with a getopt
+ * set, using the values of a configuration as their defaults. Boolean
+ * options start with the default value, so that setting them to false in
+ * the configuration file is possible. */
+func RegisterFlags(set *getopt.Set, defaults Config) *Flags {
+	flags := &Flags{set: set}
+
+	verbose := defaults.Verbose
+	set.BoolVarLong(&verbose, "verbose", 'v',
 		"Enable verbose mode with additional debugging information")
-	versionPart := getopt.BoolLong("version", 'V',
+	flags.verbose = &verbose
+	flags.version = set.BoolLong("version", 'V',
 		"Display the version and exit")
-	dataFilePart := getopt.StringLong("data-file-path", 'd',
+	flags.configFile = set.StringLong("config", 'c', os.Getenv("CONFIG_FILE"),
+		"Configuration file to read settings from")
+	flags.dataFilePath = set.StringLong("data-file-path", 'd',
 		defaults.DataFilePath, "Path to ClamAV data files")
-	diffThresholdPart := getopt.Uint16Long("diff-count-threshold", 't',
+	flags.diffThreshold = set.Uint16Long("diff-count-threshold", 't',
 		defaults.DiffThreshold,
 		"Number of diffs to download until we redownload the signature files")
-	downloadMirrorPart := getopt.StringLong("download-mirror-url", 'm',
-		defaults.DownloadMirrorURL.String(),
-		"URL to download signature updates from")
-	dnsDbInfoDomainPart := getopt.StringLong("clamav-dns-db-info-domain", 'i',
+	flags.downloadMirrors = set.StringLong("download-mirror-url", 'm',
+		joinUpstreams(defaults.Upstreams),
+		"Comma separated list of URLs to download signature updates from in "+
+			"order of preference")
+	flags.upstreamRetryBudget = set.Uint16Long("upstream-retry-budget", 0,
+		defaults.UpstreamRetryBudget,
+		"Number of mirrors to try for each file before failing over to the "+
+			"next upstream. 0 tries every mirror of a single upstream and 3 "+
+			"mirrors of each upstream when there are several")
+	flags.dnsDbInfoDomain = set.StringLong("clamav-dns-db-info-domain", 'i',
 		defaults.DNSDbInfoDomain,
 		"DNS domain to verify the virus database "+
 			"version via TXT record")
+	flags.proxy = set.StringLong("proxy", 0, proxyURLOrEmpty(defaults.ProxyURL),
+		"URL of the HTTP(S) proxy used to connect to upstreams")
+	flags.noProxy = set.StringLong("no-proxy", 0, defaults.NoProxy,
+		"Comma separated list of hosts to connect to without the proxy")
+	flags.caBundle = set.StringLong("ca-bundle", 0,
+		strings.Join(defaults.CABundlePaths, ","),
+		"Comma separated list of additional CA certificate bundles to trust")
+	flags.clientCert = set.StringLong("client-cert", 0, defaults.ClientCertPath,
+		"Client certificate presented to upstreams")
+	flags.clientKey = set.StringLong("client-key", 0, defaults.ClientKeyPath,
+		"Private key of the client certificate")
+	flags.bandwidthLimit = set.StringLong("bandwidth-limit", 0,
+		strconv.FormatUint(defaults.BandwidthLimit, 10),
+		"Maximum bytes per second to download (e.g. 512K), 0 for unlimited")
+	flags.cvdDownloadWindows = set.StringLong("cvd-download-windows", 0,
+		utils.JoinTimeWindows(defaults.CVDDownloadWindows),
+		"Comma separated local time windows (HH:MM-HH:MM) when full .cvd "+
+			"downloads are allowed")
+	flags.userAgent = set.StringLong("user-agent", 0, defaults.UserAgent,
+		"Template of the User-Agent header sent to upstreams")
+	flags.metricsTextfile = set.StringLong("metrics-textfile", 0, defaults.MetricsTextfile,
+		"File to write update metrics to for the node_exporter textfile collector")
+
+	return flags
+}
 
-	getopt.Parse()
+// VersionRequested returns true when the version option was given.
+func (flags *Flags) VersionRequested() bool {
+	return *flags.version
+}
 
-	if *versionPart {
-		fmt.Println(os.Args[0])
-		fmt.Println("")
-		fmt.Printf("Version        : %v\n", appVersionInfo.AppVersion)
-		fmt.Printf("Git Commit Hash: %v\n", appVersionInfo.GitCommitHash)
-		fmt.Printf("UTC Build Time : %v\n", appVersionInfo.UTCBuildTime)
-		fmt.Print("License        : MPLv2\n")
+// PrintVersion displays the version information of the application.
+func PrintVersion(appVersionInfo utils.AppVersionInfo) {
+	fmt.Println(os.Args[0])
+	fmt.Println("")
+	fmt.Printf("Version        : %v\n", appVersionInfo.AppVersion)
+	fmt.Printf("Git Commit Hash: %v\n", appVersionInfo.GitCommitHash)
+	fmt.Printf("UTC Build Time : %v\n", appVersionInfo.UTCBuildTime)
+	fmt.Print("License        : MPLv2\n")
+}
 
-		os.Exit(0)
+// ConfigFilePath returns the path of the configuration file, or an empty
+// string if there is none.
+func (flags *Flags) ConfigFilePath() string {
+	return *flags.configFile
+}
+
+// ReadConfigFile reads the configuration file given by the config option or
+// the CONFIG_FILE environment variable. Without one, it is empty.
+func (flags *Flags) ReadConfigFile() (utils.ConfigFile, error) {
+	if *flags.configFile == "" {
+		return utils.ConfigFile{}, nil
+	}
+
+	configFile, err := utils.ReadConfigFile(*flags.configFile)
+
+	if err != nil {
+		return nil, err
 	}
 
-	if !utils.Exists(*dataFilePart) {
-		msg := fmt.Sprintf("Data file path doesn't exist or isn't accessible: %v",
-			*dataFilePart)
-		log.Fatal(msg)
+	for name := range configFile {
+		known := false
+
+		for _, section := range configFileSections {
+			known = known || name == section
+		}
+
+		if !known {
+			return nil, errors.Errorf("Unknown section [%v] in config file [%v]. Valid "+
+				"sections: %v", name, *flags.configFile, strings.Join(configFileSections, ", "))
+		}
+	}
+
+	return configFile, nil
+}
+
+// ApplyConfigFile sets the sigupdate options that weren't given on the
+// command line or as environment variables from the configuration file.
+func (flags *Flags) ApplyConfigFile(configFile utils.ConfigFile) error {
+	err := utils.ApplyConfigSection(flags.set, configFile["sigupdate"], configSettings)
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Error in sigupdate section of config file", 1)
+	}
+
+	return nil
+}
+
+// WriteConfig writes the sigupdate options as a section of a configuration
+// file.
+func (flags *Flags) WriteConfig(writer io.Writer) {
+	utils.WriteConfigSection(writer, "sigupdate", flags.set, configSettings)
+}
+
+// WriteConfig writes a configuration as the sigupdate section of a
+// configuration file.
+func WriteConfig(writer io.Writer, config Config) {
+	RegisterFlags(getopt.New(), config).WriteConfig(writer)
+}
+
+// Config validates the options and returns the configuration that they
+// describe.
+func (flags *Flags) Config(appVersionInfo utils.AppVersionInfo) (Config, error) {
+	if !utils.Exists(*flags.dataFilePath) {
+		return Config{}, errors.Errorf("Data file path doesn't exist or isn't accessible: %v",
+			*flags.dataFilePath)
 	}
 
-	dataFileAbsPath, err := filepath.Abs(*dataFilePart)
+	dataFileAbsPath, err := filepath.Abs(*flags.dataFilePath)
 
 	if err != nil {
-		msg := fmt.Sprintf("Unable to parse absolute path of data file path: %v",
-			*dataFilePart)
-		log.Fatal(msg)
+		return Config{}, errors.Errorf("Unable to parse absolute path of data file path: %v",
+			*flags.dataFilePath)
 	}
 
 	if !utils.IsReadable(dataFileAbsPath) {
-		msg := fmt.Sprintf("Data file path doesn't have read access for "+
+		return Config{}, errors.Errorf("Data file path doesn't have read access for "+
 			"current user at path: %v", dataFileAbsPath)
-		log.Fatal(msg)
 	}
 
 	if !utils.IsWritable(dataFileAbsPath) {
-		msg := fmt.Sprintf("Data file path doesn't have write access for "+
+		return Config{}, errors.Errorf("Data file path doesn't have write access for "+
 			"current user at path: %v", dataFileAbsPath)
-		log.Fatal(msg)
 	}
 
-	var downloadMirrorServer string
+	upstreams, err := parseUpstreams(*flags.downloadMirrors)
 
-	if !strings.HasPrefix(*downloadMirrorPart, "http") {
-		downloadMirrorServer = "http://" + *downloadMirrorPart
-	} else {
-		downloadMirrorServer = *downloadMirrorPart
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing download mirror URLs [%v]: %v",
+			*flags.downloadMirrors, err)
+	}
+
+	proxyURL, err := parseProxyURL(*flags.proxy)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing proxy URL: %v", err)
+	}
+
+	caBundlePaths := parsePathList(*flags.caBundle)
+
+	for _, path := range append(caBundlePaths, *flags.clientCert, *flags.clientKey) {
+		if path != "" && !utils.Exists(path) {
+			return Config{}, errors.Errorf("Certificate file doesn't exist or isn't "+
+				"accessible: %v", path)
+		}
+	}
+
+	if (*flags.clientCert == "") != (*flags.clientKey == "") {
+		return Config{}, errors.Errorf("Both a client certificate and a client key must " +
+			"be specified")
+	}
+
+	bandwidthLimit, err := utils.ParseByteRate(*flags.bandwidthLimit)
+
+	if err != nil {
+		return Config{}, errors.Errorf("Error parsing bandwidth limit: %v", err)
 	}
 
-	downloadMirrorURL, err := url.Parse(downloadMirrorServer)
+	cvdWindows, err := utils.ParseTimeWindows(*flags.cvdDownloadWindows)
 
 	if err != nil {
-		log.Fatalf("Error parsing URL [%v]: %v", *downloadMirrorPart, err)
+		return Config{}, errors.Errorf("Error parsing .cvd download windows: %v", err)
+	}
+
+	if _, err := parseRequestTemplate("User-Agent", *flags.userAgent); err != nil {
+		return Config{}, errors.Errorf("Error parsing User-Agent template: %v", err)
 	}
 
 	return Config{
-		Verbose:           *verbosePart || defaults.Verbose,
-		DataFilePath:      dataFileAbsPath,
-		DiffThreshold:     *diffThresholdPart,
-		DownloadMirrorURL: downloadMirrorURL,
-		DNSDbInfoDomain:   *dnsDbInfoDomainPart,
+		Verbose:             *flags.verbose,
+		DataFilePath:        dataFileAbsPath,
+		DiffThreshold:       *flags.diffThreshold,
+		Upstreams:           upstreams,
+		UpstreamRetryBudget: *flags.upstreamRetryBudget,
+		DNSDbInfoDomain:     *flags.dnsDbInfoDomain,
+		ProxyURL:            proxyURL,
+		NoProxy:             *flags.noProxy,
+		CABundlePaths:       caBundlePaths,
+		ClientCertPath:      *flags.clientCert,
+		ClientKeyPath:       *flags.clientKey,
+		BandwidthLimit:      bandwidthLimit,
+		CVDDownloadWindows:  cvdWindows,
+		UserAgent:           *flags.userAgent,
+		AppVersionInfo:      appVersionInfo,
+		MetricsTextfile:     *flags.metricsTextfile,
+	}, nil
+}
+
+// Function that parses the URL of a proxy. The scheme defaults to http if
+// it isn't specified. An empty value means that no proxy is configured.
+func parseProxyURL(value string) (*url.URL, error) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return nil, nil
 	}
+
+	if !strings.Contains(value, "://") {
+		value = "http://" + value
+	}
+
+	u, err := url.Parse(value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported proxy scheme [%v]", u.Scheme)
+	}
+
+	return u, nil
+}
+
+// Function that returns the proxy URL as a string or an empty string if no
+// proxy is configured.
+func proxyURLOrEmpty(proxyURL *url.URL) string {
+	if proxyURL == nil {
+		return ""
+	}
+
+	return proxyURL.String()
+}
+
+/* Function that formats a URL with its password hidden so that it can be
+ * displayed. The userinfo is written by hand because url.URL would escape
+ * the redacted value. */
+func redactedURL(u *url.URL) string {
+	if u.User == nil {
+		return u.String()
+	}
+
+	if _, hasPassword := u.User.Password(); !hasPassword {
+		return u.String()
+	}
+
+	withoutUser := *u
+	withoutUser.User = nil
+	prefix := u.Scheme + "://"
+	userinfo := url.User(u.User.Username()).String() + ":" + utils.RedactedValue + "@"
+
+	return prefix + userinfo + strings.TrimPrefix(withoutUser.String(), prefix)
+}
+
+// Function that hides the password of a proxy URL so that it can be displayed.
+func redactProxyURL(value string) string {
+	proxyURL, err := parseProxyURL(value)
+
+	if err != nil {
+		return utils.RedactedValue
+	}
+
+	if proxyURL == nil {
+		return ""
+	}
+
+	return redactedURL(proxyURL)
+}
+
+// Function that hides the passwords and header values of a list of upstreams
+// so that it can be displayed. Header values often carry tokens.
+func redactUpstreams(value string) string {
+	if strings.TrimSpace(value) == "" {
+		return value
+	}
+
+	upstreams, err := parseUpstreams(value)
+
+	if err != nil {
+		return utils.RedactedValue
+	}
+
+	values := make([]string, len(upstreams))
+
+	for i, upstream := range upstreams {
+		headers := make(map[string]string, len(upstream.Headers))
+
+		for name := range upstream.Headers {
+			headers[name] = utils.RedactedValue
+		}
+
+		upstream.Headers = headers
+		values[i] = redactedURL(upstream.URL) + upstream.options()
+	}
+
+	return strings.Join(values, ",")
+}
+
+// Function that parses a comma separated list of file paths.
+func parsePathList(value string) []string {
+	var paths []string
+
+	for _, path := range strings.Split(value, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
 }
@@ -0,0 +1,211 @@
+package sigupdate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Filename of the file in the data directory storing upstream cooldowns
+const cooldownFilename = "sigupdate-cooldown.json"
+
+// Cooldown used when an upstream rate limits us without a Retry-After header
+const defaultRateLimitCooldown = time.Hour
+
+// Cooldown used when a mirror blocks us without a Retry-After header
+const defaultBlockedCooldown = time.Hour
+
+// Upper bound on the cooldown we will accept from a Retry-After header
+const maxCooldown = 7 * 24 * time.Hour
+
+// CooldownError is returned when an upstream has asked us to stop sending
+// requests until a given time.
+type CooldownError struct {
+	Host       string
+	StatusCode int
+	Until      time.Time
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("Upstream [%v] responded with status [%v] - not contacting "+
+		"it again until %v", e.Host, e.StatusCode, e.Until.Format(time.RFC3339))
+}
+
+// upstreamCooldown is the persisted cooldown for a single upstream host.
+type upstreamCooldown struct {
+	StatusCode int       `json:"status_code"`
+	Until      time.Time `json:"until"`
+}
+
+// Function that returns the CooldownError wrapped by an error if present.
+func asCooldownError(err error) (*CooldownError, bool) {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+
+	cooldown, ok := err.(*CooldownError)
+
+	return cooldown, ok
+}
+
+// Function that creates a CooldownError for a rate limited (429) or blocked
+// (403) response, honoring the Retry-After header if it is present.
+func newCooldownError(response *http.Response, now time.Time) *CooldownError {
+	duration, ok := parseRetryAfter(response.Header.Get("Retry-After"), now)
+
+	if !ok && response.StatusCode == http.StatusForbidden {
+		duration = defaultBlockedCooldown
+	} else if !ok {
+		duration = defaultRateLimitCooldown
+	}
+
+	if duration > maxCooldown {
+		duration = maxCooldown
+	}
+
+	return &CooldownError{
+		Host:       response.Request.URL.Host,
+		StatusCode: response.StatusCode,
+		Until:      now.Add(duration).UTC().Truncate(time.Second),
+	}
+}
+
+// Function that parses the value of a Retry-After header, which may either
+// be a number of seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if date.Before(now) {
+			return 0, true
+		}
+
+		return date.Sub(now), true
+	}
+
+	return 0, false
+}
+
+// Function that reads the upstream cooldowns from the data directory.
+func loadCooldowns(dataFilePath string) (map[string]upstreamCooldown, error) {
+	cooldowns := make(map[string]upstreamCooldown)
+	statePath := filepath.Join(dataFilePath, cooldownFilename)
+
+	if !utils.Exists(statePath) {
+		return cooldowns, nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read cooldown state [%v]", statePath)
+		return cooldowns, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := json.Unmarshal(data, &cooldowns); err != nil {
+		msg := fmt.Sprintf("Unable to parse cooldown state [%v]", statePath)
+		return cooldowns, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return cooldowns, nil
+}
+
+// Function that persists a cooldown for an upstream host to the data
+// directory so that subsequent runs don't contact the upstream until the
+// cooldown has expired. Expired cooldowns are dropped.
+func saveCooldown(dataFilePath string, host string, cooldown CooldownError) error {
+	cooldowns, err := loadCooldowns(dataFilePath)
+
+	if err != nil {
+		logError.Printf("Discarding unreadable cooldown state. %v", err)
+		cooldowns = make(map[string]upstreamCooldown)
+	}
+
+	now := time.Now()
+
+	for existingHost, existing := range cooldowns {
+		if !existing.Until.After(now) {
+			delete(cooldowns, existingHost)
+		}
+	}
+
+	cooldowns[host] = upstreamCooldown{
+		StatusCode: cooldown.StatusCode,
+		Until:      cooldown.Until,
+	}
+
+	data, err := json.MarshalIndent(cooldowns, "", "  ")
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Unable to serialize cooldown state", 1)
+	}
+
+	return utils.WriteFileAtomically(filepath.Join(dataFilePath, cooldownFilename), data, now)
+}
+
+// IsCooldownError checks to see if an update or fetch failed because an
+// upstream asked us to stop sending requests, including when every upstream
+// was already in a cooldown period.
+func IsCooldownError(err error) bool {
+	_, ok := asCooldownError(err)
+	return ok
+}
+
+// Function that returns the cooldown of the configured upstreams that ends
+// first. It is called when every upstream is in a cooldown period.
+func earliestCooldown(config Config, now time.Time) *CooldownError {
+	var earliest *CooldownError
+
+	for _, upstream := range config.Upstreams {
+		cooldown, active := activeCooldown(config.DataFilePath, upstream.URL.Host, now)
+
+		if active && (earliest == nil || cooldown.Until.Before(earliest.Until)) {
+			earliest = cooldown
+		}
+	}
+
+	if earliest == nil {
+		earliest = &CooldownError{Until: now}
+	}
+
+	return earliest
+}
+
+// Function that checks to see if an upstream host is in a cooldown period.
+func activeCooldown(dataFilePath string, host string, now time.Time) (*CooldownError, bool) {
+	cooldowns, err := loadCooldowns(dataFilePath)
+
+	if err != nil {
+		logError.Printf("Ignoring unreadable cooldown state. %v", err)
+		return nil, false
+	}
+
+	cooldown, ok := cooldowns[host]
+
+	if !ok || !cooldown.Until.After(now) {
+		return nil, false
+	}
+
+	return &CooldownError{Host: host, StatusCode: cooldown.StatusCode, Until: cooldown.Until}, true
+}
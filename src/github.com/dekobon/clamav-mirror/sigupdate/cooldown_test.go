@@ -0,0 +1,163 @@
+package sigupdate
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSecondsParseRetryAfter(t *testing.T) {
+	duration, ok := parseRetryAfter("120", time.Now())
+
+	if !ok || duration != 2*time.Minute {
+		t.Errorf("Expected 2 minutes. Actual: %v %v", duration, ok)
+	}
+}
+
+func TestHTTPDateParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 7, 27, 12, 0, 0, 0, time.UTC)
+	duration, ok := parseRetryAfter("Thu, 27 Jul 2017 13:00:00 GMT", now)
+
+	if !ok || duration != time.Hour {
+		t.Errorf("Expected 1 hour. Actual: %v %v", duration, ok)
+	}
+}
+
+func TestInvalidParseRetryAfter(t *testing.T) {
+	if _, ok := parseRetryAfter("soon", time.Now()); ok {
+		t.Error("Expected invalid Retry-After value to be rejected")
+	}
+}
+
+func TestSaveAndLoadActiveCooldown(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cooldown-")
+	defer os.RemoveAll(dir)
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	err := saveCooldown(dir, "database.clamav.net", CooldownError{StatusCode: 429, Until: until})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cooldown, active := activeCooldown(dir, "database.clamav.net", time.Now())
+
+	if !active || !cooldown.Until.Equal(until) || cooldown.StatusCode != 429 {
+		t.Errorf("Expected active cooldown until %v. Actual: %+v", until, cooldown)
+	}
+
+	if _, active := activeCooldown(dir, "other.mirror.net", time.Now()); active {
+		t.Error("Cooldowns should only apply to the host that asked for them")
+	}
+
+	if _, active := activeCooldown(dir, "database.clamav.net", until.Add(time.Second)); active {
+		t.Error("Cooldown should not be active after it expires")
+	}
+}
+
+func TestRateLimitedExecuteHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "cooldown-")
+	defer os.RemoveAll(dir)
+
+	downloadURL, _ := url.Parse(server.URL + "/daily.cvd")
+	start := time.Now()
+
+	statusCode, err := executeHTTPRequest(context.Background(), Download{Filename: "daily.cvd",
+		LocalFilePath: filepath.Join(dir, "daily.cvd")}, downloadURL, net.IPAddr{}, nil)
+
+	if statusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status code 429. Actual: %v", statusCode)
+	}
+
+	cooldown, ok := asCooldownError(err)
+
+	if !ok {
+		t.Fatalf("Expected a cooldown error. Actual: %v", err)
+	}
+
+	if cooldown.Until.Before(start.Add(59 * time.Minute)) {
+		t.Errorf("Expected cooldown to honor Retry-After. Actual: %v", cooldown.Until)
+	}
+}
+
+func TestBlockedWithoutRetryAfterExecuteHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "cooldown-")
+	defer os.RemoveAll(dir)
+
+	downloadURL, _ := url.Parse(server.URL + "/daily.cvd")
+
+	_, err := executeHTTPRequest(context.Background(), Download{Filename: "daily.cvd",
+		LocalFilePath: filepath.Join(dir, "daily.cvd")}, downloadURL, net.IPAddr{}, nil)
+
+	cooldown, ok := asCooldownError(err)
+
+	if !ok || cooldown.Until.Before(time.Now().Add(defaultBlockedCooldown-time.Minute)) {
+		t.Errorf("Expected default blocked cooldown. Actual: %v", err)
+	}
+}
+
+func TestAllUpstreamsInCooldownRunSignatureUpdate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "cooldown-")
+	defer os.RemoveAll(dir)
+
+	defer func() {
+		upstreamsConfigured = false
+		mirrors.replace(newMirrorHealthDB())
+	}()
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	saveCooldown(dir, "database.clamav.net", CooldownError{StatusCode: 429, Until: until})
+	saveCooldown(dir, "mirror.example.org", CooldownError{StatusCode: 403, Until: until.Add(time.Hour)})
+
+	upstreams, _ := parseUpstreams("https://database.clamav.net,https://mirror.example.org")
+	failures := updateFailures.Value("cooldown")
+
+	lastSuccessLock.Lock()
+	previousSuccess := lastSuccess
+	lastSuccessLock.Unlock()
+
+	result, err := RunSignatureUpdate(Config{DataFilePath: dir, Upstreams: upstreams})
+
+	cooldown, ok := asCooldownError(err)
+
+	if !ok || !IsCooldownError(err) {
+		t.Fatalf("Expected a skipped update to return a cooldown error. Actual: %v", err)
+	}
+
+	if cooldown.Host != "database.clamav.net" || !cooldown.Until.Equal(until) {
+		t.Errorf("Expected the cooldown that ends first. Actual: %+v", cooldown)
+	}
+
+	if len(result.Signatures) != 0 {
+		t.Errorf("Expected no signatures from a skipped update. Actual: %+v", result)
+	}
+
+	if updateFailures.Value("cooldown") != failures+1 {
+		t.Error("Expected a skipped update to be counted as a cooldown failure")
+	}
+
+	lastSuccessLock.Lock()
+	defer lastSuccessLock.Unlock()
+
+	if !lastSuccess.Equal(previousSuccess) {
+		t.Error("Expected a skipped update not to be recorded as a success")
+	}
+}
@@ -28,6 +28,10 @@ type Download struct {
 	Filename         string
 	LocalFilePath    string
 	oldSignatureInfo SignatureInfo
+	// Signature version expected to be in the file
+	version uint64
+	// Latest signature version advertised by ClamAV
+	advertisedVersion uint64
 }
 
 // resolveMirrorIP resolves all IPs associated with a domain.
@@ -40,15 +44,19 @@ func resolveMirrorIP(domain string) ([]net.IPAddr, error) {
 		return []net.IPAddr{}, errors.WrapPrefix(err, msg, 1)
 	}
 
+	if len(addresses) == 0 {
+		return addresses, errors.Errorf("No addresses found for domain [%v]", domain)
+	}
+
 	return addresses, nil
 }
 
-func buildDownloadURL(downloadMirrorURL *url.URL, host net.IPAddr,
-	filename string) *url.URL {
-	hostIP := host.IP.String()
-
+// Function that builds the URL of a file on an upstream. The hostname of the
+// upstream is kept so that the Host header and TLS verification are correct
+// when connecting to a specific mirror address.
+func buildDownloadURL(downloadMirrorURL *url.URL, filename string) *url.URL {
 	downloadURL := url.URL{
-		Host:       hostIP,
+		Host:       downloadMirrorURL.Host,
 		ForceQuery: downloadMirrorURL.ForceQuery,
 		Fragment:   downloadMirrorURL.Fragment,
 		Opaque:     downloadMirrorURL.Opaque,
@@ -62,26 +70,16 @@ func buildDownloadURL(downloadMirrorURL *url.URL, host net.IPAddr,
 	return &downloadURL
 }
 
-func downloadFilesWithRetry(downloads *list.List, downloadMirrorURL *url.URL) error {
-	addresses, err := resolveMirrorIP(downloadMirrorURL.Host)
-
-	if err != nil {
-		msg := fmt.Sprintf("Unable to resolve host [%v]", downloadMirrorURL.Host)
-		return errors.WrapPrefix(err, msg, 1)
-	}
-
-	// We randomize the list of address so that we are not always
-	// hitting the same mirrors.
-	utils.Shuffle(addresses)
-	mirrorIndex := 0
-	mirrorCount := len(addresses)
+// Function that downloads a list of files, stopping at the first file that
+// can't be downloaded from any upstream.
+func downloadFilesWithRetry(ctx context.Context, downloads *list.List,
+	upstreams []*upstreamState) ([]DownloadSource, error) {
+	var sources []DownloadSource
 
 	for e := downloads.Front(); e != nil; e = e.Next() {
-	retry:
-
 		d, ok := e.Value.(Download)
 		if !ok {
-			return errors.Errorf("Incorrect type. Expecting Download. "+
+			return sources, errors.Errorf("Incorrect type. Expecting Download. "+
 				"Actually: %v", e.Value)
 		}
 
@@ -89,76 +87,201 @@ func downloadFilesWithRetry(downloads *list.List, downloadMirrorURL *url.URL) er
 			continue
 		}
 
-		downloadURL := buildDownloadURL(downloadMirrorURL, addresses[mirrorIndex],
-			d.Filename)
+		source, _, err := downloadWithRetry(ctx, d, upstreams)
 
-		statusCode, err := downloadFile(d, downloadURL)
+		if err != nil {
+			return sources, err
+		}
 
-		/* Many times different mirrors will have different .cdiff files
-		 * available. We want to retry with a different mirror in case the
-		 * file can't be found. Alternatively, in the case of 500 errors, we
-		 * also want to try another mirror. */
-		if (statusCode == http.StatusNotFound && mirrorIndex < mirrorCount) ||
-			statusCode > 499 {
+		if source != (DownloadSource{}) {
+			sources = append(sources, source)
+		}
+	}
+
+	return sources, nil
+}
+
+// Function that downloads a file by trying each upstream in order. Up to the
+// upstream's retry budget of mirror addresses are tried before failing over
+// to the next upstream. The source is empty if the file was not modified.
+// Once the context is cancelled, no further mirrors are tried.
+func downloadWithRetry(ctx context.Context, download Download,
+	upstreams []*upstreamState) (DownloadSource, int, error) {
+	statusCode := -1
+	var lastErr error = errors.Errorf("No upstreams are available to download [%v]",
+		download.Filename)
 
-			mirrorIndex++
-			goto retry
+	for _, upstream := range upstreams {
+		if upstream.cooldown != nil {
+			continue
 		}
 
+		addresses, err := upstream.resolve()
+
 		if err != nil {
-			return err
+			logError.Println(err)
+			lastErr = err
+			continue
 		}
-	}
 
-	return nil
-}
+		// Number of mirrors of this upstream that have blocked us
+		blocked := 0
 
-func downloadWithRetry(download Download, downloadMirrorURL *url.URL) (int, error) {
-	addresses, err := resolveMirrorIP(downloadMirrorURL.Host)
+		for attempt := 0; attempt < int(upstream.RetryBudget) && attempt < len(addresses); attempt++ {
+			if ctx.Err() != nil {
+				return DownloadSource{}, statusCode, cancelledError(ctx)
+			}
 
-	if err != nil {
-		msg := fmt.Sprintf("Unable to resolve host [%v]", downloadMirrorURL.Host)
-		return -1, errors.WrapPrefix(err, msg, 1)
+			address := addresses[upstream.mirrorIndex%len(addresses)]
+			downloadURL := buildDownloadURL(upstream.URL, download.Filename)
+			statusCode, err = downloadFile(ctx, download, downloadURL, address, upstream.headers)
+
+			if err == nil {
+				if statusCode != http.StatusOK {
+					return DownloadSource{}, statusCode, nil
+				}
+
+				return DownloadSource{
+					Filename:   download.Filename,
+					Upstream:   upstream.URL.String(),
+					Address:    mirrorAddress(downloadURL, address),
+					Downloaded: time.Now().UTC(),
+				}, statusCode, nil
+			}
+
+			lastErr = err
+
+			if ctx.Err() != nil {
+				return DownloadSource{}, statusCode, cancelledError(ctx)
+			}
+
+			// Don't try other mirrors when the upstream has asked us to back off
+			if cooldown, ok := asCooldownError(err); ok {
+				if cooldown.StatusCode == http.StatusForbidden {
+					blocked++
+				}
+
+				lastAttempt := attempt+1 >= int(upstream.RetryBudget) || attempt+1 >= len(addresses)
+
+				if upstream.backOff(cooldown, mirrorAddress(downloadURL, address),
+					lastAttempt && blocked == attempt+1) {
+					break
+				}
+
+				upstream.mirrorIndex++
+				continue
+			}
+
+			// Other mirrors of this upstream are unlikely to do better
+			if !shouldTryNextMirror(download, statusCode, err) {
+				break
+			}
+
+			/* A stale mirror may still have given us a file newer than our local
+			 * copy. Compare against it so that another stale mirror can't replace
+			 * it with something older. */
+			if _, ok := asStaleMirrorError(err); ok && utils.Exists(download.LocalFilePath) {
+				if info, infoErr := readSignatureInfo(download.LocalFilePath); infoErr == nil {
+					download.oldSignatureInfo = info
+				}
+			}
+
+			upstream.mirrorIndex++
+		}
+
+		if verboseMode && upstream.cooldown == nil {
+			logger.Printf("Failing over from upstream [%v] for [%v]", upstream.URL,
+				download.Filename)
+		}
 	}
 
-	// We randomize the list of address so that we are not always
-	// hitting the same mirrors.
-	utils.Shuffle(addresses)
-	mirrorIndex := 0
-	mirrorCount := len(addresses)
+	// Only report a cooldown when there are no upstreams left to try
+	if _, ok := asCooldownError(lastErr); ok && !allCoolingDown(upstreams) {
+		lastErr = errors.Errorf("Unable to download [%v] from any upstream", download.Filename)
+	}
 
-retry:
-	downloadURL := buildDownloadURL(downloadMirrorURL, addresses[mirrorIndex],
-		download.Filename)
-	statusCode, err := downloadFile(download, downloadURL)
+	return DownloadSource{}, statusCode, lastErr
+}
 
-	if err != nil && mirrorIndex < mirrorCount {
-		mirrorIndex++
-		goto retry
-	} else if err != nil {
-		return statusCode, err
+// Function that decides if a failed download should be tried with another
+// mirror. Any failure of a .cvd file is retried. Many times different
+// mirrors will have different .cdiff files available, so we retry in case
+// the file can't be found. Alternatively, in the case of 500 errors or
+// connection failures, we also want to try another mirror.
+func shouldTryNextMirror(download Download, statusCode int, err error) bool {
+	if strings.HasSuffix(download.Filename, ".cvd") {
+		return true
 	}
 
-	return statusCode, err
+	return statusCode == http.StatusNotFound || statusCode > 499 ||
+		(err != nil && statusCode < 0)
 }
 
-func downloadFile(download Download, downloadURL *url.URL) (int, error) {
-	logger.Printf("Attempting to download: %v", downloadURL.String())
+func downloadFile(ctx context.Context, download Download, downloadURL *url.URL, address net.IPAddr,
+	headers http.Header) (int, error) {
+	logger.Printf("Attempting to download: %v [%v]", downloadURL.String(),
+		mirrorAddress(downloadURL, address))
 
-	statusCode, err := executeHTTPRequest(download.Filename,
-		download.LocalFilePath, downloadURL, download.oldSignatureInfo)
+	statusCode, err := executeHTTPRequest(ctx, download, downloadURL, address, headers)
 
 	if verboseMode {
 		logger.Printf("Status code: %v", statusCode)
 	}
 
+	// A cancelled download says nothing about the health of the mirror
+	if ctx.Err() == nil {
+		recordDownloadOutcome(download, mirrorAddress(downloadURL, address), statusCode, err)
+	}
+
 	return statusCode, err
 }
 
+// Function that updates the health of a mirror based on the result of a
+// download. A missing file means that the mirror is lagging behind, while
+// connection failures and server errors count against the mirror. Responses
+// asking us to back off are handled by upstreamState.backOff, so they aren't
+// recorded.
+func recordDownloadOutcome(download Download, address string, statusCode int, err error) {
+	if _, ok := asCooldownError(err); ok {
+		return
+	}
+
+	now := time.Now()
+
+	if stale, ok := asStaleMirrorError(err); ok {
+		mirrors.recordStale(address, stale.lag())
+		return
+	}
+
+	switch {
+	case statusCode == http.StatusNotFound:
+		var lag uint64
+
+		if download.advertisedVersion >= download.version && download.version > 0 {
+			lag = download.advertisedVersion - download.version + 1
+		}
+
+		mirrors.recordNotFound(address, lag)
+	case err == nil:
+		current := download.version > 0 && download.version == download.advertisedVersion
+		mirrors.recordSuccess(address, current, now)
+	case statusCode < 0 || statusCode > 499:
+		mirrors.recordFailure(address, now)
+	}
+}
+
 // Function that downloads a file from the mirror URL and moves it into the
-// data directory if it was successfully downloaded.
-func executeHTTPRequest(filename string, localFilePath string,
-	downloadURL *url.URL, oldSignatureInfo SignatureInfo) (int, error) {
+// data directory if it was successfully downloaded. The connection is made to
+// the given mirror address unless it is empty, in which case the hostname is
+// resolved as normal. The given headers are added to the request. A
+// StaleMirrorError is returned if the mirror only has a .cvd file older than
+// the advertised version. The request is aborted if the context is cancelled.
+func executeHTTPRequest(ctx context.Context, download Download, downloadURL *url.URL,
+	address net.IPAddr, headers http.Header) (int, error) {
+	filename := download.Filename
+	localFilePath := download.LocalFilePath
+	oldSignatureInfo := download.oldSignatureInfo
+	isCVD := strings.HasSuffix(filename, ".cvd")
 
 	unknownStatus := -1
 
@@ -175,15 +298,12 @@ func executeHTTPRequest(filename string, localFilePath string,
 
 	defer output.Close()
 
-	request, err := http.NewRequest("GET", downloadURL.String(), nil)
+	request, err := newUpstreamRequest(ctx, downloadURL, headers)
 
 	if err != nil {
-		msg := fmt.Sprintf("Unable to create request for: [GEt %v]", downloadURL)
-		return unknownStatus, errors.WrapPrefix(err, msg, 1)
+		return unknownStatus, err
 	}
 
-	request.Header.Add("User-Agent", "github.com/dekobon/clamav-mirror")
-
 	/* For .cvd files, the only authoritative way know what is newer is
 	 * to use sigtool. */
 	if oldSignatureInfo != (SignatureInfo{}) {
@@ -201,16 +321,42 @@ func executeHTTPRequest(filename string, localFilePath string,
 		}
 	}
 
-	response, err := http.DefaultClient.Do(request)
+	requestStart := time.Now()
+	response, err := upstreamClientFor(downloadURL, address).Do(request)
 
 	if err != nil {
 		msg := fmt.Sprintf("Unable to retrieve file from [%v]", downloadURL)
 		return unknownStatus, errors.WrapPrefix(err, msg, 1)
 	}
 
+	defer response.Body.Close()
+
+	mirrors.recordLatency(mirrorAddress(downloadURL, address), time.Since(requestStart))
+
+	/* Upstreams respond with 429 when we are being rate limited and with 403
+	 * when we have been blocked. In both cases we need to stop sending
+	 * requests until the upstream or mirror is willing to talk to us again. */
+	if response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode == http.StatusForbidden {
+		return response.StatusCode, errors.New(newCooldownError(response, time.Now()))
+	}
+
 	if response.StatusCode == http.StatusNotModified {
 		logger.Printf("Not downloading [%v] because local copy is newer or the same as remote",
 			filename)
+
+		/* The mirror doesn't have anything newer than our local copy, so if
+		 * our local copy is behind the advertised version then so is the
+		 * mirror. */
+		if isCVD && oldSignatureInfo != (SignatureInfo{}) &&
+			oldSignatureInfo.Version < download.advertisedVersion {
+			return response.StatusCode, errors.New(&StaleMirrorError{
+				Filename:          filename,
+				Version:           oldSignatureInfo.Version,
+				AdvertisedVersion: download.advertisedVersion,
+			})
+		}
+
 		return response.StatusCode, nil
 	}
 
@@ -219,11 +365,13 @@ func executeHTTPRequest(filename string, localFilePath string,
 		return response.StatusCode, errors.New(msg)
 	}
 
-	defer response.Body.Close()
-
-	n, err := io.Copy(output, response.Body)
+	body := countedReader{reader: limitBandwidth(response.Body),
+		mirror: mirrorAddress(downloadURL, address)}
+	n, err := io.Copy(output, body)
 
 	if err != nil {
+		os.Remove(output.Name())
+
 		msg := fmt.Sprintf("Error copying data from URL [%v] to local file [%v]",
 			downloadURL, localFilePath)
 		return response.StatusCode, errors.WrapPrefix(err, msg, 1)
@@ -231,7 +379,7 @@ func executeHTTPRequest(filename string, localFilePath string,
 
 	var newSignatureInfo SignatureInfo
 
-	if strings.HasSuffix(filename, ".cvd") && oldSignatureInfo != (SignatureInfo{}) {
+	if isCVD && (oldSignatureInfo != (SignatureInfo{}) || download.advertisedVersion > 0) {
 		info, err := readSignatureInfo(output.Name())
 
 		// If there is a problem with the new file, we don't overwrite the original
@@ -276,9 +424,41 @@ func executeHTTPRequest(filename string, localFilePath string,
 		}
 	}
 
+	/* We keep a stale file if it is newer than what we had, but we report it
+	 * so that another mirror can be tried for the advertised version. */
+	if isCVD && newSignatureInfo.Version < download.advertisedVersion {
+		return response.StatusCode, errors.New(&StaleMirrorError{
+			Filename:          filename,
+			Version:           newSignatureInfo.Version,
+			AdvertisedVersion: download.advertisedVersion,
+		})
+	}
+
 	return response.StatusCode, nil
 }
 
+// Function that creates a GET request for a file on an upstream with the
+// given headers. The request is aborted when the context is cancelled.
+func newUpstreamRequest(ctx context.Context, downloadURL *url.URL,
+	headers http.Header) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", downloadURL.String(), nil)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create request for: [GET %v]", downloadURL)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	for name, values := range headers {
+		request.Header[name] = values
+	}
+
+	if request.Header.Get("User-Agent") == "" {
+		request.Header.Set("User-Agent", fallbackUserAgent)
+	}
+
+	return request, nil
+}
+
 // Function that checks to see if we can overwrite a file with a newly downloaded file
 func isItOkToOverwrite(filename string, oldSignatureInfo SignatureInfo, newSignatureInfo SignatureInfo) bool {
 	if !strings.HasSuffix(filename, ".cvd") || oldSignatureInfo == (SignatureInfo{}) {
@@ -0,0 +1,195 @@
+package sigupdate
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// UpstreamFile is a file that is being downloaded from an upstream. The
+// caller is responsible for closing the body. ContentLength is -1 when the
+// upstream didn't send the length of the file.
+type UpstreamFile struct {
+	Body          io.ReadCloser
+	ContentLength int64
+	LastModified  time.Time
+	Source        DownloadSource
+}
+
+// Body of an upstream response that is subject to the bandwidth limit
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// OpenUpstreamFile requests a single file from the configured upstreams,
+// trying mirrors and failing over between upstreams in the same way as
+// RunSignatureUpdate. Unlike RunSignatureUpdate, the file isn't written to
+// the data directory or verified, so that the caller can stream it while it
+// downloads. The status code of the last response is returned along with any
+// error, or -1 if no response was received.
+func OpenUpstreamFile(config Config, filename string) (UpstreamFile, int, error) {
+	return OpenUpstreamFileContext(context.Background(), config, filename)
+}
+
+// OpenUpstreamFileContext requests a single file from the configured
+// upstreams like OpenUpstreamFile. Once the context is cancelled or its
+// deadline has passed, the request is aborted and reading the body fails.
+func OpenUpstreamFileContext(ctx context.Context, config Config, filename string) (UpstreamFile, int, error) {
+	statusCode := -1
+	var lastErr error = errors.Errorf("No upstreams are available to download [%v]",
+		filename)
+
+	if err := configureUpstreamsOnce(config); err != nil {
+		return UpstreamFile{}, statusCode, err
+	}
+
+	upstreams := availableUpstreams(config, time.Now())
+	identity := lastRequestIdentity(config)
+
+	if err := configureRequestHeaders(config, upstreams, identity); err != nil {
+		return UpstreamFile{}, statusCode, err
+	}
+
+	defer func() {
+		if saveErr := mirrors.save(config.DataFilePath); saveErr != nil {
+			logError.Printf("Unable to save mirror state. %v", saveErr)
+		}
+	}()
+
+	download := Download{Filename: filename}
+
+	for _, upstream := range upstreams {
+		addresses, err := upstream.resolve()
+
+		if err != nil {
+			logError.Println(err)
+			lastErr = err
+			continue
+		}
+
+		// Number of mirrors of this upstream that have blocked us
+		blocked := 0
+
+		for attempt := 0; attempt < int(upstream.RetryBudget) && attempt < len(addresses); attempt++ {
+			if ctx.Err() != nil {
+				msg := fmt.Sprintf("Fetching [%v] was cancelled", filename)
+				return UpstreamFile{}, statusCode, errors.WrapPrefix(ctx.Err(), msg, 1)
+			}
+
+			address := addresses[upstream.mirrorIndex%len(addresses)]
+			downloadURL := buildDownloadURL(upstream.URL, filename)
+
+			var file UpstreamFile
+			file, statusCode, err = openMirrorFile(ctx, downloadURL, address, upstream.headers)
+
+			recordDownloadOutcome(download, mirrorAddress(downloadURL, address), statusCode, err)
+
+			if err == nil {
+				file.Source = DownloadSource{
+					Filename:   filename,
+					Upstream:   upstream.URL.String(),
+					Address:    mirrorAddress(downloadURL, address),
+					Downloaded: time.Now().UTC(),
+				}
+
+				return file, statusCode, nil
+			}
+
+			lastErr = err
+
+			if cooldown, ok := asCooldownError(err); ok {
+				if cooldown.StatusCode == http.StatusForbidden {
+					blocked++
+				}
+
+				lastAttempt := attempt+1 >= int(upstream.RetryBudget) || attempt+1 >= len(addresses)
+
+				if upstream.backOff(cooldown, mirrorAddress(downloadURL, address),
+					lastAttempt && blocked == attempt+1) {
+					saveErr := saveCooldown(config.DataFilePath, cooldown.Host, *cooldown)
+
+					if saveErr != nil {
+						logError.Printf("Unable to save cooldown state. %v", saveErr)
+					}
+
+					break
+				}
+
+				upstream.mirrorIndex++
+				continue
+			}
+
+			if !shouldTryNextMirror(download, statusCode, err) {
+				break
+			}
+
+			upstream.mirrorIndex++
+		}
+	}
+
+	return UpstreamFile{}, statusCode, lastErr
+}
+
+// Function that requests a file from a single mirror address and returns the
+// response body if the mirror has the file.
+func openMirrorFile(ctx context.Context, downloadURL *url.URL, address net.IPAddr,
+	headers http.Header) (UpstreamFile, int, error) {
+	unknownStatus := -1
+
+	logger.Printf("Attempting to fetch: %v [%v]", downloadURL,
+		mirrorAddress(downloadURL, address))
+
+	request, err := newUpstreamRequest(ctx, downloadURL, headers)
+
+	if err != nil {
+		return UpstreamFile{}, unknownStatus, err
+	}
+
+	requestStart := time.Now()
+	response, err := upstreamClientFor(downloadURL, address).Do(request)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to retrieve file from [%v]", downloadURL)
+		return UpstreamFile{}, unknownStatus, errors.WrapPrefix(err, msg, 1)
+	}
+
+	mirrors.recordLatency(mirrorAddress(downloadURL, address), time.Since(requestStart))
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+
+		if response.StatusCode == http.StatusTooManyRequests ||
+			response.StatusCode == http.StatusForbidden {
+			return UpstreamFile{}, response.StatusCode,
+				errors.New(newCooldownError(response, time.Now()))
+		}
+
+		msg := fmt.Sprintf("Unable to download file: [%v]", response.Status)
+		return UpstreamFile{}, response.StatusCode, errors.New(msg)
+	}
+
+	lastModified, err := http.ParseTime(response.Header.Get("Last-Modified"))
+
+	if err != nil {
+		lastModified = time.Now()
+	}
+
+	return UpstreamFile{
+		Body: limitedBody{
+			Reader: countedReader{reader: limitBandwidth(response.Body),
+				mirror: mirrorAddress(downloadURL, address)},
+			Closer: response.Body,
+		},
+		ContentLength: response.ContentLength,
+		LastModified:  lastModified.UTC(),
+	}, response.StatusCode, nil
+}
@@ -0,0 +1,224 @@
+package sigupdate
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Timeout for establishing a connection to a mirror
+const dialTimeout = 30 * time.Second
+
+/* Mirrors are chosen by IP address, but requests must still be made using
+ * the upstream's hostname so that virtual hosted mirrors get the correct Host
+ * header and so that TLS certificates can be verified. We do this by using a
+ * transport per mirror address that dials the address directly. A transport
+ * is kept per address because transports pool connections by hostname and
+ * a pooled connection to one mirror must not be reused for another. */
+var pinnedTransports = make(map[string]*http.Transport)
+var pinnedTransportsLock sync.Mutex
+
+// Proxy and TLS settings applied to all connections made to upstreams
+var upstreamProxy = http.ProxyFromEnvironment
+var upstreamTLSConfig *tls.Config
+
+// Client used for requests that aren't made to a specific mirror address
+var upstreamClient = &http.Client{Transport: newTransport()}
+
+// Function that configures the proxy and TLS settings used to connect to
+// upstreams. Connections made with the previous settings are closed.
+func configureTransport(config Config) error {
+	tlsConfig, err := newTLSConfig(config.CABundlePaths, config.ClientCertPath,
+		config.ClientKeyPath)
+
+	if err != nil {
+		return err
+	}
+
+	pinnedTransportsLock.Lock()
+	defer pinnedTransportsLock.Unlock()
+
+	if config.ProxyURL != nil {
+		upstreamProxy = newProxyFunc(config.ProxyURL, config.NoProxy)
+	} else {
+		upstreamProxy = http.ProxyFromEnvironment
+	}
+
+	upstreamTLSConfig = tlsConfig
+
+	for key, transport := range pinnedTransports {
+		transport.CloseIdleConnections()
+		delete(pinnedTransports, key)
+	}
+
+	if transport, ok := upstreamClient.Transport.(*http.Transport); ok {
+		transport.CloseIdleConnections()
+	}
+
+	upstreamClient = &http.Client{Transport: newTransport()}
+
+	return nil
+}
+
+// Function that creates the TLS configuration used to connect to upstreams.
+// The CA bundles are trusted in addition to the system's certificates. If a
+// client certificate is given, it is presented to upstreams that request one.
+func newTLSConfig(caBundlePaths []string, clientCertPath string, clientKeyPath string) (*tls.Config, error) {
+	if len(caBundlePaths) == 0 && clientCertPath == "" && clientKeyPath == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{}
+
+	if len(caBundlePaths) > 0 {
+		pool, err := x509.SystemCertPool()
+
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		for _, caBundlePath := range caBundlePaths {
+			pem, err := ioutil.ReadFile(caBundlePath)
+
+			if err != nil {
+				msg := fmt.Sprintf("Unable to read CA bundle [%v]", caBundlePath)
+				return nil, errors.WrapPrefix(err, msg, 1)
+			}
+
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.Errorf("No certificates found in CA bundle [%v]", caBundlePath)
+			}
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCertPath != "" || clientKeyPath != "" {
+		if clientCertPath == "" || clientKeyPath == "" {
+			return nil, errors.New("Both a client certificate and a client key are required")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(clientCertPath, clientKeyPath)
+
+		if err != nil {
+			msg := fmt.Sprintf("Unable to load client certificate [%v] and key [%v]",
+				clientCertPath, clientKeyPath)
+			return nil, errors.WrapPrefix(err, msg, 1)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// Function that creates a transport with the settings used for all
+// connections to upstreams.
+func newTransport() *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 upstreamProxy,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+
+	if upstreamTLSConfig != nil {
+		transport.TLSClientConfig = upstreamTLSConfig.Clone()
+	}
+
+	return transport
+}
+
+// Function that checks to see if requests to a URL are sent through a proxy.
+// The proxy connects to the upstream on our behalf, so we can't choose which
+// mirror address is used.
+func usesProxy(target *url.URL) bool {
+	pinnedTransportsLock.Lock()
+	proxy := upstreamProxy
+	pinnedTransportsLock.Unlock()
+
+	proxyURL, err := proxy(&http.Request{URL: target})
+
+	return err == nil && proxyURL != nil
+}
+
+// Function that returns the client used for requests that aren't made to a
+// specific mirror address.
+func unpinnedClient() *http.Client {
+	pinnedTransportsLock.Lock()
+	defer pinnedTransportsLock.Unlock()
+
+	return upstreamClient
+}
+
+// Function that returns the key used to record the health of the mirror that
+// a request was sent to. When no mirror address was chosen, the hostname is
+// used instead.
+func mirrorAddress(downloadURL *url.URL, address net.IPAddr) string {
+	if address.IP == nil {
+		return downloadURL.Hostname()
+	}
+
+	return address.IP.String()
+}
+
+// Function that returns the client used to request a URL from the given
+// mirror address. An empty address resolves the hostname as normal.
+func upstreamClientFor(downloadURL *url.URL, address net.IPAddr) *http.Client {
+	if address.IP == nil {
+		return unpinnedClient()
+	}
+
+	return clientForMirror(downloadURL.Hostname(), address)
+}
+
+// Function that returns a client that connects to the given mirror address
+// for requests to the given hostname. Requests to any other hostname, such as
+// after a redirect, are dialed normally.
+func clientForMirror(hostname string, address net.IPAddr) *http.Client {
+	key := hostname + "/" + address.String()
+
+	pinnedTransportsLock.Lock()
+	defer pinnedTransportsLock.Unlock()
+
+	transport, ok := pinnedTransports[key]
+
+	if !ok {
+		transport = newTransport()
+		transport.DialContext = pinnedDialer(hostname, address)
+		pinnedTransports[key] = transport
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// Function that creates a dial function that connects to the given address
+// instead of resolving the hostname.
+func pinnedDialer(hostname string, address net.IPAddr) func(context.Context, string, string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+
+		if err != nil || host != hostname {
+			return dialer.DialContext(ctx, network, addr)
+		}
+
+		return dialer.DialContext(ctx, network, net.JoinHostPort(address.IP.String(), port))
+	}
+}
@@ -0,0 +1,78 @@
+package sigupdate
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostHeaderKeptClientForMirror(t *testing.T) {
+	var requestHost string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestHost = r.Host
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	upstreamURL, _ := url.Parse("http://mirror.invalid:" + serverURL.Port())
+
+	dir, _ := ioutil.TempDir("", "client-")
+	defer os.RemoveAll(dir)
+
+	download := Download{Filename: "daily-10.cdiff", LocalFilePath: filepath.Join(dir, "daily-10.cdiff")}
+	downloadURL := buildDownloadURL(upstreamURL, download.Filename)
+	statusCode, err := executeHTTPRequest(context.Background(), download, downloadURL,
+		net.IPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+
+	if err != nil || statusCode != http.StatusOK {
+		t.Fatalf("Expected the request to be dialed to the mirror address. Actual: %v %v",
+			statusCode, err)
+	}
+
+	if requestHost != upstreamURL.Host {
+		t.Errorf("Expected Host header [%v]. Actual: %v", upstreamURL.Host, requestHost)
+	}
+}
+
+func TestTLSVerifiedClientForMirror(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	serverURL, _ := url.Parse(server.URL)
+	address := net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+
+	// The test server's certificate is issued for example.com
+	client := clientForMirror("example.com", address)
+	client.Transport.(*http.Transport).TLSClientConfig =
+		server.Client().Transport.(*http.Transport).TLSClientConfig
+	defer delete(pinnedTransports, "example.com/127.0.0.1")
+
+	response, err := client.Get("https://example.com:" + serverURL.Port() + "/daily-10.cdiff")
+
+	if err != nil {
+		t.Fatalf("Expected certificate to be verified against the hostname. Actual: %v", err)
+	}
+
+	response.Body.Close()
+
+	// A hostname that doesn't match the certificate must fail verification
+	client = clientForMirror("mirror.invalid", address)
+	client.Transport.(*http.Transport).TLSClientConfig =
+		server.Client().Transport.(*http.Transport).TLSClientConfig
+	defer delete(pinnedTransports, "mirror.invalid/127.0.0.1")
+
+	if response, err := client.Get("https://mirror.invalid:" + serverURL.Port() + "/"); err == nil {
+		response.Body.Close()
+		t.Error("Expected certificate verification to fail for a mismatched hostname")
+	}
+}
@@ -0,0 +1,105 @@
+package sigupdate
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/metrics"
+)
+
+var updateRuns = metrics.Default.NewCounter("clamav_mirror_update_runs_total",
+	"Number of signature updates that have been run.")
+var updateFailures = metrics.Default.NewCounter("clamav_mirror_update_failures_total",
+	"Number of signature updates that failed by cause.", "cause")
+var updateDuration = metrics.Default.NewHistogram("clamav_mirror_update_duration_seconds",
+	"Time taken by signature updates.", metrics.DurationBuckets)
+var downloadedBytes = metrics.Default.NewCounter("clamav_mirror_downloaded_bytes_total",
+	"Number of bytes downloaded from each mirror.", "mirror")
+var updateDecisions = metrics.Default.NewCounter("clamav_mirror_update_decisions_total",
+	"Number of times each signature was updated with .cdiff files or a full .cvd "+
+		"download, or was already current.", "database", "decision")
+var localVersion = metrics.Default.NewGauge("clamav_mirror_local_version",
+	"Version of each signature in the data directory.", "database")
+var advertisedVersion = metrics.Default.NewGauge("clamav_mirror_advertised_version",
+	"Version of each signature advertised by ClamAV.", "database")
+var lastSuccessTimestamp = metrics.Default.NewGauge(
+	"clamav_mirror_last_successful_update_timestamp_seconds",
+	"Unix time of the last signature update that succeeded.")
+
+// Time of the last update that succeeded, used to report its age
+var lastSuccess time.Time
+var lastSuccessLock sync.Mutex
+
+func init() {
+	metrics.Default.NewGaugeFunc("clamav_mirror_seconds_since_last_successful_update",
+		"Seconds since the last signature update that succeeded.", nil, func() float64 {
+			lastSuccessLock.Lock()
+			defer lastSuccessLock.Unlock()
+
+			if lastSuccess.IsZero() {
+				return math.NaN()
+			}
+
+			return time.Since(lastSuccess).Seconds()
+		})
+}
+
+// Function that records the metrics of an update once it has finished and
+// writes them to the textfile collector file if one is configured. The cause
+// describes the step of the update that failed.
+func recordUpdateMetrics(config Config, result UpdateResult, cause string, err error, started time.Time) {
+	updateRuns.Inc()
+	updateDuration.Observe(time.Since(started).Seconds())
+
+	if _, ok := asCooldownError(err); ok {
+		cause = "cooldown"
+	} else if _, ok := asStaleMirrorError(err); ok {
+		cause = "stale_mirror"
+	}
+
+	switch {
+	case err != nil:
+		updateFailures.Inc(cause)
+	case len(result.Signatures) > 0:
+		now := time.Now()
+
+		lastSuccessLock.Lock()
+		lastSuccess = now
+		lastSuccessLock.Unlock()
+
+		lastSuccessTimestamp.Set(float64(now.Unix()))
+	}
+
+	for _, signature := range result.Signatures {
+		localVersion.Set(float64(signature.Version), signature.Name)
+		advertisedVersion.Set(float64(signature.AdvertisedVersion), signature.Name)
+	}
+
+	if config.MetricsTextfile == "" {
+		return
+	}
+
+	if writeErr := metrics.Default.WriteTextfile(config.MetricsTextfile); writeErr != nil {
+		logError.Printf("Unable to write metrics. %v", writeErr)
+	}
+}
+
+// countedReader counts the bytes read from a mirror's response.
+type countedReader struct {
+	reader io.Reader
+	mirror string
+}
+
+func (r countedReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+
+	if n > 0 {
+		downloadedBytes.Add(float64(n), r.mirror)
+	}
+
+	return n, err
+}
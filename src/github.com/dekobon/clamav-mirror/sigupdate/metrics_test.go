@@ -0,0 +1,65 @@
+package sigupdate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+func TestCauseRecordUpdateMetrics(t *testing.T) {
+	dns := updateFailures.Value("dns")
+	stale := updateFailures.Value("stale_mirror")
+	runs := updateRuns.Value()
+
+	recordUpdateMetrics(Config{}, UpdateResult{}, "dns", errors.New("no such host"), time.Now())
+	recordUpdateMetrics(Config{}, UpdateResult{}, "download",
+		errors.New(&StaleMirrorError{Filename: "daily.cvd", Version: 1, AdvertisedVersion: 2}),
+		time.Now())
+
+	if updateFailures.Value("dns") != dns+1 {
+		t.Error("Expected a DNS failure to be counted")
+	}
+
+	if updateFailures.Value("stale_mirror") != stale+1 {
+		t.Error("Expected a stale mirror failure to be counted by its cause")
+	}
+
+	if updateRuns.Value() != runs+2 {
+		t.Errorf("Expected two runs to be counted. Actual: %v", updateRuns.Value()-runs)
+	}
+}
+
+func TestTextfileRecordUpdateMetrics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "metrics-")
+	defer os.RemoveAll(dir)
+
+	config := Config{MetricsTextfile: filepath.Join(dir, "clamav_mirror.prom")}
+	result := UpdateResult{Signatures: []SignatureResult{
+		{Name: "daily", Version: 25000, AdvertisedVersion: 25001, Lag: 1},
+	}}
+
+	recordUpdateMetrics(config, result, "download", nil, time.Now())
+
+	contents, err := ioutil.ReadFile(config.MetricsTextfile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`clamav_mirror_local_version{database="daily"} 25000`,
+		`clamav_mirror_advertised_version{database="daily"} 25001`,
+		"clamav_mirror_last_successful_update_timestamp_seconds ",
+	} {
+		if !strings.Contains(string(contents), line) {
+			t.Errorf("Expected the textfile to include [%v]", line)
+		}
+	}
+}
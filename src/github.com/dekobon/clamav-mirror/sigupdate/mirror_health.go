@@ -0,0 +1,374 @@
+package sigupdate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Filename of the file in the data directory storing mirror health
+const mirrorStateFilename = "sigupdate-mirrors.json"
+
+// Number of consecutive failures after which a mirror is banned
+const mirrorBanThreshold = 3
+
+// Duration of the first ban of a mirror. Each additional failure doubles it.
+const mirrorBaseBan = 15 * time.Minute
+
+// Maximum duration that a mirror can be banned for
+const mirrorMaxBan = 24 * time.Hour
+
+// Mirrors that haven't been seen for this long are forgotten
+const mirrorRetention = 30 * 24 * time.Hour
+
+// Weight given to the latest latency sample in the moving average
+const latencySmoothing = 0.3
+
+// MirrorHealth is the recorded history of a single mirror IP address.
+type MirrorHealth struct {
+	Address             string    `json:"address"`
+	Host                string    `json:"host"`
+	Successes           uint64    `json:"successes"`
+	Failures            uint64    `json:"failures"`
+	NotFound            uint64    `json:"not_found"`
+	Stale               uint64    `json:"stale"`
+	ConsecutiveFailures uint      `json:"consecutive_failures"`
+	LatencyMillis       float64   `json:"latency_ms"`
+	Lag                 uint64    `json:"lag"`
+	LastSeen            time.Time `json:"last_seen"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	BannedUntil         time.Time `json:"banned_until,omitempty"`
+}
+
+// mirrorHealthDB is the collection of mirror health records keyed by IP
+// address.
+type mirrorHealthDB struct {
+	lock    sync.Mutex
+	mirrors map[string]*MirrorHealth
+}
+
+// Mirror health used when selecting mirrors for the current run
+var mirrors = newMirrorHealthDB()
+
+func newMirrorHealthDB() *mirrorHealthDB {
+	return &mirrorHealthDB{mirrors: make(map[string]*MirrorHealth)}
+}
+
+// Function that reads the mirror health state from the data directory.
+func loadMirrorHealth(dataFilePath string) (*mirrorHealthDB, error) {
+	db := newMirrorHealthDB()
+	statePath := filepath.Join(dataFilePath, mirrorStateFilename)
+
+	if !utils.Exists(statePath) {
+		return db, nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read mirror state [%v]", statePath)
+		return db, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := json.Unmarshal(data, &db.mirrors); err != nil {
+		msg := fmt.Sprintf("Unable to parse mirror state [%v]", statePath)
+		return newMirrorHealthDB(), errors.WrapPrefix(err, msg, 1)
+	}
+
+	return db, nil
+}
+
+// Function that replaces the health records with those of another
+// collection. Records are replaced in place because downloads made outside of
+// an update run may be using the collection at the same time.
+func (db *mirrorHealthDB) replace(other *mirrorHealthDB) {
+	other.lock.Lock()
+	records := other.mirrors
+	other.lock.Unlock()
+
+	db.lock.Lock()
+	db.mirrors = records
+	db.lock.Unlock()
+}
+
+// Function that writes the mirror health state to the data directory,
+// forgetting mirrors that haven't been seen recently.
+func (db *mirrorHealthDB) save(dataFilePath string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := time.Now()
+
+	for address, mirror := range db.mirrors {
+		if now.Sub(mirror.LastSeen) > mirrorRetention {
+			delete(db.mirrors, address)
+		}
+	}
+
+	data, err := json.MarshalIndent(db.mirrors, "", "  ")
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Unable to serialize mirror state", 1)
+	}
+
+	return utils.WriteFileAtomically(filepath.Join(dataFilePath, mirrorStateFilename), data, now)
+}
+
+// Function that gets the health record for a mirror, creating it if needed.
+// The caller must hold the lock.
+func (db *mirrorHealthDB) get(address string) *MirrorHealth {
+	mirror, ok := db.mirrors[address]
+
+	if !ok {
+		mirror = &MirrorHealth{Address: address}
+		db.mirrors[address] = mirror
+	}
+
+	return mirror
+}
+
+// Function that calculates the relative likelihood of selecting a mirror.
+// Fast mirrors with a good success rate that are up to date are preferred.
+// Mirrors that we know nothing about get an average weight so that they are
+// still tried.
+func (mirror *MirrorHealth) weight() float64 {
+	attempts := float64(mirror.Successes + mirror.Failures)
+	successRate := (float64(mirror.Successes) + 1) / (attempts + 2)
+	latencyFactor := 1.0
+
+	if mirror.LatencyMillis > 0 {
+		latencyFactor = 1 / (1 + mirror.LatencyMillis/250)
+	} else {
+		latencyFactor = 0.5
+	}
+
+	return successRate * successRate * latencyFactor / (1 + float64(mirror.Lag))
+}
+
+// Function that orders the resolved addresses for an upstream host so that
+// healthy mirrors are tried first. The ordering is randomized in proportion
+// to each mirror's weight so that we don't always hit the same mirrors.
+// Banned mirrors are excluded unless every mirror is banned.
+func (db *mirrorHealthDB) order(host string, addresses []net.IPAddr, now time.Time) []net.IPAddr {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	type candidate struct {
+		address net.IPAddr
+		key     float64
+		banned  time.Time
+	}
+
+	var available []candidate
+	var banned []candidate
+
+	for _, address := range addresses {
+		mirror := db.get(address.IP.String())
+		mirror.Host = host
+		mirror.LastSeen = now
+
+		if mirror.BannedUntil.After(now) {
+			banned = append(banned, candidate{address: address, banned: mirror.BannedUntil})
+			continue
+		}
+
+		// Weighted random sampling without replacement (Efraimidis-Spirakis)
+		key := math.Pow(rand.Float64(), 1/mirror.weight())
+		available = append(available, candidate{address: address, key: key})
+	}
+
+	sort.Slice(available, func(i, j int) bool {
+		return available[i].key > available[j].key
+	})
+
+	/* If every mirror is banned, we try the mirrors whose bans expire first
+	 * rather than giving up entirely. */
+	if len(available) == 0 {
+		sort.Slice(banned, func(i, j int) bool {
+			return banned[i].banned.Before(banned[j].banned)
+		})
+
+		available = banned
+	}
+
+	ordered := make([]net.IPAddr, len(available))
+
+	for i, c := range available {
+		ordered[i] = c.address
+	}
+
+	return ordered
+}
+
+// Function that records the time taken for a mirror to respond.
+func (db *mirrorHealthDB) recordLatency(address string, latency time.Duration) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	sample := float64(latency) / float64(time.Millisecond)
+
+	if mirror.LatencyMillis == 0 {
+		mirror.LatencyMillis = sample
+	} else {
+		mirror.LatencyMillis = latencySmoothing*sample + (1-latencySmoothing)*mirror.LatencyMillis
+	}
+}
+
+// Function that records a successful download from a mirror. If the
+// downloaded file was the latest advertised version, the mirror is current.
+func (db *mirrorHealthDB) recordSuccess(address string, current bool, now time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	mirror.Successes++
+	mirror.ConsecutiveFailures = 0
+	mirror.LastSuccess = now
+	mirror.BannedUntil = time.Time{}
+
+	if current {
+		mirror.Lag = 0
+	}
+}
+
+// Function that records a file missing from a mirror. A mirror missing a
+// recent file is behind by at least the number of versions specified.
+func (db *mirrorHealthDB) recordNotFound(address string, lag uint64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	mirror.NotFound++
+
+	if lag > mirror.Lag {
+		mirror.Lag = lag
+	}
+}
+
+// Function that records a mirror serving a file older than the advertised
+// version.
+func (db *mirrorHealthDB) recordStale(address string, lag uint64) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	mirror.Stale++
+
+	if lag > mirror.Lag {
+		mirror.Lag = lag
+	}
+}
+
+// Function that records a failed request to a mirror. Mirrors that fail
+// repeatedly are banned for an exponentially increasing duration.
+func (db *mirrorHealthDB) recordFailure(address string, now time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	mirror.Failures++
+	mirror.ConsecutiveFailures++
+	mirror.LastFailure = now
+
+	if mirror.ConsecutiveFailures >= mirrorBanThreshold {
+		exponent := float64(mirror.ConsecutiveFailures - mirrorBanThreshold)
+		ban := time.Duration(float64(mirrorBaseBan) * math.Pow(2, exponent))
+
+		if ban > mirrorMaxBan || ban <= 0 {
+			ban = mirrorMaxBan
+		}
+
+		mirror.BannedUntil = now.Add(ban)
+
+		logger.Printf("Mirror [%v] failed %v times in a row - banning it until %v",
+			address, mirror.ConsecutiveFailures, mirror.BannedUntil.Format(time.RFC3339))
+	}
+}
+
+// Function that records a mirror refusing our requests (403). The mirror is
+// banned until the time that it asked us to wait for.
+func (db *mirrorHealthDB) recordBlocked(address string, until time.Time, now time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	mirror := db.get(address)
+	mirror.Failures++
+	mirror.LastFailure = now
+
+	if until.After(mirror.BannedUntil) {
+		mirror.BannedUntil = until
+	}
+
+	logger.Printf("Mirror [%v] refused our requests - banning it until %v",
+		address, mirror.BannedUntil.Format(time.RFC3339))
+}
+
+// Function that writes the mirror health as a table.
+func (db *mirrorHealthDB) print(writer io.Writer, now time.Time) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	var records []*MirrorHealth
+
+	for _, mirror := range db.mirrors {
+		records = append(records, mirror)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Host != records[j].Host {
+			return records[i].Host < records[j].Host
+		}
+
+		return records[i].weight() > records[j].weight()
+	})
+
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "HOST\tADDRESS\tSTATUS\tLATENCY\tSUCCESSES\tFAILURES\tNOT FOUND\tSTALE\tLAG\tLAST SUCCESS")
+
+	for _, mirror := range records {
+		status := "ok"
+
+		if mirror.BannedUntil.After(now) {
+			status = "banned until " + mirror.BannedUntil.Format(time.RFC3339)
+		} else if mirror.ConsecutiveFailures > 0 {
+			status = fmt.Sprintf("failing (%d)", mirror.ConsecutiveFailures)
+		}
+
+		latency := "-"
+
+		if mirror.LatencyMillis > 0 {
+			latency = fmt.Sprintf("%.0fms", mirror.LatencyMillis)
+		}
+
+		lastSuccess := "never"
+
+		if !mirror.LastSuccess.IsZero() {
+			lastSuccess = mirror.LastSuccess.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(table, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", mirror.Host,
+			mirror.Address, status, latency, mirror.Successes, mirror.Failures,
+			mirror.NotFound, mirror.Stale, mirror.Lag, lastSuccess)
+	}
+
+	table.Flush()
+}
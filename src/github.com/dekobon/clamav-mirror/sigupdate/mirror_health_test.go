@@ -0,0 +1,182 @@
+package sigupdate
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAddresses(ips ...string) []net.IPAddr {
+	var addresses []net.IPAddr
+
+	for _, ip := range ips {
+		addresses = append(addresses, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addresses
+}
+
+func TestBannedMirrorsAreSkippedOrder(t *testing.T) {
+	db := newMirrorHealthDB()
+	now := time.Now()
+
+	for i := 0; i < mirrorBanThreshold; i++ {
+		db.recordFailure("10.0.0.1", now)
+	}
+
+	ordered := db.order("database.clamav.net", testAddresses("10.0.0.1", "10.0.0.2"), now)
+
+	if len(ordered) != 1 || ordered[0].IP.String() != "10.0.0.2" {
+		t.Errorf("Expected only the healthy mirror. Actual: %v", ordered)
+	}
+
+	// The ban expires and the mirror is eligible again
+	ordered = db.order("database.clamav.net", testAddresses("10.0.0.1", "10.0.0.2"),
+		now.Add(mirrorBaseBan+time.Second))
+
+	if len(ordered) != 2 {
+		t.Errorf("Expected both mirrors after the ban expired. Actual: %v", ordered)
+	}
+}
+
+func TestAllBannedMirrorsOrder(t *testing.T) {
+	db := newMirrorHealthDB()
+	now := time.Now()
+
+	for i := 0; i < mirrorBanThreshold+1; i++ {
+		db.recordFailure("10.0.0.1", now)
+	}
+
+	for i := 0; i < mirrorBanThreshold; i++ {
+		db.recordFailure("10.0.0.2", now)
+	}
+
+	ordered := db.order("database.clamav.net", testAddresses("10.0.0.1", "10.0.0.2"), now)
+
+	if len(ordered) != 2 || ordered[0].IP.String() != "10.0.0.2" {
+		t.Errorf("Expected the mirror with the shortest ban first. Actual: %v", ordered)
+	}
+}
+
+func TestHealthyMirrorsPreferredOrder(t *testing.T) {
+	db := newMirrorHealthDB()
+	now := time.Now()
+
+	for i := 0; i < 20; i++ {
+		db.recordLatency("10.0.0.1", 20*time.Millisecond)
+		db.recordSuccess("10.0.0.1", true, now)
+		db.recordLatency("10.0.0.2", 2*time.Second)
+		db.recordFailure("10.0.0.2", now)
+		db.recordSuccess("10.0.0.2", false, now)
+	}
+
+	db.recordNotFound("10.0.0.2", 3)
+
+	first := 0
+
+	for i := 0; i < 200; i++ {
+		ordered := db.order("database.clamav.net", testAddresses("10.0.0.1", "10.0.0.2"), now)
+
+		if ordered[0].IP.String() == "10.0.0.1" {
+			first++
+		}
+	}
+
+	if first < 180 {
+		t.Errorf("Expected the healthy mirror to usually be first. Actual: %v/200", first)
+	}
+}
+
+func TestBanDurationGrowsRecordFailure(t *testing.T) {
+	db := newMirrorHealthDB()
+	now := time.Now()
+
+	for i := 0; i < mirrorBanThreshold+1; i++ {
+		db.recordFailure("10.0.0.1", now)
+	}
+
+	if expected := now.Add(2 * mirrorBaseBan); !db.mirrors["10.0.0.1"].BannedUntil.Equal(expected) {
+		t.Errorf("Expected ban until %v. Actual: %v", expected,
+			db.mirrors["10.0.0.1"].BannedUntil)
+	}
+
+	for i := 0; i < 20; i++ {
+		db.recordFailure("10.0.0.1", now)
+	}
+
+	if expected := now.Add(mirrorMaxBan); !db.mirrors["10.0.0.1"].BannedUntil.Equal(expected) {
+		t.Errorf("Expected ban to be capped at %v. Actual: %v", expected,
+			db.mirrors["10.0.0.1"].BannedUntil)
+	}
+
+	db.recordSuccess("10.0.0.1", false, now)
+
+	if !db.mirrors["10.0.0.1"].BannedUntil.IsZero() || db.mirrors["10.0.0.1"].ConsecutiveFailures != 0 {
+		t.Error("Expected a successful download to lift the ban")
+	}
+}
+
+func TestNotFoundRecordsLagRecordDownloadOutcome(t *testing.T) {
+	mirrors = newMirrorHealthDB()
+	defer func() { mirrors = newMirrorHealthDB() }()
+
+	download := Download{Filename: "daily-98.cdiff", version: 98, advertisedVersion: 100}
+	recordDownloadOutcome(download, "10.0.0.1", 404, nil)
+
+	mirror := mirrors.mirrors["10.0.0.1"]
+
+	if mirror.Lag != 3 || mirror.NotFound != 1 || mirror.Failures != 0 {
+		t.Errorf("Expected lag of 3 without a failure. Actual: %+v", mirror)
+	}
+
+	download = Download{Filename: "daily-100.cdiff", version: 100, advertisedVersion: 100}
+	recordDownloadOutcome(download, "10.0.0.1", 200, nil)
+
+	if mirror.Lag != 0 || mirror.Successes != 1 {
+		t.Errorf("Expected the mirror to be current. Actual: %+v", mirror)
+	}
+}
+
+func TestSaveAndLoadMirrorHealth(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "mirrors-")
+	defer os.RemoveAll(dir)
+
+	db := newMirrorHealthDB()
+	now := time.Now()
+	db.order("database.clamav.net", testAddresses("10.0.0.1", "10.0.0.2"), now)
+	db.recordLatency("10.0.0.1", 150*time.Millisecond)
+	db.recordSuccess("10.0.0.1", true, now)
+	db.mirrors["10.0.0.2"].LastSeen = now.Add(-2 * mirrorRetention)
+
+	if err := db.save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadMirrorHealth(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mirror, ok := loaded.mirrors["10.0.0.1"]
+
+	if !ok || mirror.Successes != 1 || mirror.LatencyMillis != 150 ||
+		mirror.Host != "database.clamav.net" {
+		t.Errorf("Mirror health wasn't persisted. Actual: %+v", mirror)
+	}
+
+	if _, ok := loaded.mirrors["10.0.0.2"]; ok {
+		t.Error("Expected mirrors that haven't been seen recently to be forgotten")
+	}
+
+	var output bytes.Buffer
+	loaded.print(&output, now)
+
+	if !strings.Contains(output.String(), "10.0.0.1") || !strings.Contains(output.String(), "150ms") {
+		t.Errorf("Unexpected mirror table:\n%v", output.String())
+	}
+}
@@ -0,0 +1,85 @@
+package sigupdate
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Function that creates a proxy function that sends every request through the
+// given proxy except for requests to hosts in the no proxy list. Credentials
+// for the proxy are taken from the user info of the proxy URL.
+func newProxyFunc(proxyURL *url.URL, noProxy string) func(*http.Request) (*url.URL, error) {
+	return func(request *http.Request) (*url.URL, error) {
+		if bypassProxy(request.URL, noProxy) {
+			return nil, nil
+		}
+
+		return proxyURL, nil
+	}
+}
+
+// Function that checks to see if a URL matches an entry in a comma separated
+// no proxy list. Entries follow the conventions of the NO_PROXY environment
+// variable: "*" matches everything, a domain matches itself and all of its
+// subdomains, IP addresses and CIDR blocks match IP hosts, and an entry with
+// a port only matches requests to that port.
+func bypassProxy(target *url.URL, noProxy string) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+
+	if port == "" && target.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if entry == "" {
+			continue
+		}
+
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		entryHost := entry
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+
+			entryHost = h
+		}
+
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+
+	return false
+}
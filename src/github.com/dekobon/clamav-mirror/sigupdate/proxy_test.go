@@ -0,0 +1,197 @@
+package sigupdate
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEntriesBypassProxy(t *testing.T) {
+	noProxy := "localhost, .internal.example.com, mirror.example.org:8080, 10.0.0.0/8, 192.168.1.1"
+
+	cases := map[string]bool{
+		"http://localhost/daily.cvd":                 true,
+		"http://db.internal.example.com/daily.cvd":   true,
+		"http://internal.example.com/daily.cvd":      true,
+		"http://example.com/daily.cvd":               false,
+		"http://mirror.example.org:8080/daily.cvd":   true,
+		"http://mirror.example.org/daily.cvd":        false,
+		"http://10.1.2.3/daily.cvd":                  true,
+		"http://192.168.1.1/daily.cvd":               true,
+		"http://192.168.1.2/daily.cvd":               false,
+		"https://database.clamav.net/daily.cvd":      false,
+		"https://notlocalhost.example.net/daily.cvd": false,
+	}
+
+	for target, expected := range cases {
+		u, _ := url.Parse(target)
+
+		if actual := bypassProxy(u, noProxy); actual != expected {
+			t.Errorf("Expected bypass of [%v] to be %v", target, expected)
+		}
+	}
+
+	u, _ := url.Parse("http://database.clamav.net/daily.cvd")
+
+	if !bypassProxy(u, "*") {
+		t.Error("Expected * to bypass the proxy for all hosts")
+	}
+}
+
+func TestAuthenticatedProxyExecuteHTTPRequest(t *testing.T) {
+	var proxyAuthorization string
+	var requestedURL string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyAuthorization = r.Header.Get("Proxy-Authorization")
+		requestedURL = r.URL.String()
+		w.Write([]byte("diff"))
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := parseProxyURL(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+
+	if err := configureTransport(Config{ProxyURL: proxyURL, NoProxy: "localhost"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer configureTransport(Config{})
+
+	dir, _ := ioutil.TempDir("", "proxy-")
+	defer os.RemoveAll(dir)
+
+	upstreams, _ := parseUpstreams("http://mirror.invalid")
+	states := availableUpstreams(Config{DataFilePath: dir, Upstreams: upstreams}, time.Now())
+	download := Download{Filename: "daily-10.cdiff", LocalFilePath: filepath.Join(dir, "daily-10.cdiff")}
+
+	source, _, err := downloadWithRetry(context.Background(), download, states)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if requestedURL != "http://mirror.invalid/daily-10.cdiff" {
+		t.Errorf("Expected the request to be sent through the proxy. Actual: %v", requestedURL)
+	}
+
+	if proxyAuthorization != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("Expected proxy credentials to be sent. Actual: %v", proxyAuthorization)
+	}
+
+	if source.Address != "mirror.invalid" {
+		t.Errorf("Expected the hostname to be recorded for proxied requests. Actual: %v",
+			source.Address)
+	}
+
+	localhost, _ := url.Parse("http://localhost/daily.cvd")
+
+	if usesProxy(localhost) {
+		t.Error("Expected hosts in the no proxy list to be connected to directly")
+	}
+}
+
+func TestProxiedOpenUpstreamFile(t *testing.T) {
+	var requestedURL string
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedURL = r.URL.String()
+		w.Write([]byte("diff"))
+	}))
+	defer proxy.Close()
+
+	dir, _ := ioutil.TempDir("", "proxy-")
+	defer os.RemoveAll(dir)
+
+	mirrorState := `{"10.9.9.9": {"address": "10.9.9.9", "host": "mirror.invalid", ` +
+		`"last_seen": "` + time.Now().UTC().Format(time.RFC3339) + `"}}`
+	ioutil.WriteFile(filepath.Join(dir, mirrorStateFilename), []byte(mirrorState), 0644)
+
+	proxyURL, _ := parseProxyURL(proxy.URL)
+	upstreams, _ := parseUpstreams("http://mirror.invalid")
+
+	// Files may be fetched before any update has configured the transport
+	upstreamsConfigured = false
+
+	defer func() {
+		upstreamsConfigured = false
+		configureTransport(Config{})
+		mirrors.replace(newMirrorHealthDB())
+	}()
+
+	config := Config{DataFilePath: dir, Upstreams: upstreams, ProxyURL: proxyURL}
+	file, _, err := OpenUpstreamFile(config, "daily-10.cdiff")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file.Body.Close()
+
+	if requestedURL != "http://mirror.invalid/daily-10.cdiff" {
+		t.Errorf("Expected the fetch to be sent through the proxy. Actual: %v", requestedURL)
+	}
+
+	saved, err := loadMirrorHealth(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := saved.mirrors["10.9.9.9"]; !ok {
+		t.Error("Expected the saved mirror state to be kept after a fetch")
+	}
+}
+
+func TestCABundleConfigureTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "proxy-")
+	defer os.RemoveAll(dir)
+
+	caBundlePath := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	ioutil.WriteFile(caBundlePath, pem.EncodeToMemory(block), 0644)
+
+	serverURL, _ := url.Parse(server.URL)
+	address := net.IPAddr{IP: net.ParseIP("127.0.0.1")}
+	target := "https://example.com:" + serverURL.Port() + "/daily-10.cdiff"
+
+	if response, err := clientForMirror("example.com", address).Get(target); err == nil {
+		response.Body.Close()
+		t.Fatal("Expected the test certificate to be untrusted without the CA bundle")
+	}
+
+	if err := configureTransport(Config{CABundlePaths: []string{caBundlePath}}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer configureTransport(Config{})
+
+	response, err := clientForMirror("example.com", address).Get(target)
+
+	if err != nil {
+		t.Fatalf("Expected the CA bundle to be trusted. Actual: %v", err)
+	}
+
+	response.Body.Close()
+
+	if err := configureTransport(Config{CABundlePaths: []string{filepath.Join(dir, "missing.pem")}}); err == nil {
+		t.Error("Expected an error for a missing CA bundle")
+	}
+
+	if err := configureTransport(Config{ClientCertPath: caBundlePath}); err == nil {
+		t.Error("Expected an error when the client key is missing")
+	}
+}
@@ -0,0 +1,200 @@
+package sigupdate
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Default template for the User-Agent header sent to upstreams
+const defaultUserAgent = "github.com/dekobon/clamav-mirror/{{.AppVersion}}"
+
+// User-Agent sent when a request is made without rendered headers
+const fallbackUserAgent = "github.com/dekobon/clamav-mirror"
+
+// RequestIdentity is the information available to the User-Agent and
+// upstream header templates.
+type RequestIdentity struct {
+	AppVersion         string
+	GitCommitHash      string
+	ClamAVVersion      string
+	FunctionalityLevel uint64
+}
+
+// Identity used by the most recent update run
+var lastIdentity RequestIdentity
+var lastIdentityLock sync.Mutex
+
+/* Functions available to request templates. The env function allows secrets
+ * such as feed tokens to be passed in the environment rather than being
+ * written into the upstream URLs. */
+var requestTemplateFuncs = template.FuncMap{
+	"env": os.Getenv,
+}
+
+// Function that parses a template used to build a request header value.
+func parseRequestTemplate(name string, text string) (*template.Template, error) {
+	tmpl, err := template.New(name).Funcs(requestTemplateFuncs).
+		Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		msg := fmt.Sprintf("Invalid template for header [%v]", name)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return tmpl, nil
+}
+
+// Function that renders a request header value template. Rendered values may
+// not span multiple lines because they would corrupt the request.
+func renderRequestTemplate(name string, text string, identity RequestIdentity) (string, error) {
+	tmpl, err := parseRequestTemplate(name, text)
+
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+
+	if err := tmpl.Execute(&buffer, identity); err != nil {
+		msg := fmt.Sprintf("Unable to render template for header [%v]", name)
+		return "", errors.WrapPrefix(err, msg, 1)
+	}
+
+	value := strings.TrimSpace(buffer.String())
+
+	if strings.ContainsAny(value, "\r\n") {
+		return "", errors.Errorf("Rendered value for header [%v] contains a line break", name)
+	}
+
+	return value, nil
+}
+
+// Function that builds the identity that we present to upstreams. The ClamAV
+// version is the version of the local sigtool, falling back to the version
+// advertised in the TXT record when it can't be determined. The functionality
+// level is the level recommended in the TXT record.
+func newRequestIdentity(config Config, versions SignatureVersions) RequestIdentity {
+	clamavVersion, err := readClamAVVersion()
+
+	if err != nil {
+		if verboseMode {
+			logger.Printf("Using the advertised ClamAV version for requests. %v", err)
+		}
+
+		clamavVersion = versions.ClamAVVersion
+	}
+
+	return RequestIdentity{
+		AppVersion:         config.AppVersionInfo.AppVersion,
+		GitCommitHash:      config.AppVersionInfo.GitCommitHash,
+		ClamAVVersion:      clamavVersion,
+		FunctionalityLevel: versions.FunctionalityLevel,
+	}
+}
+
+// Function that records the identity used by an update run so that requests
+// made outside of an update run present the same identity.
+func setLastRequestIdentity(identity RequestIdentity) {
+	lastIdentityLock.Lock()
+	defer lastIdentityLock.Unlock()
+
+	lastIdentity = identity
+}
+
+// Function that returns the identity used by the most recent update run. If
+// there hasn't been a run yet, the identity is built without the information
+// in the TXT record.
+func lastRequestIdentity(config Config) RequestIdentity {
+	lastIdentityLock.Lock()
+	identity := lastIdentity
+	lastIdentityLock.Unlock()
+
+	if identity == (RequestIdentity{}) {
+		identity = newRequestIdentity(config, SignatureVersions{})
+	}
+
+	return identity
+}
+
+// Function that reads the version of ClamAV that the local sigtool belongs to.
+func readClamAVVersion() (string, error) {
+	if sigtoolPath == "" {
+		return "", errors.New("The path to sigtool is not known")
+	}
+
+	output, err := exec.Command(sigtoolPath, "--version").Output()
+
+	if err != nil {
+		return "", errors.WrapPrefix(err, "Error running sigtool", 1)
+	}
+
+	return parseClamAVVersion(string(output))
+}
+
+// Function that parses the output of "sigtool --version", which is in the
+// format "ClamAV 0.99.2" or "ClamAV 0.99.2/23602/Thu Jul 27 18:29:00 2017".
+func parseClamAVVersion(output string) (string, error) {
+	output = strings.TrimSpace(output)
+
+	if !strings.HasPrefix(output, "ClamAV ") {
+		return "", errors.Errorf("Unexpected sigtool version output [%v]", output)
+	}
+
+	version := strings.SplitN(strings.TrimPrefix(output, "ClamAV "), "/", 2)[0]
+
+	if version == "" {
+		return "", errors.Errorf("Unexpected sigtool version output [%v]", output)
+	}
+
+	return version, nil
+}
+
+// Function that renders the headers sent with every request to each upstream.
+// Header values are never logged because they may contain credentials.
+func configureRequestHeaders(config Config, upstreams []*upstreamState, identity RequestIdentity) error {
+	userAgentTemplate := config.UserAgent
+
+	if userAgentTemplate == "" {
+		userAgentTemplate = defaultUserAgent
+	}
+
+	userAgent, err := renderRequestTemplate("User-Agent", userAgentTemplate, identity)
+
+	if err != nil {
+		return err
+	}
+
+	if verboseMode {
+		logger.Printf("Identifying to upstreams as [%v]", userAgent)
+	}
+
+	for _, upstream := range upstreams {
+		headers := http.Header{}
+		headers.Set("User-Agent", userAgent)
+
+		for name, valueTemplate := range upstream.Headers {
+			value, err := renderRequestTemplate(name, valueTemplate, identity)
+
+			if err != nil {
+				msg := fmt.Sprintf("Unable to build headers for upstream [%v]", upstream.URL)
+				return errors.WrapPrefix(err, msg, 1)
+			}
+
+			headers.Set(name, value)
+		}
+
+		upstream.headers = headers
+	}
+
+	return nil
+}
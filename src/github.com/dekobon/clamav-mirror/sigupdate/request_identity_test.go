@@ -0,0 +1,120 @@
+package sigupdate
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplatesConfigureRequestHeaders(t *testing.T) {
+	os.Setenv("SIGUPDATE_TEST_TOKEN", "secret")
+	defer os.Unsetenv("SIGUPDATE_TEST_TOKEN")
+
+	upstreams, err := parseUpstreams(`db.us.clamav.net;header=Authorization: Bearer {{env "SIGUPDATE_TEST_TOKEN"}}`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := []*upstreamState{{Upstream: upstreams[0]}}
+	config := Config{UserAgent: "ClamAV/{{.ClamAVVersion}} (FLEVEL {{.FunctionalityLevel}}; mirror {{.AppVersion}})"}
+	identity := RequestIdentity{AppVersion: "1.2.3", ClamAVVersion: "0.99.2", FunctionalityLevel: 63}
+
+	if err := configureRequestHeaders(config, states, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	if userAgent := states[0].headers.Get("User-Agent"); userAgent != "ClamAV/0.99.2 (FLEVEL 63; mirror 1.2.3)" {
+		t.Errorf("Unexpected User-Agent: %v", userAgent)
+	}
+
+	if auth := states[0].headers.Get("Authorization"); auth != "Bearer secret" {
+		t.Errorf("Unexpected Authorization header: %v", auth)
+	}
+}
+
+func TestDefaultConfigureRequestHeaders(t *testing.T) {
+	states := []*upstreamState{{}}
+
+	if err := configureRequestHeaders(Config{}, states,
+		RequestIdentity{AppVersion: "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if userAgent := states[0].headers.Get("User-Agent"); userAgent !=
+		"github.com/dekobon/clamav-mirror/unknown" {
+		t.Errorf("Unexpected User-Agent: %v", userAgent)
+	}
+}
+
+func TestLineBreakRenderRequestTemplate(t *testing.T) {
+	os.Setenv("SIGUPDATE_TEST_TOKEN", "secret\r\nX-Injected: true")
+	defer os.Unsetenv("SIGUPDATE_TEST_TOKEN")
+
+	if _, err := renderRequestTemplate("X-Token", `{{env "SIGUPDATE_TEST_TOKEN"}}`,
+		RequestIdentity{}); err == nil {
+		t.Error("Expected a rendered value with a line break to be rejected")
+	}
+}
+
+func TestParseClamAVVersion(t *testing.T) {
+	outputs := map[string]string{
+		"ClamAV 0.99.2\n": "0.99.2",
+		"ClamAV 0.103.8/26890/Thu Apr 20 07:35:39 2023\n": "0.103.8",
+	}
+
+	for output, expected := range outputs {
+		version, err := parseClamAVVersion(output)
+
+		if err != nil || version != expected {
+			t.Errorf("Expected [%v] from [%v]. Actual: [%v] %v", expected, output, version, err)
+		}
+	}
+
+	if _, err := parseClamAVVersion("sigtool: unknown option"); err == nil {
+		t.Error("Expected unexpected output to be rejected")
+	}
+}
+
+func TestHeadersExecuteHTTPRequest(t *testing.T) {
+	var received http.Header
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "request-identity-")
+	defer os.RemoveAll(dir)
+
+	serverURL, _ := url.Parse(server.URL)
+	downloadURL := buildDownloadURL(serverURL, "daily-10.cdiff")
+	download := Download{Filename: "daily-10.cdiff", LocalFilePath: filepath.Join(dir, "daily-10.cdiff")}
+	headers := http.Header{"User-Agent": {"ClamAV/0.99.2"}, "X-Feed-Token": {"secret"}}
+
+	_, err := executeHTTPRequest(context.Background(), download, downloadURL, net.IPAddr{}, headers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Get("User-Agent") != "ClamAV/0.99.2" || received.Get("X-Feed-Token") != "secret" {
+		t.Errorf("Expected the configured headers to be sent. Actual: %v", received)
+	}
+
+	if _, err = executeHTTPRequest(context.Background(), download, downloadURL,
+		net.IPAddr{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if received.Get("User-Agent") != fallbackUserAgent {
+		t.Errorf("Expected the fallback User-Agent. Actual: %v", received.Get("User-Agent"))
+	}
+}
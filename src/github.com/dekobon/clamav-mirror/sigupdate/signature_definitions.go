@@ -8,6 +8,7 @@ import (
 // published in ClamAV's TXT record.
 type SignatureVersions struct {
 	ClamAVVersion       string
+	FunctionalityLevel  uint64
 	MainVersion         uint64
 	DailyVersion        uint64
 	SafeBrowsingVersion uint64
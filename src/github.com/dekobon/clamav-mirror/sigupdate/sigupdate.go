@@ -2,14 +2,16 @@ package sigupdate
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"log"
 	"net"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 import (
@@ -25,14 +27,38 @@ var logError *log.Logger
 var sigtoolPath string
 var verboseMode bool
 
+// Set once the connections to upstreams have been configured
+var upstreamsConfigured bool
+var upstreamsConfiguredLock sync.Mutex
+
 func init() {
 	logger = log.New(os.Stdout, "", log.LstdFlags)
 	logError = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
 }
 
 // RunSignatureUpdate is the functional entry point to the application.
-// Use this method to invoke the downloader from external code.
-func RunSignatureUpdate(config Config) error {
+// Use this method to invoke the downloader from external code. The result
+// reports how far each signature is behind the version advertised by ClamAV.
+func RunSignatureUpdate(config Config) (UpdateResult, error) {
+	return RunSignatureUpdateContext(context.Background(), config)
+}
+
+// RunSignatureUpdateContext runs a signature update that stops downloading
+// once the context is cancelled. Files that were completely downloaded
+// before the update was cancelled are kept.
+func RunSignatureUpdateContext(ctx context.Context, config Config) (result UpdateResult, err error) {
+	// Step of the update that is in progress, reported if the update fails
+	cause := "configuration"
+	started := time.Now()
+
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			cause = "cancelled"
+		}
+
+		recordUpdateMetrics(config, result, cause, err, started)
+	}()
+
 	logger.Println("Updating ClamAV signatures")
 
 	verboseMode = config.Verbose
@@ -41,10 +67,46 @@ func RunSignatureUpdate(config Config) error {
 		logger.Printf("Data file directory: %v", config.DataFilePath)
 	}
 
+	if err := configureUpstreams(config); err != nil {
+		return result, err
+	}
+
+	upstreams := availableUpstreams(config, time.Now())
+
+	if len(upstreams) == 0 {
+		logger.Println("Skipping update because all upstreams are in a cooldown period")
+		return result, errors.New(earliestCooldown(config, time.Now()))
+	}
+
+	var sources []DownloadSource
+
+	defer func() {
+		if saveErr := mirrors.save(config.DataFilePath); saveErr != nil {
+			logError.Printf("Unable to save mirror state. %v", saveErr)
+		}
+
+		for _, upstream := range upstreams {
+			if upstream.cooldown == nil {
+				continue
+			}
+
+			saveErr := saveCooldown(config.DataFilePath, upstream.URL.Host, *upstream.cooldown)
+
+			if saveErr != nil {
+				logError.Printf("Unable to save cooldown state. %v", saveErr)
+			}
+		}
+
+		if saveErr := saveDownloadSources(config.DataFilePath, sources); saveErr != nil {
+			logError.Printf("Unable to save download sources. %v", saveErr)
+		}
+	}()
+
+	cause = "sigtool"
 	sigtoolParsedPath, err := findSigtoolPath(os.Getenv("PATH"))
 
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	sigtoolPath = sigtoolParsedPath
@@ -53,10 +115,11 @@ func RunSignatureUpdate(config Config) error {
 		logger.Printf("ClamAV executable sigtool found at path: %v", sigtoolPath)
 	}
 
+	cause = "dns"
 	versionTxtRecord, err := pullTxtRecord(config.DNSDbInfoDomain)
 
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	if verboseMode {
@@ -66,13 +129,24 @@ func RunSignatureUpdate(config Config) error {
 	versions, err := parseTxtRecord(versionTxtRecord)
 
 	if err != nil {
-		return err
+		return result, err
 	}
 
 	if verboseMode {
 		logger.Printf("TXT record values parsed: %v", versions)
 	}
 
+	identity := newRequestIdentity(config, versions)
+	setLastRequestIdentity(identity)
+
+	cause = "configuration"
+
+	if err := configureRequestHeaders(config, upstreams, identity); err != nil {
+		return result, err
+	}
+
+	cause = "download"
+
 	var signaturesToUpdate = [3]Signature{
 		{Name: "main", Version: versions.MainVersion},
 		{Name: "daily", Version: versions.DailyVersion},
@@ -80,17 +154,78 @@ func RunSignatureUpdate(config Config) error {
 	}
 
 	for _, signature := range signaturesToUpdate {
-		err = updateFile(config.DataFilePath, signature,
-			config.DownloadMirrorURL, config.DiffThreshold)
+		if ctx.Err() != nil {
+			return result, cancelledError(ctx)
+		}
+
+		signatureResult, err := updateFile(ctx, config, signature, upstreams)
+
+		sources = append(sources, signatureResult.Sources...)
 
 		if err != nil {
-			return err
+			return result, err
+		}
+
+		result.Signatures = append(result.Signatures, signatureResult)
+
+		if signatureResult.Lag > 0 {
+			logger.Printf("Signature [%v] is at version [%v] which is [%v] versions "+
+				"behind the advertised version [%v]", signatureResult.Name,
+				signatureResult.Version, signatureResult.Lag, signatureResult.AdvertisedVersion)
 		}
 	}
 
+	return result, nil
+}
+
+// Function that configures the proxy, TLS settings and bandwidth limit used
+// to connect to upstreams and loads the mirror health state. Every update
+// reconfigures upstreams so that configuration changes are picked up.
+func configureUpstreams(config Config) error {
+	upstreamsConfiguredLock.Lock()
+	defer upstreamsConfiguredLock.Unlock()
+
+	return configureUpstreamsLocked(config)
+}
+
+// Function that configures upstreams unless an update or an earlier fetch
+// has already done so. Files may be fetched before the first update runs.
+func configureUpstreamsOnce(config Config) error {
+	upstreamsConfiguredLock.Lock()
+	defer upstreamsConfiguredLock.Unlock()
+
+	if upstreamsConfigured {
+		return nil
+	}
+
+	return configureUpstreamsLocked(config)
+}
+
+func configureUpstreamsLocked(config Config) error {
+	if err := configureTransport(config); err != nil {
+		return err
+	}
+
+	configureBandwidthLimit(config.BandwidthLimit)
+
+	mirrorHealth, err := loadMirrorHealth(config.DataFilePath)
+
+	if err != nil {
+		logError.Printf("Discarding unreadable mirror state. %v", err)
+	}
+
+	mirrors.replace(mirrorHealth)
+	upstreamsConfigured = true
+
 	return nil
 }
 
+// Function that returns the error reported when an update stops because its
+// context was cancelled.
+func cancelledError(ctx context.Context) error {
+	return errors.WrapPrefix(ctx.Err(), "Signature update was cancelled", 1)
+}
+
 // Function that gets retrieves the value of the DNS TXT record published by
 // ClamAV.
 func pullTxtRecord(dnsDbInfoDomain string) (string, error) {
@@ -142,6 +277,12 @@ func parseTxtRecord(mirrorTxtRecord string) (SignatureVersions, error) {
 		return versions, errors.WrapPrefix(err, "Error parsing daily version:", 1)
 	}
 
+	flevel, err := strconv.ParseUint(s[5], 10, 64)
+
+	if err != nil {
+		return versions, errors.WrapPrefix(err, "Error parsing functionality level", 1)
+	}
+
 	safebrowsingv, err := strconv.ParseUint(s[6], 10, 64)
 
 	if err != nil {
@@ -156,6 +297,7 @@ func parseTxtRecord(mirrorTxtRecord string) (SignatureVersions, error) {
 
 	versions = SignatureVersions{
 		ClamAVVersion:       clamavVersion,
+		FunctionalityLevel:  flevel,
 		MainVersion:         mainv,
 		DailyVersion:        daily,
 		SafeBrowsingVersion: safebrowsingv,
@@ -197,9 +339,12 @@ func findSigtoolPath(envPath string) (string, error) {
 }
 
 // Function that updates the data files for a given signature by either
-// downloading the datafile or downloading diffs.
-func updateFile(dataFilePath string,
-	signature Signature, downloadMirrorURL *url.URL, diffCountThreshold uint16) error {
+// downloading the datafile or downloading diffs. If mirrors only have older
+// versions of the signature, the lag is reported in the result rather than
+// as an error.
+func updateFile(ctx context.Context, config Config, signature Signature,
+	upstreams []*upstreamState) (SignatureResult, error) {
+	dataFilePath := config.DataFilePath
 	filePrefix := signature.Name
 	currentVersion := signature.Version
 	separator := string(filepath.Separator)
@@ -210,7 +355,7 @@ func updateFile(dataFilePath string,
 	downloadNewBaseSignature, err := existsAndIsAccessible(localFilePath)
 
 	if err != nil {
-		return err
+		return SignatureResult{}, err
 	}
 
 	signatureInfo, err := readSignatureInfo(localFilePath)
@@ -228,6 +373,7 @@ func updateFile(dataFilePath string,
 	}
 
 	oldVersion := signatureInfo.Version
+	var sources []DownloadSource
 
 	if !downloadNewBaseSignature {
 		downloads := list.New()
@@ -248,13 +394,21 @@ func updateFile(dataFilePath string,
 			}
 
 			downloads.PushBack(Download{
-				Filename:         diffFilename,
-				LocalFilePath:    localDiffFilePath,
-				oldSignatureInfo: signatureInfo,
+				Filename:          diffFilename,
+				LocalFilePath:     localDiffFilePath,
+				oldSignatureInfo:  signatureInfo,
+				version:           count,
+				advertisedVersion: currentVersion,
 			})
 		}
 
-		err := downloadFilesWithRetry(downloads, downloadMirrorURL)
+		diffSources, err := downloadFilesWithRetry(ctx, downloads, upstreams)
+		sources = append(sources, diffSources...)
+
+		// Don't fall back to downloading the .cvd when we were told to stop
+		if _, ok := asCooldownError(err); ok || ctx.Err() != nil {
+			return SignatureResult{Name: signature.Name, Sources: sources}, err
+		}
 
 		/* Give up attempting to download incremental diffs if we can't find a
 		 * diff file corresponding to the version needed. We just go download
@@ -270,30 +424,67 @@ func updateFile(dataFilePath string,
 	/* If we have too many diffs, we go ahead and download the whole signatures
 	 * after we have the diffs so that our base signature files stay relatively
 	 * current. */
-	if !downloadNewBaseSignature && (currentVersion-oldVersion > uint64(diffCountThreshold)) {
+	if !downloadNewBaseSignature && (currentVersion-oldVersion > uint64(config.DiffThreshold)) {
 		logger.Printf("Original signature has deviated beyond threshold from diffs, "+
 			"so we are downloading the file [%v] again", filename)
 
 		downloadNewBaseSignature = true
 	}
 
+	/* Full .cvd downloads are large, so they may be limited to certain times
+	 * of day. We always allow them when we don't have a usable copy. */
+	bootstrap := signatureInfo == (SignatureInfo{})
+
+	if downloadNewBaseSignature && !bootstrap &&
+		!utils.InTimeWindows(config.CVDDownloadWindows, time.Now()) {
+		logger.Printf("Not downloading [%v] because it is outside of the .cvd "+
+			"download windows [%v]", filename, utils.JoinTimeWindows(config.CVDDownloadWindows))
+
+		downloadNewBaseSignature = false
+	}
+
+	switch {
+	case downloadNewBaseSignature:
+		updateDecisions.Inc(signature.Name, "cvd")
+	case oldVersion < currentVersion:
+		updateDecisions.Inc(signature.Name, "cdiff")
+	default:
+		updateDecisions.Inc(signature.Name, "current")
+	}
+
 	if downloadNewBaseSignature {
 		download := Download{
-			Filename:         filename,
-			LocalFilePath:    localFilePath,
-			oldSignatureInfo: signatureInfo,
+			Filename:          filename,
+			LocalFilePath:     localFilePath,
+			oldSignatureInfo:  signatureInfo,
+			version:           currentVersion,
+			advertisedVersion: currentVersion,
 		}
 
-		_, err := downloadWithRetry(download, downloadMirrorURL)
+		source, _, err := downloadWithRetry(ctx, download, upstreams)
 
-		if err != nil {
-			return err
+		if source != (DownloadSource{}) {
+			sources = append(sources, source)
 		}
 
-		return nil
+		if stale, ok := asStaleMirrorError(err); ok {
+			logger.Printf("No mirror had the advertised version of [%v]. %v", filename, stale)
+		} else if err != nil {
+			return SignatureResult{Name: signature.Name, Sources: sources}, err
+		}
+
+		signatureInfo, err = readSignatureInfo(localFilePath)
+
+		if err != nil {
+			return SignatureResult{Name: signature.Name, Sources: sources}, err
+		}
 	}
 
-	return nil
+	version := effectiveVersion(dataFilePath, filePrefix, signatureInfo.Version, currentVersion)
+	result := newSignatureResult(signature.Name, version, currentVersion)
+	result.Sources = sources
+
+	return result, nil
 }
 
 // Function that checks to see if the specified file already exists. This function
@@ -33,6 +33,11 @@ func TestTypicalRecordParseTxtRecord(t *testing.T) {
 			"Actually: %v", versions.MainVersion)
 	}
 
+	if versions.FunctionalityLevel != 63 {
+		t.Errorf("Didn't parse functionality level correctly. Expected 63."+
+			"Actually: %v", versions.FunctionalityLevel)
+	}
+
 	if versions.SafeBrowsingVersion != 46223 {
 		t.Errorf("Didn't parse safe browsing version correctly. Expected 46223."+
 			"Actually: %v", versions.SafeBrowsingVersion)
@@ -0,0 +1,102 @@
+package sigupdate
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// UpdateResult is a summary of the signatures available in the data
+// directory after a signature update.
+type UpdateResult struct {
+	Signatures []SignatureResult
+}
+
+// SignatureResult is the outcome of updating a single signature. Lag is the
+// number of versions that the mirrored signature is behind the version
+// advertised by ClamAV. Sources lists the upstream that served each file
+// downloaded during the update.
+type SignatureResult struct {
+	Name              string           `json:"name"`
+	AdvertisedVersion uint64           `json:"advertised_version"`
+	Version           uint64           `json:"version"`
+	Lag               uint64           `json:"lag"`
+	Sources           []DownloadSource `json:"sources,omitempty"`
+}
+
+// StaleMirrorError is returned when a mirror serves a signature file that is
+// older than the version advertised in the ClamAV TXT record.
+type StaleMirrorError struct {
+	Filename          string
+	Version           uint64
+	AdvertisedVersion uint64
+}
+
+func (e *StaleMirrorError) Error() string {
+	return fmt.Sprintf("Mirror served [%v] version [%v] which is behind the "+
+		"advertised version [%v]", e.Filename, e.Version, e.AdvertisedVersion)
+}
+
+// Function that returns the number of versions the mirror is behind.
+func (e *StaleMirrorError) lag() uint64 {
+	if e.Version >= e.AdvertisedVersion {
+		return 0
+	}
+
+	return e.AdvertisedVersion - e.Version
+}
+
+// Function that returns the StaleMirrorError wrapped by an error if present.
+func asStaleMirrorError(err error) (*StaleMirrorError, bool) {
+	if wrapped, ok := err.(*errors.Error); ok {
+		err = wrapped.Err
+	}
+
+	stale, ok := err.(*StaleMirrorError)
+
+	return stale, ok
+}
+
+// Function that determines the signature version that clients can update to
+// from the data directory: the version of the .cvd file plus every
+// consecutive .cdiff that follows it.
+func effectiveVersion(dataFilePath string, filePrefix string, cvdVersion uint64,
+	advertisedVersion uint64) uint64 {
+
+	version := cvdVersion
+
+	for version < advertisedVersion {
+		diffFilename := filePrefix + "-" + strconv.FormatUint(version+1, 10) + ".cdiff"
+
+		if !utils.Exists(filepath.Join(dataFilePath, diffFilename)) {
+			break
+		}
+
+		version++
+	}
+
+	return version
+}
+
+// Function that creates the result for a signature after it has been updated.
+func newSignatureResult(name string, version uint64, advertisedVersion uint64) SignatureResult {
+	result := SignatureResult{
+		Name:              name,
+		AdvertisedVersion: advertisedVersion,
+		Version:           version,
+	}
+
+	if version < advertisedVersion {
+		result.Lag = advertisedVersion - version
+	}
+
+	return result
+}
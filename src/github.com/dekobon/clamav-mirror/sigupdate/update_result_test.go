@@ -0,0 +1,91 @@
+package sigupdate
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsecutiveDiffsEffectiveVersion(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "result-")
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"daily-11.cdiff", "daily-12.cdiff", "daily-14.cdiff"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644)
+	}
+
+	if version := effectiveVersion(dir, "daily", 10, 14); version != 12 {
+		t.Errorf("Expected version 12 because daily-13.cdiff is missing. Actual: %v", version)
+	}
+
+	if version := effectiveVersion(dir, "daily", 15, 14); version != 15 {
+		t.Errorf("Expected the .cvd version when it is ahead. Actual: %v", version)
+	}
+}
+
+func TestLagNewSignatureResult(t *testing.T) {
+	result := newSignatureResult("daily", 12, 14)
+
+	if result.Lag != 2 {
+		t.Errorf("Expected lag of 2. Actual: %+v", result)
+	}
+
+	if result := newSignatureResult("daily", 14, 14); result.Lag != 0 {
+		t.Errorf("Expected no lag. Actual: %+v", result)
+	}
+}
+
+func TestNotModifiedBehindAdvertisedExecuteHTTPRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "result-")
+	defer os.RemoveAll(dir)
+
+	downloadURL, _ := url.Parse(server.URL + "/daily.cvd")
+	download := Download{
+		Filename:          "daily.cvd",
+		LocalFilePath:     filepath.Join(dir, "daily.cvd"),
+		oldSignatureInfo:  SignatureInfo{Version: 10, BuildTime: time.Now()},
+		version:           12,
+		advertisedVersion: 12,
+	}
+
+	_, err := executeHTTPRequest(context.Background(), download, downloadURL, net.IPAddr{}, nil)
+	stale, ok := asStaleMirrorError(err)
+
+	if !ok || stale.lag() != 2 {
+		t.Fatalf("Expected a stale mirror error with lag of 2. Actual: %v", err)
+	}
+
+	download.advertisedVersion = 10
+	download.version = 10
+
+	if _, err := executeHTTPRequest(context.Background(), download, downloadURL,
+		net.IPAddr{}, nil); err != nil {
+		t.Errorf("Expected no error when the local copy is current. Actual: %v", err)
+	}
+}
+
+func TestStaleRecordDownloadOutcome(t *testing.T) {
+	mirrors = newMirrorHealthDB()
+	defer func() { mirrors = newMirrorHealthDB() }()
+
+	err := &StaleMirrorError{Filename: "daily.cvd", Version: 10, AdvertisedVersion: 14}
+	recordDownloadOutcome(Download{Filename: "daily.cvd"}, "10.0.0.1", 200, err)
+
+	mirror := mirrors.mirrors["10.0.0.1"]
+
+	if mirror.Stale != 1 || mirror.Lag != 4 || mirror.Successes != 0 {
+		t.Errorf("Expected a stale mirror with lag of 4. Actual: %+v", mirror)
+	}
+}
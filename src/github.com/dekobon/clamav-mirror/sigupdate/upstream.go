@@ -0,0 +1,383 @@
+package sigupdate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+import (
+	"github.com/dekobon/clamav-mirror/utils"
+)
+
+// Number of mirrors tried for each file when there are several upstreams and
+// no retry budget is configured
+const defaultUpstreamRetryBudget = 3
+
+// Filename of the file in the data directory recording where files came from
+const downloadSourcesFilename = "sigupdate-sources.json"
+
+// Upstream is a source of signature files. RetryBudget is the number of
+// mirror addresses that are tried for each file before failing over to the
+// next upstream. A RetryBudget of zero uses the configured budget. Headers
+// are extra request headers sent to the upstream, with values that are
+// templates rendered with a RequestIdentity.
+type Upstream struct {
+	URL         *url.URL
+	RetryBudget uint16
+	Headers     map[string]string
+}
+
+func (u Upstream) String() string {
+	return u.URL.String() + u.options()
+}
+
+// Function that formats the ";key=value" options that follow the URL of an
+// upstream.
+func (u Upstream) options() string {
+	value := ""
+
+	if u.RetryBudget != 0 {
+		value += fmt.Sprintf(";retries=%d", u.RetryBudget)
+	}
+
+	names := make([]string, 0, len(u.Headers))
+
+	for name := range u.Headers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		value += fmt.Sprintf(";header=%v: %v", name, escapeUpstreamValue(u.Headers[name]))
+	}
+
+	return value
+}
+
+// DownloadSource records the upstream and mirror address that a file was
+// downloaded from.
+type DownloadSource struct {
+	Filename   string    `json:"filename"`
+	Upstream   string    `json:"upstream"`
+	Address    string    `json:"address"`
+	Downloaded time.Time `json:"downloaded"`
+}
+
+// upstreamState is the state of an upstream during a single update run.
+type upstreamState struct {
+	Upstream
+	addresses   []net.IPAddr
+	resolved    bool
+	mirrorIndex int
+	cooldown    *CooldownError
+	headers     http.Header
+}
+
+// Function that parses a comma separated list of upstream URLs in order of
+// preference. Each URL may be followed by ";retries=N" to override the
+// default retry budget and by any number of ";header=Name: value" options
+// to send extra headers to the upstream. A "," or ";" within a header value
+// must be escaped with a backslash.
+func parseUpstreams(value string) ([]Upstream, error) {
+	var upstreams []Upstream
+
+	for _, entry := range splitUnescaped(value, ',') {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		options := splitUnescaped(entry, ';')
+		entry = strings.TrimSpace(options[0])
+		upstream := Upstream{}
+
+		for _, option := range options[1:] {
+			if err := parseUpstreamOption(&upstream, option); err != nil {
+				msg := fmt.Sprintf("Invalid option for upstream [%v]", entry)
+				return nil, errors.WrapPrefix(err, msg, 1)
+			}
+		}
+
+		if !strings.HasPrefix(entry, "http") {
+			entry = "http://" + entry
+		}
+
+		u, err := url.Parse(entry)
+
+		if err != nil {
+			msg := fmt.Sprintf("Error parsing URL [%v]", entry)
+			return nil, errors.WrapPrefix(err, msg, 1)
+		}
+
+		upstream.URL = u
+		upstreams = append(upstreams, upstream)
+	}
+
+	if len(upstreams) == 0 {
+		return nil, errors.New("At least one download mirror URL must be specified")
+	}
+
+	return upstreams, nil
+}
+
+// Function that parses a single ";key=value" option following an upstream URL.
+func parseUpstreamOption(upstream *Upstream, option string) error {
+	i := strings.Index(option, "=")
+
+	if i < 0 {
+		return errors.Errorf("Option [%v] must be in the format key=value", option)
+	}
+
+	key := strings.TrimSpace(option[:i])
+	value := option[i+1:]
+
+	switch key {
+	case "retries":
+		budget, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid retry budget", 1)
+		}
+
+		upstream.RetryBudget = uint16(budget)
+	case "header":
+		j := strings.Index(value, ":")
+
+		if j < 0 {
+			return errors.Errorf("Header [%v] must be in the format Name: value", value)
+		}
+
+		name := strings.TrimSpace(value[:j])
+
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			return errors.Errorf("Invalid header name [%v]", name)
+		}
+
+		headerValue := unescapeUpstreamValue(strings.TrimSpace(value[j+1:]))
+
+		if _, err := parseRequestTemplate(name, headerValue); err != nil {
+			return err
+		}
+
+		if upstream.Headers == nil {
+			upstream.Headers = make(map[string]string)
+		}
+
+		upstream.Headers[http.CanonicalHeaderKey(name)] = headerValue
+	default:
+		return errors.Errorf("Unknown option [%v]. Valid options: retries, header", key)
+	}
+
+	return nil
+}
+
+// Function that splits a value on each separator that isn't escaped with a
+// backslash. Escapes are kept so that the parts can be split again.
+func splitUnescaped(value string, separator byte) []string {
+	var parts []string
+	start := 0
+
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			// Skip the escaped character
+			i++
+		case separator:
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, value[start:])
+}
+
+// Escapes of the characters that separate upstreams and their options
+var upstreamEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `;`, `\;`)
+var upstreamUnescaper = strings.NewReplacer(`\\`, `\`, `\,`, `,`, `\;`, `;`)
+
+// Function that escapes a header value so that it can follow an upstream URL.
+func escapeUpstreamValue(value string) string {
+	return upstreamEscaper.Replace(value)
+}
+
+// Function that removes the escapes from a header value.
+func unescapeUpstreamValue(value string) string {
+	return upstreamUnescaper.Replace(value)
+}
+
+// Function that joins upstreams into the format accepted by parseUpstreams.
+func joinUpstreams(upstreams []Upstream) string {
+	values := make([]string, len(upstreams))
+
+	for i, upstream := range upstreams {
+		values[i] = upstream.String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+// Function that creates the run state for each configured upstream. Upstreams
+// that are in a cooldown period are left out.
+func availableUpstreams(config Config, now time.Time) []*upstreamState {
+	var states []*upstreamState
+
+	for _, upstream := range config.Upstreams {
+		host := upstream.URL.Host
+
+		if cooldown, active := activeCooldown(config.DataFilePath, host, now); active {
+			logger.Printf("Skipping upstream [%v] because it is in a cooldown "+
+				"period until %v", host, cooldown.Until.Format(time.RFC3339))
+			continue
+		}
+
+		if upstream.RetryBudget == 0 {
+			upstream.RetryBudget = config.UpstreamRetryBudget
+		}
+
+		/* A single upstream has nothing to fail over to, so by default every
+		 * one of its mirrors is tried. */
+		if upstream.RetryBudget == 0 && len(config.Upstreams) == 1 {
+			upstream.RetryBudget = math.MaxUint16
+		} else if upstream.RetryBudget == 0 {
+			upstream.RetryBudget = defaultUpstreamRetryBudget
+		}
+
+		states = append(states, &upstreamState{Upstream: upstream})
+	}
+
+	return states
+}
+
+// Function that resolves the mirror addresses of an upstream the first time
+// that they are needed.
+func (upstream *upstreamState) resolve() ([]net.IPAddr, error) {
+	if upstream.resolved {
+		return upstream.addresses, nil
+	}
+
+	/* When a proxy is used, the proxy decides which mirror we are connected
+	 * to, so we use a single unpinned address. */
+	if usesProxy(upstream.URL) {
+		upstream.addresses = []net.IPAddr{{}}
+		upstream.resolved = true
+
+		return upstream.addresses, nil
+	}
+
+	host := upstream.URL.Hostname()
+	addresses, err := resolveMirrorIP(host)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to resolve host [%v]", host)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	// Healthy mirrors are tried first, but we still spread requests out so
+	// that we are not always hitting the same mirrors.
+	upstream.addresses = mirrors.order(upstream.URL.Host, addresses, time.Now())
+	upstream.resolved = true
+
+	return upstream.addresses, nil
+}
+
+/* Function that handles a response asking us to back off. A 429 puts the
+ * whole upstream into a cooldown period. A 403 may come from a single mirror
+ * that blocks us while the others don't, so it only bans the mirror address
+ * unless every mirror that was tried blocked us. Returns true when the
+ * upstream is in a cooldown period. */
+func (upstream *upstreamState) backOff(cooldown *CooldownError, address string, allBlocked bool) bool {
+	cooldown.Host = upstream.URL.Host
+
+	if cooldown.StatusCode == http.StatusForbidden {
+		mirrors.recordBlocked(address, cooldown.Until, time.Now())
+
+		if !allBlocked {
+			return false
+		}
+	}
+
+	upstream.cooldown = cooldown
+
+	return true
+}
+
+// Function that checks to see if every upstream has asked us to back off.
+func allCoolingDown(upstreams []*upstreamState) bool {
+	for _, upstream := range upstreams {
+		if upstream.cooldown == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Function that reads the record of where each file was downloaded from.
+func loadDownloadSources(dataFilePath string) (map[string]DownloadSource, error) {
+	sources := make(map[string]DownloadSource)
+	statePath := filepath.Join(dataFilePath, downloadSourcesFilename)
+
+	if !utils.Exists(statePath) {
+		return sources, nil
+	}
+
+	data, err := ioutil.ReadFile(statePath)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to read download sources [%v]", statePath)
+		return sources, errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := json.Unmarshal(data, &sources); err != nil {
+		msg := fmt.Sprintf("Unable to parse download sources [%v]", statePath)
+		return sources, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return sources, nil
+}
+
+// Function that adds newly downloaded files to the record of where each file
+// was downloaded from. Files that no longer exist are dropped.
+func saveDownloadSources(dataFilePath string, downloaded []DownloadSource) error {
+	sources, err := loadDownloadSources(dataFilePath)
+
+	if err != nil {
+		logError.Printf("Discarding unreadable download sources. %v", err)
+		sources = make(map[string]DownloadSource)
+	}
+
+	for _, source := range downloaded {
+		sources[source.Filename] = source
+	}
+
+	for filename := range sources {
+		if !utils.Exists(filepath.Join(dataFilePath, filename)) {
+			delete(sources, filename)
+		}
+	}
+
+	data, err := json.MarshalIndent(sources, "", "  ")
+
+	if err != nil {
+		return errors.WrapPrefix(err, "Unable to serialize download sources", 1)
+	}
+
+	return utils.WriteFileAtomically(filepath.Join(dataFilePath, downloadSourcesFilename),
+		data, time.Now())
+}
@@ -0,0 +1,308 @@
+package sigupdate
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryBudgetParseUpstreams(t *testing.T) {
+	upstreams, err := parseUpstreams("db.us.clamav.net, http://mirror.example.com:8080/clamav;retries=5")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(upstreams) != 2 {
+		t.Fatalf("Expected 2 upstreams. Actual: %v", upstreams)
+	}
+
+	if upstreams[0].URL.String() != "http://db.us.clamav.net" || upstreams[0].RetryBudget != 0 {
+		t.Errorf("Unexpected first upstream: %v", upstreams[0])
+	}
+
+	if upstreams[1].URL.Host != "mirror.example.com:8080" || upstreams[1].RetryBudget != 5 {
+		t.Errorf("Unexpected second upstream: %v", upstreams[1])
+	}
+
+	if joined := joinUpstreams(upstreams); joined !=
+		"http://db.us.clamav.net,http://mirror.example.com:8080/clamav;retries=5" {
+		t.Errorf("Unexpected joined upstreams: %v", joined)
+	}
+}
+
+func TestInvalidParseUpstreams(t *testing.T) {
+	if _, err := parseUpstreams("db.us.clamav.net;retries=lots"); err == nil {
+		t.Error("Expected invalid retry budget to be rejected")
+	}
+
+	if _, err := parseUpstreams(" , "); err == nil {
+		t.Error("Expected an empty list of upstreams to be rejected")
+	}
+}
+
+func TestDefaultRetryBudgetAvailableUpstreams(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upstream-")
+	defer os.RemoveAll(dir)
+
+	single, _ := parseUpstreams("db.us.clamav.net")
+	states := availableUpstreams(Config{DataFilePath: dir, Upstreams: single}, time.Now())
+
+	if states[0].RetryBudget != math.MaxUint16 {
+		t.Errorf("Expected every mirror of a single upstream to be tried. Actual: %v",
+			states[0].RetryBudget)
+	}
+
+	several, _ := parseUpstreams("db.us.clamav.net,mirror.example.com;retries=5")
+	states = availableUpstreams(Config{DataFilePath: dir, Upstreams: several}, time.Now())
+
+	if states[0].RetryBudget != defaultUpstreamRetryBudget || states[1].RetryBudget != 5 {
+		t.Errorf("Unexpected retry budgets with several upstreams: %v %v",
+			states[0].RetryBudget, states[1].RetryBudget)
+	}
+
+	states = availableUpstreams(Config{DataFilePath: dir, Upstreams: single,
+		UpstreamRetryBudget: 2}, time.Now())
+
+	if states[0].RetryBudget != 2 {
+		t.Errorf("Expected the configured retry budget. Actual: %v", states[0].RetryBudget)
+	}
+}
+
+func TestFailoverDownloadWithRetry(t *testing.T) {
+	mirrors = newMirrorHealthDB()
+	defer func() { mirrors = newMirrorHealthDB() }()
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+
+	limited := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer limited.Close()
+
+	available := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("diff"))
+	}))
+	defer available.Close()
+
+	dir, _ := ioutil.TempDir("", "upstream-")
+	defer os.RemoveAll(dir)
+
+	upstreams, _ := parseUpstreams(missing.URL + "," + limited.URL + "," + available.URL)
+	states := availableUpstreams(Config{DataFilePath: dir, Upstreams: upstreams,
+		UpstreamRetryBudget: 2}, time.Now())
+
+	download := Download{Filename: "daily-10.cdiff", LocalFilePath: filepath.Join(dir, "daily-10.cdiff")}
+	source, statusCode, err := downloadWithRetry(context.Background(), download, states)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if statusCode != http.StatusOK || source.Upstream != available.URL || source.Address != "127.0.0.1" {
+		t.Errorf("Expected the file to come from the last upstream. Actual: %+v", source)
+	}
+
+	if states[1].cooldown == nil || states[0].cooldown != nil {
+		t.Error("Expected only the rate limited upstream to be cooling down")
+	}
+
+	// Subsequent downloads skip the upstream that asked us to back off
+	download = Download{Filename: "daily-11.cdiff", LocalFilePath: filepath.Join(dir, "daily-11.cdiff")}
+
+	if _, _, err := downloadWithRetry(context.Background(), download, states[:2]); err == nil {
+		t.Error("Expected an error when no upstream has the file")
+	} else if _, ok := asCooldownError(err); ok {
+		t.Error("A cooldown should only be reported when every upstream is cooling down")
+	}
+}
+
+func TestBlockedMirrorDownloadWithRetry(t *testing.T) {
+	mirrors = newMirrorHealthDB()
+	defer func() { mirrors = newMirrorHealthDB() }()
+
+	var requests int32
+	var blockAll int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 || atomic.LoadInt32(&blockAll) == 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		w.Write([]byte("diff"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "upstream-")
+	defer os.RemoveAll(dir)
+
+	// Two mirror addresses that both lead to the test server
+	newStates := func() []*upstreamState {
+		upstreams, _ := parseUpstreams(server.URL + ";retries=2")
+		states := availableUpstreams(Config{DataFilePath: dir, Upstreams: upstreams}, time.Now())
+		states[0].addresses = []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("127.0.0.1")}}
+		states[0].resolved = true
+
+		return states
+	}
+
+	states := newStates()
+	download := Download{Filename: "daily-10.cdiff", LocalFilePath: filepath.Join(dir, "daily-10.cdiff")}
+
+	if _, _, err := downloadWithRetry(context.Background(), download, states); err != nil {
+		t.Fatal(err)
+	}
+
+	if states[0].cooldown != nil || requests != 2 {
+		t.Errorf("Expected a single blocked mirror not to cool down the upstream. "+
+			"Requests: %v", requests)
+	}
+
+	// Once every mirror tried has blocked us, the upstream is cooling down
+	atomic.StoreInt32(&blockAll, 1)
+	states = newStates()
+	download = Download{Filename: "daily-11.cdiff", LocalFilePath: filepath.Join(dir, "daily-11.cdiff")}
+
+	if _, _, err := downloadWithRetry(context.Background(), download, states); err == nil {
+		t.Error("Expected an error when every mirror blocked us")
+	}
+
+	if states[0].cooldown == nil || states[0].cooldown.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the upstream to be cooling down. Actual: %v", states[0].cooldown)
+	}
+
+	if !mirrors.get("127.0.0.1").BannedUntil.After(time.Now()) {
+		t.Error("Expected the blocked mirror to be banned")
+	}
+}
+
+func TestCancelledDownloadWithRetry(t *testing.T) {
+	mirrors = newMirrorHealthDB()
+	defer func() { mirrors = newMirrorHealthDB() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "upstream-")
+	defer os.RemoveAll(dir)
+
+	upstreams, _ := parseUpstreams(server.URL + ";retries=3")
+	states := availableUpstreams(Config{DataFilePath: dir, Upstreams: upstreams}, time.Now())
+
+	download := Download{Filename: "daily.cvd", LocalFilePath: filepath.Join(dir, "daily.cvd")}
+
+	if _, _, err := downloadWithRetry(ctx, download, states); err == nil {
+		t.Fatal("Expected a cancelled download to fail")
+	}
+
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("Expected no mirrors to be tried once cancelled. Requests: %v", count)
+	}
+
+	if mirrors.get("127.0.0.1").Failures != 0 {
+		t.Error("Expected a cancelled download not to count against the mirror")
+	}
+}
+
+func TestSaveDownloadSources(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "upstream-")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "daily.cvd"), []byte{}, 0644)
+
+	err := saveDownloadSources(dir, []DownloadSource{
+		{Filename: "daily.cvd", Upstream: "http://db.us.clamav.net", Address: "10.0.0.1"},
+		{Filename: "daily-10.cdiff", Upstream: "http://db.us.clamav.net", Address: "10.0.0.1"},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := loadDownloadSources(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sources) != 1 || sources["daily.cvd"].Address != "10.0.0.1" {
+		t.Errorf("Expected only files that exist to be recorded. Actual: %v", sources)
+	}
+}
+
+func TestHeaderParseUpstreams(t *testing.T) {
+	value := `https://feed.example.com/clamav;retries=2;header=x-feed-token: {{env "FEED_TOKEN"}}`
+	upstreams, err := parseUpstreams(value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token := upstreams[0].Headers["X-Feed-Token"]; token != `{{env "FEED_TOKEN"}}` {
+		t.Errorf("Unexpected header template: %v", upstreams[0].Headers)
+	}
+
+	if joined := joinUpstreams(upstreams); joined !=
+		`https://feed.example.com/clamav;retries=2;header=X-Feed-Token: {{env "FEED_TOKEN"}}` {
+		t.Errorf("Unexpected joined upstreams: %v", joined)
+	}
+
+	for _, invalid := range []string{"db.us.clamav.net;header=NoValue",
+		"db.us.clamav.net;header=X-Token: {{.Missing", "db.us.clamav.net;mirrors=2"} {
+		if _, err := parseUpstreams(invalid); err == nil {
+			t.Errorf("Expected [%v] to be rejected", invalid)
+		}
+	}
+}
+
+func TestEscapedHeaderParseUpstreams(t *testing.T) {
+	value := `https://feed.example.com;header=Cookie: session=abc\; theme=dark\, wide;retries=2,` +
+		`db.us.clamav.net;header=X-Path: C:\\feeds\\`
+	upstreams, err := parseUpstreams(value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(upstreams) != 2 {
+		t.Fatalf("Expected escaped separators not to split upstreams. Actual: %v", upstreams)
+	}
+
+	if cookie := upstreams[0].Headers["Cookie"]; cookie != "session=abc; theme=dark, wide" {
+		t.Errorf("Unexpected header with escaped separators: %v", cookie)
+	}
+
+	if upstreams[0].RetryBudget != 2 {
+		t.Errorf("Expected the option after an escaped header to be parsed. Actual: %v",
+			upstreams[0].RetryBudget)
+	}
+
+	if path := upstreams[1].Headers["X-Path"]; path != `C:\feeds\` {
+		t.Errorf("Unexpected header with escaped backslashes: %v", path)
+	}
+
+	reparsed, err := parseUpstreams(joinUpstreams(upstreams))
+
+	if err != nil || !reflect.DeepEqual(reparsed, upstreams) {
+		t.Errorf("Expected joined upstreams to be parsed as the original. Actual: %v %v",
+			reparsed, err)
+	}
+}
@@ -3,7 +3,7 @@ package utils
 // AppVersionInfo is a data structure that represents the version information
 // we want to display to users.
 type AppVersionInfo struct {
-	AppVersion    string
-	GitCommitHash string
-	UTCBuildTime  string
+	AppVersion    string `json:"version"`
+	GitCommitHash string `json:"git_commit_hash"`
+	UTCBuildTime  string `json:"utc_build_time"`
 }
@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/go-errors/errors"
+	"github.com/pborman/getopt"
+)
+
+// RedactedValue is written in place of secrets when a configuration is
+// displayed.
+const RedactedValue = "********"
+
+/* ConfigFile is the parsed contents of a configuration file. The file is a
+ * small subset of YAML: each top level key names a section, and each section
+ * maps the long names of command line options to their values. Lists, either
+ * as "- item" lines or "[a, b]", become comma separated values because that
+ * is how every list option is given on the command line. */
+type ConfigFile map[string]map[string]string
+
+/* ConfigSetting describes an option that can be set in a configuration file.
+ * Its environment variable takes precedence over the file. When the setting
+ * is displayed, a secret is replaced entirely, while Redact can remove just
+ * the credentials from a value such as a URL. */
+type ConfigSetting struct {
+	Option string
+	EnvVar string
+	Secret bool
+	Redact func(value string) string
+}
+
+// ReadConfigFile reads and parses a configuration file.
+func ReadConfigFile(path string) (ConfigFile, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to open config file [%v]", path)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer file.Close()
+
+	config, err := ParseConfigFile(file)
+
+	if err != nil {
+		msg := fmt.Sprintf("Error parsing config file [%v]", path)
+		return nil, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return config, nil
+}
+
+// ParseConfigFile parses the contents of a configuration file.
+func ParseConfigFile(reader io.Reader) (ConfigFile, error) {
+	config := make(ConfigFile)
+	scanner := bufio.NewScanner(reader)
+
+	var section map[string]string
+	var settingIndent int
+	var listKey string
+	var listIndent int
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := stripConfigComment(strings.TrimRight(scanner.Text(), " \t\r"))
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+
+		if content == "" {
+			continue
+		}
+
+		if strings.HasPrefix(content, "\t") {
+			return nil, errors.Errorf("line %d: indent with spaces rather than tabs", lineNumber)
+		}
+
+		if listKey != "" && indent > listIndent && strings.HasPrefix(content+" ", "- ") {
+			item, err := parseConfigScalar(strings.TrimSpace(content[1:]))
+
+			if err != nil {
+				return nil, errors.Errorf("line %d: %v", lineNumber, err)
+			}
+
+			if section[listKey] != "" {
+				item = section[listKey] + "," + item
+			}
+
+			section[listKey] = item
+			continue
+		}
+
+		listKey = ""
+		colon := strings.Index(content, ":")
+
+		if colon < 1 || (colon+1 < len(content) && content[colon+1] != ' ') {
+			return nil, errors.Errorf("line %d: expected \"name: value\"", lineNumber)
+		}
+
+		key := content[:colon]
+		value := strings.TrimSpace(content[colon+1:])
+
+		if strings.ContainsAny(key, " \"'") {
+			return nil, errors.Errorf("line %d: invalid name [%v]", lineNumber, key)
+		}
+
+		if indent == 0 {
+			if value != "" {
+				return nil, errors.Errorf("line %d: expected a section such as \"%v:\"",
+					lineNumber, key)
+			}
+
+			if _, exists := config[key]; exists {
+				return nil, errors.Errorf("line %d: section [%v] is repeated", lineNumber, key)
+			}
+
+			section = make(map[string]string)
+			settingIndent = 0
+			config[key] = section
+			continue
+		}
+
+		if section == nil {
+			return nil, errors.Errorf("line %d: setting [%v] must be inside a section",
+				lineNumber, key)
+		}
+
+		if settingIndent == 0 {
+			settingIndent = indent
+		} else if indent != settingIndent {
+			return nil, errors.Errorf("line %d: inconsistent indentation", lineNumber)
+		}
+
+		if _, exists := section[key]; exists {
+			return nil, errors.Errorf("line %d: setting [%v] is repeated", lineNumber, key)
+		}
+
+		var err error
+
+		switch {
+		case value == "":
+			// A list of "- item" lines may follow
+			listKey = key
+			listIndent = indent
+		case strings.HasPrefix(value, "["):
+			value, err = parseConfigFlowList(value)
+		default:
+			value, err = parseConfigScalar(value)
+		}
+
+		if err != nil {
+			return nil, errors.Errorf("line %d: %v", lineNumber, err)
+		}
+
+		section[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, 1)
+	}
+
+	return config, nil
+}
+
+// Function that removes a comment from a line. A comment starts with a # at
+// the start of the line or after a space, outside of quotes.
+func stripConfigComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+
+	return line
+}
+
+// Function that parses a single value, which can be double quoted with
+// backslash escapes, single quoted or unquoted.
+func parseConfigScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "\""):
+		unquoted, err := strconv.Unquote(value)
+
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value %v", value)
+		}
+
+		return unquoted, nil
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("invalid quoted value %v", value)
+		}
+
+		return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+	default:
+		return value, nil
+	}
+}
+
+// Function that parses a list such as [a, b] into comma separated values.
+func parseConfigFlowList(value string) (string, error) {
+	if !strings.HasSuffix(value, "]") {
+		return "", fmt.Errorf("list %v is missing a closing ]", value)
+	}
+
+	var items []string
+
+	for _, item := range strings.Split(value[1:len(value)-1], ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		parsed, err := parseConfigScalar(item)
+
+		if err != nil {
+			return "", err
+		}
+
+		items = append(items, parsed)
+	}
+
+	return strings.Join(items, ","), nil
+}
+
+/* ApplyConfigSection sets the options of a getopt set from a section of a
+ * configuration file. Options given on the command line and options whose
+ * environment variable is set are left alone, so the file has the lowest
+ * precedence. This must be called after the set has been parsed. */
+func ApplyConfigSection(set *getopt.Set, section map[string]string, settings []ConfigSetting) error {
+	known := make(map[string]ConfigSetting)
+
+	for _, setting := range settings {
+		known[setting.Option] = setting
+	}
+
+	var names []string
+
+	for name := range section {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		setting, exists := known[name]
+		option := set.Lookup(name)
+
+		if !exists || option == nil {
+			return errors.Errorf("Unknown setting [%v]", name)
+		}
+
+		if option.Seen() {
+			continue
+		}
+
+		if _, present := os.LookupEnv(setting.EnvVar); present {
+			continue
+		}
+
+		if err := option.Value().Set(section[name], option); err != nil {
+			return errors.Errorf("Invalid value for setting [%v]: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// WriteConfigSection writes the current values of the options of a getopt
+// set as a section of a configuration file. Secrets and credentials are
+// redacted.
+func WriteConfigSection(writer io.Writer, name string, set *getopt.Set, settings []ConfigSetting) {
+	fmt.Fprintf(writer, "%v:\n", name)
+
+	for _, setting := range settings {
+		option := set.Lookup(setting.Option)
+
+		if option == nil {
+			continue
+		}
+
+		value := option.String()
+
+		if setting.Secret && value != "" {
+			value = RedactedValue
+		} else if setting.Redact != nil {
+			value = setting.Redact(value)
+		}
+
+		fmt.Fprintf(writer, "  %v: %v\n", setting.Option, formatConfigValue(value))
+	}
+}
+
+// Function that quotes a value unless it is plain enough to be written as it
+// is without YAML reading it differently.
+func formatConfigValue(value string) string {
+	if value == "" || strings.TrimSpace(value) != value || strings.HasPrefix(value, "-") {
+		return strconv.Quote(value)
+	}
+
+	for _, c := range value {
+		plain := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			strings.ContainsRune(" ._/+=-", c)
+
+		if !plain {
+			return strconv.Quote(value)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/pborman/getopt"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	contents := `# Settings shared by both applications
+sigupdate:
+  data-file-path: /var/clamav/data   # comment
+  download-mirror-url:
+    - http://one.example.com
+    - "http://two.example.com;header=X-Token: a#b"
+  verbose: true
+
+sigserver:
+  api-allow: [10.0.0.0/8, '192.168.0.0/16']
+  admin-token: 'it''s'
+  redirect-missing-url:
+`
+
+	config, err := ParseConfigFile(strings.NewReader(contents))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := ConfigFile{
+		"sigupdate": {
+			"data-file-path":      "/var/clamav/data",
+			"download-mirror-url": "http://one.example.com,http://two.example.com;header=X-Token: a#b",
+			"verbose":             "true",
+		},
+		"sigserver": {
+			"api-allow":            "10.0.0.0/8,192.168.0.0/16",
+			"admin-token":          "it's",
+			"redirect-missing-url": "",
+		},
+	}
+
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Config file not parsed as expected.\n"+
+			"Expected: %v\n"+
+			"Actual  : %v", expected, config)
+	}
+}
+
+func TestInvalidParseConfigFile(t *testing.T) {
+	for _, contents := range []string{
+		"port: 80\n",
+		"sigserver:\n\tport: 80\n",
+		"sigserver:\n  port: 80\n  port: 81\n",
+		"sigserver:\n  port: 80\n    tls-port: 443\n",
+		"sigserver:\n  port 80\n",
+		"sigserver:\n  api-allow: [10.0.0.0/8\n",
+		"sigserver:\n  admin-token: \"unterminated\n",
+		"sigserver:\nsigserver:\n",
+		"sigserver: 80\n",
+	} {
+		if _, err := ParseConfigFile(strings.NewReader(contents)); err == nil {
+			t.Errorf("Expected an error parsing config file: %q", contents)
+		}
+	}
+}
+
+func TestPrecedenceApplyConfigSection(t *testing.T) {
+	set := getopt.New()
+	port := set.StringLong("port", 'p', "80", "")
+	tlsPort := set.StringLong("tls-port", 0, "443", "")
+	token := set.StringLong("admin-token", 0, "", "")
+	search := set.BoolLong("signature-search", 0, "")
+	settings := []ConfigSetting{
+		{Option: "port", EnvVar: "TEST_CONFIG_PORT"},
+		{Option: "tls-port", EnvVar: "TEST_CONFIG_TLS_PORT"},
+		{Option: "admin-token", EnvVar: "TEST_CONFIG_ADMIN_TOKEN"},
+		{Option: "signature-search", EnvVar: "TEST_CONFIG_SIGNATURE_SEARCH"},
+	}
+
+	os.Setenv("TEST_CONFIG_TLS_PORT", "8443")
+	defer os.Unsetenv("TEST_CONFIG_TLS_PORT")
+
+	set.Parse([]string{"sigserver", "-p", "8080"})
+
+	err := ApplyConfigSection(set, map[string]string{
+		"port":             "9090",
+		"tls-port":         "9443",
+		"admin-token":      "secret",
+		"signature-search": "true",
+	}, settings)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *port != "8080" {
+		t.Errorf("Expected the command line to take precedence. Actual: %v", *port)
+	}
+
+	if *tlsPort != "443" {
+		t.Errorf("Expected the environment variable to take precedence. Actual: %v", *tlsPort)
+	}
+
+	if *token != "secret" || !*search {
+		t.Errorf("Expected settings to be applied from the file. Actual: %v %v", *token, *search)
+	}
+
+	if err := ApplyConfigSection(set, map[string]string{"prot": "80"}, settings); err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+
+	if err := ApplyConfigSection(set, map[string]string{"signature-search": "maybe"}, settings); err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+}
+
+func TestRoundTripWriteConfigSection(t *testing.T) {
+	set := getopt.New()
+	set.StringLong("download-mirror-url", 0, "http://one.example.com;header=X-Token: a#b", "")
+	set.StringLong("user-agent", 0, " padded ", "")
+	set.StringLong("no-proxy", 0, "", "")
+	set.StringLong("admin-token", 0, "secret", "")
+	settings := []ConfigSetting{
+		{Option: "download-mirror-url"},
+		{Option: "user-agent"},
+		{Option: "no-proxy"},
+		{Option: "admin-token", Secret: true},
+	}
+
+	var buffer bytes.Buffer
+	WriteConfigSection(&buffer, "sigupdate", set, settings)
+
+	config, err := ParseConfigFile(&buffer)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"download-mirror-url": "http://one.example.com;header=X-Token: a#b",
+		"user-agent":          " padded ",
+		"no-proxy":            "",
+		"admin-token":         RedactedValue,
+	}
+
+	if !reflect.DeepEqual(config["sigupdate"], expected) {
+		t.Errorf("Written config not read back as expected.\n"+
+			"Expected: %v\n"+
+			"Actual  : %v", expected, config["sigupdate"])
+	}
+}
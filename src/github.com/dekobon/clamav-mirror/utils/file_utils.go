@@ -1,8 +1,16 @@
 package utils
 
 import (
-	"golang.org/x/sys/unix"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+	"golang.org/x/sys/unix"
 )
 
 // Exists function that determines if a given path exists.
@@ -25,3 +33,38 @@ func IsWritable(path string) (writable bool) {
 func IsReadable(path string) (readable bool) {
 	return unix.Access(path, unix.R_OK) == nil
 }
+
+// WriteFileAtomically writes data to a temporary file in the same directory
+// as the destination and then moves it into place, so that readers never see
+// a partially written file. The file's modification time is set to modTime.
+func WriteFileAtomically(filePath string, data []byte, modTime time.Time) error {
+	temp, err := ioutil.TempFile(filepath.Dir(filePath), "."+filepath.Base(filePath)+"-")
+
+	if err != nil {
+		msg := fmt.Sprintf("Unable to create temporary file for [%v]", filePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		msg := fmt.Sprintf("Unable to write temporary file for [%v]", filePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	if err := temp.Close(); err != nil {
+		msg := fmt.Sprintf("Unable to write temporary file for [%v]", filePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	os.Chmod(temp.Name(), 0644)
+	os.Chtimes(temp.Name(), modTime, modTime)
+
+	if err := os.Rename(temp.Name(), filePath); err != nil {
+		msg := fmt.Sprintf("Unable to move temporary file into place at [%v]", filePath)
+		return errors.WrapPrefix(err, msg, 1)
+	}
+
+	return nil
+}
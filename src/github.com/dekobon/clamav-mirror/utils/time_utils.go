@@ -1,6 +1,15 @@
 package utils
 
-import "time"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
 
 const clamavTimeLayout = "02 Jan 2006 15:04 -0700"
 
@@ -9,3 +18,118 @@ const clamavTimeLayout = "02 Jan 2006 15:04 -0700"
 func ParseClamAVTimeStamp(timeString string) (time.Time, error) {
 	return time.Parse(clamavTimeLayout, timeString)
 }
+
+// ParseDuration parses a duration string in the same format as
+// time.ParseDuration with the addition of whole days (e.g. 30d).
+func ParseDuration(durationString string) (time.Duration, error) {
+	if strings.HasSuffix(durationString, "d") {
+		days, err := strconv.ParseUint(strings.TrimSuffix(durationString, "d"), 10, 16)
+
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	return time.ParseDuration(durationString)
+}
+
+// TimeWindow is a daily period of time specified as offsets from midnight
+// in local time. Windows that end before they start span midnight.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (w TimeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// Contains checks to see if a time falls within the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+
+	return offset >= w.Start || offset < w.End
+}
+
+// InTimeWindows checks to see if a time falls within any of the windows. When
+// there are no windows, all times are allowed.
+func InTimeWindows(windows []TimeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+
+	for _, window := range windows {
+		if window.Contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseTimeWindows parses a comma separated list of daily time windows in
+// the format HH:MM-HH:MM, for example: 22:00-06:00,12:00-13:00.
+func ParseTimeWindows(windows string) ([]TimeWindow, error) {
+	var parsed []TimeWindow
+
+	for _, window := range strings.Split(windows, ",") {
+		window = strings.TrimSpace(window)
+
+		if window == "" {
+			continue
+		}
+
+		parts := strings.Split(window, "-")
+
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid time window [%v]. Expecting HH:MM-HH:MM", window)
+		}
+
+		start, err := parseTimeOfDay(parts[0])
+
+		if err != nil {
+			return nil, errors.Errorf("Invalid time window [%v]. %v", window, err)
+		}
+
+		end, err := parseTimeOfDay(parts[1])
+
+		if err != nil {
+			return nil, errors.Errorf("Invalid time window [%v]. %v", window, err)
+		}
+
+		parsed = append(parsed, TimeWindow{Start: start, End: end})
+	}
+
+	return parsed, nil
+}
+
+// JoinTimeWindows formats time windows in the format parsed by
+// ParseTimeWindows.
+func JoinTimeWindows(windows []TimeWindow) string {
+	values := make([]string, len(windows))
+
+	for i, window := range windows {
+		values[i] = window.String()
+	}
+
+	return strings.Join(values, ",")
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", strings.TrimSpace(value))
+
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
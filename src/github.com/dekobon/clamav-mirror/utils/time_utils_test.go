@@ -33,3 +33,78 @@ func TestInvalidParseClamAVTimeStamp(t *testing.T) {
 		t.Error("Expected time parsing exception not thrown")
 	}
 }
+
+func TestDaysParseDuration(t *testing.T) {
+	duration, err := ParseDuration("30d")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if duration != 30*24*time.Hour {
+		t.Errorf("Expected 30 days. Actual: %v", duration)
+	}
+}
+
+func TestStandardParseDuration(t *testing.T) {
+	duration, err := ParseDuration("1h30m")
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if duration != 90*time.Minute {
+		t.Errorf("Expected 90 minutes. Actual: %v", duration)
+	}
+}
+
+func TestInvalidParseDuration(t *testing.T) {
+	_, err := ParseDuration("xd")
+
+	if err == nil {
+		t.Error("Expected duration parsing exception not thrown")
+	}
+}
+
+func TestSpanningMidnightParseTimeWindows(t *testing.T) {
+	windows, err := ParseTimeWindows("22:00-06:00, 12:00-13:30")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(windows) != 2 || JoinTimeWindows(windows) != "22:00-06:00,12:00-13:30" {
+		t.Fatalf("Unexpected windows: %v", windows)
+	}
+
+	day := func(hour int, minute int) time.Time {
+		return time.Date(2017, 7, 27, hour, minute, 0, 0, time.Local)
+	}
+
+	cases := map[time.Time]bool{
+		day(23, 0):  true,
+		day(2, 0):   true,
+		day(6, 0):   false,
+		day(12, 45): true,
+		day(13, 30): false,
+		day(18, 0):  false,
+	}
+
+	for moment, expected := range cases {
+		if InTimeWindows(windows, moment) != expected {
+			t.Errorf("Expected %v to be in windows: %v", moment.Format("15:04"), expected)
+		}
+	}
+
+	if !InTimeWindows(nil, day(18, 0)) {
+		t.Error("Expected all times to be allowed without windows")
+	}
+}
+
+func TestInvalidParseTimeWindows(t *testing.T) {
+	for _, invalid := range []string{"22:00", "25:00-06:00", "22:00-06:00-07:00"} {
+		if _, err := ParseTimeWindows(invalid); err == nil {
+			t.Errorf("Expected time window [%v] to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// Smallest number of tokens that a bucket can hold
+const minimumBurst = 1024
+
+// TokenBucket limits the rate at which tokens, such as bytes transferred,
+// are consumed. A single bucket can be shared by many goroutines so that
+// they are limited to the rate in aggregate.
+type TokenBucket struct {
+	lock     sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+	sleep    func(time.Duration)
+}
+
+// NewTokenBucket creates a token bucket that refills at the given rate of
+// tokens per second and holds up to one second of tokens.
+func NewTokenBucket(rate uint64) *TokenBucket {
+	capacity := float64(rate)
+
+	if capacity < minimumBurst {
+		capacity = minimumBurst
+	}
+
+	return &TokenBucket{
+		rate:     float64(rate),
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// NewIntervalTokenBucket creates a token bucket that allows the given number
+// of tokens to be consumed per interval, for example to limit an event to 60
+// times a minute. Up to a whole interval of tokens can be consumed at once.
+func NewIntervalTokenBucket(tokens uint64, interval time.Duration) *TokenBucket {
+	return &TokenBucket{
+		rate:     float64(tokens) / interval.Seconds(),
+		capacity: float64(tokens),
+		tokens:   float64(tokens),
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// Rate returns the number of tokens per second that the bucket refills at.
+func (b *TokenBucket) Rate() uint64 {
+	return uint64(b.rate)
+}
+
+// Wait blocks until the given number of tokens have been consumed and
+// returns how long it waited. Tokens are reserved immediately, so concurrent
+// callers wait their turn rather than competing for the same tokens.
+func (b *TokenBucket) Wait(tokens int) time.Duration {
+	b.lock.Lock()
+	b.refill()
+	b.tokens -= float64(tokens)
+	deficit := -b.tokens
+
+	b.lock.Unlock()
+
+	if deficit <= 0 {
+		return 0
+	}
+
+	wait := time.Duration(deficit / b.rate * float64(time.Second))
+	b.sleep(wait)
+
+	return wait
+}
+
+// TryTake consumes the given number of tokens if they are available without
+// waiting and reports whether they were consumed.
+func (b *TokenBucket) TryTake(tokens int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	if b.tokens < float64(tokens) {
+		return false
+	}
+
+	b.tokens -= float64(tokens)
+
+	return true
+}
+
+// Delay returns how long it will be until the given number of tokens are
+// available, or zero if they are available now.
+func (b *TokenBucket) Delay(tokens int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refill()
+
+	deficit := float64(tokens) - b.tokens
+
+	if deficit <= 0 {
+		return 0
+	}
+
+	return time.Duration(deficit / b.rate * float64(time.Second))
+}
+
+// Function that adds the tokens accumulated since the last refill. The caller
+// must hold the lock.
+func (b *TokenBucket) refill() {
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	b.last = now
+
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// Reader wraps a reader so that reading from it consumes a token per byte.
+func (b *TokenBucket) Reader(reader io.Reader) io.Reader {
+	return &rateLimitedReader{reader: reader, bucket: b}
+}
+
+type rateLimitedReader struct {
+	reader io.Reader
+	bucket *TokenBucket
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	// Reads larger than the bucket would let a single read exceed the rate
+	if len(p) > int(r.bucket.capacity) {
+		p = p[:int(r.bucket.capacity)]
+	}
+
+	n, err := r.reader.Read(p)
+
+	if n > 0 {
+		r.bucket.Wait(n)
+	}
+
+	return n, err
+}
+
+// ParseByteRate parses a number of bytes per second with an optional K, M or
+// G suffix (powers of 1024), for example: 512K.
+func ParseByteRate(rate string) (uint64, error) {
+	rate = strings.ToUpper(strings.TrimSpace(rate))
+	rate = strings.TrimSuffix(strings.TrimSuffix(rate, "/S"), "B")
+	multiplier := uint64(1)
+
+	switch {
+	case strings.HasSuffix(rate, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(rate, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(rate, "G"):
+		multiplier = 1024 * 1024 * 1024
+	}
+
+	if multiplier > 1 {
+		rate = rate[:len(rate)-1]
+	}
+
+	value, err := strconv.ParseUint(rate, 10, 64)
+
+	if err != nil {
+		msg := fmt.Sprintf("Invalid byte rate [%v]", rate)
+		return 0, errors.WrapPrefix(err, msg, 1)
+	}
+
+	return value * multiplier, nil
+}
@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func newTestTokenBucket(rate uint64) (*TokenBucket, *time.Duration) {
+	var slept time.Duration
+	now := time.Date(2017, 7, 27, 12, 0, 0, 0, time.UTC)
+
+	bucket := NewTokenBucket(rate)
+	bucket.last = now
+	bucket.now = func() time.Time { return now }
+	bucket.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	return bucket, &slept
+}
+
+func TestSharedWaitTokenBucket(t *testing.T) {
+	bucket, slept := newTestTokenBucket(2048)
+
+	// The first second worth of tokens is available immediately
+	bucket.Wait(2048)
+
+	if *slept != 0 {
+		t.Errorf("Expected no wait for the initial burst. Actual: %v", *slept)
+	}
+
+	bucket.Wait(1024)
+	bucket.Wait(1024)
+
+	if *slept != time.Second {
+		t.Errorf("Expected to wait 1 second for 2048 more tokens. Actual: %v", *slept)
+	}
+}
+
+func TestDelayTokenBucket(t *testing.T) {
+	bucket, _ := newTestTokenBucket(2048)
+
+	if delay := bucket.Delay(2048); delay != 0 {
+		t.Errorf("Expected no delay while tokens are available. Actual: %v", delay)
+	}
+
+	if waited := bucket.Wait(3072); waited != 500*time.Millisecond {
+		t.Errorf("Expected to wait half a second. Actual: %v", waited)
+	}
+
+	if delay := bucket.Delay(1024); delay != 500*time.Millisecond {
+		t.Errorf("Expected a delay of half a second. Actual: %v", delay)
+	}
+}
+
+func TestRateLimitedReaderTokenBucket(t *testing.T) {
+	bucket, slept := newTestTokenBucket(4096)
+	data := make([]byte, 4096*3)
+
+	read, err := ioutil.ReadAll(bucket.Reader(bytes.NewReader(data)))
+
+	if err != nil || len(read) != len(data) {
+		t.Fatalf("Expected all data to be read. Actual: %v %v", len(read), err)
+	}
+
+	if *slept < 1900*time.Millisecond || *slept > 2100*time.Millisecond {
+		t.Errorf("Expected reading 3 seconds of data with a 1 second burst to wait "+
+			"2 seconds. Actual: %v", *slept)
+	}
+}
+
+func TestUnitsParseByteRate(t *testing.T) {
+	cases := map[string]uint64{
+		"0":      0,
+		"1000":   1000,
+		"512K":   512 * 1024,
+		"2MB/s":  2 * 1024 * 1024,
+		"1g":     1024 * 1024 * 1024,
+		" 64kb ": 64 * 1024,
+	}
+
+	for value, expected := range cases {
+		actual, err := ParseByteRate(value)
+
+		if err != nil || actual != expected {
+			t.Errorf("Expected [%v] to be %v. Actual: %v %v", value, expected, actual, err)
+		}
+	}
+
+	if _, err := ParseByteRate("fast"); err == nil {
+		t.Error("Expected invalid byte rate to be rejected")
+	}
+}
+
+func TestIntervalTryTakeTokenBucket(t *testing.T) {
+	now := time.Date(2017, 7, 27, 12, 0, 0, 0, time.UTC)
+	bucket := NewIntervalTokenBucket(2, time.Minute)
+	bucket.last = now
+	bucket.now = func() time.Time { return now }
+
+	if !bucket.TryTake(1) || !bucket.TryTake(1) {
+		t.Fatal("Expected the whole interval's tokens to be available immediately")
+	}
+
+	if bucket.TryTake(1) {
+		t.Error("Expected no tokens to be left")
+	}
+
+	now = now.Add(30 * time.Second)
+
+	if !bucket.TryTake(1) {
+		t.Error("Expected a token to be available after half an interval")
+	}
+}